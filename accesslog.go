@@ -0,0 +1,57 @@
+package microblob
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLogEntry is a single line of the structured access log.
+type accessLogEntry struct {
+	Time      string  `json:"time"`
+	RequestID string  `json:"request_id,omitempty"`
+	Remote    string  `json:"remote"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Key       string  `json:"key,omitempty"`
+	Status    int     `json:"status"`
+	Bytes     int64   `json:"bytes"`
+	Latency   float64 `json:"latency"` // seconds
+}
+
+// WithJSONAccessLog writes one JSON object per request to w. The request ID is
+// included, if the handler is wrapped by WithRequestID.
+func WithJSONAccessLog(w io.Writer, h http.Handler) http.Handler {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	f := func(rw http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		sw := &statusWriter{ResponseWriter: rw}
+		h.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		entry := accessLogEntry{
+			Time:      started.Format(time.RFC3339Nano),
+			RequestID: RequestID(r.Context()),
+			Remote:    r.RemoteAddr,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Status:    sw.status,
+			Bytes:     sw.n,
+			Latency:   time.Since(started).Seconds(),
+		}
+		if r.URL.Path == "/blob" {
+			entry.Key = r.URL.RawQuery // Legacy route.
+		} else {
+			entry.Key = strings.TrimPrefix(r.URL.Path, "/")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(entry)
+	}
+	return http.HandlerFunc(f)
+}
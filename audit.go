@@ -0,0 +1,194 @@
+package microblob
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Audit actions.
+const (
+	AuditUpdate = "update" // POST /update, also when queued and when the job ran
+	AuditPut    = "put"    // PUT /{key}
+	AuditPatch  = "patch"  // PATCH /{key}
+	AuditDelete = "delete" // DELETE /{key}
+	AuditAppend = "append" // append command and gRPC Append
+	AuditLoad   = "load"   // POST /load
+)
+
+// defaultAuditLimit is the number of records listed at most, if not set.
+const defaultAuditLimit = 1000
+
+// AuditRecord describes a mutation: who made it, when, what changed and
+// whether it succeeded.
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Blobfile  string    `json:"blobfile,omitempty"`
+	Client    string    `json:"client,omitempty"` // IP of the client, or unix for unix domain sockets
+	User      string    `json:"user,omitempty"`   // common name of the client certificate, or local user
+	RequestID string    `json:"request_id,omitempty"`
+	Job       string    `json:"job,omitempty"`    // ID of a queued update
+	Key       string    `json:"key,omitempty"`    // key put or deleted
+	Source    string    `json:"source,omitempty"` // URL or file appended
+	Offset    int64     `json:"offset"`           // start of the bytes appended to the blob file
+	Length    int64     `json:"length"`           // number of bytes appended
+	Keys      int64     `json:"keys"`             // number of keys indexed, or deleted
+	Status    int       `json:"status,omitempty"` // HTTP status of the request
+	Error     string    `json:"error,omitempty"`
+}
+
+// AuditLog records mutations as JSON lines in an append-only file, synced
+// after each record, e.g. to follow data governance rules. Safe for concurrent
+// use; processes can share the file.
+type AuditLog struct {
+	Filename string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// OpenAuditLog opens or creates an audit log for appending.
+func OpenAuditLog(filename string) (*AuditLog, error) {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{Filename: filename, f: f}, nil
+}
+
+// Record appends a record, setting its time, if it is zero. A nil log does
+// nothing.
+func (l *AuditLog) Record(rec AuditRecord) error {
+	if l == nil {
+		return nil
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+// record appends a record and logs failures, since mutations went through.
+func (l *AuditLog) record(rec AuditRecord) {
+	if err := l.Record(rec); err != nil {
+		log.Printf("audit log %s: %v", l.Filename, err)
+	}
+}
+
+// Records returns up to limit of the most recent records matching the filter,
+// oldest first.
+func (l *AuditLog) Records(match func(AuditRecord) bool, limit int) ([]AuditRecord, error) {
+	f, err := os.Open(l.Filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []AuditRecord
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			break // Incomplete or no line.
+		}
+		var rec AuditRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			continue
+		}
+		if match != nil && !match(rec) {
+			continue
+		}
+		records = append(records, rec)
+		if limit > 0 && len(records) > 2*limit {
+			records = append(records[:0], records[len(records)-limit:]...)
+		}
+	}
+	if limit > 0 && len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+	return records, nil
+}
+
+// Close closes the log file.
+func (l *AuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// ServeHTTP lists the most recent records as JSON array, oldest first,
+// optionally filtered by action, key and client and newer than since, given
+// in RFC 3339 format. Up to limit records are listed, 1000 by default.
+func (l *AuditLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := defaultAuditLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	var since time.Time
+	if v := q.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "invalid since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+	action, key, client := q.Get("action"), q.Get("key"), q.Get("client")
+	records, err := l.Records(func(rec AuditRecord) bool {
+		return (action == "" || rec.Action == action) &&
+			(key == "" || rec.Key == key) &&
+			(client == "" || rec.Client == client) &&
+			!rec.Time.Before(since)
+	}, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if records == nil {
+		records = []AuditRecord{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
+
+// auditRecord returns a record of an action with the client of a request.
+func auditRecord(r *http.Request, action, blobfile string) AuditRecord {
+	rec := AuditRecord{
+		Action:    action,
+		Blobfile:  blobfile,
+		RequestID: RequestID(r.Context()),
+	}
+	if _, ok := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr); ok {
+		rec.Client = "unix"
+	} else if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		rec.Client = host
+	} else {
+		rec.Client = r.RemoteAddr
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		rec.User = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return rec
+}
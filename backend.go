@@ -2,23 +2,48 @@
 package microblob
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 // ErrInvalidValue if a value is corrupted.
 var ErrInvalidValue = errors.New("invalid entry")
 
+// ErrNotImplemented if a backend does not support an operation.
+var ErrNotImplemented = errors.New("not implemented")
+
+// DefaultKeySeparator joins the fields of a composite key.
+const DefaultKeySeparator = ":"
+
 // Entry associates a string key with a section in a file specified by offset and length.
 type Entry struct {
-	Key    string `json:"k"`
-	Offset int64  `json:"o"`
-	Length int64  `json:"l"`
+	Key      string  `json:"k"`
+	Offset   int64   `json:"o"`
+	Length   int64   `json:"l"`
+	Size     int64   `json:"s,omitempty"` // decompressed length, if the section is compressed
+	File     int     `json:"f,omitempty"` // blob file the section belongs to, 0 is the first
+	Expires  int64   `json:"e,omitempty"` // unix time after which the key is gone, 0 if it never expires
+	Version  int64   `json:"n,omitempty"` // number of the version, if versions are kept, 0 is the same as 1
+	Previous []Entry `json:"p,omitempty"` // superseded versions, newest first, if versions are kept
+	CRC      uint32  `json:"c,omitempty"` // CRC-32 of the section as stored, 0 if not computed, see ErrCRCMismatch
+	Data     []byte  `json:"-"`           // copy of the section, if stored in the index
+}
+
+// expired returns true, if the entry has an expiry time, that has passed.
+func (e Entry) expired(now time.Time) bool {
+	return e.Expires > 0 && now.Unix() >= e.Expires
 }
 
 // Counter can return the number of elements.
@@ -26,6 +51,34 @@ type Counter interface {
 	Count() (int64, error)
 }
 
+// KeyLister can list keys in lexicographic order.
+type KeyLister interface {
+	// Keys returns up to limit keys with the given prefix, that sort after
+	// the given start key.
+	Keys(prefix, start string, limit int) ([]string, error)
+}
+
+// Deleter can remove keys. The blob stays in the file.
+type Deleter interface {
+	Delete(key string) error
+}
+
+// Locator can find the offset and length of the blob for a key, without
+// reading it.
+type Locator interface {
+	Locate(key string) (Entry, error)
+}
+
+// Checker can report, whether a backend is ready to serve.
+type Checker interface {
+	Check() error
+}
+
+// Reloader can reopen its underlying files.
+type Reloader interface {
+	Reload() error
+}
+
 // Backend abstracts various implementations.
 type Backend interface {
 	Get(key string) ([]byte, error)
@@ -55,6 +108,202 @@ func (b DebugBackend) Close() error { return nil }
 // Get is a noop, always return nothing.
 func (b DebugBackend) Get(key string) ([]byte, error) { return []byte{}, nil }
 
+// TransformBackend applies a key transformation on write and on lookup, so
+// keys are normalized the same way at index and at query time.
+type TransformBackend struct {
+	Backend
+	Transform KeyTransform
+	Hashed    bool // keys are stored as digests, so key prefixes are lost
+}
+
+// WriteEntries transforms keys, then writes entries to the wrapped backend.
+func (b TransformBackend) WriteEntries(entries []Entry) error {
+	for i := range entries {
+		key, err := b.Transform(entries[i].Key)
+		if err != nil {
+			return err
+		}
+		entries[i].Key = key
+	}
+	return b.Backend.WriteEntries(entries)
+}
+
+// WriteEntriesStrict transforms keys, then writes entries to the wrapped
+// backend, see StrictWriter.
+func (b TransformBackend) WriteEntriesStrict(entries []Entry) error {
+	for i := range entries {
+		key, err := b.Transform(entries[i].Key)
+		if err != nil {
+			return err
+		}
+		entries[i].Key = key
+	}
+	return WriteEntriesStrict(b.Backend, entries)
+}
+
+// Get transforms the key, then retrieves the data from the wrapped backend.
+func (b TransformBackend) Get(key string) ([]byte, error) {
+	key, err := b.Transform(key)
+	if err != nil {
+		return nil, err
+	}
+	return b.Backend.Get(key)
+}
+
+// transformKeys returns a key function, that applies the transformation to all
+// keys extracted by kf.
+func (b TransformBackend) transformKeys(kf KeysFunc) KeysFunc {
+	return TransformKeys(kf, b.Transform)
+}
+
+// TransformKeys returns a key function, that applies the transformation to all
+// keys extracted by kf, or kf, if there is no transformation.
+func TransformKeys(kf KeysFunc, t KeyTransform) KeysFunc {
+	if t == nil {
+		return kf
+	}
+	return func(p []byte) ([]string, error) {
+		keys, err := kf(p)
+		if err != nil {
+			return nil, err
+		}
+		for i := range keys {
+			if keys[i], err = t(keys[i]); err != nil {
+				return nil, err
+			}
+		}
+		return keys, nil
+	}
+}
+
+// Count returns the number of documents of the wrapped backend.
+func (b TransformBackend) Count() (int64, error) {
+	if c, ok := b.Backend.(Counter); ok {
+		return c.Count()
+	}
+	return 0, ErrNotImplemented
+}
+
+// DuplicatePolicy decides what happens, if a key is indexed more than once.
+type DuplicatePolicy string
+
+// Supported duplicate policies. With DuplicateLast, the default, the last write
+// wins. DuplicateFirst keeps the entry with the smallest offset, DuplicateError
+// fails and DuplicateReport keeps the entry with the largest offset and writes
+// each duplicate to a report.
+const (
+	DuplicateLast   DuplicatePolicy = "last"
+	DuplicateFirst  DuplicatePolicy = "first"
+	DuplicateError  DuplicatePolicy = "error"
+	DuplicateReport DuplicatePolicy = "report"
+)
+
+// ErrDuplicateKey if a key is indexed more than once with DuplicateError. The
+// error returned wraps it and names the key and the offsets of both documents.
+var ErrDuplicateKey = errors.New("duplicate key")
+
+// ErrKeyExists is returned for a document put to a key, that is indexed
+// already, if the duplicate policy keeps the first document.
+var ErrKeyExists = errors.New("key exists")
+
+// StrictWriter is a backend, that can write the entries of documents put
+// explicitly, e.g. with PUT, failing with ErrKeyExists instead of silently
+// dropping an entry under the duplicate policy.
+type StrictWriter interface {
+	WriteEntriesStrict(entries []Entry) error
+}
+
+// WriteEntriesStrict writes entries, using WriteEntriesStrict, if the backend
+// supports it, otherwise with WriteEntries.
+func WriteEntriesStrict(backend Backend, entries []Entry) error {
+	if sw, ok := backend.(StrictWriter); ok {
+		return sw.WriteEntriesStrict(entries)
+	}
+	return backend.WriteEntries(entries)
+}
+
+// Keys transforms the prefix, then lists keys of the wrapped backend. Keys are
+// listed as stored and start, e.g. from a cursor, is a stored key as well.
+// With hashed keys, only listing all keys is supported.
+func (b TransformBackend) Keys(prefix, start string, limit int) ([]string, error) {
+	l, ok := b.Backend.(KeyLister)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	if prefix != "" {
+		if b.Hashed {
+			return nil, ErrNotImplemented
+		}
+		var err error
+		if prefix, err = b.Transform(prefix); err != nil {
+			return nil, err
+		}
+	}
+	return l.Keys(prefix, start, limit)
+}
+
+// storedBackend returns the backend wrapped by transform backends, which looks
+// up keys as stored, e.g. as listed by Keys.
+func storedBackend(backend Backend) Backend {
+	for {
+		tb, ok := backend.(TransformBackend)
+		if !ok {
+			return backend
+		}
+		backend = tb.Backend
+	}
+}
+
+// Delete transforms the key, then removes it from the wrapped backend.
+func (b TransformBackend) Delete(key string) error {
+	d, ok := b.Backend.(Deleter)
+	if !ok {
+		return ErrNotImplemented
+	}
+	key, err := b.Transform(key)
+	if err != nil {
+		return err
+	}
+	return d.Delete(key)
+}
+
+// Locate transforms the key, then locates it in the wrapped backend.
+func (b TransformBackend) Locate(key string) (Entry, error) {
+	l, ok := b.Backend.(Locator)
+	if !ok {
+		return Entry{}, ErrNotImplemented
+	}
+	key, err := b.Transform(key)
+	if err != nil {
+		return Entry{}, err
+	}
+	return l.Locate(key)
+}
+
+// Export exports all documents of the wrapped backend.
+func (b TransformBackend) Export(w io.Writer) error {
+	if e, ok := b.Backend.(Exporter); ok {
+		return e.Export(w)
+	}
+	return ErrNotImplemented
+}
+
+// Check checks the wrapped backend.
+func (b TransformBackend) Check() error {
+	if c, ok := b.Backend.(Checker); ok {
+		return c.Check()
+	}
+	return nil
+}
+
+// Reload reloads the wrapped backend.
+func (b TransformBackend) Reload() error {
+	if r, ok := b.Backend.(Reloader); ok {
+		return r.Reload()
+	}
+	return ErrNotImplemented
+}
+
 // LevelDBBackend writes entries into LevelDB.
 type LevelDBBackend struct {
 	Blobfile         string
@@ -62,12 +311,74 @@ type LevelDBBackend struct {
 	Filename         string
 	db               *leveldb.DB
 	AllowEmptyValues bool
+	OnDuplicate      DuplicatePolicy
+	Compression      string       // "zstd", if each blob is stored as a separate zstd frame
+	Separator        byte         // terminates records in the blob file, defaults to newline
+	DuplicateReport  io.Writer    // receives duplicates as TSV: key, old offset, new offset
+	Blobfiles        []string     // additional blob files, entries with file id n refer to Blobfiles[n-1]
+	Remote           io.ReaderAt  // if set, the first blob file is read from here instead of Blobfile, e.g. HTTPBlob
+	Mmap             bool         // serve from memory mapped blob files, where supported
+	Cache            *Cache       // if set, caches blobs of recently requested keys
+	ReadOnly         bool         // open the index read-only
+	Inline           int64        // if positive, sections up to this length are copied into the index
+	Bloom            *Bloom       // if set, answers lookups for missing keys without a database lookup
+	Misses           *MissCache   // if set, remembers keys recently not found, see MissCache
+	DBOptions        *opt.Options // if set, used to open the index, e.g. to tune large indexing runs
+	Suppressed       *DenyList    // if set, keys on the list are not served
+	KeepVersions     int          // if positive, the number of superseded versions kept per key
+	Sparse           int          // if positive, the index holds blocks of this many records, see IndexSparse
+	SparseKeys       KeysFunc     // extracts the stored keys of a record, to scan blocks with Sparse
+	MaxRecordSize    int64        // if positive, longer documents are not read, see ErrRecordTooLarge
+	Shared           *SharedDB    // if set, the database is shared with other datasets, Prefix is required
+	Prefix           string       // if set, prepended to keys in the database, to tell datasets apart
+	Fsync            FsyncPolicy  // when appended data is synced to disk, see FsyncPolicy
+	CRC              bool         // if set, a CRC is stored per record on indexing and verified on read
+	Format           RecordFormat // frames records in the blob file, if not separated, e.g. FormatMARC
+	Journal          bool         // journal appends, so interrupted ones are rolled back, see Journaler
+	maps             [][]byte
+	extra            []*os.File
+	tombstones       *tombstones    // deleted keys, loaded with the database
+	dir              string         // index directory open, Filename or the one it links to, see Reindex
+	generations      map[int]string // of the blob files by id, see Generation, guarded by openMu
+	checksums        *Cache         // sums of documents by location, see Checksum
+	checksumsOnce    sync.Once
+
+	mu     sync.RWMutex // guards db and blob handles against Close and Reload
+	openMu sync.Mutex   // serializes lazy opening of db and blob
+
+	journalMu sync.Mutex // guards journal
+	journal   *appendJournal
 }
 
 // Close closes database handle and blob file.
 func (b *LevelDBBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closeHandles()
+}
+
+// closeHandles closes database handle and blob file, the caller must hold the
+// write lock.
+func (b *LevelDBBackend) closeHandles() error {
+	if b.Cache != nil {
+		b.Cache.Purge()
+	}
+	if b.Misses != nil {
+		b.Misses.Purge()
+	}
+	if b.checksums != nil {
+		b.checksums.Purge()
+	}
+	b.generations = nil
+	if err := b.unmap(); err != nil {
+		return err
+	}
 	if b.db != nil {
-		if err := b.db.Close(); err != nil {
+		closeDB := b.db.Close
+		if b.Shared != nil {
+			closeDB = b.Shared.release
+		}
+		if err := closeDB(); err != nil {
 			return err
 		}
 		b.db = nil
@@ -78,43 +389,596 @@ func (b *LevelDBBackend) Close() error {
 		}
 		b.blob = nil
 	}
+	b.tombstones = nil
+	for i, f := range b.extra {
+		if f == nil {
+			continue
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		b.extra[i] = nil
+	}
 	return nil
 }
 
-// WriteEntries writes entries as batch into LevelDB. The value is fixed 16 byte
-// slice, first 8 bytes represents the offset, last 8 bytes the length.
-// https://play.golang.org/p/xwX8BmWtVl
+// Reload closes database and blob file, they are reopened on next access. This
+// allows to swap in a rebuilt blob file and index without a restart. The deny
+// list is reloaded as well.
+func (b *LevelDBBackend) Reload() error {
+	if b.Suppressed != nil {
+		if err := b.Suppressed.Load(); err != nil {
+			return err
+		}
+	}
+	return b.Close()
+}
+
+// WriteEntries writes entries as batch into LevelDB. The value holds offset
+// and length of the section, see encodeEntry.
 func (b *LevelDBBackend) WriteEntries(entries []Entry) error {
+	return b.writeEntries(entries, false)
+}
+
+// WriteEntriesStrict writes entries like WriteEntries, but fails with
+// ErrKeyExists, if the duplicate policy would keep an indexed document instead
+// of one of the entries.
+func (b *LevelDBBackend) WriteEntriesStrict(entries []Entry) error {
+	return b.writeEntries(entries, true)
+}
+
+// writeEntries writes entries, with strict, dropping none of them.
+func (b *LevelDBBackend) writeEntries(entries []Entry, strict bool) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 	if err := b.openDatabase(); err != nil {
 		return err
 	}
+	entries = b.tombstones.filter(entries)
+	if b.OnDuplicate != "" && b.OnDuplicate != DuplicateLast {
+		var err error
+		if entries, err = b.resolveDuplicates(entries, strict); err != nil {
+			return err
+		}
+	}
+	if b.KeepVersions > 0 {
+		if err := b.retainVersions(entries); err != nil {
+			return err
+		}
+	}
+	if b.Inline > 0 {
+		if err := b.inline(entries); err != nil {
+			return err
+		}
+	}
+	if err := b.journalEntries(entries); err != nil {
+		return err
+	}
 	batch := new(leveldb.Batch)
 	for _, entry := range entries {
-		value := make([]byte, 16)
-		binary.PutVarint(value[:8], entry.Offset)
-		binary.PutVarint(value[8:], entry.Length)
-		batch.Put([]byte(entry.Key), value)
+		batch.Put(b.dbKey(entry.Key), encodeEntry(entry))
+		if b.Bloom != nil {
+			b.Bloom.Add(entry.Key)
+		}
+	}
+	var wo *opt.WriteOptions
+	if b.Fsync == FsyncAll {
+		wo = &opt.WriteOptions{Sync: true}
+	}
+	if err := b.db.Write(batch, wo); err != nil {
+		return err
+	}
+	if b.Cache != nil {
+		for _, entry := range entries {
+			b.Cache.Remove(entry.Key)
+		}
+	}
+	if b.Misses != nil {
+		keys := make([]string, len(entries))
+		for i, entry := range entries {
+			keys[i] = entry.Key
+		}
+		b.Misses.Remove(keys...)
+	}
+	return nil
+}
+
+// inline reads the sections of small entries from the blob file, so they can
+// be served from the index without another disk access. The blob file stays
+// complete, so compaction, export and verification work as before.
+func (b *LevelDBBackend) inline(entries []Entry) error {
+	for i, e := range entries {
+		if e.Data != nil || e.Length == 0 || e.Length > b.Inline || (e.File == 0 && b.Remote != nil) {
+			continue
+		}
+		file, err := b.blobFile(e.File)
+		if err != nil {
+			return err
+		}
+		data := make([]byte, e.Length)
+		if _, err := file.ReadAt(data, e.Offset); err != nil {
+			return err
+		}
+		entries[i].Data = data
+	}
+	return nil
+}
+
+// resolveDuplicates applies the duplicate policy to entries, considering
+// duplicates within the batch and keys already in the database. With strict,
+// an entry, that would be dropped, fails with ErrKeyExists.
+func (b *LevelDBBackend) resolveDuplicates(entries []Entry, strict bool) ([]Entry, error) {
+	var (
+		seen   = make(map[string]int) // key to index in result
+		result []Entry
+	)
+	for _, entry := range entries {
+		var (
+			prev  Entry
+			found bool
+		)
+		if i, ok := seen[entry.Key]; ok {
+			prev, found = result[i], true
+		} else {
+			value, err := b.db.Get(b.dbKey(entry.Key), nil)
+			switch {
+			case err == leveldb.ErrNotFound:
+			case err != nil:
+				return nil, err
+			default:
+				if prev, err = decodeEntry([]byte(entry.Key), value); err != nil {
+					return nil, err
+				}
+				found = !prev.expired(time.Now())
+			}
+		}
+		if !found {
+			seen[entry.Key] = len(result)
+			result = append(result, entry)
+			continue
+		}
+		if prev.File == entry.File && prev.Offset == entry.Offset {
+			continue // Same document, e.g. with the key under several paths.
+		}
+		keep := after(entry, prev)
+		switch b.OnDuplicate {
+		case DuplicateError:
+			if prev.File != entry.File {
+				return nil, fmt.Errorf("%w: %s at offset %d of file %d and offset %d of file %d",
+					ErrDuplicateKey, entry.Key, prev.Offset, prev.File, entry.Offset, entry.File)
+			}
+			return nil, fmt.Errorf("%w: %s at offsets %d and %d", ErrDuplicateKey, entry.Key, prev.Offset, entry.Offset)
+		case DuplicateFirst:
+			keep = after(prev, entry)
+		case DuplicateReport:
+			if b.DuplicateReport != nil {
+				if _, err := fmt.Fprintf(b.DuplicateReport, "%s\t%d\t%d\n", entry.Key, prev.Offset, entry.Offset); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if !keep && strict {
+			return nil, fmt.Errorf("%w: %s at offset %d", ErrKeyExists, entry.Key, prev.Offset)
+		}
+		if !keep {
+			continue
+		}
+		if i, ok := seen[entry.Key]; ok {
+			result[i] = entry
+		} else {
+			seen[entry.Key] = len(result)
+			result = append(result, entry)
+		}
+	}
+	return result, nil
+}
+
+// retainVersions records the entries superseded by entries as their previous
+// versions, up to KeepVersions. Another key for the same document does not
+// create a new version.
+func (b *LevelDBBackend) retainVersions(entries []Entry) error {
+	latest := make(map[string]Entry) // last entry per key in the batch
+	for i, entry := range entries {
+		prev, found := latest[entry.Key]
+		if !found {
+			value, err := b.db.Get(b.dbKey(entry.Key), nil)
+			switch {
+			case err == leveldb.ErrNotFound:
+			case err != nil:
+				return err
+			default:
+				if prev, err = decodeEntry([]byte(entry.Key), value); err != nil {
+					return err
+				}
+				found = true
+			}
+		}
+		switch {
+		case !found:
+		case prev.File == entry.File && prev.Offset == entry.Offset:
+			entry.Version, entry.Previous = prev.Version, prev.Previous
+		default:
+			version := prev.Version
+			if version == 0 {
+				version = 1
+			}
+			superseded := Entry{Offset: prev.Offset, Length: prev.Length, Size: prev.Size, File: prev.File, Version: version}
+			entry.Version = version + 1
+			entry.Previous = append([]Entry{superseded}, prev.Previous...)
+			if len(entry.Previous) > b.KeepVersions {
+				entry.Previous = entry.Previous[:b.KeepVersions]
+			}
+		}
+		entries[i] = entry
+		latest[entry.Key] = entry
+	}
+	return nil
+}
+
+// after reports whether entry a comes after entry b in the blob files.
+func after(a, b Entry) bool {
+	if a.File != b.File {
+		return a.File > b.File
+	}
+	return a.Offset > b.Offset
+}
+
+// Index values come in two formats. The fixed format, written by earlier
+// versions, stores offset and length as varints padded to 8 bytes each, then
+// optionally the decompressed size, the file id and an inlined section, after
+// 16, 24 and 32 bytes. The compact format starts with a flags byte, followed by
+// unpadded varints and the inlined section, if any. Only the compact format
+// can store an expiry time, previous versions, each as offset, length, size,
+// file id and version number, and the CRC of the section, which previous
+// versions do not keep. Fixed values start with the
+// varint of a non-negative offset, which is always even, so compact flags have
+// the lowest bit set.
+const (
+	compactValue byte = 1 << iota
+	compactSize
+	compactFile
+	compactData
+	compactExpires
+	compactVersions
+	compactCRC
+)
+
+// encodeEntry returns the value for an entry, in the compact format.
+func encodeEntry(e Entry) []byte {
+	flags := compactValue
+	if e.Size > 0 {
+		flags |= compactSize
+	}
+	if e.File > 0 {
+		flags |= compactFile
+	}
+	if len(e.Data) > 0 {
+		flags |= compactData
+	}
+	if e.Expires > 0 {
+		flags |= compactExpires
+	}
+	if e.Version > 0 || len(e.Previous) > 0 {
+		flags |= compactVersions
+	}
+	if e.CRC != 0 {
+		flags |= compactCRC
+	}
+	value := make([]byte, 1+(8+5*len(e.Previous))*binary.MaxVarintLen64+len(e.Data))
+	value[0] = flags
+	n := 1
+	n += binary.PutUvarint(value[n:], uint64(e.Offset))
+	n += binary.PutUvarint(value[n:], uint64(e.Length))
+	if e.Size > 0 {
+		n += binary.PutUvarint(value[n:], uint64(e.Size))
+	}
+	if e.File > 0 {
+		n += binary.PutUvarint(value[n:], uint64(e.File))
+	}
+	if e.Expires > 0 {
+		n += binary.PutUvarint(value[n:], uint64(e.Expires))
+	}
+	if flags&compactVersions != 0 {
+		n += binary.PutUvarint(value[n:], uint64(e.Version))
+		n += binary.PutUvarint(value[n:], uint64(len(e.Previous)))
+		for _, p := range e.Previous {
+			for _, v := range []int64{p.Offset, p.Length, p.Size, int64(p.File), p.Version} {
+				n += binary.PutUvarint(value[n:], uint64(v))
+			}
+		}
+	}
+	if e.CRC != 0 {
+		n += binary.PutUvarint(value[n:], uint64(e.CRC))
+	}
+	n += copy(value[n:], e.Data)
+	return value[:n]
+}
+
+// decodeEntry returns the entry for a key and value in either format.
+func decodeEntry(key, value []byte) (Entry, error) {
+	if len(value) == 0 {
+		return Entry{}, ErrInvalidValue
+	}
+	if value[0]&compactValue == 0 {
+		return decodeFixedEntry(key, value)
+	}
+	var (
+		flags = value[0]
+		rest  = value[1:]
+		e     = Entry{Key: string(key)}
+	)
+	next := func() int64 {
+		v, n := binary.Uvarint(rest)
+		if n <= 0 {
+			rest = nil
+			return -1
+		}
+		rest = rest[n:]
+		return int64(v)
+	}
+	e.Offset, e.Length = next(), next()
+	if flags&compactSize != 0 {
+		e.Size = next()
+	}
+	if flags&compactFile != 0 {
+		e.File = int(next())
 	}
-	return b.db.Write(batch, nil)
+	if flags&compactExpires != 0 {
+		e.Expires = next()
+	}
+	if e.Offset < 0 || e.Length < 0 || e.Size < 0 || e.File < 0 || e.Expires < 0 {
+		return Entry{}, ErrInvalidValue
+	}
+	if flags&compactVersions != 0 {
+		e.Version = next()
+		count := next()
+		if e.Version < 0 || count < 0 || count > int64(len(rest)) {
+			return Entry{}, ErrInvalidValue
+		}
+		for i := int64(0); i < count; i++ {
+			p := Entry{Key: e.Key, Offset: next(), Length: next(), Size: next()}
+			p.File, p.Version = int(next()), next()
+			if p.Offset < 0 || p.Length < 0 || p.Size < 0 || p.File < 0 || p.Version < 0 {
+				return Entry{}, ErrInvalidValue
+			}
+			e.Previous = append(e.Previous, p)
+		}
+	}
+	if flags&compactCRC != 0 {
+		crc := next()
+		if crc <= 0 || crc > math.MaxUint32 {
+			return Entry{}, ErrInvalidValue
+		}
+		e.CRC = uint32(crc)
+	}
+	if flags&compactData != 0 {
+		e.Data = append([]byte(nil), rest...)
+	}
+	return e, nil
+}
+
+// decodeFixedEntry returns the entry for a key and a value in the fixed format.
+func decodeFixedEntry(key, value []byte) (Entry, error) {
+	offset, length, err := decodeValue(value)
+	if err != nil {
+		return Entry{}, err
+	}
+	e := Entry{Key: string(key), Offset: offset, Length: length}
+	if len(value) >= 24 {
+		if e.Size, err = binary.ReadVarint(bytes.NewBuffer(value[16:24])); err != nil {
+			return Entry{}, err
+		}
+	}
+	if len(value) >= 32 {
+		id, err := binary.ReadVarint(bytes.NewBuffer(value[24:32]))
+		if err != nil {
+			return Entry{}, err
+		}
+		e.File = int(id)
+	}
+	if len(value) > 32 {
+		e.Data = append([]byte(nil), value[32:]...)
+	}
+	return e, nil
 }
 
-// Count returns the number of documents added. LevelDB says: There is no way
-// to implement Count more efficiently inside leveldb than outside.
+// decodeValue returns offset and length stored in a value in the fixed format.
+func decodeValue(value []byte) (offset, length int64, err error) {
+	if len(value) < 16 {
+		return 0, 0, ErrInvalidValue
+	}
+	if offset, err = binary.ReadVarint(bytes.NewBuffer(value[:8])); err != nil {
+		return 0, 0, err
+	}
+	if length, err = binary.ReadVarint(bytes.NewBuffer(value[8:])); err != nil {
+		return 0, 0, err
+	}
+	return offset, length, nil
+}
+
+// Count returns the number of documents added, without expired keys. LevelDB
+// says: There is no way to implement Count more efficiently inside leveldb than
+// outside.
 func (b *LevelDBBackend) Count() (n int64, err error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 	if err = b.openDatabase(); err != nil {
 		return 0, err
 	}
-	iter := b.db.NewIterator(nil, nil)
+	iter := b.db.NewIterator(b.keyRange(), nil)
 	defer iter.Release()
+	now := time.Now()
 	for iter.Next() {
+		if e, err := decodeEntry(iter.Key(), iter.Value()); err == nil && e.expired(now) {
+			continue
+		}
 		n++
 	}
 	err = iter.Error()
 	return
 }
 
+// Locate returns offset and length of the blob for a key.
+func (b *LevelDBBackend) Locate(key string) (Entry, error) {
+	if b.Suppressed.Contains(key) {
+		return Entry{}, ErrSuppressed
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.locate(key)
+}
+
+// locate returns offset and length of the blob for a key, the caller must hold
+// a read lock. Expired keys are not found.
+func (b *LevelDBBackend) locate(key string) (Entry, error) {
+	if b.Misses == nil {
+		return b.locateIndex(key)
+	}
+	if b.Misses.Contains(key) {
+		return Entry{}, leveldb.ErrNotFound
+	}
+	gen := b.Misses.Generation()
+	e, err := b.locateIndex(key)
+	if err == leveldb.ErrNotFound {
+		b.Misses.Add(key, gen)
+	}
+	return e, err
+}
+
+// locateIndex looks up the entry for a key in the database.
+func (b *LevelDBBackend) locateIndex(key string) (Entry, error) {
+	defer stageLatency.Observe("index", time.Now())
+	if err := b.openDatabase(); err != nil {
+		return Entry{}, err
+	}
+	if b.Sparse > 0 {
+		if err := b.notShared("a sparse index"); err != nil {
+			return Entry{}, err
+		}
+		return b.locateSparse(key)
+	}
+	if b.Bloom != nil && !b.Bloom.Test(key) {
+		return Entry{}, leveldb.ErrNotFound
+	}
+	value, err := b.db.Get(b.dbKey(key), nil)
+	if err != nil {
+		return Entry{}, err
+	}
+	e, err := decodeEntry([]byte(key), value)
+	if err != nil {
+		return Entry{}, err
+	}
+	if e.expired(time.Now()) {
+		return Entry{}, leveldb.ErrNotFound
+	}
+	return e, nil
+}
+
+// Delete removes a key from the database, the blob stays in the file until
+// compaction. A tombstone is recorded next to the blob file first, so the key
+// stays deleted, when the blob file is indexed again. Returns
+// leveldb.ErrNotFound, if the key does not exist.
+func (b *LevelDBBackend) Delete(key string) error {
+	// Appends hold the lock, so the size of the blob file is at a document
+	// boundary and no document of the key is being appended.
+	unlock, err := lockBlob(b.Blobfile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := b.reopenReplaced(); err != nil {
+		return err
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if err := b.openDatabase(); err != nil {
+		return err
+	}
+	value, err := b.db.Get(b.dbKey(key), nil)
+	if err != nil {
+		return err
+	}
+	e, err := decodeEntry([]byte(key), value)
+	if err != nil {
+		return err
+	}
+	ts := tombstone{Key: key, File: e.File, Offset: e.Offset + e.Length}
+	if e.File != 0 || b.Remote == nil {
+		name, err := b.blobPath(e.File)
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		ts.Offset = fi.Size()
+	}
+	if err := b.tombstones.add(ts); err != nil {
+		return err
+	}
+	if err := b.db.Delete(b.dbKey(key), nil); err != nil {
+		return err
+	}
+	if b.Cache != nil {
+		b.Cache.Remove(key)
+	}
+	return nil
+}
+
+// Keys returns up to limit keys with the given prefix, that sort after start.
+// Expired and suppressed keys are skipped.
+func (b *LevelDBBackend) Keys(prefix, start string, limit int) (keys []string, err error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if err = b.openDatabase(); err != nil {
+		return nil, err
+	}
+	iter := b.db.NewIterator(util.BytesPrefix(b.dbKey(prefix)), nil)
+	defer iter.Release()
+	ok := iter.First()
+	if start != "" {
+		ok = iter.Seek(b.dbKey(start))
+		if ok && string(iter.Key()) == b.Prefix+start {
+			ok = iter.Next()
+		}
+	}
+	now := time.Now()
+	for ; ok && len(keys) < limit; ok = iter.Next() {
+		if e, err := decodeEntry(iter.Key(), iter.Value()); err == nil && e.expired(now) {
+			continue
+		}
+		key := string(iter.Key()[len(b.Prefix):])
+		if b.Suppressed.Contains(key) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, iter.Error()
+}
+
+// Check returns an error, if the database or the blob file cannot be opened.
+func (b *LevelDBBackend) Check() error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if err := b.openDatabase(); err != nil {
+		return err
+	}
+	for i := 0; i <= len(b.Blobfiles); i++ {
+		if i == 0 && b.Remote != nil {
+			continue
+		}
+		if _, err := b.blobFile(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // openBlob opens the raw file. Save to call many times.
 func (b *LevelDBBackend) openBlob() error {
+	b.openMu.Lock()
+	defer b.openMu.Unlock()
 	// TODO(miku): Store a SHA of the origin file in the blob store, compare with the
 	// SHA of the currently used blob file, so we can warn the user if database and
 	// file won't match.
@@ -129,19 +993,158 @@ func (b *LevelDBBackend) openBlob() error {
 	return nil
 }
 
+// blobFile returns the handle for the blob file with the given id, opening it
+// if necessary.
+func (b *LevelDBBackend) blobFile(id int) (*os.File, error) {
+	if id == 0 {
+		if err := b.openBlob(); err != nil {
+			return nil, err
+		}
+		return b.blob, nil
+	}
+	if id < 0 || id > len(b.Blobfiles) {
+		return nil, fmt.Errorf("%w: unknown blob file %d", ErrInvalidValue, id)
+	}
+	b.openMu.Lock()
+	defer b.openMu.Unlock()
+	if b.extra == nil {
+		b.extra = make([]*os.File, len(b.Blobfiles))
+	}
+	if b.extra[id-1] != nil {
+		return b.extra[id-1], nil
+	}
+	file, err := os.Open(b.Blobfiles[id-1])
+	if err != nil {
+		return nil, err
+	}
+	b.extra[id-1] = file
+	return file, nil
+}
+
+// BlobID returns the id of the blob file with the given name, to index
+// documents appended to any of the blob files, e.g. an overlay next to a
+// read-only file.
+func (b *LevelDBBackend) BlobID(name string) (int, bool) {
+	for i, fn := range append([]string{b.Blobfile}, b.Blobfiles...) {
+		if filepath.Clean(fn) == filepath.Clean(name) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// BlobID returns the id of a blob file of the wrapped backend.
+func (b TransformBackend) BlobID(name string) (int, bool) {
+	if s, ok := b.Backend.(interface{ BlobID(string) (int, bool) }); ok {
+		return s.BlobID(name)
+	}
+	return 0, false
+}
+
+// blobID returns the id of the blob file with the given name, 0 if the
+// backend does not know it.
+func blobID(backend Backend, name string) int {
+	if s, ok := backend.(interface{ BlobID(string) (int, bool) }); ok {
+		if id, ok := s.BlobID(name); ok {
+			return id
+		}
+	}
+	return 0
+}
+
+// blobPath returns the name of the blob file with the given id.
+func (b *LevelDBBackend) blobPath(id int) (string, error) {
+	if id == 0 {
+		return b.Blobfile, nil
+	}
+	if id < 0 || id > len(b.Blobfiles) {
+		return "", fmt.Errorf("%w: unknown blob file %d", ErrInvalidValue, id)
+	}
+	return b.Blobfiles[id-1], nil
+}
+
 // openDatabase creates a LevelDB handle. Save to call many times.
 func (b *LevelDBBackend) openDatabase() error {
+	b.openMu.Lock()
+	defer b.openMu.Unlock()
 	if b.db != nil {
 		return nil
 	}
-	db, err := leveldb.OpenFile(b.Filename, nil)
+	if b.tombstones == nil {
+		ts, err := loadTombstones(b.Blobfile)
+		if err != nil {
+			return err
+		}
+		b.tombstones = ts
+	}
+	if b.Shared != nil {
+		if b.Prefix == "" {
+			return fmt.Errorf("a shared database requires a key prefix")
+		}
+		db, err := b.Shared.acquire()
+		if err != nil {
+			return err
+		}
+		if b.Bloom != nil {
+			if err := fillBloom(b.Bloom, db, b.keyRange()); err != nil {
+				b.Shared.release()
+				return err
+			}
+		}
+		b.db = db
+		return nil
+	}
+	var o *opt.Options
+	if b.DBOptions != nil {
+		v := *b.DBOptions
+		o = &v
+	}
+	if b.ReadOnly {
+		// Read-only handles can be shared by multiple processes.
+		if o == nil {
+			o = &opt.Options{}
+		}
+		o.ReadOnly, o.ErrorIfMissing = true, true
+	}
+	// Open the directory the index links to, so the database keeps its files
+	// there, when the link is switched by a reindex.
+	dir := indexDir(b.Filename)
+	db, err := leveldb.OpenFile(dir, o)
 	if err != nil {
 		return err
 	}
-	b.db = db
+	if !b.ReadOnly {
+		if _, err := recoverJournal(db, b.Filename); err != nil {
+			db.Close()
+			return err
+		}
+	}
+	if b.Bloom != nil {
+		if err := fillBloom(b.Bloom, db, b.keyRange()); err != nil {
+			db.Close()
+			return err
+		}
+	}
+	b.db, b.dir = db, dir
 	return nil
 }
 
+// fillBloom adds the keys of the database in the given range, all keys, if
+// nil, to the bloom filter, without the prefix of the range.
+func fillBloom(f *Bloom, db *leveldb.DB, r *util.Range) error {
+	f.Reset()
+	iter := db.NewIterator(r, nil)
+	defer iter.Release()
+	var n int
+	if r != nil {
+		n = len(r.Start)
+	}
+	for iter.Next() {
+		f.Add(string(iter.Key()[n:]))
+	}
+	return iter.Error()
+}
+
 // IsAllZero returns true, if all bytes in a slice are zero.
 func IsAllZero(p []byte) bool {
 	for _, b := range p {
@@ -3,41 +3,86 @@
 package microblob
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
 	"syscall"
+	"time"
 )
 
-// Get retrieves the data for a given key, using pread(2).
+// Get retrieves the data for a given key, using pread(2) or, with Mmap, a copy
+// from the mapped file.
 func (b *LevelDBBackend) Get(key string) (data []byte, err error) {
-	if err = b.openDatabase(); err != nil {
-		return nil, err
+	if b.Suppressed.Contains(key) {
+		return nil, ErrSuppressed
 	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 
-	var value []byte
-	var offset, length int64
+	if b.Cache != nil {
+		if data, ok := b.Cache.Get(key); ok {
+			return data, nil
+		}
+	}
 
-	if value, err = b.db.Get([]byte(key), nil); err != nil {
+	entry, err := b.locate(key)
+	if err != nil {
 		return nil, err
 	}
-	if len(value) < 16 {
-		return nil, ErrInvalidValue
-	}
-	if offset, err = binary.ReadVarint(bytes.NewBuffer(value[:8])); err != nil {
-		return nil, err
-	}
-	if length, err = binary.ReadVarint(bytes.NewBuffer(value[8:])); err != nil {
-		return nil, err
+	data, err = b.read(entry)
+	if err == nil && b.Cache != nil && entry.Expires == 0 {
+		b.Cache.Add(key, data)
 	}
+	return data, err
+}
+
+// read returns the section of an entry, the caller must hold a read lock.
+func (b *LevelDBBackend) read(entry Entry) (data []byte, err error) {
+	defer stageLatency.Observe("blob", time.Now())
+	offset, length := entry.Offset, entry.Length
 
-	if err = b.openBlob(); err != nil {
+	if err := checkRecordSize(entry, b.MaxRecordSize); err != nil {
 		return nil, err
 	}
 
 	data = make([]byte, length)
 
-	_, err = syscall.Pread(int(b.blob.Fd()), data, offset)
+	switch {
+	case entry.Data != nil:
+		copy(data, entry.Data)
+	case entry.File == 0 && b.Remote != nil:
+		_, err = b.Remote.ReadAt(data, offset)
+	case b.Mmap:
+		var m []byte
+		if m, err = b.mapped(entry.File); err != nil {
+			return nil, err
+		}
+		// Documents appended after mapping are outside the mapping, read those.
+		if offset >= 0 && offset+length <= int64(len(m)) {
+			err = copyMapped(data, m[offset:offset+length])
+			break
+		}
+		fallthrough
+	default:
+		var file *os.File
+		if file, err = b.blobFile(entry.File); err != nil {
+			return nil, err
+		}
+		var n int
+		if n, err = syscall.Pread(int(file.Fd()), data, offset); err == nil && n < len(data) {
+			// Part of the section is missing, e.g. after the blob file was truncated.
+			err = io.ErrUnexpectedEOF
+		}
+	}
+
+	if err == nil {
+		err = verifyCRC(entry, data)
+	}
+	if err == nil {
+		data, err = b.decode(data)
+	}
 
 	if !b.AllowEmptyValues && IsAllZero(data) {
 		return nil, fmt.Errorf("empty value")
@@ -45,3 +90,75 @@ func (b *LevelDBBackend) Get(key string) (data []byte, err error) {
 
 	return data, err
 }
+
+// copyMapped copies from a mapping, failing with io.ErrUnexpectedEOF instead
+// of a crash, if the mapped file was truncated below the section meanwhile.
+func copyMapped(dst, m []byte) (err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if recover() != nil {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+	copy(dst, m)
+	return nil
+}
+
+// mapped returns the committed part of the blob file with the given id, that
+// is, the size recorded in its fingerprint after the last append, mapped into
+// memory on first use. An append in progress or rolled back and truncated
+// again is not mapped. Files, that are empty or have no fingerprint, are not
+// mapped.
+func (b *LevelDBBackend) mapped(id int) ([]byte, error) {
+	file, err := b.blobFile(id)
+	if err != nil {
+		return nil, err
+	}
+	b.openMu.Lock()
+	defer b.openMu.Unlock()
+	if b.maps == nil {
+		b.maps = make([][]byte, len(b.Blobfiles)+1)
+	}
+	if b.maps[id] != nil {
+		return b.maps[id], nil
+	}
+	name, err := b.blobPath(id)
+	if err != nil {
+		return nil, err
+	}
+	fps, err := readFingerprints(b.openDir())
+	if err != nil {
+		return nil, err
+	}
+	size := fps[filepath.Base(name)].Size
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() < size {
+		size = fi.Size()
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	m, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	b.maps[id] = m
+	return m, nil
+}
+
+// unmap releases all mappings, the caller must hold the write lock.
+func (b *LevelDBBackend) unmap() error {
+	for i, m := range b.maps {
+		if m == nil {
+			continue
+		}
+		if err := syscall.Munmap(m); err != nil {
+			return err
+		}
+		b.maps[i] = nil
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+// +build darwin dragonfly freebsd linux nacl netbsd openbsd solaris
+
+package microblob
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMmapTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "microblob-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blobfn := filepath.Join(dir, "blob.ldj")
+	backend := &LevelDBBackend{Blobfile: blobfn, Filename: filepath.Join(dir, "index"), Mmap: true, AllowEmptyValues: true}
+	defer backend.Close()
+	appendTestDocuments(t, dir, backend, `{"name": "a"}`, `{"name": "b"}`)
+
+	// An append in progress is not mapped.
+	f, err := os.OpenFile(blobfn, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"name": "c"}` + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := backend.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := backend.mapped(0); err != nil || len(m) != 28 {
+		t.Fatalf("got %d bytes mapped, %v, want 28", len(m), err)
+	}
+
+	if err := os.Truncate(blobfn, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Get("b"); err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
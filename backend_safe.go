@@ -3,15 +3,10 @@
 package microblob
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
-	"io"
-	"sync"
+	"time"
 )
 
-var mu sync.Mutex // Protects seek and read on systems without pread.
-
 // Get retrieves the data for a given key.
 // Raw timings of the operations:
 // Cold:
@@ -32,39 +27,68 @@ var mu sync.Mutex // Protects seek and read on systems without pread.
 //     b.blob.Read: 252.66µs
 //
 func (b *LevelDBBackend) Get(key string) (data []byte, err error) {
-	if err = b.openDatabase(); err != nil {
-		return nil, err
+	if b.Suppressed.Contains(key) {
+		return nil, ErrSuppressed
 	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 
-	var value []byte
-	var offset, length int64
+	if b.Cache != nil {
+		if data, ok := b.Cache.Get(key); ok {
+			return data, nil
+		}
+	}
 
-	if value, err = b.db.Get([]byte(key), nil); err != nil {
+	entry, err := b.locate(key)
+	if err != nil {
 		return nil, err
 	}
-	if len(value) < 16 {
-		return nil, ErrInvalidValue
-	}
-	if offset, err = binary.ReadVarint(bytes.NewBuffer(value[:8])); err != nil {
+	if data, err = b.read(entry); err != nil {
 		return nil, err
 	}
-	if length, err = binary.ReadVarint(bytes.NewBuffer(value[8:])); err != nil {
-		return nil, err
+
+	if b.Cache != nil && entry.Expires == 0 {
+		b.Cache.Add(key, data)
 	}
 
-	if err = b.openBlob(); err != nil {
+	return data, nil
+}
+
+// read returns the section of an entry, the caller must hold a read lock.
+func (b *LevelDBBackend) read(entry Entry) (data []byte, err error) {
+	defer stageLatency.Observe("blob", time.Now())
+	offset, length := entry.Offset, entry.Length
+
+	if err := checkRecordSize(entry, b.MaxRecordSize); err != nil {
 		return nil, err
 	}
 
 	data = make([]byte, length)
 
-	mu.Lock()
-	defer mu.Unlock()
+	if entry.Data != nil {
+		copy(data, entry.Data)
+	} else if entry.File == 0 && b.Remote != nil {
+		if _, err = b.Remote.ReadAt(data, offset); err != nil {
+			return nil, err
+		}
+	} else {
+		file, err := b.blobFile(entry.File)
+		if err != nil {
+			return nil, err
+		}
+
+		// ReadAt does not move the file offset, so concurrent reads are safe,
+		// e.g. with overlapped reads on Windows.
+		if _, err = file.ReadAt(data, offset); err != nil {
+			return nil, err
+		}
+	}
 
-	if _, err = b.blob.Seek(offset, io.SeekStart); err != nil {
+	if err := verifyCRC(entry, data); err != nil {
 		return nil, err
 	}
-	if _, err = b.blob.Read(data); err != nil {
+
+	if data, err = b.decode(data); err != nil {
 		return nil, err
 	}
 
@@ -74,3 +98,8 @@ func (b *LevelDBBackend) Get(key string) (data []byte, err error) {
 
 	return data, nil
 }
+
+// unmap is a no-op, Mmap is not supported on this system.
+func (b *LevelDBBackend) unmap() error {
+	return nil
+}
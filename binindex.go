@@ -0,0 +1,183 @@
+package microblob
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// The binary index format holds all entries of an index, including inlined
+// sections, expiry times and previous versions, for a fast load into an empty
+// index on another machine. After a magic, each entry is written as uvarint
+// key length plus one, uvarint value length, key and value in the compact
+// format of the index. A zero key length ends the entries, followed by the
+// CRC-32 (Castagnoli) of all preceding bytes.
+var binaryIndexMagic = []byte("MBINDEX\x01")
+
+// ErrBinaryIndexChecksum if a binary index is truncated or corrupted.
+var ErrBinaryIndexChecksum = errors.New("binary index checksum mismatch")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// maxBinaryEntry bounds key and value length, so corrupt lengths are detected
+// before allocating.
+const maxBinaryEntry = 1 << 30
+
+// WriteBinaryIndex writes all entries of the index to w in the binary index
+// format, without reading the blob files. Returns the number of entries
+// written.
+func WriteBinaryIndex(w io.Writer, src EntryIterator) (n int64, err error) {
+	var (
+		h   = crc32.New(castagnoli)
+		bw  = bufio.NewWriterSize(io.MultiWriter(w, h), 1<<20)
+		buf = make([]byte, 2*binary.MaxVarintLen64)
+	)
+	if _, err := bw.Write(binaryIndexMagic); err != nil {
+		return 0, err
+	}
+	err = withSuppressed{src}.Entries(func(e Entry) error {
+		value := encodeEntry(e)
+		k := binary.PutUvarint(buf, uint64(len(e.Key))+1)
+		k += binary.PutUvarint(buf[k:], uint64(len(value)))
+		if _, err := bw.Write(buf[:k]); err != nil {
+			return err
+		}
+		if _, err := bw.WriteString(e.Key); err != nil {
+			return err
+		}
+		if _, err := bw.Write(value); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	if err := bw.WriteByte(0); err != nil {
+		return n, err
+	}
+	if err := bw.Flush(); err != nil {
+		return n, err
+	}
+	binary.BigEndian.PutUint32(buf[:4], h.Sum32())
+	_, err = w.Write(buf[:4])
+	return n, err
+}
+
+// checksumReader hashes the bytes read through it.
+type checksumReader struct {
+	r *bufio.Reader
+	h hash.Hash32
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.h.Write(p[:n])
+	return n, err
+}
+
+func (c *checksumReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.h.Write([]byte{b})
+	}
+	return b, err
+}
+
+// ReadBinaryIndex writes the entries read from r in the binary index format to
+// dst in batches of the given size. Entries are written before the checksum
+// at the end is verified, so dst must be discarded on error. Returns the
+// number of entries written.
+func ReadBinaryIndex(r io.Reader, dst Backend, batchSize int) (n int64, err error) {
+	if batchSize < 1 {
+		batchSize = 100000
+	}
+	var (
+		br    = bufio.NewReaderSize(r, 1<<20)
+		cr    = &checksumReader{r: br, h: crc32.New(castagnoli)}
+		magic = make([]byte, len(binaryIndexMagic))
+		batch = make([]Entry, 0, batchSize)
+	)
+	if _, err := io.ReadFull(cr, magic); err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(magic, binaryIndexMagic) {
+		return 0, fmt.Errorf("not a binary index")
+	}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := dst.WriteEntries(batch); err != nil {
+			return err
+		}
+		n += int64(len(batch))
+		batch = batch[:0]
+		return nil
+	}
+	for {
+		klen, err := binary.ReadUvarint(cr)
+		if err != nil {
+			return n, binaryIndexError(err)
+		}
+		if klen == 0 {
+			break
+		}
+		vlen, err := binary.ReadUvarint(cr)
+		if err != nil {
+			return n, binaryIndexError(err)
+		}
+		if klen > maxBinaryEntry || vlen > maxBinaryEntry {
+			return n, ErrBinaryIndexChecksum
+		}
+		kv := make([]byte, klen-1+vlen)
+		if _, err := io.ReadFull(cr, kv); err != nil {
+			return n, binaryIndexError(err)
+		}
+		e, err := decodeEntry(kv[:klen-1], kv[klen-1:])
+		if err != nil {
+			return n, fmt.Errorf("entry %d: %v", n+int64(len(batch))+1, err)
+		}
+		if batch = append(batch, e); len(batch) == batchSize {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return n, err
+	}
+	var sum [4]byte
+	if _, err := io.ReadFull(br, sum[:]); err != nil {
+		return n, binaryIndexError(err)
+	}
+	if binary.BigEndian.Uint32(sum[:]) != cr.h.Sum32() {
+		return n, ErrBinaryIndexChecksum
+	}
+	return n, nil
+}
+
+// binaryIndexError reports an unexpected end of a binary index as checksum
+// error.
+func binaryIndexError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrBinaryIndexChecksum
+	}
+	return err
+}
+
+// LoadIndex writes the entries read from r in the binary or the flat index
+// format, detected by the magic of the binary format, to dst.
+func LoadIndex(r io.Reader, dst Backend, batchSize int) (int64, error) {
+	br := bufio.NewReaderSize(r, 1<<20)
+	if magic, _ := br.Peek(len(binaryIndexMagic)); bytes.Equal(magic, binaryIndexMagic) {
+		return ReadBinaryIndex(br, dst, batchSize)
+	}
+	return ReadFlatIndex(br, dst, batchSize)
+}
@@ -0,0 +1,75 @@
+package microblob
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// blobSet reads sections from the blob files of an immutable index, as served
+// by CDBBackend and MPHBackend. The files are opened on first access.
+type blobSet struct {
+	mu    sync.Mutex
+	files []*os.File
+}
+
+// open opens the blob files, if they are not open yet. Safe to call many
+// times.
+func (s *blobSet) open(names []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files != nil {
+		return nil
+	}
+	var files []*os.File
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return err
+		}
+		files = append(files, f)
+	}
+	s.files = files
+	return nil
+}
+
+// read returns the decoded section of an entry, up to max bytes long, if max
+// is positive.
+func (s *blobSet) read(e Entry, compression string, sep byte, max int64) ([]byte, error) {
+	defer stageLatency.Observe("blob", time.Now())
+	if err := checkRecordSize(e, max); err != nil {
+		return nil, err
+	}
+	if e.Data != nil {
+		return decodeSection(append([]byte(nil), e.Data...), compression, sep)
+	}
+	s.mu.Lock()
+	files := s.files
+	s.mu.Unlock()
+	if e.File < 0 || e.File >= len(files) {
+		return nil, fmt.Errorf("%w: unknown blob file %d", ErrInvalidValue, e.File)
+	}
+	data := make([]byte, e.Length)
+	if _, err := files[e.File].ReadAt(data, e.Offset); err != nil {
+		return nil, err
+	}
+	return decodeSection(data, compression, sep)
+}
+
+// Close closes the blob files, they are reopened on next access.
+func (s *blobSet) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for _, f := range s.files {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	s.files = nil
+	return err
+}
@@ -0,0 +1,74 @@
+package microblob
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// bloomHashes is the number of bits set per key, optimal for about ten bits
+// per key, which yields around one percent false positives.
+const bloomHashes = 7
+
+// Bloom is a bloom filter over keys, to answer lookups for keys, that do not
+// exist, without a database lookup. Keys cannot be removed, so deleted keys
+// remain false positives. Safe for concurrent use.
+type Bloom struct {
+	mu   sync.RWMutex
+	bits []uint64
+}
+
+// NewBloom returns a bloom filter using size bytes of memory.
+func NewBloom(size int64) *Bloom {
+	n := size / 8
+	if n < 1 {
+		n = 1
+	}
+	return &Bloom{bits: make([]uint64, n)}
+}
+
+// keyHashes returns two hashes of a key, from which any number of positions in
+// a bloom filter or sketch are derived.
+func keyHashes(key string) (h1, h2 uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h1 = h.Sum64()
+	h2 = h1>>33 | h1<<31 | 1
+	return h1, h2
+}
+
+// Add adds a key.
+func (f *Bloom) Add(key string) {
+	h1, h2 := keyHashes(key)
+	m := uint64(len(f.bits)) * 64
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// Test returns false, if the key was never added, and true, if it may have
+// been added.
+func (f *Bloom) Test(key string) bool {
+	h1, h2 := keyHashes(key)
+	m := uint64(len(f.bits)) * 64
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Reset removes all keys.
+func (f *Bloom) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.bits {
+		f.bits[i] = 0
+	}
+}
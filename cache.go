@@ -0,0 +1,93 @@
+package microblob
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Cache is a LRU cache for blobs, limited by the total size of the cached
+// blobs. Safe for concurrent use.
+type Cache struct {
+	MaxBytes int64
+
+	mu    sync.Mutex
+	size  int64
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+// cacheItem is a cached blob.
+type cacheItem struct {
+	key  string
+	data []byte
+}
+
+// NewCache returns a cache holding up to maxBytes of blobs.
+func NewCache(maxBytes int64) *Cache {
+	return &Cache{
+		MaxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns the blob for a key, if cached. The returned slice must not be
+// modified.
+func (c *Cache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		return e.Value.(*cacheItem).data, true
+	}
+	return nil, false
+}
+
+// Add caches a blob, evicting the least recently used blobs as needed. Blobs
+// larger than the cache are not cached.
+func (c *Cache) Add(key string, data []byte) {
+	if int64(len(data)) > c.MaxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.removeElement(e)
+	}
+	c.items[key] = c.ll.PushFront(&cacheItem{key: key, data: data})
+	c.size += int64(len(data))
+	for c.size > c.MaxBytes {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// Remove drops a key from the cache.
+func (c *Cache) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.removeElement(e)
+	}
+}
+
+// Purge drops all cached blobs.
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.size = 0
+}
+
+// Len returns the number of cached blobs and their total size.
+func (c *Cache) Len() (n int, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len(), c.size
+}
+
+func (c *Cache) removeElement(e *list.Element) {
+	item := c.ll.Remove(e).(*cacheItem)
+	delete(c.items, item.key)
+	c.size -= int64(len(item.data))
+}
@@ -0,0 +1,65 @@
+package microblob
+
+import (
+	"net/http"
+	"time"
+)
+
+// cacheResponseWriter adds caching headers to successful and not modified
+// responses, so errors, like a missing key, are not cached.
+type cacheResponseWriter struct {
+	http.ResponseWriter
+	cacheControl string
+	expires      time.Duration
+	wroteHeader  bool
+}
+
+func (w *cacheResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if code < 300 || code == http.StatusNotModified {
+			if w.cacheControl != "" {
+				w.Header().Set("Cache-Control", w.cacheControl)
+			}
+			if w.expires > 0 {
+				w.Header().Set("Expires", time.Now().Add(w.expires).UTC().Format(http.TimeFormat))
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *cacheResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// WithCacheHeaders sends a Cache-Control header, like "public, max-age=3600",
+// and an Expires header, this long after the response, if positive, with
+// documents, so a CDN or browser in front of the server can cache them. Empty
+// values send no header.
+func WithCacheHeaders(cacheControl string, expires time.Duration, h http.Handler) http.Handler {
+	if cacheControl == "" && expires <= 0 {
+		return h
+	}
+	f := func(w http.ResponseWriter, r *http.Request) {
+		cw := &cacheResponseWriter{ResponseWriter: w, cacheControl: cacheControl, expires: expires}
+		h.ServeHTTP(cw, r)
+		if !cw.wroteHeader {
+			// Like HEAD requests answered from the index, without a body.
+			cw.WriteHeader(http.StatusOK)
+		}
+	}
+	return http.HandlerFunc(f)
+}
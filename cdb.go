@@ -0,0 +1,282 @@
+package microblob
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// The CDB file follows the layout of D. J. Bernstein's constant database, with
+// 64 bit positions, so it is not limited to 4GB: a header of 256 hash table
+// references (position and number of slots), the records (key length and
+// value length as uint32, key, value), then the 256 hash tables, whose slots
+// hold a hash and a record position. A lookup reads one header entry, one or
+// a few slots and the record. All numbers are little endian. The value is the
+// entry in the compact index format, see encodeEntry.
+const (
+	cdbTables     = 256
+	cdbHeaderSize = cdbTables * 16
+	cdbSlotSize   = 16
+)
+
+// cdbHash is the hash function of cdb.
+func cdbHash(key []byte) uint32 {
+	h := uint32(5381)
+	for _, c := range key {
+		h = ((h << 5) + h) ^ uint32(c)
+	}
+	return h
+}
+
+// BuildCDB writes all entries of an index into a new CDB file in one pass, so
+// it can be served with CDBBackend. The file is written next to filename and
+// renamed, when complete. Returns the number of entries written. Keys are
+// copied as stored.
+func BuildCDB(filename string, src EntryIterator) (n int64, err error) {
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	type slot struct {
+		hash uint32
+		pos  uint64
+	}
+	var (
+		bw     = bufio.NewWriterSize(f, 1<<20)
+		pos    = uint64(cdbHeaderSize)
+		tables [cdbTables][]slot
+		buf    [8]byte
+	)
+	if _, err := bw.Write(make([]byte, cdbHeaderSize)); err != nil {
+		return 0, err
+	}
+	err = withSuppressed{src}.Entries(func(e Entry) error {
+		key, value := []byte(e.Key), encodeEntry(e)
+		binary.LittleEndian.PutUint32(buf[:4], uint32(len(key)))
+		binary.LittleEndian.PutUint32(buf[4:], uint32(len(value)))
+		for _, p := range [][]byte{buf[:], key, value} {
+			if _, err := bw.Write(p); err != nil {
+				return err
+			}
+		}
+		h := cdbHash(key)
+		tables[h%cdbTables] = append(tables[h%cdbTables], slot{hash: h, pos: pos})
+		pos += uint64(8 + len(key) + len(value))
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	header := make([]byte, cdbHeaderSize)
+	for i, entries := range tables {
+		// Twice the slots needed keeps probe sequences short.
+		slots := make([]slot, 2*len(entries))
+		for _, s := range entries {
+			j := int(s.hash/cdbTables) % len(slots)
+			for slots[j].pos != 0 {
+				j = (j + 1) % len(slots)
+			}
+			slots[j] = s
+		}
+		binary.LittleEndian.PutUint64(header[i*16:], pos)
+		binary.LittleEndian.PutUint64(header[i*16+8:], uint64(len(slots)))
+		var b [cdbSlotSize]byte
+		for _, s := range slots {
+			binary.LittleEndian.PutUint64(b[:8], uint64(s.hash))
+			binary.LittleEndian.PutUint64(b[8:], s.pos)
+			if _, err := bw.Write(b[:]); err != nil {
+				return n, err
+			}
+		}
+		pos += uint64(len(slots) * cdbSlotSize)
+	}
+	if err := bw.Flush(); err != nil {
+		return n, err
+	}
+	if _, err := f.WriteAt(header, 0); err != nil {
+		return n, err
+	}
+	if err := f.Sync(); err != nil {
+		return n, err
+	}
+	if err := f.Close(); err != nil {
+		return n, err
+	}
+	return n, os.Rename(f.Name(), filename)
+}
+
+// CDBBackend serves documents with an immutable index in a single CDB file,
+// as written by BuildCDB: there is nothing to write or compact at serve time
+// and each lookup takes a constant number of reads, which the page cache
+// usually answers. Updates are not supported.
+type CDBBackend struct {
+	Filename      string
+	Blobfile      string
+	Blobfiles     []string // additional blob files, entries with file id n refer to Blobfiles[n-1]
+	Separator     byte     // terminates records in the blob file, defaults to newline
+	Compression   string   // "zstd", if each blob is stored as a separate zstd frame
+	MaxRecordSize int64    // if positive, longer documents are not read, see ErrRecordTooLarge
+
+	mu    sync.Mutex
+	index *os.File
+	blobs blobSet
+}
+
+// open opens index and blob files. Safe to call many times.
+func (b *CDBBackend) open() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.index != nil {
+		return nil
+	}
+	index, err := os.Open(b.Filename)
+	if err != nil {
+		return err
+	}
+	if err := b.blobs.open(append([]string{b.Blobfile}, b.Blobfiles...)); err != nil {
+		index.Close()
+		return err
+	}
+	b.index = index
+	return nil
+}
+
+// WriteEntries fails, the index is immutable.
+func (b *CDBBackend) WriteEntries(entries []Entry) error {
+	return fmt.Errorf("cdb index %s is read-only", b.Filename)
+}
+
+// Locate returns the entry for a key, leveldb.ErrNotFound, if there is none.
+func (b *CDBBackend) Locate(key string) (Entry, error) {
+	defer stageLatency.Observe("index", time.Now())
+	if err := b.open(); err != nil {
+		return Entry{}, err
+	}
+	var (
+		k    = []byte(key)
+		h    = cdbHash(k)
+		head [16]byte
+	)
+	if _, err := b.index.ReadAt(head[:], int64(h%cdbTables)*16); err != nil {
+		return Entry{}, err
+	}
+	tpos := binary.LittleEndian.Uint64(head[:8])
+	nslots := binary.LittleEndian.Uint64(head[8:])
+	if nslots == 0 {
+		return Entry{}, leveldb.ErrNotFound
+	}
+	var s [cdbSlotSize]byte
+	for i, j := uint64(0), uint64(h/cdbTables)%nslots; i < nslots; i, j = i+1, (j+1)%nslots {
+		if _, err := b.index.ReadAt(s[:], int64(tpos+j*cdbSlotSize)); err != nil {
+			return Entry{}, err
+		}
+		pos := binary.LittleEndian.Uint64(s[8:])
+		if pos == 0 {
+			break
+		}
+		if uint32(binary.LittleEndian.Uint64(s[:8])) != h {
+			continue
+		}
+		var lens [8]byte
+		if _, err := b.index.ReadAt(lens[:], int64(pos)); err != nil {
+			return Entry{}, err
+		}
+		klen := binary.LittleEndian.Uint32(lens[:4])
+		vlen := binary.LittleEndian.Uint32(lens[4:])
+		if int(klen) != len(k) {
+			continue
+		}
+		record := make([]byte, int(klen)+int(vlen))
+		if _, err := b.index.ReadAt(record, int64(pos)+8); err != nil {
+			return Entry{}, err
+		}
+		if bytes.Equal(record[:klen], k) {
+			e, err := decodeEntry(k, record[klen:])
+			if err != nil {
+				return Entry{}, err
+			}
+			if e.expired(time.Now()) {
+				return Entry{}, leveldb.ErrNotFound
+			}
+			return e, nil
+		}
+	}
+	return Entry{}, leveldb.ErrNotFound
+}
+
+// Get retrieves the document for a key.
+func (b *CDBBackend) Get(key string) ([]byte, error) {
+	e, err := b.Locate(key)
+	if err != nil {
+		return nil, err
+	}
+	return b.blobs.read(e, b.Compression, b.Separator, b.MaxRecordSize)
+}
+
+// Count returns the number of entries, from the sizes of the hash tables.
+func (b *CDBBackend) Count() (int64, error) {
+	if err := b.open(); err != nil {
+		return 0, err
+	}
+	header := make([]byte, cdbHeaderSize)
+	if _, err := b.index.ReadAt(header, 0); err != nil {
+		return 0, err
+	}
+	var n int64
+	for i := 0; i < cdbTables; i++ {
+		n += int64(binary.LittleEndian.Uint64(header[i*16+8:]) / 2)
+	}
+	return n, nil
+}
+
+// Check returns an error, if index or blob files cannot be opened.
+func (b *CDBBackend) Check() error { return b.open() }
+
+// RecordSeparator returns the record separator of the blob files.
+func (b *CDBBackend) RecordSeparator() byte {
+	if b.Separator == 0 {
+		return '\n'
+	}
+	return b.Separator
+}
+
+// IndexSize returns the size of the CDB file.
+func (b *CDBBackend) IndexSize() (int64, error) {
+	fi, err := os.Stat(b.Filename)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// Reload closes index and blob files, they are reopened on next access, e.g.
+// after a rebuilt index has been moved into place.
+func (b *CDBBackend) Reload() error { return b.Close() }
+
+// Close closes index and blob files.
+func (b *CDBBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.index == nil {
+		return nil
+	}
+	err := b.index.Close()
+	if cerr := b.blobs.Close(); err == nil {
+		err = cerr
+	}
+	b.index = nil
+	return err
+}
@@ -0,0 +1,107 @@
+package microblob
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// checksumCacheSize is the number of bytes of cached checksums, about a
+// million sums.
+const checksumCacheSize = 32 << 20
+
+// Checksummer can return a checksum of the document for a key, so mirrors can
+// compare documents without transferring them.
+type Checksummer interface {
+	Checksum(key string) (string, error)
+}
+
+// Checksum returns the hex encoded SHA-256 of the document for a key. Sums are
+// computed on first request and cached by location, as blob files are only
+// appended to: an update moves a key to a new location. The cache is dropped,
+// when compaction or reindexing rewrites the blob files.
+func (b *LevelDBBackend) Checksum(key string) (string, error) {
+	if b.Suppressed.Contains(key) {
+		return "", ErrSuppressed
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	entry, err := b.locate(key)
+	if err != nil {
+		return "", err
+	}
+	b.checksumsOnce.Do(func() { b.checksums = NewCache(checksumCacheSize) })
+	loc := fmt.Sprintf("%d:%d:%d", entry.File, entry.Offset, entry.Length)
+	if sum, ok := b.checksums.Get(loc); ok {
+		return hex.EncodeToString(sum), nil
+	}
+	data, err := b.read(entry)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	b.checksums.Add(loc, sum[:])
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Checksum transforms the key, then asks the wrapped backend for the checksum.
+func (b TransformBackend) Checksum(key string) (string, error) {
+	c, ok := b.Backend.(Checksummer)
+	if !ok {
+		return "", ErrNotImplemented
+	}
+	key, err := b.Transform(key)
+	if err != nil {
+		return "", err
+	}
+	return c.Checksum(key)
+}
+
+// ChecksumHandler serves the checksum of the document for a key.
+type ChecksumHandler struct {
+	Backend Backend
+}
+
+// ServeHTTP responds with key and SHA-256 of the document as JSON. Backends,
+// that are no Checksummer, read the document on each request.
+func (h *ChecksumHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	var (
+		sum string
+		err error
+	)
+	if c, ok := h.Backend.(Checksummer); ok {
+		sum, err = c.Checksum(key)
+	} else {
+		err = ErrNotImplemented
+	}
+	if err == ErrNotImplemented {
+		var b []byte
+		if b, err = GetContext(r.Context(), h.Backend, key); err == nil {
+			s := sha256.Sum256(b)
+			sum = hex.EncodeToString(s[:])
+		}
+	}
+	switch {
+	case err == ErrSuppressed:
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	case err == leveldb.ErrNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), failureStatus(err))
+		return
+	}
+	w.Header().Set("X-Blob", Version)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]string{"key": key, "sha256": sum}); err != nil {
+		http.Error(w, "could not serialize", http.StatusInternalServerError)
+		return
+	}
+}
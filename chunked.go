@@ -0,0 +1,31 @@
+package microblob
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+// writeChunks copies n bytes from r to w in chunks of the given size, flushing
+// after each, so clients receive the start of large documents early. Stops,
+// when the client goes away or the request times out.
+func writeChunks(ctx context.Context, w io.Writer, r io.Reader, n, size int64) error {
+	flusher, _ := w.(http.Flusher)
+	for n > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		k := size
+		if n < k {
+			k = n
+		}
+		if _, err := io.CopyN(w, r, k); err != nil {
+			return err
+		}
+		n -= k
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bench replays lookups of keys against a running server.
+type bench struct {
+	Addr        string // host:port, URL or unix:///path/to/socket
+	Keys        []string
+	Requests    int // number of requests, randomly sampled from keys
+	Concurrency int
+}
+
+// benchResult summarizes a benchmark run.
+type benchResult struct {
+	Elapsed   time.Duration
+	Latencies []time.Duration // sorted
+	Status    map[int]int
+	Errors    int
+	Bytes     int64
+}
+
+// readKeys reads one key per line, skipping empty lines.
+func readKeys(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var keys []string
+	br := bufio.NewScanner(f)
+	br.Buffer(make([]byte, 64*1024), 1<<20)
+	for br.Scan() {
+		if key := strings.TrimSpace(br.Text()); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys, br.Err()
+}
+
+// client returns the base URL and a client for the address.
+func (b bench) client() (string, *http.Client) {
+	transport := &http.Transport{MaxIdleConnsPerHost: b.Concurrency}
+	switch {
+	case strings.HasPrefix(b.Addr, "unix://"):
+		path := strings.TrimPrefix(b.Addr, "unix://")
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		return "http://unix", &http.Client{Transport: transport}
+	case strings.HasPrefix(b.Addr, "http://"), strings.HasPrefix(b.Addr, "https://"):
+		return strings.TrimSuffix(b.Addr, "/"), &http.Client{Transport: transport}
+	default:
+		return "http://" + b.Addr, &http.Client{Transport: transport}
+	}
+}
+
+// Run issues the requests and collects latencies and status codes.
+func (b bench) Run() (*benchResult, error) {
+	if len(b.Keys) == 0 {
+		return nil, fmt.Errorf("no keys to look up")
+	}
+	if b.Concurrency < 1 {
+		b.Concurrency = 1
+	}
+	base, client := b.client()
+	var (
+		queue  = make(chan string)
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		result = &benchResult{Status: make(map[int]int)}
+	)
+	for i := 0; i < b.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range queue {
+				started := time.Now()
+				resp, err := client.Get(base + "/" + url.PathEscape(key))
+				var n int64
+				if err == nil {
+					n, err = io.Copy(ioutil.Discard, resp.Body)
+					resp.Body.Close()
+				}
+				latency := time.Since(started)
+				mu.Lock()
+				if err != nil {
+					result.Errors++
+				} else {
+					result.Status[resp.StatusCode]++
+					result.Latencies = append(result.Latencies, latency)
+					result.Bytes += n
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	started := time.Now()
+	for i := 0; i < b.Requests; i++ {
+		queue <- b.Keys[rand.Intn(len(b.Keys))]
+	}
+	close(queue)
+	wg.Wait()
+	result.Elapsed = time.Since(started)
+	sort.Slice(result.Latencies, func(i, j int) bool { return result.Latencies[i] < result.Latencies[j] })
+	return result, nil
+}
+
+// percentile returns the latency below which p percent of the requests
+// completed.
+func (r *benchResult) percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(r.Latencies))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(r.Latencies) {
+		i = len(r.Latencies) - 1
+	}
+	return r.Latencies[i]
+}
+
+// WriteTo writes a summary of throughput, status codes and latency
+// percentiles.
+func (r *benchResult) WriteTo(w io.Writer) (int64, error) {
+	var sb strings.Builder
+	n := len(r.Latencies) + r.Errors
+	fmt.Fprintf(&sb, "requests:   %d in %v, %d errors\n", n, r.Elapsed.Round(time.Millisecond), r.Errors)
+	fmt.Fprintf(&sb, "throughput: %.1f req/s, %.1f MB/s\n",
+		float64(n)/r.Elapsed.Seconds(), float64(r.Bytes)/r.Elapsed.Seconds()/(1<<20))
+	var codes []int
+	for code := range r.Status {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(&sb, "status:     %d %d\n", code, r.Status[code])
+	}
+	if len(r.Latencies) > 0 {
+		fmt.Fprintf(&sb, "latency:    p50 %v, p90 %v, p99 %v, p99.9 %v, max %v\n",
+			r.percentile(50), r.percentile(90), r.percentile(99), r.percentile(99.9),
+			r.Latencies[len(r.Latencies)-1])
+	}
+	k, err := io.WriteString(w, sb.String())
+	return int64(k), err
+}
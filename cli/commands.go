@@ -0,0 +1,115 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// command is a subcommand, accepting the common flags and its own.
+type command struct {
+	name  string
+	args  string
+	help  string
+	flags []string
+}
+
+var (
+	// commonFlags are accepted by all commands, they select file, key and index.
+	commonFlags = []string{
+		"backend", "column", "config", "db", "delimiter", "extractor", "file",
+		"format", "key", "key-hash", "key-sep", "key-template", "key-transform",
+		"leveldb-block-cache", "leveldb-bloom-bits", "leveldb-no-compression",
+		"leveldb-write-buffer", "log-format", "overlay", "r", "separator", "sparse",
+		"xml-path", "zstd",
+	}
+	indexFlags = []string{
+		"batch", "batch-bytes", "broken-report", "crc", "duplicate-report", "fsync",
+		"ignore-missing-keys", "inline", "journal", "keep-versions",
+		"max-record-size", "on-duplicate", "quiet", "skip-broken", "strict-unique",
+		"workers", "write-index",
+	}
+	serveFlags = []string{
+		"addr", "admin-addr", "admin-allow", "admin-deny", "admin-local",
+		"audit-log", "auth-token", "auth-token-file", "bloom", "burst",
+		"cache-control", "cache-size", "chunk-size", "client-burst", "client-rate",
+		"content-type", "cors-headers", "cors-methods", "cors-origins", "dedup",
+		"expires", "fallback-cache", "fallback-url", "fetch-interval", "fetch-url",
+		"follow", "grpc-addr", "h2c", "idle-timeout", "log", "log-keep",
+		"log-max-age", "log-max-size", "manifest-key", "max-conns",
+		"max-header-bytes", "miss-ttl", "mmap", "not-found", "rate", "read-timeout",
+		"readonly", "remote", "replicate", "replicate-interval", "request-timeout",
+		"scan-max-bytes", "scan-on-miss", "scan-timeout", "selfcheck",
+		"selfcheck-warn", "shard", "shutdown-timeout", "signed-prefixes",
+		"socket-mode", "stream-size", "suggest", "suppress", "suppress-interval",
+		"tls-cert", "tls-client-ca", "tls-key", "top-keys", "ttl", "update-spool",
+		"update-urls", "url-key", "verify-manifest", "warmup", "watch", "webhook",
+		"with-key", "with-key-field", "write-timeout",
+	}
+)
+
+var commands = []command{
+	{"index", "blobfile", "build the index for a file and exit", indexFlags},
+	{"serve", "blobfile", "serve a file, build the index first, if necessary", append(indexFlags, serveFlags...)},
+	{"append", "blobfile file ...", "append files or URLs to the blob file, index them and exit", append([]string{"append-url", "audit-log", "dedup", "ttl", "webhook"}, indexFlags...)},
+	{"verify", "blobfile", "verify the index against the blob file, report problems and exit", nil},
+	{"compact", "blobfile", "drop superseded documents from the blob file, rebuild the index and exit", nil},
+	{"gc", "blobfile", "report the bytes of the blob files no entry refers to as JSON, compact, if their share reaches -gc-threshold, and exit", []string{"dry-run", "gc-threshold"}},
+	{"reindex", "blobfile", "rebuild the index, swap it into place and exit", indexFlags},
+	{"backup", "blobfile", "write a consistent tar archive of blob file and index to stdout and exit", nil},
+	{"restore", "archive [dir]", "extract a backup into dir, check that index and blob file match and exit", nil},
+	{"migrate", "blobfile", "rewrite an index from an earlier version in the smaller current format, or copy it to another backend, and exit", []string{"batch", "from", "to"}},
+	{"freeze", "blobfile", "build a minimal perfect hash index from the index, to serve with -backend mph, and exit", nil},
+	{"dump", "blobfile", "write the index as sorted TSV of key, offset, length, size, file and expiry to stdout and exit", []string{"binary"}},
+	{"load", "blobfile file", "build the index from a file written by dump or -write-index, or - for stdin, and exit", []string{"batch", "inline"}},
+	{"split", "file", "write the records of a file to one file per shard in the config file, next to it, and exit", nil},
+	{"diff", "a b", "compare two indexes, directories, dumps or servers, report keys only in one and keys with other entries as TSV and exit", nil},
+	{"get", "blobfile key ...", "look up keys, write their documents to stdout and exit", nil},
+	{"keys", "blobfile", "write all indexed keys to stdout, in key order, and exit", []string{"offsets"}},
+	{"bench", "", "replay lookups of sampled keys against a running server, report throughput and latency and exit", []string{"addr", "c", "keys", "n"}},
+	{"manifest", "blobfile", "write a signed manifest of key count, blob file and index hashes as JSON to stdout and exit", []string{"manifest-key"}},
+	{"sign", "path ...", "write links to the paths, signed with -url-key and valid for -sign-ttl, to stdout and exit", []string{"sign-ttl", "url-key"}},
+	{"stats", "blobfile", "print number of keys, blob file and index size as JSON and exit", nil},
+}
+
+// findCommand returns the command with the given name.
+func findCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+// flagSet returns a flag set with the flags of the command, sharing their
+// values with the flags in fs.
+func (c command) flagSet(fs *flag.FlagSet) *flag.FlagSet {
+	allowed := make(map[string]bool)
+	for _, name := range append(commonFlags, c.flags...) {
+		allowed[name] = true
+	}
+	set := flag.NewFlagSet(c.name, flag.ExitOnError)
+	fs.VisitAll(func(f *flag.Flag) {
+		if allowed[f.Name] {
+			set.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "Usage: %s %s [flags] %s\n\nThe %s command will %s.\n\n", os.Args[0], c.name, c.args, c.name, c.help)
+		set.PrintDefaults()
+	}
+	return set
+}
+
+// usage prints the commands and all flags, which can also be used without a
+// command, to serve a file.
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "Usage: %s [command] [flags] blobfile\n\nCommands:\n\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", c.name, c.help)
+	}
+	fmt.Fprintf(w, "\nWithout a command, all flags are accepted:\n\n")
+	flag.PrintDefaults()
+}
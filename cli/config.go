@@ -0,0 +1,435 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miku/microblob"
+	log "github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfig reads a YAML file mapping flag names to values and sets all flags,
+// that have not been set explicitly. Lists set repeatable flags multiple times.
+// The special key "blobfile" names the file to serve, if none is given as
+// argument.
+//
+//	addr: 0.0.0.0:8820
+//	key:
+//	  - id
+//	  - doi
+//	blobfile: /var/lib/microblob/data.ldj
+func loadConfig(filename string, set func(name, value string) error, isSet func(name string) bool) (blobfile string, err error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	var config map[string]interface{}
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return "", fmt.Errorf("config %s: %v", filename, err)
+	}
+	for name, v := range config {
+		if name == "blobfile" {
+			blobfile = fmt.Sprint(v)
+			continue
+		}
+		if name == "namespaces" || name == "shards" || name == "rewrite" || name == "headers" || name == "quotas" {
+			continue // See loadNamespaces, loadShards, loadRewrite, loadHeaders and loadQuotas.
+		}
+		if isSet(name) {
+			continue
+		}
+		values, ok := v.([]interface{})
+		if !ok {
+			values = []interface{}{v}
+		}
+		for _, value := range values {
+			if err := set(name, fmt.Sprint(value)); err != nil {
+				return "", fmt.Errorf("config %s: %s: %v", filename, name, err)
+			}
+		}
+	}
+	return blobfile, nil
+}
+
+// envName returns the environment variable for a flag, e.g. MICROBLOB_KEY_SEP
+// for key-sep.
+func envName(name string) string {
+	return "MICROBLOB_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// loadEnv sets all flags, that have not been set explicitly, from MICROBLOB_*
+// environment variables and returns the names of the flags set. The variable
+// MICROBLOB_BLOBFILE names the file to serve.
+func loadEnv(fs *flag.FlagSet, isSet func(name string) bool) (names []string, blobfile string, err error) {
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || isSet(f.Name) {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if err = fs.Set(f.Name, value); err != nil {
+			err = fmt.Errorf("%s: %v", envName(f.Name), err)
+			return
+		}
+		names = append(names, f.Name)
+	})
+	return names, os.Getenv(envName("blobfile")), err
+}
+
+// stringList is a YAML value, that can be a single string or a list.
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = stringList{value.Value}
+		return nil
+	}
+	var v []string
+	if err := value.Decode(&v); err != nil {
+		return err
+	}
+	*l = v
+	return nil
+}
+
+// namespace is an additional dataset served under /ns/{name}/, with its own
+// blob file and index. Namespaces with the same shared index keep their
+// entries in one LevelDB directory, under their name as key prefix.
+type namespace struct {
+	Blobfile    string     `yaml:"blobfile"`
+	Key         stringList `yaml:"key"`
+	KeySep      string     `yaml:"key-sep"`
+	Pattern     string     `yaml:"r"`
+	Column      int        `yaml:"column"`
+	Delimiter   string     `yaml:"delimiter"`
+	XMLPath     string     `yaml:"xml-path"`
+	KeyTemplate string     `yaml:"key-template"`
+	Extractor   string     `yaml:"extractor"`
+	Separator   string     `yaml:"separator"`
+	Format      string     `yaml:"format"`
+	ContentType string     `yaml:"content-type"`
+	SharedIndex string     `yaml:"shared-index"`
+	// Rewrite rules for the keys of lookups, like the top-level rewrite.
+	Rewrite []microblob.RewriteRule `yaml:"rewrite"`
+	// Headers by key prefix, like the top-level headers.
+	Headers []microblob.HeaderRule `yaml:"headers"`
+}
+
+// loadNamespaces reads the namespaces section of a YAML config file, mapping
+// names to datasets:
+//
+//	namespaces:
+//	  books:
+//	    blobfile: /var/lib/microblob/books.ldj
+//	    key: id
+//	  articles:
+//	    blobfile: /var/lib/microblob/articles.ldj
+//	    key: [doi, id]
+//	  maps:
+//	    blobfile: /var/lib/microblob/maps.ldj
+//	    key: id
+//	    shared-index: /var/lib/microblob/small.db
+func loadNamespaces(filename string) (map[string]namespace, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Namespaces map[string]namespace `yaml:"namespaces"`
+	}
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("config %s: %v", filename, err)
+	}
+	for name, ns := range config.Namespaces {
+		if name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("config %s: invalid namespace name: %q", filename, name)
+		}
+		if ns.Blobfile == "" {
+			return nil, fmt.Errorf("config %s: namespace %s: blobfile required", filename, name)
+		}
+	}
+	return config.Namespaces, nil
+}
+
+// loadShards reads the shards section of a YAML config file, mapping the
+// names of the shards of a cluster to their URLs. All shards share the
+// section, each is started with its own name as -shard:
+//
+//	shards:
+//	  a: http://10.0.0.1:8820
+//	  b: http://10.0.0.2:8820
+//	  c: http://10.0.0.3:8820
+func loadShards(filename string) (*microblob.ShardMap, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Shards map[string]string `yaml:"shards"`
+	}
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("config %s: %v", filename, err)
+	}
+	var shards []microblob.Shard
+	for name, link := range config.Shards {
+		shards = append(shards, microblob.Shard{Name: name, URL: link})
+	}
+	m, err := microblob.NewShardMap(shards)
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %v", filename, err)
+	}
+	return m, nil
+}
+
+// loadRewrite reads the rewrite section of a YAML config file, rules applied
+// to the keys of lookups, in order, the first matching rule wins:
+//
+//	rewrite:
+//	  - prefix: "ark:/12345/"
+//	    replace: "urn:x:"
+//	  - match: "^isbn:([0-9-]+)$"
+//	    replace: "urn:isbn:$1"
+//
+// Rule fields decode by their lowercased names.
+func loadRewrite(filename string) (microblob.KeyTransform, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Rewrite []microblob.RewriteRule `yaml:"rewrite"`
+	}
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("config %s: %v", filename, err)
+	}
+	t, err := microblob.ParseRewriteRules(config.Rewrite)
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %v", filename, err)
+	}
+	return t, nil
+}
+
+// loadHeaders reads the headers section of a YAML config file, the content
+// type and additional headers of documents by key prefix, the first matching
+// rule wins:
+//
+//	headers:
+//	  - prefix: "xml:"
+//	    content-type: application/xml
+//	  - prefix: "marc:"
+//	    content-type: application/marc
+//	    headers:
+//	      Content-Disposition: attachment
+func loadHeaders(filename string) (microblob.HeaderRules, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Headers []microblob.HeaderRule `yaml:"headers"`
+	}
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("config %s: %v", filename, err)
+	}
+	rules, err := microblob.ParseHeaderRules(config.Headers)
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %v", filename, err)
+	}
+	return rules, nil
+}
+
+// quota is a quota in a YAML config file, with the bytes as size, e.g. 100GB.
+type quota struct {
+	Period   time.Duration `yaml:"period"`
+	Requests int64         `yaml:"requests"`
+	Bytes    string        `yaml:"bytes"`
+}
+
+// parse returns the quota, if it is valid.
+func (q quota) parse() (microblob.Quota, error) {
+	parsed := microblob.Quota{Period: q.Period, Requests: q.Requests}
+	if q.Bytes != "" {
+		n, err := parseSize(q.Bytes)
+		if err != nil {
+			return parsed, err
+		}
+		parsed.Bytes = n
+	}
+	if parsed.Requests < 0 || parsed.Bytes < 0 {
+		return parsed, fmt.Errorf("negative limit")
+	}
+	if parsed.Period <= 0 && (parsed.Requests > 0 || parsed.Bytes > 0) {
+		return parsed, fmt.Errorf("period required")
+	}
+	return parsed, nil
+}
+
+// loadQuotas reads the quotas section of a YAML config file, limits of the
+// requests and bytes served per period, globally, per client IP for requests
+// without API key, per API key and per namespace. Returns nil without quotas.
+//
+//	quotas:
+//	  global: {period: 24h, bytes: 2TB}
+//	  anonymous: {period: 1h, requests: 1000, bytes: 1GB}
+//	  keys:
+//	    d1f0c9a7e5: {period: 24h, requests: 1000000, bytes: 100GB}
+//	  namespaces:
+//	    books: {period: 24h, bytes: 500GB}
+func loadQuotas(filename string) (*microblob.Quotas, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Quotas *struct {
+			Global     quota            `yaml:"global"`
+			Anonymous  quota            `yaml:"anonymous"`
+			Keys       map[string]quota `yaml:"keys"`
+			Namespaces map[string]quota `yaml:"namespaces"`
+		} `yaml:"quotas"`
+	}
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("config %s: %v", filename, err)
+	}
+	c := config.Quotas
+	if c == nil {
+		return nil, nil
+	}
+	q := &microblob.Quotas{
+		Keys:       make(map[string]microblob.Quota),
+		Namespaces: make(map[string]microblob.Quota),
+	}
+	if q.Global, err = c.Global.parse(); err != nil {
+		return nil, fmt.Errorf("config %s: global quota: %v", filename, err)
+	}
+	if q.Anonymous, err = c.Anonymous.parse(); err != nil {
+		return nil, fmt.Errorf("config %s: anonymous quota: %v", filename, err)
+	}
+	for key, v := range c.Keys {
+		if q.Keys[key], err = v.parse(); err != nil {
+			return nil, fmt.Errorf("config %s: quota of key %s: %v", filename, key, err)
+		}
+	}
+	for name, v := range c.Namespaces {
+		if q.Namespaces[name], err = v.parse(); err != nil {
+			return nil, fmt.Errorf("config %s: quota of namespace %s: %v", filename, name, err)
+		}
+	}
+	return q, nil
+}
+
+// open opens the index of the namespace, indexing the blob file with the given
+// options first, if no index exists yet. Shared indexes are looked up by
+// directory in shared and added, when first used.
+func (ns namespace) open(name string, shared map[string]*microblob.SharedDB, opts microblob.AppendOptions, readOnly bool) (*microblob.LevelDBBackend, error) {
+	ko := keyOptions{
+		Backend:   "leveldb",
+		Keypaths:  ns.Key,
+		KeySep:    ns.KeySep,
+		Pattern:   ns.Pattern,
+		Column:    ns.Column,
+		Delimiter: ns.Delimiter,
+		XMLPath:   ns.XMLPath,
+		Template:  ns.KeyTemplate,
+		Extractor: ns.Extractor,
+		Separator: ns.Separator,
+		Format:    ns.Format,
+	}
+	if ko.KeySep == "" {
+		ko.KeySep = microblob.DefaultKeySeparator
+	}
+	if ko.Delimiter == "" {
+		ko.Delimiter = `\t`
+	}
+	if err := ko.validate(); err != nil {
+		return nil, err
+	}
+	if ns.Format != "" && strings.HasSuffix(ns.Blobfile, ".zst") {
+		return nil, fmt.Errorf("format %s requires an uncompressed blob file", ns.Format)
+	}
+	extractor, err := ko.extractor()
+	if err != nil {
+		return nil, err
+	}
+	if ns.SharedIndex != "" {
+		return ns.openShared(name, shared, extractor.ExtractKeys, ko, opts, readOnly)
+	}
+	dbfile, err := ko.dbfile(ns.Blobfile, nil)
+	if err != nil {
+		return nil, err
+	}
+	backend := &microblob.LevelDBBackend{Filename: dbfile, Blobfile: ns.Blobfile, Format: microblob.RecordFormat(ns.Format)}
+	if backend.Separator, err = ko.recordSeparator(); err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(ns.Blobfile, ".zst") {
+		backend.Compression = "zstd"
+	}
+	if _, err := os.Stat(dbfile); os.IsNotExist(err) {
+		log.Printf("indexing %s ...", ns.Blobfile)
+		if err := microblob.AppendKeysOptions(ns.Blobfile, "", backend, extractor.ExtractKeys, opts); err != nil {
+			os.RemoveAll(dbfile)
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if err := backend.CheckBlob(ns.Blobfile); err != nil {
+		return nil, err
+	}
+	backend.ReadOnly = readOnly
+	return backend, nil
+}
+
+// openShared opens the namespace in its shared index, with the name as key
+// prefix, indexing the blob file first, if the index has no entries for it.
+func (ns namespace) openShared(name string, shared map[string]*microblob.SharedDB, kf microblob.KeysFunc, ko keyOptions, opts microblob.AppendOptions, readOnly bool) (*microblob.LevelDBBackend, error) {
+	db, ok := shared[ns.SharedIndex]
+	if !ok {
+		db = &microblob.SharedDB{Filename: ns.SharedIndex}
+		if readOnly {
+			db.Options = &opt.Options{ReadOnly: true, ErrorIfMissing: true}
+		}
+		shared[ns.SharedIndex] = db
+	}
+	backend := &microblob.LevelDBBackend{
+		Filename: ns.SharedIndex,
+		Blobfile: ns.Blobfile,
+		Shared:   db,
+		Prefix:   name + "/",
+		ReadOnly: readOnly,
+		Format:   microblob.RecordFormat(ko.Format),
+	}
+	var err error
+	if backend.Separator, err = ko.recordSeparator(); err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(ns.Blobfile, ".zst") {
+		backend.Compression = "zstd"
+	}
+	keys, err := backend.Keys("", "", 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 && !readOnly {
+		log.Printf("indexing %s into %s ...", ns.Blobfile, ns.SharedIndex)
+		if err := microblob.AppendKeysOptions(ns.Blobfile, "", backend, kf, opts); err != nil {
+			backend.DeleteAll()
+			backend.Close()
+			return nil, err
+		}
+	}
+	if err := backend.CheckBlob(ns.Blobfile); err != nil {
+		backend.Close()
+		return nil, err
+	}
+	return backend, nil
+}
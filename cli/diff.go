@@ -0,0 +1,45 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/miku/microblob"
+)
+
+// diffSource returns the entries to compare: a running server, given by URL,
+// whose index is read from /dump, an index directory, a flat index as written
+// by dump, or - for stdin. The closer releases the source.
+func diffSource(name string) (microblob.EntryIterator, io.Closer, error) {
+	if strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://") {
+		resp, err := http.Get(strings.TrimSuffix(name, "/") + "/dump")
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, nil, fmt.Errorf("dump from %s failed: %s", name, resp.Status)
+		}
+		return microblob.FlatEntries{R: resp.Body}, resp.Body, nil
+	}
+	if name == "-" {
+		return microblob.FlatEntries{R: os.Stdin}, ioutil.NopCloser(os.Stdin), nil
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fi.IsDir() {
+		b := &microblob.LevelDBBackend{Filename: name, ReadOnly: true}
+		return b, b, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return microblob.FlatEntries{R: f}, f, nil
+}
@@ -0,0 +1,220 @@
+package cli
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/miku/microblob"
+)
+
+// keyOptions are the options, that determine the keys of the documents and
+// with that the index.
+type keyOptions struct {
+	Backend   string
+	Keypaths  []string
+	KeySep    string
+	Pattern   string
+	Column    int
+	Delimiter string // as given, with escapes like \t
+	XMLPath   string
+	Template  string // key template over JSON fields
+	Extractor string // registered extractor with options, like json:id
+	Separator string // record separator as given, with escapes like \x1e
+	Format    string // record format, like marc, empty for separated records
+	Transform string
+	Hash      string
+	Sparse    int // records per block of a sparse index, 0 for a full index
+}
+
+// keypath returns all key paths in a single string.
+func (o keyOptions) keypath() string {
+	return strings.Join(o.Keypaths, " ")
+}
+
+// validate checks, that there is a way to identify keys.
+func (o keyOptions) validate() error {
+	format, err := microblob.ParseRecordFormat(o.Format)
+	if err != nil {
+		return err
+	}
+	if format != "" && (o.Pattern != "" || o.Column > 0 || o.XMLPath != "" || o.Template != "") {
+		return fmt.Errorf("with format %s, keys are taken from the fields given as key", format)
+	}
+	if format == "" && o.keypath() == "" && o.Pattern == "" && o.Column == 0 && o.XMLPath == "" && o.Template == "" && o.Extractor == "" {
+		return fmt.Errorf("need path, pattern, column, XML path, template or extractor to identify key")
+	}
+	if o.Template != "" {
+		if _, err := microblob.NewTemplateExtractor(o.Template); err != nil {
+			return err
+		}
+	}
+	if o.Extractor != "" {
+		if _, err := microblob.NewExtractor(o.Extractor); err != nil {
+			return err
+		}
+	}
+	if _, err := o.sep(); err != nil {
+		return err
+	}
+	if _, err := o.recordSeparator(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// recordSeparator returns the unquoted record separator, newline by default.
+func (o keyOptions) recordSeparator() (byte, error) {
+	if o.Separator == "" {
+		return '\n', nil
+	}
+	sep, err := strconv.Unquote(`"` + o.Separator + `"`)
+	if err != nil || len(sep) != 1 || sep[0] >= 0x80 {
+		return 0, fmt.Errorf("invalid record separator, need a single ASCII character: %s", o.Separator)
+	}
+	return sep[0], nil
+}
+
+// sep returns the unquoted column delimiter.
+func (o keyOptions) sep() (string, error) {
+	sep, err := strconv.Unquote(`"` + o.Delimiter + `"`)
+	if err != nil {
+		return "", fmt.Errorf("invalid delimiter: %s", o.Delimiter)
+	}
+	return sep, nil
+}
+
+// dbfile returns the name of the index for a blob file, which depends on all
+// options, that change the keys, and the additional blob files.
+func (o keyOptions) dbfile(blobfile string, more []string) (string, error) {
+	h := sha1.New()
+	keypath := o.keypath()
+	if _, err := fmt.Fprintf(h, "%s:%s:%s", o.Backend, keypath, o.Pattern); err != nil {
+		return "", err
+	}
+	// Composite keys depend on the separator as well.
+	if strings.Contains(keypath, ",") {
+		if _, err := fmt.Fprintf(h, ":%s", o.KeySep); err != nil {
+			return "", err
+		}
+	}
+	if o.Column > 0 {
+		sep, err := o.sep()
+		if err != nil {
+			return "", err
+		}
+		if _, err := fmt.Fprintf(h, ":%d:%s", o.Column, sep); err != nil {
+			return "", err
+		}
+	}
+	if o.XMLPath != "" {
+		if _, err := fmt.Fprintf(h, ":xml:%s", o.XMLPath); err != nil {
+			return "", err
+		}
+	}
+	if o.Template != "" {
+		if _, err := fmt.Fprintf(h, ":template:%s", o.Template); err != nil {
+			return "", err
+		}
+	}
+	if o.Extractor != "" {
+		if _, err := fmt.Fprintf(h, ":extractor:%s", o.Extractor); err != nil {
+			return "", err
+		}
+	}
+	if o.Format != "" {
+		if _, err := fmt.Fprintf(h, ":format:%s", o.Format); err != nil {
+			return "", err
+		}
+	}
+	// Offsets depend on the record separator, unless it is the default.
+	if rs, err := o.recordSeparator(); err != nil {
+		return "", err
+	} else if rs != '\n' {
+		if _, err := fmt.Fprintf(h, ":rs:%x", rs); err != nil {
+			return "", err
+		}
+	}
+	if o.Transform != "" {
+		if _, err := fmt.Fprintf(h, ":%s", o.Transform); err != nil {
+			return "", err
+		}
+	}
+	// Digests are base64 encoded, an index of hex digests is not reused.
+	if o.Hash != "" {
+		if _, err := fmt.Fprintf(h, ":%s:base64", o.Hash); err != nil {
+			return "", err
+		}
+	}
+	// A sparse index holds blocks instead of records.
+	if o.Sparse > 0 {
+		if _, err := fmt.Fprintf(h, ":sparse:%d", o.Sparse); err != nil {
+			return "", err
+		}
+	}
+	// An index over multiple files depends on the additional files, named
+	// with forward slashes, so the index is found with either separator on
+	// Windows.
+	for _, name := range more {
+		if _, err := fmt.Fprintf(h, ":%s", filepath.ToSlash(name)); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%s.%.4x.db", blobfile, h.Sum(nil)), nil
+}
+
+// extractor returns the key extractor for the options.
+func (o keyOptions) extractor() (extractor microblob.MultiExtractor, err error) {
+	fields := o.Keypaths
+	if len(fields) == 0 {
+		fields = []string{"001"}
+	}
+	switch {
+	case o.Format == string(microblob.FormatMARC):
+		for _, field := range fields {
+			extractor.Extractors = append(extractor.Extractors, microblob.MARCExtractor{Field: field})
+		}
+	case o.Format == string(microblob.FormatMARCXML):
+		for _, field := range fields {
+			extractor.Extractors = append(extractor.Extractors, microblob.MARCXMLExtractor{Field: field})
+		}
+	case o.Column > 0:
+		sep, err := o.sep()
+		if err != nil {
+			return extractor, err
+		}
+		extractor.Extractors = append(extractor.Extractors, microblob.ColumnExtractor{Delimiter: sep, Column: o.Column})
+	case o.Pattern != "":
+		p, err := regexp.Compile(o.Pattern)
+		if err != nil {
+			return extractor, err
+		}
+		extractor.Extractors = append(extractor.Extractors, microblob.RegexpExtractor{Pattern: p})
+	case o.XMLPath != "":
+		extractor.Extractors = append(extractor.Extractors, microblob.XMLExtractor{Path: o.XMLPath})
+	case o.keypath() != "":
+		for _, kp := range o.Keypaths {
+			extractor.Extractors = append(extractor.Extractors, microblob.NewKeyPathExtractor(kp, o.KeySep))
+		}
+	}
+	// A template adds a key to those of the key paths, if any.
+	if o.Template != "" {
+		t, err := microblob.NewTemplateExtractor(o.Template)
+		if err != nil {
+			return extractor, err
+		}
+		extractor.Extractors = append(extractor.Extractors, t)
+	}
+	// So does a registered extractor.
+	if o.Extractor != "" {
+		e, err := microblob.NewExtractor(o.Extractor)
+		if err != nil {
+			return extractor, err
+		}
+		extractor.Extractors = append(extractor.Extractors, e)
+	}
+	return extractor, nil
+}
@@ -0,0 +1,240 @@
+package cli
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// listenSpec is an address to serve, as given with -addr, optionally with its
+// own TLS settings as query, since interfaces can have different policies:
+//
+//	[::]:8820
+//	tcp4://0.0.0.0:8820
+//	10.0.0.5:8443?tls-cert=internal.pem&tls-key=internal.key&tls-client-ca=ca.pem
+//	127.0.0.1:8820?tls=off
+//	unix:///run/microblob.sock
+//
+// Settings not given fall back to -tls-cert, -tls-key and -tls-client-ca;
+// tls=off serves plain HTTP, even if those are set.
+type listenSpec struct {
+	Network     string // tcp, tcp4, tcp6 or unix
+	Addr        string // host and port or path of the socket
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+	NoTLS       bool
+}
+
+// openedListener is a listener opened by listen, under its name, see
+// listenSpec.name.
+type openedListener struct {
+	name string
+	ln   net.Listener
+}
+
+var (
+	// inherited holds the listeners handed over by the old process on an
+	// upgrade, by name, until listen takes them.
+	inherited = make(map[string]net.Listener)
+	// opened lists the listeners opened, to hand them over on an upgrade.
+	opened []openedListener
+)
+
+// parseListenSpec parses an address given with -addr.
+func parseListenSpec(s string) (listenSpec, error) {
+	spec := listenSpec{Network: "tcp", Addr: s}
+	if i := strings.Index(s, "?"); i >= 0 {
+		spec.Addr = s[:i]
+		query, err := url.ParseQuery(s[i+1:])
+		if err != nil {
+			return spec, fmt.Errorf("invalid address %s: %v", s, err)
+		}
+		for name, values := range query {
+			v := values[len(values)-1]
+			switch name {
+			case "tls-cert":
+				spec.TLSCert = v
+			case "tls-key":
+				spec.TLSKey = v
+			case "tls-client-ca":
+				spec.TLSClientCA = v
+			case "tls":
+				switch v {
+				case "off", "0", "false":
+					spec.NoTLS = true
+				case "on", "1", "true":
+				default:
+					return spec, fmt.Errorf("invalid address %s: tls must be on or off", s)
+				}
+			default:
+				return spec, fmt.Errorf("invalid address %s: unknown option %s", s, name)
+			}
+		}
+	}
+	for _, network := range []string{"tcp", "tcp4", "tcp6", "unix"} {
+		if strings.HasPrefix(spec.Addr, network+"://") {
+			spec.Network, spec.Addr = network, strings.TrimPrefix(spec.Addr, network+"://")
+			break
+		}
+	}
+	if spec.Addr == "" {
+		return spec, fmt.Errorf("invalid address: %s", s)
+	}
+	if (spec.TLSCert == "") != (spec.TLSKey == "") {
+		return spec, fmt.Errorf("invalid address %s: need both tls-cert and tls-key", s)
+	}
+	if spec.NoTLS && (spec.TLSCert != "" || spec.TLSClientCA != "") {
+		return spec, fmt.Errorf("invalid address %s: tls=off with TLS settings", s)
+	}
+	return spec, nil
+}
+
+// String returns the address without TLS settings, e.g. for logging.
+func (s listenSpec) String() string {
+	if s.Network == "unix" {
+		return "unix://" + s.Addr
+	}
+	return s.Addr
+}
+
+// hasTLSSettings returns true, if the address has TLS settings of its own.
+func (s listenSpec) hasTLSSettings() bool {
+	return s.TLSCert != "" || s.TLSClientCA != "" || s.NoTLS
+}
+
+// name identifies the address, when listeners are handed over.
+func (s listenSpec) name() string {
+	return s.Network + "://" + s.Addr
+}
+
+// listen returns a listener for the address, the one handed over by the old
+// process, if any. A stale socket file is removed first, the socket file gets
+// the given permissions.
+func (s listenSpec) listen(mode os.FileMode) (net.Listener, error) {
+	if ln, ok := inherited[s.name()]; ok {
+		delete(inherited, s.name())
+		opened = append(opened, openedListener{s.name(), ln})
+		return ln, nil
+	}
+	ln, err := s.bind(mode)
+	if err != nil {
+		return nil, err
+	}
+	opened = append(opened, openedListener{s.name(), ln})
+	return ln, nil
+}
+
+// bind creates a new listener for the address.
+func (s listenSpec) bind(mode os.FileMode) (net.Listener, error) {
+	if s.Network != "unix" {
+		return net.Listen(s.Network, s.Addr)
+	}
+	if fi, err := os.Stat(s.Addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(s.Addr); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", s.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(s.Addr, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// closeInherited closes the listeners handed over, that are not used anymore,
+// e.g. after an address was removed from the configuration.
+func closeInherited() {
+	for name, ln := range inherited {
+		log.Printf("closing inherited listener %s, not configured anymore", name)
+		ln.Close()
+		delete(inherited, name)
+	}
+}
+
+// tlsConfig returns the TLS configuration of the address, with the given
+// settings for those the address does not set, nil for plain HTTP.
+func (s listenSpec) tlsConfig(cert, key, clientCA string) (*tls.Config, error) {
+	if s.NoTLS {
+		return nil, nil
+	}
+	if s.TLSCert != "" {
+		cert, key = s.TLSCert, s.TLSKey
+	}
+	if s.TLSClientCA != "" {
+		clientCA = s.TLSClientCA
+	}
+	if cert == "" {
+		if s.TLSClientCA != "" {
+			return nil, fmt.Errorf("%s: tls-client-ca requires a certificate", s)
+		}
+		return nil, nil
+	}
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if clientCA != "" {
+		if config.ClientCAs, err = loadCertPool(clientCA); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// loadCertPool reads the CA certificates in a PEM file.
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %s", filename)
+	}
+	return pool, nil
+}
+
+// separateFamilies binds wildcard IPv6 addresses, like [::]:8820, to IPv6
+// only, if IPv4 addresses with the same port are given as well, which the
+// dual-stack socket would occupy otherwise.
+func separateFamilies(specs []listenSpec) {
+	for i, s := range specs {
+		if s.Network != "tcp" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(s.Addr)
+		if err != nil || (host != "::" && host != "") {
+			continue
+		}
+		for j, t := range specs {
+			if i == j || t.Network == "unix" || t.Network == "tcp6" {
+				continue
+			}
+			h, p, err := net.SplitHostPort(t.Addr)
+			if err != nil || p != port {
+				continue
+			}
+			if ip := net.ParseIP(h); ip != nil && ip.To4() != nil {
+				specs[i].Network = "tcp6"
+				break
+			}
+		}
+	}
+}
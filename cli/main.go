@@ -0,0 +1,2169 @@
+// Package cli implements the microblob command line tool, so that wrapper
+// binaries can add key extractors, registered with
+// microblob.RegisterExtractor, and call Main.
+package cli
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	_ "expvar"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/handlers"
+	"github.com/miku/microblob"
+	log "github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb/filter"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/netutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// stringSlice collects values of a repeated flag.
+type stringSlice []string
+
+func (s *stringSlice) String() string { return strings.Join(*s, ", ") }
+
+func (s *stringSlice) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// splitList splits a comma separated list, dropping empty elements.
+func splitList(s string) (result []string) {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// localUser returns the name of the user running the command, for the audit
+// log.
+func localUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// readKeyFile reads a signing key from the file given with a flag.
+func readKeyFile(name, filename string) ([]byte, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("-%s required", name)
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key := []byte(strings.TrimSpace(string(b)))
+	if len(key) == 0 {
+		return nil, fmt.Errorf("empty key in %s", filename)
+	}
+	return key, nil
+}
+
+// parseSize parses a size in bytes with an optional KB, MB or GB suffix, e.g.
+// 512MB.
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	var unit int64 = 1
+	for _, u := range []struct {
+		suffix string
+		size   int64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"B", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return n * unit, nil
+}
+
+// writeIndexFile writes the entries of the index in the binary index format to
+// a file, replaced only when complete.
+func writeIndexFile(name string, backend microblob.Backend) error {
+	src, ok := backend.(microblob.EntryIterator)
+	if !ok {
+		return fmt.Errorf("backend does not support listing entries")
+	}
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	n, err := microblob.WriteBinaryIndex(f, src)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return err
+	}
+	log.Printf("wrote %d entries to %s", n, name)
+	return nil
+}
+
+// leveldbOptions returns the options to open the index with, or nil, if all
+// options are left at their defaults.
+func leveldbOptions(writeBuffer, blockCache string, bloomBits int, noCompression bool) (*opt.Options, error) {
+	wb, err := parseSize(writeBuffer)
+	if err != nil {
+		return nil, err
+	}
+	bc, err := parseSize(blockCache)
+	if err != nil {
+		return nil, err
+	}
+	if bloomBits < 0 {
+		return nil, fmt.Errorf("invalid bloom bits: %d", bloomBits)
+	}
+	if wb == 0 && bc == 0 && bloomBits == 0 && !noCompression {
+		return nil, nil
+	}
+	o := &opt.Options{WriteBuffer: int(wb), BlockCacheCapacity: int(bc)}
+	if bloomBits > 0 {
+		o.Filter = filter.NewBloomFilter(bloomBits)
+	}
+	if noCompression {
+		o.Compression = opt.NoCompression
+	}
+	return o, nil
+}
+
+// adminPaths are the routes of admin endpoints, including paths below.
+var adminPaths = []string{"/audit", "/metrics", "/stats", "/debug", "/jobs", "/load", "/rebuild", "/replicate", "/snapshot", "/ui", "/update"}
+
+// isAdminRequest returns true for requests to admin endpoints and for requests
+// adding or removing documents, of the main dataset or of a namespace.
+func isAdminRequest(r *http.Request) bool {
+	switch r.Method {
+	case "PUT", "DELETE", "PATCH":
+		return true
+	}
+	path := r.URL.Path
+	if rest := strings.TrimPrefix(path, "/ns/"); rest != path {
+		if i := strings.Index(rest, "/"); i >= 0 {
+			path = rest[i:]
+		}
+	}
+	for _, p := range adminPaths {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// adminOnly responds with 404 to admin requests, unless allow returns true.
+func adminOnly(h http.Handler, allow func(r *http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isAdminRequest(r) && !allow(r) {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// adminFiltered responds with 403 to admin requests from clients, that the
+// filter does not allow.
+func adminFiltered(h http.Handler, f *microblob.IPFilter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isAdminRequest(r) && !f.Allowed(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isLocal returns true, if the request arrived on a loopback address or a
+// unix domain socket.
+func isLocal(r *http.Request) bool {
+	switch addr := r.Context().Value(http.LocalAddrContextKey).(type) {
+	case *net.UnixAddr:
+		return true
+	case *net.TCPAddr:
+		return addr.IP.IsLoopback()
+	default:
+		return false
+	}
+}
+
+// listen returns a listener for a TCP address or a unix domain socket given as
+// unix:///path/to/socket, see listenSpec. TLS settings are supported with
+// -addr only.
+func listen(addr string, mode os.FileMode) (net.Listener, error) {
+	spec, err := parseListenSpec(addr)
+	if err != nil {
+		return nil, err
+	}
+	if spec.hasTLSSettings() {
+		return nil, fmt.Errorf("%s: TLS settings are supported with -addr only", spec)
+	}
+	return spec.listen(mode)
+}
+
+// textAccessLog writes a line in Common Log Format, followed by the quoted
+// request ID.
+func textAccessLog(w io.Writer, p handlers.LogFormatterParams) {
+	host, _, err := net.SplitHostPort(p.Request.RemoteAddr)
+	if err != nil {
+		host = p.Request.RemoteAddr
+	}
+	uri := p.Request.RequestURI
+	if uri == "" {
+		uri = p.URL.RequestURI()
+	}
+	fmt.Fprintf(w, "%s - - [%s] %q %d %d %q\n", host, p.TimeStamp.Format("02/Jan/2006:15:04:05 -0700"),
+		p.Request.Method+" "+uri+" "+p.Request.Proto, p.StatusCode, p.Size,
+		microblob.RequestID(p.Request.Context()))
+}
+
+// Main runs the microblob command line tool with the arguments in os.Args.
+// Wrapper binaries can register additional key extractors, see
+// microblob.RegisterExtractor, before calling it.
+func Main() {
+	var keypaths, files, appendURLs, addrs stringSlice
+
+	pattern := flag.String("r", "", "regular expression to use as key extractor")
+	flag.Var(&keypaths, "key", "key to extract, json, top-level only, comma separated fields for a composite key, repeat to index under multiple keys")
+	keyExtractor := flag.String("extractor", "", "registered key extractor with options after a colon, e.g. json:id or regexp:[0-9]+, built in are json, regexp, xml, template, marc and marcxml")
+	keyTemplate := flag.String("key-template", "", `template building a key from top-level fields of JSON documents, e.g. "{{.source}}-{{.id | lower}}", with lower, upper, trim, urldecode, stripprefix, stripsuffix and replace`)
+	keysep := flag.String("key-sep", microblob.DefaultKeySeparator, "separator for composite keys")
+	keytransform := flag.String("key-transform", "", "key transformations applied at index and query time: lower, upper, trim, urldecode, strip-prefix=PREFIX")
+	delimiter := flag.String("delimiter", "\\t", "column delimiter, used with -column")
+	xmlPath := flag.String("xml-path", "", "path of the element with the key in XML records, e.g. header/identifier or record/@id")
+	separator := flag.String("separator", "", `record separator, e.g. \x1e for JSON text sequences (default newline)`)
+	column := flag.Int("column", 0, "use column of a delimited file as key, 1-based")
+	recordFormat := flag.String("format", "", "record format, if not separated records: marc (binary MARC21) or marcxml, with -key naming the fields with keys, like 001 (default) or 035a")
+	keyhash := flag.String("key-hash", "", "store keys as digests: sha1, fnv")
+	authToken := flag.String("auth-token", "", "bearer token required for mutating endpoints")
+	authTokenFile := flag.String("auth-token-file", "", "file containing the bearer token required for mutating endpoints")
+	dbname := flag.String("backend", "leveldb", "backend to use: leveldb, cdb (read-only, built with migrate -to cdb), mph (read-only, built with freeze), debug")
+	migrateFrom := flag.String("from", "", "with migrate, backend to copy the index from, defaults to -backend")
+	migrateTo := flag.String("to", "", "with migrate, backend to copy the index to, instead of rewriting it in the current format")
+	benchKeys := flag.String("keys", "", "with bench, file with one key per line to sample lookups from")
+	benchConcurrency := flag.Int("c", 16, "with bench, number of concurrent requests")
+	benchRequests := flag.Int("n", 0, "with bench, number of requests, defaults to the number of keys")
+	withOffsets := flag.Bool("offsets", false, "with keys, write key, offset and length of each entry as TSV")
+	binaryDump := flag.Bool("binary", false, "with dump, write all entries in the binary index format, which load reads as well")
+	writeIndex := flag.String("write-index", "", "after building the index, write it in the binary index format to this file, to load on another machine")
+	dbdir := flag.String("db", "", "index directory, derived from file and key options, if empty")
+	flag.Var(&addrs, "addr", "address to serve, or unix:///path/to/socket, tcp4:// or tcp6:// for one family, with TLS settings as query, e.g. 10.0.0.5:8443?tls-cert=a.pem&tls-key=a.key or ?tls=off, repeat to serve on multiple addresses (default 127.0.0.1:8820)")
+	adminLocal := flag.Bool("admin-local", false, "serve metrics, stats, debug vars, the status page, snapshots and updates only on loopback addresses and unix domain sockets")
+	adminAllow := flag.String("admin-allow", "", "comma separated networks, like 10.1.0.0/16, or addresses of the only clients allowed to call admin endpoints and updates")
+	adminDeny := flag.String("admin-deny", "", "comma separated networks or addresses of clients denied admin endpoints and updates, even if allowed")
+	adminAddr := flag.String("admin-addr", "", "address to serve metrics, stats, debug vars, the status page, snapshots and updates on, exclusively, or unix:///path/to/socket")
+	grpcAddr := flag.String("grpc-addr", "", "address to serve the gRPC API on, disabled if empty")
+	batchsize := flag.Int("batch", 200000, "number of lines in a batch")
+	useCRC := flag.Bool("crc", false, "store a CRC per document when indexing and appending, documents not matching it are not served")
+	useJournal := flag.Bool("journal", false, "journal appends, so an append interrupted by a crash is rolled back on the next start")
+	fsync := flag.String("fsync", "none", "when appended data is synced to disk: none, blob (the blob file, before its index entries are written) or all (blob file and index writes)")
+	maxRecordSizeFlag := flag.String("max-record-size", "0", "longest record accepted when indexing and read when serving, guards against pathological records and corrupt index entries, 0 for no limit")
+	batchBytesFlag := flag.String("batch-bytes", "64MB", "maximum size of a batch, bounds the memory used for documents during indexing, 0 for no limit")
+	useZstd := flag.Bool("zstd", false, "store and serve documents from a zstd compressed copy of the file, with one frame per document")
+	quiet := flag.Bool("quiet", false, "do not report indexing progress")
+	workers := flag.Int("workers", runtime.NumCPU(), "number of key extraction workers during indexing")
+	compact := flag.Bool("compact", false, "rewrite blob file with currently indexed documents only, rebuild index and exit")
+	reindex := flag.Bool("reindex", false, "rebuild the index from the blob file, swap it into place and exit")
+	dryRun := flag.Bool("dry-run", false, "with gc, only report the unreferenced bytes, do not compact")
+	gcThreshold := flag.Float64("gc-threshold", 0.2, "with gc, compact, if at least this share of the blob file is unreferenced")
+	verify := flag.Bool("verify", false, "verify index against blob file, report problems and exit")
+	version := flag.Bool("version", false, "show version and exit")
+	logfile := flag.String("log", "", "access log file, don't log if empty")
+	logMaxSize := flag.String("log-max-size", "0", "rotate the access log before it exceeds this size, e.g. 100MB, 0 disables")
+	logMaxAge := flag.Duration("log-max-age", 0, "rotate the access log after this time, e.g. 24h, 0 disables")
+	logKeep := flag.Int("log-keep", 0, "number of rotated access logs to keep, 0 keeps all")
+	logFormat := flag.String("log-format", "text", "log format for access and application logs: text, json")
+	onDuplicate := flag.String("on-duplicate", "last", "what to do with duplicate keys: last, first, error, report")
+	strictUnique := flag.Bool("strict-unique", false, "fail indexing at the first duplicate key, same as -on-duplicate error")
+	duplicateReport := flag.String("duplicate-report", "", "file to write duplicate keys to, with -on-duplicate report, defaults to stderr")
+	socketMode := flag.String("socket-mode", "0660", "permissions of the socket file, if listening on a unix domain socket")
+	corsOrigins := flag.String("cors-origins", "", "comma separated list of allowed CORS origins, * for any, CORS disabled if empty")
+	corsMethods := flag.String("cors-methods", "GET,HEAD,POST", "comma separated list of allowed CORS methods")
+	corsHeaders := flag.String("cors-headers", "Content-Type,Authorization", "comma separated list of allowed CORS headers")
+	rate := flag.Float64("rate", 0, "global rate limit in requests per second, 0 disables")
+	burst := flag.Int("burst", 100, "global rate limit burst")
+	clientRate := flag.Float64("client-rate", 0, "rate limit per client IP in requests per second, 0 disables")
+	clientBurst := flag.Int("client-burst", 20, "rate limit burst per client IP")
+	readTimeout := flag.Duration("read-timeout", 0, "maximum time to read a request including the body, 0 disables")
+	requestTimeout := flag.Duration("request-timeout", 0, "maximum time for a lookup, answered with 503 when exceeded, 0 disables")
+	writeTimeout := flag.Duration("write-timeout", 0, "maximum time to write a response, 0 disables")
+	idleTimeout := flag.Duration("idle-timeout", 2*time.Minute, "maximum time to keep an idle connection open, 0 disables")
+	maxHeaderBytes := flag.String("max-header-bytes", "1MB", "maximum size of request headers")
+	maxConns := flag.Int("max-conns", 0, "maximum number of concurrent connections, 0 disables")
+	useH2C := flag.Bool("h2c", false, "accept cleartext HTTP/2 connections, e.g. behind a trusted load balancer")
+	topKeys := flag.Int("top-keys", 0, "number of most frequently looked up keys to track and serve at /stats/topkeys, 0 disables")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "time to wait for in-flight requests on shutdown")
+	upgradeTimeout := flag.Duration("upgrade-timeout", time.Minute, "time to wait for the new process on SIGUSR2 to be ready, before it is stopped and the old process keeps serving")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file, serve HTTPS if set")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA certificate file to verify client certificates against (mTLS)")
+	skipBroken := flag.Bool("skip-broken", false, "skip documents, that fail key extraction, report them and continue")
+	brokenReport := flag.String("broken-report", "", "file to write skipped documents to as TSV of line, offset and error, with -skip-broken, defaults to stderr")
+	ignoreMissingKeys := flag.Bool("ignore-missing-keys", false, "ignore record, that do not have a the specified key")
+	follow := flag.Bool("follow", false, "keep indexing records appended to the blob file by an external writer while serving, like tail -f; disables updates")
+	watchDir := flag.String("watch", "", "spool directory to watch, new files are appended, indexed and moved to a done subdirectory")
+	sparse := flag.Int("sparse", 0, "index only the first of each block of this many records, sorted by key, and scan the block on lookup, 0 indexes all records")
+	keepVersions := flag.Int("keep-versions", 0, "number of superseded versions to keep per key, served with the version parameter, 0 disables")
+	inline := flag.String("inline", "0", "copy documents up to this size into the index, to serve them without reading the blob file, e.g. 1KB, 0 disables")
+	bloomSize := flag.String("bloom", "0", "size of an in-memory bloom filter of all keys, to reject lookups of missing keys early, e.g. 64MB, 0 disables")
+	contentType := flag.String("content-type", "application/json", "content type of served documents")
+	writeBuffer := flag.String("leveldb-write-buffer", "0", "LevelDB write buffer size, e.g. 64MB, 0 uses the LevelDB default of 4MB")
+	blockCache := flag.String("leveldb-block-cache", "0", "LevelDB block cache size, e.g. 256MB, 0 uses the LevelDB default of 8MB")
+	bloomBits := flag.Int("leveldb-bloom-bits", 0, "bits per key of the LevelDB bloom filter on disk, 0 disables, 10 is a good value")
+	noCompression := flag.Bool("leveldb-no-compression", false, "disable snappy compression of LevelDB blocks")
+	scanTimeout := flag.Duration("scan-timeout", 10*time.Second, "time budget of a /scan request")
+	scanMaxBytes := flag.String("scan-max-bytes", "1GB", "number of bytes a /scan request may read")
+	cacheControl := flag.String("cache-control", "", "Cache-Control header sent with documents, e.g. \"public, max-age=3600\" or \"public, max-age=31536000, immutable\"")
+	expires := flag.Duration("expires", 0, "send an Expires header this long ahead with documents, 0 disables")
+	withKey := flag.Bool("with-key", false, "add the key to served JSON documents under the -with-key-field field, requests can opt out with withkey=0")
+	withKeyField := flag.String("with-key-field", "_key", "field the key is added under, with -with-key or withkey=1")
+	streamSize := flag.String("stream-size", "1MB", "documents of at least this size are copied from the blob file to the response instead of being read into memory, 0 disables")
+	fallbackURL := flag.String("fallback-url", "", "URL of another microblob instance or endpoint to fetch documents missing locally from, the key is appended or replaces {key}")
+	shardName := flag.String("shard", "", "name of this instance among the shards in the config file, lookups of keys owned by other shards are forwarded to them")
+	fallbackCache := flag.String("fallback-cache", "0", "size of the in-memory cache for documents fetched with -fallback-url, e.g. 256MB, 0 disables")
+	cacheSize := flag.String("cache-size", "0", "size of the in-memory cache for recently requested documents, e.g. 512MB, 0 disables")
+	notFound := flag.String("not-found", "text", "format of responses to lookups of missing keys: text or json, with key and status and, with -suggest, the nearest keys")
+	suggest := flag.Int("suggest", 0, "with -not-found json, list up to this many indexed keys sharing the longest prefix with a missing key, 0 disables")
+	chunkSize := flag.String("chunk-size", "1MB", "write documents larger than this in chunks of this size, flushed after each, stopping when the client goes away, 0 writes them at once")
+	scanOnMiss := flag.String("scan-on-miss", "0", "scan blob files up to this size, e.g. 64MB, for keys missing from the index, before answering 404, e.g. while repairing an index, 0 disables")
+	missTTL := flag.Duration("miss-ttl", 0, "how long to remember keys not found, to answer repeated lookups of missing keys from memory, 0 disables")
+	useMmap := flag.Bool("mmap", false, "serve documents from memory mapped blob files instead of a read per request")
+	replicate := flag.String("replicate", "", "run as replica of the primary at this URL, e.g. http://primary:8820")
+	fetchURL := flag.String("fetch-url", "", "URL of a feed to fetch periodically, new documents are appended and indexed")
+	fetchInterval := flag.Duration("fetch-interval", time.Hour, "time between fetches of -fetch-url")
+	replicateInterval := flag.Duration("replicate-interval", 5*time.Second, "time between polls of the primary")
+	readOnly := flag.Bool("readonly", false, "open the index read-only and disable updates, the index must exist")
+	remote := flag.String("remote", "", "read documents via HTTP range requests from this URL, e.g. an S3 object, the index must exist locally")
+	flag.Var(&appendURLs, "append-url", "with append, URL of a file to fetch and append, repeat for multiple files")
+	suppress := flag.String("suppress", "", "file or URL with keys, one per line, that are not served, even if indexed; reloaded on SIGHUP")
+	suppressInterval := flag.Duration("suppress-interval", 0, "time between reloads of -suppress, 0 reloads on SIGHUP only")
+	dedup := flag.Bool("dedup", false, "with append and updates, store documents identical to one appended before in the same run only once, pointing all keys at the first copy")
+	ttl := flag.Duration("ttl", 0, "keys added by appends, updates and fetches expire after this duration, 0 never expires")
+	overlay := flag.String("overlay", "", "file documents are appended to instead of the blob file, which is left unchanged, e.g. on a read-only mount; served and indexed as additional blob file")
+	warmup := flag.String("warmup", "", "file with keys, one per line, whose documents are read after start to warm caches, or all to read the blob files sequentially; not ready until done")
+	manifestKey := flag.String("manifest-key", "", "file with the key manifests are signed and checked with, required by manifest and -verify-manifest")
+	selfcheck := flag.Int("selfcheck", 0, "before serving, check this many randomly sampled index entries against the blob files and refuse to serve on problems, 0 disables")
+	selfcheckWarn := flag.Bool("selfcheck-warn", false, "with -selfcheck, log problems and serve anyway")
+	verifyManifest := flag.String("verify-manifest", "", "manifest written by the manifest command, to check blob files and index against before serving")
+	urlKey := flag.String("url-key", "", "file with the key links are signed with; restricted documents are then served only with a valid signature and expiry time")
+	signedPrefixes := flag.String("signed-prefixes", "", "comma separated list of key prefixes of the documents restricted with -url-key, all documents, if empty")
+	signTTL := flag.Duration("sign-ttl", time.Hour, "with sign, how long links are valid")
+	auditLog := flag.String("audit-log", "", "append-only file recording updates, documents put, deletions and appends as JSON lines, listed at /audit")
+	webhook := flag.String("webhook", "", "URL to post a JSON summary to after each successful update or append")
+	updateSpool := flag.String("update-spool", "", "directory to spool updates to, so /update returns 202 at once and appends in the background, with the state at /jobs/ID")
+	updateURLs := flag.String("update-urls", "", "comma separated list of URL prefixes, that /update may fetch files from with the url parameter, disabled if empty")
+	flag.Var(&files, "file", "file to index and serve, repeat to serve multiple files behind a single index")
+	configFile := flag.String("config", "", "YAML config file with flag values, flags given on the command line take precedence")
+
+	// A command restricts the flags to those relevant for it, without a command
+	// all flags are accepted and the file is served.
+	var (
+		cmd  string
+		set  = flag.CommandLine
+		args = os.Args[1:]
+	)
+	if len(args) > 0 {
+		if c, ok := findCommand(args[0]); ok {
+			cmd, set, args = c.name, c.flagSet(flag.CommandLine), args[1:]
+		}
+	}
+	flag.Usage = usage
+	set.Parse(args)
+
+	switch cmd {
+	case "compact":
+		*compact = true
+	case "reindex":
+		*reindex = true
+	case "verify":
+		*verify = true
+	case "get", "keys", "dump", "freeze", "manifest":
+		*readOnly = true
+	case "gc":
+		*readOnly = *dryRun
+	case "migrate":
+		if *migrateTo != "" {
+			*readOnly = true
+		}
+		if *migrateFrom != "" {
+			*dbname = *migrateFrom
+		}
+	}
+
+	// Precedence is flag, environment, config file, default.
+	explicit := make(map[string]bool)
+	set.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	isSet := func(name string) bool { return explicit[name] }
+
+	fromEnv, envBlobfile, err := loadEnv(flag.CommandLine, isSet)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, name := range fromEnv {
+		explicit[name] = true
+	}
+	var configBlobfile string
+	if *configFile != "" {
+		if configBlobfile, err = loadConfig(*configFile, flag.Set, isSet); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *version {
+		fmt.Println(microblob.Version)
+		os.Exit(0)
+	}
+
+	switch *logFormat {
+	case "text":
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		log.Fatalf("unknown log format: %s", *logFormat)
+	}
+
+	if *strictUnique {
+		if isSet("on-duplicate") && *onDuplicate != string(microblob.DuplicateError) {
+			log.Fatal("-strict-unique cannot be combined with -on-duplicate " + *onDuplicate)
+		}
+		*onDuplicate = string(microblob.DuplicateError)
+	}
+
+	if len(addrs) == 0 {
+		addrs = stringSlice{"127.0.0.1:8820"}
+	}
+	specs := make([]listenSpec, len(addrs))
+	for i, addr := range addrs {
+		spec, err := parseListenSpec(addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		specs[i] = spec
+	}
+	separateFamilies(specs)
+	if err := adoptListeners(); err != nil {
+		log.Fatal(err)
+	}
+
+	if cmd == "bench" {
+		if *benchKeys == "" {
+			log.Fatal("file with keys required")
+		}
+		keys, err := readKeys(*benchKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		b := bench{Addr: specs[0].String(), Keys: keys, Requests: *benchRequests, Concurrency: *benchConcurrency}
+		if b.Requests == 0 {
+			b.Requests = len(keys)
+		}
+		log.Printf("sending %d requests for %d keys to %s, %d concurrent", b.Requests, len(keys), b.Addr, b.Concurrency)
+		result, err := b.Run()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := result.WriteTo(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if cmd == "sign" {
+		key, err := readKeyFile("url-key", *urlKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		signer := microblob.SignedURLs{Key: key}
+		expires := time.Now().Add(*signTTL)
+		for _, path := range set.Args() {
+			if !strings.HasPrefix(path, "/") {
+				path = "/" + path
+			}
+			fmt.Println(signer.Sign(path, expires))
+		}
+		return
+	}
+
+	if cmd == "diff" {
+		args = set.Args()
+		if len(args) != 2 {
+			log.Fatal("usage: diff a b")
+		}
+		var sources [2]microblob.EntryIterator
+		for i, name := range args {
+			src, closer, err := diffSource(name)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer closer.Close()
+			sources[i] = src
+		}
+		w := bufio.NewWriter(os.Stdout)
+		summary, err := microblob.DiffEntries(sources[0], sources[1], func(d microblob.Difference) error {
+			_, err := fmt.Fprintln(w, d)
+			return err
+		})
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("%d keys only in %s, %d only in %s, %d changed, %d same",
+			summary.OnlyA, args[0], summary.OnlyB, args[1], summary.Changed, summary.Same)
+		if summary.Differs() {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cmd == "restore" {
+		args = set.Args()
+		if len(args) < 1 || len(args) > 2 {
+			log.Fatal("usage: restore archive [dir]")
+		}
+		dir := "."
+		if len(args) == 2 {
+			dir = args[1]
+		}
+		var r io.Reader = os.Stdin
+		if args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			r = f
+		}
+		blobfiles, index, err := microblob.Restore(bufio.NewReader(r), dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("restored %s with index %s", strings.Join(blobfiles, ", "), index)
+		return
+	}
+
+	// With append, get and load, the first argument is the blob file, unless
+	// given with -file, the others are the files to append, the keys to look up
+	// or the flat index to load.
+	var inputs []string
+	args = set.Args()
+	if cmd == "append" || cmd == "get" || cmd == "load" {
+		if len(files) == 0 && len(args) > 0 {
+			files, args = append(files, args[0]), args[1:]
+		}
+		if cmd == "append" {
+			args = append(args, appendURLs...)
+		}
+		if inputs, args = args, nil; len(inputs) == 0 {
+			switch cmd {
+			case "get":
+				log.Fatal("keys to look up required")
+			case "load":
+				log.Fatal("flat index to load required")
+			}
+			log.Fatal("files to append required")
+		}
+		if cmd == "load" && len(inputs) > 1 {
+			log.Fatal("a single flat index to load required")
+		}
+	}
+	files = append(files, args...)
+	var blobfile string
+	if len(files) > 0 {
+		blobfile = files[0]
+	}
+	if blobfile == "" {
+		blobfile = envBlobfile
+	}
+	if blobfile == "" {
+		blobfile = configBlobfile
+	}
+
+	if blobfile == "" {
+		log.Fatal("file to index and serve required")
+	}
+
+	// A compressed file is decompressed next to it during indexing, the
+	// decompressed file is served.
+	var source string
+	if strings.HasSuffix(blobfile, ".gz") {
+		source, blobfile = blobfile, strings.TrimSuffix(blobfile, ".gz")
+		if _, err := os.Stat(blobfile); err == nil {
+			log.Printf("%s exists, serving it instead of %s", blobfile, source)
+			source = ""
+		}
+	}
+
+	// Additional files are indexed and served in place.
+	more := []string(files)
+	if len(more) > 0 {
+		more = more[1:]
+	}
+	for _, name := range more {
+		if strings.HasSuffix(name, ".gz") || *useZstd {
+			log.Fatalf("compressed files are only supported as the first file: %s", name)
+		}
+	}
+
+	// With -zstd, documents are compressed into a file ending in .zst during
+	// indexing and served from there.
+	if *useZstd && !strings.HasSuffix(blobfile, ".zst") {
+		src := blobfile
+		if source != "" {
+			src = source
+		}
+		blobfile = blobfile + ".zst"
+		source = ""
+		if _, err := os.Stat(blobfile); os.IsNotExist(err) {
+			source = src
+		}
+	}
+
+	// With -overlay, appends go to the overlay, the last of the blob files,
+	// which is created, if it does not exist yet.
+	appendfile := blobfile
+	if *overlay != "" {
+		for _, name := range append([]string{blobfile}, more...) {
+			if filepath.Clean(name) == filepath.Clean(*overlay) || filepath.Base(name) == filepath.Base(*overlay) {
+				log.Fatalf("overlay %s needs a file name distinct from the blob files", *overlay)
+			}
+		}
+		f, err := os.OpenFile(*overlay, os.O_CREATE|os.O_RDONLY, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		f.Close()
+		more = append(more, *overlay)
+		appendfile = *overlay
+	}
+
+	ko := keyOptions{
+		Backend:   *dbname,
+		Keypaths:  keypaths,
+		KeySep:    *keysep,
+		Pattern:   *pattern,
+		Column:    *column,
+		Delimiter: *delimiter,
+		XMLPath:   *xmlPath,
+		Template:  *keyTemplate,
+		Extractor: *keyExtractor,
+		Separator: *separator,
+		Format:    *recordFormat,
+		Transform: *keytransform,
+		Hash:      *keyhash,
+		Sparse:    *sparse,
+	}
+	if err := ko.validate(); err != nil {
+		log.Fatal(err)
+	}
+	dbfile, err := ko.dbfile(blobfile, more)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *dbdir != "" {
+		dbfile = *dbdir
+	}
+
+	transform, err := microblob.ParseKeyTransform(*keytransform)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hasher, err := microblob.ParseKeyHash(*keyhash)
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch {
+	case transform != nil && hasher != nil:
+		transform = microblob.ChainTransforms(transform, hasher)
+	case hasher != nil:
+		transform = hasher
+	}
+
+	extractor, err := ko.extractor()
+	if err != nil {
+		log.Fatal(err)
+	}
+	maxRecordSize, err := parseSize(*maxRecordSizeFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fsyncPolicy, err := microblob.ParseFsyncPolicy(*fsync)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cmd == "split" {
+		if *configFile == "" {
+			log.Fatal("config file with shards required")
+		}
+		shards, err := loadShards(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sep, err := ko.recordSeparator()
+		if err != nil {
+			log.Fatal(err)
+		}
+		name := blobfile
+		if source != "" {
+			name = source
+		}
+		counts, err := splitFile(name, microblob.TransformKeys(extractor.ExtractKeys, transform), sep, shards)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range shards.Shards() {
+			log.Printf("wrote %d records for shard %s to %s", counts[s.Name], s.Name, shardFile(name, s.Name))
+		}
+		return
+	}
+
+	// After an upgrade, the old process has to close the index first, unless
+	// it is opened read-only. It does so, once this process took over the
+	// listeners and reports to be ready; with -readonly, that is after it
+	// opened the index, see below.
+	if !*readOnly {
+		upgradeReady(nil)
+		waitForOldProcess(*shutdownTimeout + 10*time.Second)
+	}
+
+	var backend microblob.Backend
+
+	switch *dbname {
+	case "debug":
+		backend = microblob.DebugBackend{Writer: os.Stdout}
+	case "cdb":
+		cb := &microblob.CDBBackend{
+			Filename:      dbfile,
+			Blobfile:      blobfile,
+			Blobfiles:     more,
+			MaxRecordSize: maxRecordSize,
+		}
+		if strings.HasSuffix(blobfile, ".zst") {
+			cb.Compression = "zstd"
+		}
+		if cb.Separator, err = ko.recordSeparator(); err != nil {
+			log.Fatal(err)
+		}
+		backend = cb
+	case "mph":
+		mb := &microblob.MPHBackend{
+			Filename:      dbfile,
+			Blobfile:      blobfile,
+			Blobfiles:     more,
+			MaxRecordSize: maxRecordSize,
+		}
+		if strings.HasSuffix(blobfile, ".zst") {
+			mb.Compression = "zstd"
+		}
+		if mb.Separator, err = ko.recordSeparator(); err != nil {
+			log.Fatal(err)
+		}
+		backend = mb
+	default:
+		policy := microblob.DuplicatePolicy(*onDuplicate)
+		switch policy {
+		case microblob.DuplicateLast, microblob.DuplicateFirst, microblob.DuplicateError, microblob.DuplicateReport:
+		default:
+			log.Fatalf("unknown duplicate policy: %s", *onDuplicate)
+		}
+		lb := &microblob.LevelDBBackend{
+			Filename:      dbfile,
+			Blobfile:      blobfile,
+			Blobfiles:     more,
+			OnDuplicate:   policy,
+			MaxRecordSize: maxRecordSize,
+			Fsync:         fsyncPolicy,
+		}
+		if strings.HasSuffix(blobfile, ".zst") {
+			lb.Compression = "zstd"
+		}
+		lb.Mmap = *useMmap
+		lb.CRC = *useCRC
+		lb.Journal = *useJournal
+		lb.Format = microblob.RecordFormat(*recordFormat)
+		lb.ReadOnly = *readOnly
+		lb.KeepVersions = *keepVersions
+		if *sparse > 0 {
+			lb.Sparse, lb.SparseKeys = *sparse, microblob.TransformKeys(extractor.ExtractKeys, transform)
+		}
+		if lb.DBOptions, err = leveldbOptions(*writeBuffer, *blockCache, *bloomBits, *noCompression); err != nil {
+			log.Fatal(err)
+		}
+		if lb.Separator, err = ko.recordSeparator(); err != nil {
+			log.Fatal(err)
+		}
+		if lb.Inline, err = parseSize(*inline); err != nil {
+			log.Fatal(err)
+		}
+		size, err := parseSize(*bloomSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if size > 0 {
+			lb.Bloom = microblob.NewBloom(size)
+		}
+		size, err = parseSize(*cacheSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if size > 0 {
+			lb.Cache = microblob.NewCache(size)
+		}
+		if *missTTL > 0 {
+			lb.Misses = microblob.NewMissCache(*missTTL)
+		}
+		if *remote != "" {
+			lb.Remote = microblob.HTTPBlob{URL: *remote}
+		}
+		if *suppress != "" {
+			lb.Suppressed = &microblob.DenyList{Source: *suppress, Transform: transform}
+			if err := lb.Suppressed.Load(); err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("suppressing %d keys from %s", lb.Suppressed.Len(), *suppress)
+			if *suppressInterval > 0 {
+				go lb.Suppressed.Run(context.Background(), *suppressInterval)
+			}
+		}
+		if policy == microblob.DuplicateReport {
+			lb.DuplicateReport = os.Stderr
+			if *duplicateReport != "" {
+				file, err := os.Create(*duplicateReport)
+				if err != nil {
+					log.Fatal(err)
+				}
+				defer file.Close()
+				lb.DuplicateReport = file
+			}
+		}
+		backend = lb
+	}
+
+	if transform != nil {
+		backend = microblob.TransformBackend{Backend: backend, Transform: transform, Hashed: hasher != nil}
+	}
+
+	defer func() {
+		if err := backend.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	var (
+		loggingWriter = ioutil.Discard
+		accessLog     *microblob.LogFile
+	)
+
+	if *logfile != "" {
+		accessLog, err = microblob.OpenLogFile(*logfile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if accessLog.MaxSize, err = parseSize(*logMaxSize); err != nil {
+			log.Fatal(err)
+		}
+		accessLog.MaxAge, accessLog.Keep = *logMaxAge, *logKeep
+		loggingWriter = accessLog
+		defer accessLog.Close()
+	}
+
+	var progressWriter io.Writer = os.Stderr
+	if *quiet {
+		progressWriter = nil
+	}
+
+	var brokenWriter io.Writer
+	if *skipBroken {
+		brokenWriter = os.Stderr
+		if *brokenReport != "" {
+			file, err := os.Create(*brokenReport)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer file.Close()
+			brokenWriter = file
+		}
+	}
+
+	batchBytes, err := parseSize(*batchBytesFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *sparse > 0 {
+		if *compact || *reindex || *verify || *watchDir != "" || *replicate != "" || *fetchURL != "" || cmd == "append" {
+			log.Fatal("-sparse cannot be combined with -compact, -reindex, -verify, -watch, -replicate, -fetch-url or append")
+		}
+		if len(more) > 0 || source != "" || strings.HasSuffix(blobfile, ".zst") {
+			log.Fatal("-sparse requires a single uncompressed blob file")
+		}
+		if *dbname != "leveldb" || *migrateTo == "cdb" || cmd == "freeze" {
+			log.Fatal("-sparse requires the leveldb backend")
+		}
+		if size, _ := parseSize(*bloomSize); size > 0 || *keepVersions > 0 {
+			log.Fatal("-sparse cannot be combined with -bloom or -keep-versions")
+		}
+	}
+
+	if *recordFormat != "" {
+		if *sparse > 0 || strings.HasSuffix(blobfile, ".zst") || cmd == "split" {
+			log.Fatal("-format cannot be combined with -sparse, -zstd or split")
+		}
+		if *dbname == "cdb" || *dbname == "mph" {
+			log.Fatal("-format requires the leveldb backend")
+		}
+	}
+
+	if *dbname == "cdb" || *dbname == "mph" {
+		build := map[string]string{"cdb": "migrate -to cdb", "mph": "freeze"}[*dbname]
+		if *compact || *reindex || *verify || *watchDir != "" || *replicate != "" || *fetchURL != "" || *remote != "" || cmd == "append" {
+			log.Fatalf("-backend %s cannot be combined with -compact, -reindex, -verify, -watch, -replicate, -fetch-url, -remote or append", *dbname)
+		}
+		if (cmd == "migrate" && *migrateTo == "") || cmd == "freeze" {
+			log.Fatalf("-backend %s cannot be rewritten, rebuild it from a leveldb index with %s", *dbname, build)
+		}
+		if _, err := os.Stat(dbfile); os.IsNotExist(err) {
+			log.Fatalf("index %s required with -backend %s, build it from a leveldb index with %s", dbfile, *dbname, build)
+		}
+	}
+
+	if *readOnly {
+		if *compact || *reindex || *watchDir != "" || *replicate != "" || *fetchURL != "" || cmd == "append" {
+			log.Fatal("-readonly cannot be combined with -compact, -reindex, -watch, -replicate, -fetch-url or append")
+		}
+		if _, err := os.Stat(dbfile); os.IsNotExist(err) {
+			log.Fatalf("index %s required with -readonly, get and keys", dbfile)
+		}
+	}
+
+	if *overlay != "" && (*compact || *replicate != "") {
+		log.Fatal("-overlay cannot be combined with -compact or -replicate")
+	}
+
+	if *remote != "" {
+		if *compact || *reindex || *verify || *watchDir != "" || *fetchURL != "" {
+			log.Fatal("-compact, -reindex, -verify, -watch and -fetch-url require a local blob file")
+		}
+		if _, err := os.Stat(dbfile); os.IsNotExist(err) {
+			log.Fatalf("index %s required with -remote", dbfile)
+		}
+	}
+
+	if *follow {
+		if *readOnly || *replicate != "" || *fetchURL != "" || *remote != "" || *overlay != "" || *sparse > 0 || strings.HasSuffix(blobfile, ".zst") || *recordFormat != "" {
+			log.Fatal("-follow cannot be combined with -readonly, -replicate, -fetch-url, -remote, -overlay, -sparse, -zstd or -format")
+		}
+	}
+
+	if cmd == "gc" {
+		if *remote != "" {
+			log.Fatal("gc requires a local blob file")
+		}
+		if _, err := os.Stat(dbfile); err != nil {
+			log.Fatal(err)
+		}
+		src, ok := backend.(microblob.EntryIterator)
+		if !ok {
+			log.Fatalf("backend %s does not support listing entries", *dbname)
+		}
+		report, err := microblob.AnalyzeGarbage(src, append([]string{blobfile}, more...))
+		if err != nil {
+			log.Fatal(err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			log.Fatal(err)
+		}
+		switch {
+		case *dryRun:
+			return
+		case report.Unreferenced == 0 || report.Ratio < *gcThreshold:
+			log.Printf("%d of %d bytes unreferenced, below -gc-threshold %v, not compacting", report.Unreferenced, report.Size, *gcThreshold)
+			return
+		}
+		c, ok := backend.(microblob.Compactor)
+		if !ok {
+			log.Fatalf("backend %s does not support compaction", *dbname)
+		}
+		before, after, err := c.Compact()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("compacted %s from %d to %d bytes", blobfile, before, after)
+		return
+	}
+
+	if *compact {
+		if _, err := os.Stat(dbfile); err != nil {
+			log.Fatal(err)
+		}
+		c, ok := backend.(microblob.Compactor)
+		if !ok {
+			log.Fatalf("backend %s does not support compaction", *dbname)
+		}
+		before, after, err := c.Compact()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("compacted %s from %d to %d bytes", blobfile, before, after)
+		return
+	}
+
+	if *reindex {
+		r, ok := backend.(microblob.Reindexer)
+		if !ok {
+			log.Fatalf("backend %s does not support reindexing", *dbname)
+		}
+		log.Printf("reindexing %s into %s ...", blobfile, dbfile)
+		if err := r.Reindex(extractor.ExtractKeys, microblob.AppendOptions{
+			BatchSize:         *batchsize,
+			BatchBytes:        batchBytes,
+			MaxRecordSize:     maxRecordSize,
+			IgnoreMissingKeys: *ignoreMissingKeys,
+			Workers:           *workers,
+			Progress:          progressWriter,
+			BrokenReport:      brokenWriter,
+		}); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if cmd == "backup" {
+		s, ok := backend.(microblob.Snapshotter)
+		if !ok {
+			log.Fatalf("backend %s does not support backups", *dbname)
+		}
+		w := bufio.NewWriter(os.Stdout)
+		if err := s.Snapshot(w); err != nil {
+			log.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if cmd == "migrate" && *migrateTo != "" {
+		if *migrateTo == *dbname {
+			log.Fatalf("cannot migrate from %s to itself", *dbname)
+		}
+		src, ok := backend.(microblob.EntryIterator)
+		if !ok {
+			log.Fatalf("backend %s does not support listing entries", *dbname)
+		}
+		tko := ko
+		tko.Backend = *migrateTo
+		target, err := tko.dbfile(blobfile, more)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *migrateTo == "cdb" {
+			if _, err := os.Stat(target); err == nil {
+				log.Fatalf("index %s exists, will not overwrite", target)
+			}
+			log.Printf("building cdb index %s from %s ...", target, dbfile)
+			n, err := microblob.BuildCDB(target, src)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("copied %d entries to %s", n, target)
+			return
+		}
+		var dst microblob.Backend
+		switch *migrateTo {
+		case "debug":
+			dst = microblob.DebugBackend{Writer: os.Stdout}
+		case "leveldb":
+			if _, err := os.Stat(target); err == nil {
+				log.Fatalf("index %s exists, will not overwrite", target)
+			}
+			lb := &microblob.LevelDBBackend{
+				Filename:  target,
+				Blobfile:  blobfile,
+				Blobfiles: more,
+			}
+			if strings.HasSuffix(blobfile, ".zst") {
+				lb.Compression = "zstd"
+			}
+			if lb.DBOptions, err = leveldbOptions(*writeBuffer, *blockCache, *bloomBits, *noCompression); err != nil {
+				log.Fatal(err)
+			}
+			if lb.Separator, err = ko.recordSeparator(); err != nil {
+				log.Fatal(err)
+			}
+			dst = lb
+		default:
+			log.Fatalf("unknown backend: %s", *migrateTo)
+		}
+		log.Printf("copying index %s to %s backend at %s ...", dbfile, *migrateTo, target)
+		n, err := microblob.CopyEntries(dst, src, *batchsize)
+		if err == nil {
+			if g, ok := dst.(microblob.BlobGuard); ok {
+				for _, name := range append([]string{blobfile}, more...) {
+					if err = g.RecordBlob(name); err != nil {
+						break
+					}
+				}
+			}
+		}
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			if *migrateTo != "debug" {
+				os.RemoveAll(target)
+			}
+			log.Fatal(err)
+		}
+		log.Printf("copied %d entries to %s", n, target)
+		return
+	}
+
+	if cmd == "migrate" {
+		if _, err := os.Stat(dbfile); err != nil {
+			log.Fatal(err)
+		}
+		m, ok := backend.(microblob.Migrator)
+		if !ok {
+			log.Fatalf("backend %s does not support migration", *dbname)
+		}
+		size := func() int64 {
+			if s, ok := backend.(microblob.IndexSizer); ok {
+				n, _ := s.IndexSize()
+				return n
+			}
+			return 0
+		}
+		before := size()
+		n, err := m.Migrate()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("migrated %d values, index size %d to %d bytes", n, before, size())
+		return
+	}
+
+	if cmd == "stats" {
+		if _, err := os.Stat(dbfile); err != nil {
+			log.Fatal(err)
+		}
+		name := blobfile
+		if *remote != "" {
+			name = ""
+		}
+		info, err := microblob.ReadInfo(backend, name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(info); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if cmd == "manifest" {
+		if *remote != "" {
+			log.Fatal("manifest requires a local blob file")
+		}
+		if _, err := os.Stat(dbfile); err != nil {
+			log.Fatal(err)
+		}
+		src, ok := backend.(microblob.EntryIterator)
+		if !ok {
+			log.Fatalf("backend %s does not support listing entries", *dbname)
+		}
+		key, err := readKeyFile("manifest-key", *manifestKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		m, err := microblob.BuildManifest(src, append([]string{blobfile}, more...))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := m.Sign(key); err != nil {
+			log.Fatal(err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(m); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if cmd == "freeze" {
+		src, ok := backend.(microblob.EntryIterator)
+		if !ok {
+			log.Fatalf("backend %s does not support listing entries", *dbname)
+		}
+		tko := ko
+		tko.Backend = "mph"
+		target, err := tko.dbfile(blobfile, more)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := os.Stat(target); err == nil {
+			log.Fatalf("index %s exists, will not overwrite", target)
+		}
+		log.Printf("building mph index %s from %s ...", target, dbfile)
+		n, err := microblob.BuildMPH(target, src)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("froze %d entries into %s", n, target)
+		return
+	}
+
+	if cmd == "dump" {
+		src, ok := backend.(microblob.EntryIterator)
+		if !ok {
+			log.Fatalf("backend %s does not support listing entries", *dbname)
+		}
+		write := microblob.WriteFlatIndex
+		if *binaryDump {
+			write = microblob.WriteBinaryIndex
+		}
+		if _, err := write(os.Stdout, src); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if cmd == "load" {
+		if _, err := os.Stat(dbfile); err == nil {
+			log.Fatalf("index %s exists, will not overwrite", dbfile)
+		}
+		var r io.Reader = os.Stdin
+		if inputs[0] != "-" {
+			f, err := os.Open(inputs[0])
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			r = f
+		}
+		// Keys in the flat index are stored keys, they must not be
+		// transformed again.
+		dst := backend
+		if t, ok := backend.(microblob.TransformBackend); ok {
+			dst = t.Backend
+		}
+		n, err := microblob.LoadIndex(r, dst, *batchsize)
+		if g, ok := dst.(microblob.BlobGuard); ok && err == nil {
+			for _, name := range append([]string{blobfile}, more...) {
+				if err = g.RecordBlob(name); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			backend.Close()
+			os.RemoveAll(dbfile)
+			log.Fatal(err)
+		}
+		log.Printf("loaded %d entries into %s", n, dbfile)
+		return
+	}
+
+	if cmd == "keys" {
+		it, ok := backend.(microblob.Iterator)
+		if !ok {
+			log.Fatalf("backend %s does not support listing keys", *dbname)
+		}
+		w := bufio.NewWriter(os.Stdout)
+		if err := it.ForEach(func(key string, offset, length int64) error {
+			if *withOffsets {
+				_, err := fmt.Fprintf(w, "%s\t%d\t%d\n", key, offset, length)
+				return err
+			}
+			_, err := fmt.Fprintln(w, key)
+			return err
+		}); err != nil {
+			log.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *verify {
+		if _, err := os.Stat(dbfile); err != nil {
+			log.Fatal(err)
+		}
+		v, ok := backend.(microblob.Verifier)
+		if !ok {
+			log.Fatalf("backend %s does not support verification", *dbname)
+		}
+		var problems int64
+		checked, err := v.Verify(extractor.ExtractKeys, func(p microblob.Problem) error {
+			problems++
+			_, err := fmt.Println(p)
+			return err
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("verified %d entries, %d problems", checked, problems)
+		if problems > 0 {
+			backend.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
+	// If dbfile does not exists, create it now.
+	if _, err := os.Stat(dbfile); os.IsNotExist(err) {
+		log.Printf("creating db %s ...", dbfile)
+		if batchBytes > 0 {
+			log.Printf("batches of up to %d lines or %d bytes, buffering about %d bytes of documents with %d workers",
+				*batchsize, batchBytes, int64(*workers+2)*batchBytes, *workers)
+		}
+
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt)
+		go func() {
+			for sig := range c {
+				log.Printf("%v -- cleaning up: %s", sig, dbfile)
+				if err := os.RemoveAll(dbfile); err != nil {
+					log.Fatal(err)
+				}
+				os.Exit(0)
+			}
+		}()
+
+		if source == "" {
+			if ok, err := microblob.IsGzipFile(blobfile); err != nil && !os.IsNotExist(err) {
+				log.Fatal(err)
+			} else if ok {
+				log.Fatal(microblob.ErrCompressedBlob)
+			}
+		}
+		if *sparse > 0 {
+			err = microblob.IndexSparse(blobfile, backend, extractor.ExtractKeys, *sparse, microblob.AppendOptions{
+				BatchSize:         *batchsize,
+				IgnoreMissingKeys: *ignoreMissingKeys,
+			})
+		} else {
+			err = microblob.AppendKeysOptions(blobfile, source, backend, extractor.ExtractKeys, microblob.AppendOptions{
+				BatchSize:         *batchsize,
+				BatchBytes:        batchBytes,
+				MaxRecordSize:     maxRecordSize,
+				IgnoreMissingKeys: *ignoreMissingKeys,
+				Workers:           *workers,
+				Progress:          progressWriter,
+				BrokenReport:      brokenWriter,
+			})
+		}
+		if err != nil {
+			os.RemoveAll(dbfile)
+			if source != "" {
+				os.Remove(blobfile)
+			}
+			log.Fatal(err)
+		}
+		for i, name := range more {
+			if err := microblob.AppendKeysOptions(name, "", backend, extractor.ExtractKeys, microblob.AppendOptions{
+				BatchSize:         *batchsize,
+				BatchBytes:        batchBytes,
+				MaxRecordSize:     maxRecordSize,
+				IgnoreMissingKeys: *ignoreMissingKeys,
+				Workers:           *workers,
+				Progress:          progressWriter,
+				BrokenReport:      brokenWriter,
+				File:              i + 1,
+			}); err != nil {
+				os.RemoveAll(dbfile)
+				log.Fatal(err)
+			}
+		}
+		signal.Stop(c)
+		if *writeIndex != "" {
+			if err := writeIndexFile(*writeIndex, backend); err != nil {
+				log.Fatal(err)
+			}
+		}
+	} else if cmd == "index" {
+		log.Printf("db %s exists", dbfile)
+	}
+
+	var audit *microblob.AuditLog
+	if *auditLog != "" {
+		if audit, err = microblob.OpenAuditLog(*auditLog); err != nil {
+			log.Fatal(err)
+		}
+		defer audit.Close()
+	}
+
+	switch cmd {
+	case "index":
+		return
+	case "append":
+		var (
+			started = time.Now()
+			summary microblob.AppendSummary
+			seen    *microblob.DedupSet
+		)
+		if *dedup {
+			seen = microblob.NewDedupSet()
+		}
+		for _, name := range inputs {
+			log.Printf("appending %s to %s ...", name, appendfile)
+			var s microblob.AppendSummary
+			opts := microblob.AppendOptions{
+				BatchSize:         *batchsize,
+				BatchBytes:        batchBytes,
+				MaxRecordSize:     maxRecordSize,
+				IgnoreMissingKeys: *ignoreMissingKeys,
+				Workers:           *workers,
+				Progress:          progressWriter,
+				BrokenReport:      brokenWriter,
+				Summary:           &s,
+				TTL:               *ttl,
+				Dedup:             seen,
+			}
+			if strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://") {
+				err = microblob.AppendURL(context.Background(), nil, appendfile, name, backend, extractor.ExtractKeys, opts)
+			} else {
+				err = microblob.AppendKeysOptions(appendfile, name, backend, extractor.ExtractKeys, opts)
+			}
+			summary.Keys, summary.Bytes = summary.Keys+s.Keys, summary.Bytes+s.Bytes
+			if audit != nil {
+				rec := microblob.AuditRecord{Action: microblob.AuditAppend, Blobfile: appendfile, User: localUser(), Source: name, Offset: s.Offset, Length: s.Bytes, Keys: s.Keys}
+				if err != nil {
+					rec.Error = err.Error()
+				}
+				if aerr := audit.Record(rec); aerr != nil {
+					log.Printf("audit log %s: %v", *auditLog, aerr)
+				}
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if seen != nil {
+			n, size := seen.Stats()
+			log.Printf("%d duplicate documents, %d bytes not appended", n, size)
+		}
+		hook := &microblob.Webhook{URL: *webhook}
+		if err := hook.Notify(context.Background(), appendfile, summary, time.Since(started)); err != nil {
+			log.Printf("webhook failed: %v", err)
+		}
+		return
+	}
+
+	if g, ok := backend.(microblob.BlobGuard); ok && *remote == "" {
+		for _, name := range append([]string{blobfile}, more...) {
+			if err := g.CheckBlob(name); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	if *verifyManifest != "" {
+		if *remote != "" {
+			log.Fatal("-verify-manifest requires a local blob file")
+		}
+		src, ok := backend.(microblob.EntryIterator)
+		if !ok {
+			log.Fatalf("backend %s does not support listing entries", *dbname)
+		}
+		key, err := readKeyFile("manifest-key", *manifestKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		want, err := microblob.ReadManifest(*verifyManifest)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := want.VerifySignature(key); err != nil {
+			log.Fatalf("%s: %v", *verifyManifest, err)
+		}
+		log.Printf("checking %s against manifest %s ...", blobfile, *verifyManifest)
+		m, err := microblob.BuildManifest(src, append([]string{blobfile}, more...))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := m.Compare(want); err != nil {
+			log.Fatalf("%s: %v", *verifyManifest, err)
+		}
+		log.Printf("%d keys match manifest created %s", m.Keys, want.Created.Format(time.RFC3339))
+	}
+
+	if cmd == "get" {
+		w := bufio.NewWriter(os.Stdout)
+		var missing int
+		for _, key := range inputs {
+			b, err := backend.Get(key)
+			if err != nil {
+				log.Printf("%s: %v", key, err)
+				missing++
+				continue
+			}
+			if len(b) > 0 && b[len(b)-1] != '\n' {
+				b = append(b, '\n')
+			}
+			if _, err := w.Write(b); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			log.Fatal(err)
+		}
+		if missing > 0 {
+			backend.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *selfcheck > 0 {
+		v, ok := backend.(microblob.VerifySampler)
+		if !ok || *remote != "" {
+			log.Fatalf("backend %s does not support -selfcheck", *dbname)
+		}
+		var problems int64
+		checked, err := v.VerifySample(extractor.ExtractKeys, *selfcheck, func(p microblob.Problem) error {
+			problems++
+			log.Printf("selfcheck: %s", p)
+			return nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		switch {
+		case problems == 0:
+			log.Printf("selfcheck: %d sampled entries match the blob files", checked)
+		case *selfcheckWarn:
+			log.Printf("selfcheck: %d of %d sampled entries do not match the blob files, serving anyway", problems, checked)
+		default:
+			log.Fatalf("selfcheck: %d of %d sampled entries do not match the blob files", problems, checked)
+		}
+	}
+
+	token := *authToken
+	if *authTokenFile != "" {
+		b, err := ioutil.ReadFile(*authTokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+
+	if *replicate != "" {
+		replica := &microblob.Replica{
+			URL:      *replicate,
+			Blobfile: blobfile,
+			Backend:  backend,
+			KeysFunc: extractor.ExtractKeys,
+			Options: microblob.AppendOptions{
+				BatchSize:         *batchsize,
+				BatchBytes:        batchBytes,
+				MaxRecordSize:     maxRecordSize,
+				IgnoreMissingKeys: *ignoreMissingKeys,
+				Workers:           *workers,
+			},
+			Interval: *replicateInterval,
+			Token:    token,
+		}
+		go func() {
+			log.Printf("replicating from %s", *replicate)
+			replica.Run(context.Background())
+		}()
+	}
+
+	if *follow {
+		follower := &microblob.Follower{
+			Blobfile: blobfile,
+			Backend:  backend,
+			KeysFunc: extractor.ExtractKeys,
+			Options: microblob.AppendOptions{
+				BatchSize:         *batchsize,
+				BatchBytes:        batchBytes,
+				MaxRecordSize:     maxRecordSize,
+				IgnoreMissingKeys: *ignoreMissingKeys,
+				Workers:           *workers,
+				TTL:               *ttl,
+			},
+		}
+		go func() {
+			log.Printf("following %s", blobfile)
+			if err := follower.Run(context.Background()); err != nil {
+				log.Printf("follow stopped: %v", err)
+			}
+		}()
+	}
+
+	if *fetchURL != "" {
+		harvester := &microblob.Harvester{
+			URL:      *fetchURL,
+			Blobfile: appendfile,
+			Backend:  backend,
+			KeysFunc: extractor.ExtractKeys,
+			Options: microblob.AppendOptions{
+				BatchSize:         *batchsize,
+				BatchBytes:        batchBytes,
+				MaxRecordSize:     maxRecordSize,
+				IgnoreMissingKeys: *ignoreMissingKeys,
+				Workers:           *workers,
+				TTL:               *ttl,
+			},
+			Interval: *fetchInterval,
+		}
+		go func() {
+			log.Printf("fetching %s every %v", *fetchURL, *fetchInterval)
+			harvester.Run(context.Background())
+		}()
+	}
+
+	if *watchDir != "" {
+		go func() {
+			log.Printf("watching %s for new files", *watchDir)
+			if err := microblob.WatchDir(*watchDir, appendfile, backend, extractor.ExtractKeys); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	served := appendfile
+	if *remote != "" && *overlay == "" {
+		served = "" // No local file to check for readiness or to append to.
+	}
+	hopts := microblob.HandlerOptions{
+		AuthToken:      token,
+		ReadOnly:       *readOnly || *follow || *sparse > 0 || *dbname == "cdb" || *dbname == "mph",
+		ContentType:    *contentType,
+		TopKeys:        *topKeys,
+		UpdateURLs:     splitList(*updateURLs),
+		BatchSize:      *batchsize,
+		Webhook:        *webhook,
+		Audit:          audit,
+		TTL:            *ttl,
+		Dedup:          *dedup,
+		ScanTimeout:    *scanTimeout,
+		WithKey:        *withKey,
+		KeyField:       *withKeyField,
+		CacheControl:   *cacheControl,
+		Expires:        *expires,
+		RequestTimeout: *requestTimeout,
+		KeysFunc:       extractor.ExtractKeys,
+	}
+	if hopts.ScanMaxBytes, err = parseSize(*scanMaxBytes); err != nil {
+		log.Fatal(err)
+	}
+	if hopts.StreamSize, err = parseSize(*streamSize); err != nil {
+		log.Fatal(err)
+	}
+	if hopts.ChunkSize, err = parseSize(*chunkSize); err != nil {
+		log.Fatal(err)
+	}
+	if *urlKey != "" {
+		key, err := readKeyFile("url-key", *urlKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		hopts.SignedURLs = &microblob.SignedURLs{Key: key, Prefixes: splitList(*signedPrefixes)}
+	} else if *signedPrefixes != "" {
+		log.Fatal("-signed-prefixes requires -url-key")
+	}
+	switch *notFound {
+	case "text":
+		if *suggest > 0 {
+			log.Fatal("-suggest requires -not-found json")
+		}
+	case "json":
+		hopts.NotFound = &microblob.NotFound{Suggest: *suggest}
+	default:
+		log.Fatalf("unknown -not-found format: %s", *notFound)
+	}
+	if *warmup != "" {
+		var warming int32 = 1
+		hopts.Ready = func() error {
+			if atomic.LoadInt32(&warming) == 1 {
+				return errors.New("warming up")
+			}
+			return nil
+		}
+		go func() {
+			defer atomic.StoreInt32(&warming, 0)
+			started := time.Now()
+			switch {
+			case *warmup == "all" && *remote != "":
+				log.Printf("skipping warmup of remote blob file")
+			case *warmup == "all":
+				size, err := microblob.WarmupFiles(context.Background(), append([]string{blobfile}, more...)...)
+				if err != nil {
+					log.Printf("warmup failed: %v", err)
+					return
+				}
+				log.Printf("warmed up %d bytes in %s", size, time.Since(started))
+			default:
+				f, err := os.Open(*warmup)
+				if err != nil {
+					log.Printf("warmup failed: %v", err)
+					return
+				}
+				defer f.Close()
+				docs, size, err := microblob.WarmupKeys(context.Background(), backend, f, *workers)
+				if err != nil {
+					log.Printf("warmup failed: %v", err)
+					return
+				}
+				log.Printf("warmed up %d documents (%d bytes) in %s", docs, size, time.Since(started))
+			}
+		}()
+	}
+	if *fallbackURL != "" {
+		hopts.Fallback = &microblob.Fallback{URL: *fallbackURL}
+		size, err := parseSize(*fallbackCache)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if size > 0 {
+			hopts.Fallback.Cache = microblob.NewCache(size)
+		}
+	}
+	if size, err := parseSize(*scanOnMiss); err != nil {
+		log.Fatal(err)
+	} else if size > 0 {
+		if len(more) > 0 || *remote != "" || *recordFormat != "" || strings.HasSuffix(blobfile, ".zst") {
+			log.Fatal("-scan-on-miss requires a single, local, uncompressed blob file of separated records")
+		}
+		sep, err := ko.recordSeparator()
+		if err != nil {
+			log.Fatal(err)
+		}
+		hopts.ScanOnMiss = &microblob.ScanOnMiss{
+			Blobfile:  blobfile,
+			KeysFunc:  extractor.ExtractKeys,
+			Transform: transform,
+			Separator: sep,
+			MaxSize:   size,
+		}
+	}
+	if _, ok := backend.(microblob.Rebuilder); ok && !hopts.ReadOnly {
+		hopts.Rebuild = &microblob.RebuildHandler{
+			Backend:  backend,
+			Blobfile: blobfile,
+			KeysFunc: extractor.ExtractKeys,
+			Options: microblob.AppendOptions{
+				BatchSize:         *batchsize,
+				BatchBytes:        batchBytes,
+				MaxRecordSize:     maxRecordSize,
+				IgnoreMissingKeys: *ignoreMissingKeys,
+				Workers:           *workers,
+			},
+		}
+	}
+	if *updateSpool != "" && !hopts.ReadOnly {
+		if hopts.Queue, err = microblob.NewAppendQueue(*updateSpool); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *configFile != "" {
+		if hopts.Rewrite, err = loadRewrite(*configFile); err != nil {
+			log.Fatal(err)
+		}
+		if hopts.Headers, err = loadHeaders(*configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *shardName != "" {
+		if *configFile == "" {
+			log.Fatal("-shard requires a config file with shards")
+		}
+		shards, err := loadShards(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, ok := shards.Shard(*shardName); !ok {
+			log.Fatalf("shard %s not found in %s", *shardName, *configFile)
+		}
+		hopts.Shards = &microblob.ShardRouter{Map: shards, Self: *shardName, Transform: transform}
+		if hopts.Rewrite != nil {
+			// Owners are looked up for the rewritten keys, on all shards.
+			hopts.Shards.Transform = hopts.Rewrite
+			if transform != nil {
+				hopts.Shards.Transform = microblob.ChainTransforms(hopts.Rewrite, transform)
+			}
+		}
+		log.Printf("serving shard %s of %d", *shardName, len(shards.Shards()))
+	}
+	r := microblob.NewHandlerOptions(backend, served, hopts)
+	if *configFile != "" {
+		namespaces, err := loadNamespaces(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(namespaces) > 0 {
+			mux := http.NewServeMux()
+			mux.Handle("/", r)
+			shared := make(map[string]*microblob.SharedDB)
+			for name, ns := range namespaces {
+				nb, err := ns.open(name, shared, microblob.AppendOptions{
+					BatchSize:         *batchsize,
+					BatchBytes:        batchBytes,
+					MaxRecordSize:     maxRecordSize,
+					IgnoreMissingKeys: *ignoreMissingKeys,
+					Workers:           *workers,
+				}, *readOnly)
+				if err != nil {
+					log.Fatalf("namespace %s: %v", name, err)
+				}
+				defer nb.Close()
+				nb.Fsync = fsyncPolicy
+				nb.Journal = *useJournal
+				if *missTTL > 0 {
+					nb.Misses = microblob.NewMissCache(*missTTL)
+				}
+				prefix := "/ns/" + name
+				options := []microblob.Option{
+					microblob.Blobfile(ns.Blobfile),
+					microblob.PathPrefix(prefix),
+					microblob.AuthToken(token),
+					microblob.ContentType(*contentType),
+					microblob.TopKeys(*topKeys),
+					microblob.UpdateURLs(splitList(*updateURLs)...),
+					microblob.UpdateBatchSize(*batchsize),
+					microblob.WebhookURL(*webhook),
+					microblob.Audit(audit),
+					microblob.DefaultTTL(*ttl),
+					microblob.NotFoundJSON(hopts.NotFound),
+					microblob.SignURLs(hopts.SignedURLs),
+					microblob.ChunkSize(hopts.ChunkSize),
+				}
+				if ns.ContentType != "" {
+					options = append(options, microblob.ContentType(ns.ContentType))
+				}
+				rewrite, err := microblob.ParseRewriteRules(ns.Rewrite)
+				if err != nil {
+					log.Fatalf("namespace %s: %v", name, err)
+				}
+				options = append(options, microblob.RewriteKeys(rewrite))
+				headers, err := microblob.ParseHeaderRules(ns.Headers)
+				if err != nil {
+					log.Fatalf("namespace %s: %v", name, err)
+				}
+				options = append(options, microblob.PrefixHeaders(headers))
+				if *readOnly {
+					options = append(options, microblob.ReadOnly())
+				}
+				mux.Handle(prefix+"/", microblob.NewHandler(nb, options...))
+				log.Printf("serving namespace %s at %s/ (%s)", name, prefix, ns.Blobfile)
+			}
+			r = mux
+		}
+	}
+	var quotas *microblob.Quotas
+	if *configFile != "" {
+		if quotas, err = loadQuotas(*configFile); err != nil {
+			log.Fatal(err)
+		}
+		if quotas != nil {
+			r = microblob.WithQuotas(quotas, r)
+		}
+	}
+	if *rate > 0 || *clientRate > 0 {
+		r = microblob.WithRateLimit(&microblob.RateLimiter{
+			Rate:        *rate,
+			Burst:       float64(*burst),
+			ClientRate:  *clientRate,
+			ClientBurst: float64(*clientBurst),
+		}, r)
+	}
+	if *corsOrigins != "" {
+		r = handlers.CORS(
+			handlers.AllowedOrigins(splitList(*corsOrigins)),
+			handlers.AllowedMethods(splitList(*corsMethods)),
+			handlers.AllowedHeaders(splitList(*corsHeaders)),
+		)(r)
+	}
+	var adminFilter *microblob.IPFilter
+	if *adminAllow != "" || *adminDeny != "" {
+		if adminFilter, err = microblob.ParseIPFilter(splitList(*adminAllow), splitList(*adminDeny)); err != nil {
+			log.Fatal(err)
+		}
+		r = adminFiltered(r, adminFilter)
+	}
+	var loggedRouter http.Handler
+	switch *logFormat {
+	case "json":
+		loggedRouter = microblob.WithJSONAccessLog(loggingWriter, r)
+	default:
+		loggedRouter = handlers.CustomLoggingHandler(loggingWriter, r, textAccessLog)
+	}
+	loggedRouter = microblob.WithRequestID(loggedRouter)
+	adminRouter := loggedRouter
+	switch {
+	case *adminLocal:
+		loggedRouter = adminOnly(loggedRouter, isLocal)
+	case *adminAddr != "":
+		loggedRouter = adminOnly(loggedRouter, func(*http.Request) bool { return false })
+	}
+	headerBytes, err := parseSize(*maxHeaderBytes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := &http.Server{
+		Addr:           specs[0].String(),
+		Handler:        loggedRouter,
+		ReadTimeout:    *readTimeout,
+		WriteTimeout:   *writeTimeout,
+		IdleTimeout:    *idleTimeout,
+		MaxHeaderBytes: int(headerBytes),
+	}
+
+	mode, err := strconv.ParseUint(*socketMode, 8, 32)
+	if err != nil {
+		log.Fatalf("invalid socket mode: %s", *socketMode)
+	}
+	useTLS := *tlsCert != "" || *tlsKey != ""
+	if useTLS && (*tlsCert == "" || *tlsKey == "") {
+		log.Fatal("need both -tls-cert and -tls-key")
+	}
+	// Listeners with TLS get their own configuration, so addresses can use
+	// different certificates or client CAs.
+	var (
+		listeners []net.Listener
+		secure    []bool
+	)
+	for _, spec := range specs {
+		ln, err := spec.listen(os.FileMode(mode))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *maxConns > 0 {
+			ln = netutil.LimitListener(ln, *maxConns)
+		}
+		defer ln.Close()
+		config, err := spec.tlsConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if config != nil {
+			ln = tls.NewListener(ln, config)
+		}
+		listeners = append(listeners, ln)
+		secure = append(secure, config != nil)
+	}
+	if *useH2C {
+		if useTLS {
+			log.Fatal("-h2c is for cleartext connections only, HTTP/2 is enabled with TLS anyway")
+		}
+		server.Handler = h2c.NewHandler(server.Handler, &http2.Server{IdleTimeout: *idleTimeout})
+	}
+	if *tlsClientCA != "" {
+		pool, err := loadCertPool(*tlsClientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.TLSConfig = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+		}
+	}
+
+	// The admin server shares the routes, but not the listeners.
+	var admin *http.Server
+	if *adminAddr != "" {
+		admin = &http.Server{
+			Addr:           *adminAddr,
+			Handler:        adminRouter,
+			ReadTimeout:    *readTimeout,
+			WriteTimeout:   *writeTimeout,
+			IdleTimeout:    *idleTimeout,
+			MaxHeaderBytes: int(headerBytes),
+			TLSConfig:      server.TLSConfig,
+		}
+		ln, err := listen(*adminAddr, os.FileMode(mode))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer ln.Close()
+		listeners = append(listeners, ln)
+	}
+
+	var gs *grpc.Server
+	if *grpcAddr != "" {
+		var sopts []grpc.ServerOption
+		if useTLS {
+			creds, err := credentials.NewServerTLSFromFile(*tlsCert, *tlsKey)
+			if err != nil {
+				log.Fatal(err)
+			}
+			sopts = append(sopts, grpc.Creds(creds))
+		}
+		if quotas != nil {
+			sopts = append(sopts, microblob.GRPCQuotas(quotas)...)
+		}
+		if adminFilter != nil {
+			sopts = append(sopts, microblob.GRPCIPFilter(adminFilter))
+		}
+		gs = microblob.NewGRPCServer(backend, served, hopts, sopts...)
+		gln, err := listen(*grpcAddr, os.FileMode(mode))
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Printf("serving gRPC at %v", *grpcAddr)
+			if err := gs.Serve(gln); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	closeInherited()
+
+	if *readOnly {
+		upgradeReady(func() error {
+			if c, ok := backend.(microblob.Checker); ok {
+				return c.Check()
+			}
+			return nil
+		})
+	}
+
+	// Reopen blob file and index on SIGHUP, so a rebuilt file and index can be
+	// swapped in without a restart.
+	if rl, ok := backend.(microblob.Reloader); ok {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				log.Printf("SIGHUP -- reloading %s and %s", blobfile, dbfile)
+				if err := rl.Reload(); err != nil {
+					log.Printf("reload failed: %v", err)
+				}
+			}
+		}()
+	}
+
+	// Reopen the access log on SIGUSR1, after it was moved away by an external
+	// log rotation.
+	if accessLog != nil {
+		usr1 := make(chan os.Signal, 1)
+		notifyReopen(usr1)
+		go func() {
+			for range usr1 {
+				if err := accessLog.Reopen(); err != nil {
+					log.Printf("reopen %s failed: %v", *logfile, err)
+				}
+			}
+		}()
+	}
+
+	// Shutdown gracefully on SIGINT and SIGTERM, so in-flight requests can
+	// complete and the backend is closed cleanly. On SIGUSR2, e.g. after a
+	// binary upgrade, the executable is started again first, taking over the
+	// listeners, so no connection is refused, and this one shuts down, once
+	// the new process is ready. The new process serves at once with
+	// -readonly, otherwise after this one closed the index; connections wait
+	// in the backlog meanwhile. If the new process fails before it is ready,
+	// this one keeps serving.
+	idle := make(chan struct{})
+	go func() {
+		sigs, upgrade := make(chan os.Signal, 1), make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		notifyUpgrade(upgrade)
+		var sig os.Signal
+		for sig == nil {
+			select {
+			case sig = <-sigs:
+			case s := <-upgrade:
+				p, err := startUpgrade(*upgradeTimeout)
+				if err != nil {
+					log.Printf("upgrade failed: %v", err)
+					continue
+				}
+				log.Printf("%v -- process %d took over the listeners", s, p.Pid)
+				sig = s
+			}
+		}
+		log.Printf("%v -- shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if gs != nil {
+			gs.GracefulStop()
+		}
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+		if admin != nil {
+			if err := admin.Shutdown(ctx); err != nil {
+				log.Printf("shutdown: %v", err)
+			}
+		}
+		close(idle)
+	}()
+
+	// All listeners but the admin listener share the server, so Shutdown
+	// stops them all.
+	errc := make(chan error, len(listeners))
+	for i, ln := range listeners {
+		if i < len(specs) {
+			go func(addr string, secure bool, ln net.Listener) {
+				if secure {
+					log.Printf("listening at https://%v (%s)", addr, dbfile)
+				} else {
+					log.Printf("listening at http://%v (%s)", addr, dbfile)
+				}
+				errc <- server.Serve(ln)
+			}(specs[i].String(), secure[i], ln)
+			continue
+		}
+		go func(ln net.Listener) {
+			if useTLS {
+				log.Printf("admin listening at https://%v (%s)", *adminAddr, dbfile)
+				errc <- admin.ServeTLS(ln, *tlsCert, *tlsKey)
+			} else {
+				log.Printf("admin listening at http://%v (%s)", *adminAddr, dbfile)
+				errc <- admin.Serve(ln)
+			}
+		}(ln)
+	}
+	for range listeners {
+		if err := <-errc; err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}
+	<-idle
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package cli
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyReopen relays SIGUSR1, which asks to reopen the access log.
+func notifyReopen(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
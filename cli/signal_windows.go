@@ -0,0 +1,7 @@
+package cli
+
+import "os"
+
+// notifyReopen does nothing, there is no SIGUSR1 on Windows; use -log-max-size
+// or -log-max-age to rotate the access log instead.
+func notifyReopen(c chan<- os.Signal) {}
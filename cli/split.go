@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/miku/microblob"
+)
+
+// shardFile returns the name of the part of a file for a shard, e.g.
+// data.a.ldj for data.ldj or data.ldj.gz and shard a.
+func shardFile(name, shard string) string {
+	name = strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ".zst")
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + shard + ext
+}
+
+// splitFile writes the records of a file, which may be compressed, to one
+// file per shard, next to it. Returns the number of records per shard.
+func splitFile(name string, kf microblob.KeysFunc, sep byte, m *microblob.ShardMap) (counts map[string]int64, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := microblob.NewDecompressReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var (
+		writers = make(map[string]*bufio.Writer)
+		files   []*os.File
+	)
+	defer func() {
+		for _, file := range files {
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}()
+	targets := make(map[string]io.Writer)
+	for _, s := range m.Shards() {
+		file, err := os.Create(shardFile(name, s.Name))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+		writers[s.Name] = bufio.NewWriterSize(file, 1<<20)
+		targets[s.Name] = writers[s.Name]
+	}
+	if counts, err = microblob.SplitShards(r, kf, sep, m, targets); err != nil {
+		return counts, err
+	}
+	for _, w := range writers {
+		if err := w.Flush(); err != nil {
+			return counts, err
+		}
+	}
+	return counts, nil
+}
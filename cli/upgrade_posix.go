@@ -0,0 +1,184 @@
+//go:build !windows
+// +build !windows
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Environment variables passing the listeners, as JSON list of their names,
+// with the file descriptors from 3 on in that order, the process ID of the old
+// process and the file descriptor of the pipe to report readiness on to a new
+// one started by an upgrade.
+const (
+	upgradeListenersEnv = "MICROBLOB_UPGRADE_LISTENERS"
+	upgradePIDEnv       = "MICROBLOB_UPGRADE_PID"
+	upgradeReadyEnv     = "MICROBLOB_UPGRADE_READY"
+)
+
+// upgradeReadyMessage is written to the pipe by a new process, that is ready
+// to take over.
+const upgradeReadyMessage = "ready\n"
+
+// notifyUpgrade relays SIGUSR2, which asks to start the executable again, in
+// the new version after a binary upgrade, handing over the listeners.
+func notifyUpgrade(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+// adoptListeners takes over the listeners handed over by the old process, if
+// started by an upgrade, so listen uses them instead of binding again.
+func adoptListeners() error {
+	v, ok := os.LookupEnv(upgradeListenersEnv)
+	if !ok {
+		return nil
+	}
+	os.Unsetenv(upgradeListenersEnv)
+	var names []string
+	if err := json.Unmarshal([]byte(v), &names); err != nil {
+		return fmt.Errorf("%s: %v", upgradeListenersEnv, err)
+	}
+	for i, name := range names {
+		f := os.NewFile(uintptr(3+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("inherited listener %s: %v", name, err)
+		}
+		inherited[name] = ln
+	}
+	log.Printf("took over %d listeners", len(names))
+	return nil
+}
+
+// upgradeReady reports to the old process, if started by an upgrade, that this
+// one is ready to take over, once check, if not nil, passed. Exits, if the
+// check fails, so the old process keeps serving.
+func upgradeReady(check func() error) {
+	v, ok := os.LookupEnv(upgradeReadyEnv)
+	if !ok {
+		return
+	}
+	os.Unsetenv(upgradeReadyEnv)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("%s: %v", upgradeReadyEnv, err)
+	}
+	f := os.NewFile(uintptr(fd), "upgrade-ready")
+	defer f.Close()
+	if check != nil {
+		if err := check(); err != nil {
+			log.Fatalf("not ready to take over: %v", err)
+		}
+	}
+	if _, err := io.WriteString(f, upgradeReadyMessage); err != nil {
+		log.Fatalf("cannot report readiness: %v", err)
+	}
+}
+
+// waitForOldProcess waits up to the given time for the old process to exit,
+// if started by an upgrade, since only one process can open an index for
+// writing. Connections wait in the backlog of the listeners meanwhile.
+func waitForOldProcess(timeout time.Duration) {
+	v, ok := os.LookupEnv(upgradePIDEnv)
+	if !ok {
+		return
+	}
+	os.Unsetenv(upgradePIDEnv)
+	pid, err := strconv.Atoi(v)
+	if err != nil || pid <= 1 {
+		return
+	}
+	deadline := time.Now().Add(timeout)
+	for syscall.Kill(pid, 0) == nil {
+		if time.Now().After(deadline) {
+			log.Printf("old process %d still running after %v", pid, timeout)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// startUpgrade starts the executable again with the same arguments, handing
+// over the open listeners, and waits up to the given time for it to report,
+// that it is ready to take over. A new process, that exits or does not report
+// in time, is stopped and an error returned, so this one keeps serving. Unix
+// domain sockets are not removed, when the old process closes them.
+func startUpgrade(timeout time.Duration) (*os.Process, error) {
+	name, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		names []string
+		files []*os.File
+	)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, o := range opened {
+		fl, ok := o.ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("cannot hand over listener %s", o.name)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, o.name)
+		files = append(files, f)
+	}
+	b, err := json.Marshal(names)
+	if err != nil {
+		return nil, err
+	}
+	ready, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer ready.Close()
+	cmd := exec.Command(name, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	cmd.Env = append(os.Environ(),
+		upgradeListenersEnv+"="+string(b),
+		upgradePIDEnv+"="+strconv.Itoa(os.Getpid()),
+		upgradeReadyEnv+"="+strconv.Itoa(3+len(files)))
+	err = cmd.Start()
+	w.Close() // only the new process writes, so its exit ends the read
+	if err != nil {
+		return nil, err
+	}
+	if err := ready.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, len(upgradeReadyMessage))
+	if _, err := io.ReadFull(ready, buf); err != nil || string(buf) != upgradeReadyMessage {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if err == nil || err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("exited before it was ready")
+		}
+		return nil, fmt.Errorf("new process %d: %v", cmd.Process.Pid, err)
+	}
+	for _, o := range opened {
+		if ul, ok := o.ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return cmd.Process, nil
+}
@@ -0,0 +1,24 @@
+package cli
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// notifyUpgrade does nothing, listeners cannot be handed over on Windows.
+func notifyUpgrade(c chan<- os.Signal) {}
+
+// adoptListeners does nothing on Windows.
+func adoptListeners() error { return nil }
+
+// upgradeReady does nothing on Windows.
+func upgradeReady(check func() error) {}
+
+// waitForOldProcess does nothing on Windows.
+func waitForOldProcess(timeout time.Duration) {}
+
+// startUpgrade is not supported on Windows.
+func startUpgrade(timeout time.Duration) (*os.Process, error) {
+	return nil, errors.New("upgrades are not supported on Windows")
+}
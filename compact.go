@@ -0,0 +1,156 @@
+package microblob
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Compactor can drop superseded documents from the blob file.
+type Compactor interface {
+	Compact() (before, after int64, err error)
+}
+
+// Compact compacts the wrapped backend.
+func (b TransformBackend) Compact() (before, after int64, err error) {
+	if c, ok := b.Backend.(Compactor); ok {
+		return c.Compact()
+	}
+	return 0, 0, ErrNotImplemented
+}
+
+// Compact writes a new blob file containing only the currently indexed
+// documents, without expired keys, builds a new index against it and swaps both into place. Returns
+// the size of the blob file before and after compaction. Appends are blocked
+// while compacting, reads are blocked only during the swap. The documents of
+// deleted keys are gone from the new blob file, so their tombstones are
+// dropped.
+func (b *LevelDBBackend) Compact() (before, after int64, err error) {
+	if len(b.Blobfiles) > 0 {
+		return 0, 0, fmt.Errorf("compaction of multiple blob files is not supported")
+	}
+	if err := b.notShared("compaction"); err != nil {
+		return 0, 0, err
+	}
+
+	unlock, err := lockBlob(b.Blobfile)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer unlock()
+
+	var entries []Entry
+	if err := b.allEntries(func(e Entry) error {
+		entries = append(entries, e)
+		return nil
+	}); err != nil {
+		return 0, 0, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Offset < entries[j].Offset })
+
+	var (
+		blobTmp = b.Blobfile + ".compact"
+		dbTmp   = b.Filename + ".compact"
+		dbOld   = b.Filename + ".old"
+	)
+	if err := os.RemoveAll(dbTmp); err != nil {
+		return 0, 0, err
+	}
+	if after, err = writeCompacted(b.Blobfile, blobTmp, dbTmp, entries); err == nil {
+		err = recordFingerprint(dbTmp, b.Blobfile, blobTmp, after)
+	}
+	if err != nil {
+		os.Remove(blobTmp)
+		os.RemoveAll(dbTmp)
+		return 0, 0, err
+	}
+	fi, err := os.Stat(b.Blobfile)
+	if err != nil {
+		return 0, 0, err
+	}
+	before = fi.Size()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.closeHandles(); err != nil {
+		return 0, 0, err
+	}
+	if err := os.Rename(b.Filename, dbOld); err != nil {
+		return 0, 0, err
+	}
+	if err := os.Rename(dbTmp, b.Filename); err != nil {
+		return 0, 0, fmt.Errorf("swap failed, old index at %s: %v", dbOld, err)
+	}
+	if err := os.Rename(blobTmp, b.Blobfile); err != nil {
+		return 0, 0, fmt.Errorf("swap failed, old index at %s: %v", dbOld, err)
+	}
+	if err := os.Remove(tombstoneFile(b.Blobfile)); err != nil && !os.IsNotExist(err) {
+		return 0, 0, err
+	}
+	return before, after, removeIndex(dbOld)
+}
+
+// writeCompacted copies the regions of entries, sorted by offset, from blobfn
+// to a new file and writes an index for the new file. Returns the size of the
+// new blob file.
+func writeCompacted(blobfn, blobTmp, dbTmp string, entries []Entry) (int64, error) {
+	src, err := os.Open(blobfn)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	dst, err := os.Create(blobTmp)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+	db, err := leveldb.OpenFile(dbTmp, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var (
+		br        = bufio.NewReaderSize(src, 1<<20)
+		bw        = bufio.NewWriterSize(dst, 1<<20)
+		batch     = new(leveldb.Batch)
+		pos, npos int64 // position in old and new file
+		last      = int64(-1)
+	)
+	for _, e := range entries {
+		if e.Offset != last {
+			// A new region, documents indexed under multiple keys share one.
+			if e.Offset < pos {
+				return 0, fmt.Errorf("overlapping regions at offset %d", e.Offset)
+			}
+			// Unlike Discard, CopyN skips gaps beyond 2GB on 32-bit platforms, too.
+			if _, err := io.CopyN(ioutil.Discard, br, e.Offset-pos); err != nil {
+				return 0, err
+			}
+			if _, err := io.CopyN(bw, br, e.Length); err != nil {
+				return 0, err
+			}
+			pos, last = e.Offset+e.Length, e.Offset
+			npos += e.Length
+		}
+		batch.Put([]byte(e.Key), encodeEntry(Entry{Offset: npos - e.Length, Length: e.Length, Size: e.Size, Expires: e.Expires, Version: e.Version, CRC: e.CRC, Data: e.Data}))
+		if batch.Len() >= 100000 {
+			if err := db.Write(batch, nil); err != nil {
+				return 0, err
+			}
+			batch.Reset()
+		}
+	}
+	if err := db.Write(batch, nil); err != nil {
+		return 0, err
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	return npos, dst.Sync()
+}
@@ -0,0 +1,161 @@
+package microblob
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// encoder is a compressor, that can be reused for another response.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+var (
+	// gzipEncoders and zstdEncoders keep encoders for reuse, since setting up
+	// an encoder for each response is expensive, for zstd in particular.
+	gzipEncoders = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	zstdEncoders = sync.Pool{New: func() interface{} {
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil
+		}
+		return enc
+	}}
+)
+
+// encoderPool returns the pool of encoders for a content coding.
+func encoderPool(coding string) *sync.Pool {
+	if coding == "zstd" {
+		return &zstdEncoders
+	}
+	return &gzipEncoders
+}
+
+// compressResponseWriter sends the response body through a compressor. The
+// compressor is set up with the header, so responses without body, like 204
+// and 304, are sent as they are.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	coding  string
+	enc     encoder // nil, until a compressed body is started
+	started bool
+}
+
+func (w *compressResponseWriter) WriteHeader(code int) {
+	if w.started {
+		return
+	}
+	if code < 200 {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.started = true
+	switch code {
+	case http.StatusNoContent:
+	case http.StatusNotModified:
+		w.weakenTag()
+	default:
+		if enc, ok := encoderPool(w.coding).Get().(encoder); ok {
+			enc.Reset(w.ResponseWriter)
+			w.enc = enc
+			w.Header().Del("Content-Length")
+			w.Header().Set("Content-Encoding", w.coding)
+			w.weakenTag()
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// weakenTag marks the ETag as weak, since the compressed body differs from
+// the uncompressed one, byte by byte. A 304 carries the tag of the compressed
+// response, it stands for.
+func (w *compressResponseWriter) weakenTag() {
+	if tag := w.Header().Get("ETag"); tag != "" && !strings.HasPrefix(tag, "W/") {
+		w.Header().Set("ETag", "W/"+tag)
+	}
+}
+
+func (w *compressResponseWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.enc == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.enc.Write(p)
+}
+
+// Flush sends the data compressed so far to the client.
+func (w *compressResponseWriter) Flush() {
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close finishes the compressed body, if any, and returns the encoder to its
+// pool.
+func (w *compressResponseWriter) close() {
+	if w.enc == nil {
+		return
+	}
+	w.enc.Close()
+	w.enc.Reset(nil)
+	encoderPool(w.coding).Put(w.enc)
+	w.enc = nil
+}
+
+// acceptsEncoding returns true, if the client accepts a given content coding.
+func acceptsEncoding(r *http.Request, coding string) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(v, ";")
+		if strings.TrimSpace(parts[0]) != coding {
+			continue
+		}
+		for _, p := range parts[1:] {
+			if q := strings.TrimSpace(p); q == "q=0" || q == "q=0.0" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// WithCompression compresses responses with zstd or gzip, if the client sends
+// a matching Accept-Encoding header; zstd is preferred. The ETag of a
+// compressed response is weak, since its bytes differ from the uncompressed
+// one. Responses vary by Accept-Encoding, whether compressed or not.
+func WithCompression(h http.Handler) http.Handler {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		var coding string
+		switch {
+		case r.Method == "HEAD", r.Header.Get("Range") != "":
+			// Keep the Content-Length of the uncompressed blob, to which
+			// ranges refer as well.
+			h.ServeHTTP(w, r)
+			return
+		case acceptsEncoding(r, "zstd"):
+			coding = "zstd"
+		case acceptsEncoding(r, "gzip"):
+			coding = "gzip"
+		default:
+			h.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressResponseWriter{ResponseWriter: w, coding: coding}
+		defer cw.close()
+		h.ServeHTTP(cw, r)
+	}
+	return http.HandlerFunc(f)
+}
@@ -0,0 +1,117 @@
+package microblob
+
+import (
+	"context"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// ContextBackend is a backend, whose operations can be canceled, e.g. when an
+// HTTP client disconnects.
+type ContextBackend interface {
+	GetContext(ctx context.Context, key string) ([]byte, error)
+	WriteEntriesContext(ctx context.Context, entries []Entry) error
+}
+
+// GetContext retrieves the data for a key, using GetContext, if the backend
+// supports it. Otherwise the context is only checked before the lookup.
+func GetContext(ctx context.Context, backend Backend, key string) ([]byte, error) {
+	if cb, ok := backend.(ContextBackend); ok {
+		return cb.GetContext(ctx, key)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return backend.Get(key)
+}
+
+// WriteEntriesContext writes entries, using WriteEntriesContext, if the
+// backend supports it. Otherwise the context is only checked before writing.
+func WriteEntriesContext(ctx context.Context, backend Backend, entries []Entry) error {
+	if cb, ok := backend.(ContextBackend); ok {
+		return cb.WriteEntriesContext(ctx, entries)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return backend.WriteEntries(entries)
+}
+
+// exists reports whether a key is indexed. Backends, that can locate keys,
+// answer from the index alone, without reading the blob.
+func exists(ctx context.Context, backend Backend, key string) (bool, error) {
+	var err error
+	l, ok := backend.(Locator)
+	if ok {
+		_, err = l.Locate(key)
+	}
+	if !ok || err == ErrNotImplemented {
+		_, err = GetContext(ctx, backend, key)
+	}
+	switch err {
+	case nil:
+		return true, nil
+	case leveldb.ErrNotFound, ErrSuppressed:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// getResult is the outcome of a lookup running in the background.
+type getResult struct {
+	data []byte
+	err  error
+}
+
+// GetContext retrieves the data for a key and returns early with the context
+// error, if the context is done before the lookup completes, e.g. during a
+// compaction stall. The abandoned lookup finishes in the background.
+func (b *LevelDBBackend) GetContext(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ch := make(chan getResult, 1)
+	go func() {
+		data, err := b.Get(key)
+		ch <- getResult{data: data, err: err}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-ch:
+		return r.data, r.err
+	}
+}
+
+// WriteEntriesContext writes entries, unless the context is already done. A
+// started batch write is not interrupted, so the index stays consistent.
+func (b *LevelDBBackend) WriteEntriesContext(ctx context.Context, entries []Entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.WriteEntries(entries)
+}
+
+// GetContext transforms the key, then retrieves the data from the wrapped
+// backend.
+func (b TransformBackend) GetContext(ctx context.Context, key string) ([]byte, error) {
+	key, err := b.Transform(key)
+	if err != nil {
+		return nil, err
+	}
+	return GetContext(ctx, b.Backend, key)
+}
+
+// WriteEntriesContext transforms keys, then writes entries to the wrapped
+// backend.
+func (b TransformBackend) WriteEntriesContext(ctx context.Context, entries []Entry) error {
+	for i := range entries {
+		key, err := b.Transform(entries[i].Key)
+		if err != nil {
+			return err
+		}
+		entries[i].Key = key
+	}
+	return WriteEntriesContext(ctx, b.Backend, entries)
+}
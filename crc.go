@@ -0,0 +1,47 @@
+package microblob
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"hash/crc32"
+)
+
+// ErrCRCMismatch is returned, if a section read from a blob file does not
+// match the CRC stored in its entry, e.g. after bit rot on disk.
+var ErrCRCMismatch = errors.New("crc mismatch")
+
+// crcErrors counts sections, that failed verification.
+var crcErrors = expvar.NewInt("crcErrors")
+
+// sectionCRC returns the CRC-32 (Castagnoli) of a section as stored in the blob
+// file, compressed or not. A CRC of zero means no CRC, so the few sections
+// with a zero CRC are stored as if it was not computed.
+func sectionCRC(b []byte) uint32 {
+	return crc32.Checksum(b, castagnoli)
+}
+
+// verifyCRC checks a section read for an entry against the stored CRC, if
+// any, and counts mismatches.
+func verifyCRC(e Entry, data []byte) error {
+	if e.CRC == 0 || sectionCRC(data) == e.CRC {
+		return nil
+	}
+	crcErrors.Add(1)
+	return fmt.Errorf("%w: %s at offset %d of blob file %d", ErrCRCMismatch, e.Key, e.Offset, e.File)
+}
+
+// RecordCRC returns true, if the backend stores a CRC per record.
+func (b *LevelDBBackend) RecordCRC() bool { return b.CRC }
+
+// RecordCRC reports, whether the wrapped backend stores a CRC per record.
+func (b TransformBackend) RecordCRC() bool { return recordCRC(b.Backend) }
+
+// recordCRC returns true, if a CRC should be stored in the entries written to
+// the backend.
+func recordCRC(backend Backend) bool {
+	if s, ok := backend.(interface{ RecordCRC() bool }); ok {
+		return s.RecordCRC()
+	}
+	return false
+}
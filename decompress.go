@@ -0,0 +1,67 @@
+package microblob
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// zstdReadCloser releases the decoder on Close.
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (r zstdReadCloser) Close() error {
+	r.Decoder.Close()
+	return nil
+}
+
+// NewDecompressReader returns a reader with the decompressed input, if r
+// starts with the gzip or zstd magic number, and the input as is otherwise, so
+// compressed and plain files can be appended alike. Closing the reader
+// releases the decompressor, but does not close r.
+func NewDecompressReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return decodeContent(br, "gzip")
+	case bytes.HasPrefix(magic, zstdMagic):
+		return decodeContent(br, "zstd")
+	default:
+		return ioutil.NopCloser(br), nil
+	}
+}
+
+// decodeContent returns a reader with the input decompressed according to a
+// content coding, as in a Content-Encoding header. An empty coding or identity
+// means uncompressed.
+func decodeContent(r io.Reader, coding string) (io.ReadCloser, error) {
+	switch coding {
+	case "", "identity":
+		return ioutil.NopCloser(r), nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReadCloser{dec}, nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %s", coding)
+	}
+}
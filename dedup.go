@@ -0,0 +1,70 @@
+package microblob
+
+import (
+	"crypto/sha256"
+	"sync"
+)
+
+// DedupSet remembers where documents were appended by a hash of their
+// content, so a repeated document is stored once and its keys point to the
+// first copy. It holds about 100 bytes per distinct document, so it is meant
+// to span a single append or command, not the lifetime of an index. Safe for
+// concurrent use.
+type DedupSet struct {
+	mu   sync.Mutex
+	seen map[[16]byte]Entry
+	n    int64 // documents found again
+	size int64 // bytes not appended
+}
+
+// NewDedupSet returns an empty set.
+func NewDedupSet() *DedupSet {
+	return &DedupSet{seen: make(map[[16]byte]Entry)}
+}
+
+// contentHash returns the hash identifying a document, the first half of its
+// SHA-256.
+func contentHash(doc []byte) (h [16]byte) {
+	sum := sha256.Sum256(doc)
+	copy(h[:], sum[:16])
+	return h
+}
+
+// lookup returns the location of an earlier copy of a document with the given
+// hash and counts the saved bytes, if there is one.
+func (s *DedupSet) lookup(h [16]byte, length int64) (Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.seen[h]
+	if ok {
+		s.n++
+		s.size += length
+	}
+	return e, ok
+}
+
+// add records the location of a document.
+func (s *DedupSet) add(h [16]byte, e Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seen[h] = Entry{Offset: e.Offset, Length: e.Length, Size: e.Size, File: e.File, CRC: e.CRC}
+}
+
+// truncate forgets the documents at or after offset in a blob file, after a
+// failed append.
+func (s *DedupSet) truncate(file int, offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for h, e := range s.seen {
+		if e.File == file && e.Offset >= offset {
+			delete(s.seen, h)
+		}
+	}
+}
+
+// Stats returns the number of repeated documents and the bytes saved.
+func (s *DedupSet) Stats() (docs, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.n, s.size
+}
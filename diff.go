@@ -0,0 +1,177 @@
+package microblob
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// errStopped ends an iteration early, when the consumer of a stream is done.
+var errStopped = errors.New("stopped")
+
+// Difference is a key, whose entries differ between two indexes. A or B is
+// nil, if the key is only in the other index.
+type Difference struct {
+	Key string
+	A   *Entry
+	B   *Entry
+}
+
+// String formats a difference as TSV: key, only-a, only-b or changed and, for
+// changed keys, the fields that differ, with the values in A and B.
+func (d Difference) String() string {
+	switch {
+	case d.B == nil:
+		return fmt.Sprintf("%s\tonly-a", d.Key)
+	case d.A == nil:
+		return fmt.Sprintf("%s\tonly-b", d.Key)
+	}
+	var fields []string
+	for _, f := range []struct {
+		name string
+		a, b int64
+	}{
+		{"offset", d.A.Offset, d.B.Offset},
+		{"length", d.A.Length, d.B.Length},
+		{"size", d.A.Size, d.B.Size},
+		{"file", int64(d.A.File), int64(d.B.File)},
+		{"crc", int64(d.A.CRC), int64(d.B.CRC)},
+	} {
+		if f.a != f.b {
+			fields = append(fields, fmt.Sprintf("%s %d %d", f.name, f.a, f.b))
+		}
+	}
+	return fmt.Sprintf("%s\tchanged\t%s", d.Key, strings.Join(fields, ", "))
+}
+
+// DiffSummary counts the keys compared by DiffEntries.
+type DiffSummary struct {
+	OnlyA   int64 `json:"only_a"`
+	OnlyB   int64 `json:"only_b"`
+	Changed int64 `json:"changed"`
+	Same    int64 `json:"same"`
+}
+
+// Differs returns true, if the indexes are not the same.
+func (s DiffSummary) Differs() bool {
+	return s.OnlyA > 0 || s.OnlyB > 0 || s.Changed > 0
+}
+
+// sameEntry returns true, if two entries point to the same document. Expiry
+// times are not compared, since they are set anew, when an index is rebuilt.
+func sameEntry(a, b Entry) bool {
+	return a.Offset == b.Offset && a.Length == b.Length && a.Size == b.Size && a.File == b.File && a.CRC == b.CRC
+}
+
+// DiffEntries compares the entries of two indexes, both in key order, e.g. to
+// check a rebuilt index against the previous generation, and calls f for each
+// key only in one of them or with a different offset, length, size, file or
+// checksum.
+func DiffEntries(a, b EntryIterator, f func(Difference) error) (DiffSummary, error) {
+	var summary DiffSummary
+	nextA, stopA := entryStream(a)
+	defer stopA()
+	nextB, stopB := entryStream(b)
+	defer stopB()
+	ea, okA, err := nextA()
+	if err != nil {
+		return summary, err
+	}
+	eb, okB, err := nextB()
+	if err != nil {
+		return summary, err
+	}
+	for okA || okB {
+		var d *Difference
+		switch {
+		case okA && (!okB || ea.Key < eb.Key):
+			summary.OnlyA++
+			e := ea
+			d = &Difference{Key: ea.Key, A: &e}
+			if ea, okA, err = nextA(); err != nil {
+				return summary, err
+			}
+		case okB && (!okA || eb.Key < ea.Key):
+			summary.OnlyB++
+			e := eb
+			d = &Difference{Key: eb.Key, B: &e}
+			if eb, okB, err = nextB(); err != nil {
+				return summary, err
+			}
+		default:
+			if sameEntry(ea, eb) {
+				summary.Same++
+			} else {
+				summary.Changed++
+				x, y := ea, eb
+				d = &Difference{Key: ea.Key, A: &x, B: &y}
+			}
+			if ea, okA, err = nextA(); err != nil {
+				return summary, err
+			}
+			if eb, okB, err = nextB(); err != nil {
+				return summary, err
+			}
+		}
+		if d != nil {
+			if err := f(*d); err != nil {
+				return summary, err
+			}
+		}
+	}
+	return summary, nil
+}
+
+// entryStream returns the entries of an iterator one at a time, read in the
+// background. Call stop, when done.
+func entryStream(src EntryIterator) (next func() (Entry, bool, error), stop func()) {
+	var (
+		entries = make(chan Entry, 1024)
+		done    = make(chan struct{})
+		result  = make(chan error, 1)
+	)
+	go func() {
+		defer close(entries)
+		result <- src.Entries(func(e Entry) error {
+			select {
+			case entries <- e:
+				return nil
+			case <-done:
+				return errStopped
+			}
+		})
+	}()
+	next = func() (Entry, bool, error) {
+		if e, ok := <-entries; ok {
+			return e, true, nil
+		}
+		if err := <-result; err != nil {
+			result <- err
+			return Entry{}, false, err
+		}
+		result <- nil
+		return Entry{}, false, nil
+	}
+	stop = func() { close(done) }
+	return next, stop
+}
+
+// FlatEntries lists the entries read from a flat index, as written by
+// WriteFlatIndex, once.
+type FlatEntries struct {
+	R io.Reader
+}
+
+// Entries calls f with each entry read.
+func (s FlatEntries) Entries(f func(Entry) error) error {
+	_, err := readFlatEntries(s.R, 1000, func(entries []Entry) error {
+		for _, e := range entries {
+			if err := f(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,92 @@
+package microblob
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+// IndexTimer can tell, when a blob file was last indexed or appended to.
+type IndexTimer interface {
+	IndexTime(file int) (time.Time, error)
+}
+
+// IndexTime returns the time the fingerprint of the blob file with the given
+// id was recorded, the zero time, if there is none.
+func (b *LevelDBBackend) IndexTime(file int) (time.Time, error) {
+	name, err := b.blobPath(file)
+	if err != nil {
+		return time.Time{}, err
+	}
+	fps, err := readFingerprints(b.Filename)
+	if err != nil {
+		return time.Time{}, err
+	}
+	fp, ok := fps[filepath.Base(name)]
+	if !ok || fp.Indexed == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(fp.Indexed, 0), nil
+}
+
+// IndexTime returns the index time from the wrapped backend.
+func (b TransformBackend) IndexTime(file int) (time.Time, error) {
+	if t, ok := b.Backend.(IndexTimer); ok {
+		return t.IndexTime(file)
+	}
+	return time.Time{}, ErrNotImplemented
+}
+
+// envelope wraps a document with its location, for ?envelope=1.
+type envelope struct {
+	Key       string      `json:"key"`
+	Offset    int64       `json:"offset"`
+	Length    int64       `json:"length"`
+	File      int         `json:"file,omitempty"`
+	IndexedAt string      `json:"indexed_at,omitempty"`
+	Payload   interface{} `json:"payload"`
+}
+
+// serveEnvelope writes the document for a key wrapped in a JSON object with
+// key, offset, length and the time its blob file was last indexed. Documents,
+// that are not JSON, are included as string.
+func (h *BlobHandler) serveEnvelope(w http.ResponseWriter, r *http.Request, key string) {
+	w.Header().Set("Content-Type", "application/json")
+	l, ok := h.Backend.(Locator)
+	if !ok {
+		http.Error(w, "not implemented", http.StatusNotFound)
+		errCounter.Add(1)
+		return
+	}
+	entry, err := l.Locate(key)
+	var b []byte
+	if err == nil {
+		b, err = GetContext(r.Context(), h.Backend, key)
+	}
+	if err != nil {
+		w.WriteHeader(lookupStatus(err))
+		w.Write([]byte(err.Error()))
+		errCounter.Add(1)
+		return
+	}
+	env := envelope{Key: key, Offset: entry.Offset, Length: entry.Length, File: entry.File}
+	if t, ok := h.Backend.(IndexTimer); ok {
+		if at, err := t.IndexTime(entry.File); err == nil && !at.IsZero() {
+			env.IndexedAt = at.UTC().Format(time.RFC3339)
+		}
+	}
+	if trimmed := bytes.TrimSpace(b); json.Valid(trimmed) {
+		env.Payload = json.RawMessage(trimmed)
+	} else {
+		env.Payload = string(b)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(env); err != nil {
+		errCounter.Add(1)
+		return
+	}
+	okCounter.Add(1)
+}
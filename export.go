@@ -0,0 +1,150 @@
+package microblob
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// Exporter can write all currently indexed documents to a writer.
+type Exporter interface {
+	Export(w io.Writer) error
+}
+
+// Iterator can walk all index entries, in key order.
+type Iterator interface {
+	ForEach(f func(key string, offset, length int64) error) error
+}
+
+// ForEach calls f with key, offset and length of each entry in the database,
+// in key order. Iteration stops at the first error returned by f.
+func (b *LevelDBBackend) ForEach(f func(key string, offset, length int64) error) error {
+	return b.Entries(func(e Entry) error {
+		return f(e.Key, e.Offset, e.Length)
+	})
+}
+
+// ForEach walks the entries of the wrapped backend. Keys are reported as
+// stored, that is, transformed.
+func (b TransformBackend) ForEach(f func(key string, offset, length int64) error) error {
+	if it, ok := b.Backend.(Iterator); ok {
+		return it.ForEach(f)
+	}
+	return ErrNotImplemented
+}
+
+// Entries calls f for each entry in the database, in key order. Expired
+// entries and suppressed keys are skipped.
+func (b *LevelDBBackend) Entries(f func(Entry) error) error {
+	return b.allEntries(func(e Entry) error {
+		if b.Suppressed.Contains(e.Key) {
+			return nil
+		}
+		return f(e)
+	})
+}
+
+// allEntries calls f for each entry, like Entries, including suppressed
+// keys. Expired and deleted entries are skipped, so they are dropped by
+// compaction.
+func (b *LevelDBBackend) allEntries(f func(Entry) error) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if err := b.openDatabase(); err != nil {
+		return err
+	}
+	iter := b.db.NewIterator(b.keyRange(), nil)
+	defer iter.Release()
+	now := time.Now()
+	for iter.Next() {
+		e, err := decodeEntry(iter.Key()[len(b.Prefix):], iter.Value())
+		if err != nil {
+			return err
+		}
+		if e.expired(now) || b.tombstones.isDeleted(e) {
+			continue
+		}
+		if err := f(e); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// Export writes all indexed documents to w, reading each blob file sequentially
+// by ascending offset. Superseded, deleted and suppressed documents are
+// skipped, documents indexed under multiple keys are written once.
+func (b *LevelDBBackend) Export(w io.Writer) error {
+	var entries []Entry
+	if err := b.Entries(func(e Entry) error {
+		e.Key = ""
+		entries = append(entries, e)
+		return nil
+	}); err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return after(entries[j], entries[i]) })
+
+	var (
+		f    *os.File
+		br   *bufio.Reader
+		pos  int64
+		file = -1
+	)
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	for _, e := range entries {
+		if e.File != file {
+			if f != nil {
+				f.Close()
+			}
+			f = nil
+			if e.File == 0 && b.Remote != nil {
+				// Sequential reads turn into range requests of the buffer size.
+				br = bufio.NewReaderSize(io.NewSectionReader(b.Remote, 0, math.MaxInt64), 1<<20)
+			} else {
+				name, err := b.blobPath(e.File)
+				if err != nil {
+					return err
+				}
+				if f, err = os.Open(name); err != nil {
+					return err
+				}
+				br = bufio.NewReaderSize(f, 1<<20)
+			}
+			pos, file = 0, e.File
+		}
+		if e.Offset < pos {
+			continue // Same document under another key.
+		}
+		if _, err := io.CopyN(ioutil.Discard, br, e.Offset-pos); err != nil {
+			return err
+		}
+		if b.Compression == "" {
+			if _, err := io.CopyN(w, br, e.Length); err != nil {
+				return err
+			}
+		} else {
+			data := make([]byte, e.Length)
+			if _, err := io.ReadFull(br, data); err != nil {
+				return err
+			}
+			data, err := b.decode(data)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+		}
+		pos = e.Offset + e.Length
+	}
+	return nil
+}
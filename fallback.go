@@ -0,0 +1,67 @@
+package microblob
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Fallback fetches documents missing locally from another microblob instance
+// or any HTTP endpoint, e.g. a large cold store behind a small hot one.
+type Fallback struct {
+	URL    string       // the key is appended as path segment or replaces {key}
+	Cache  *Cache       // caches fetched documents, if not nil
+	Client *http.Client // defaults to a client with a 10s timeout
+}
+
+// link returns the URL of the document for a key.
+func (f *Fallback) link(key string) string {
+	if strings.Contains(f.URL, "{key}") {
+		return strings.Replace(f.URL, "{key}", url.PathEscape(key), -1)
+	}
+	return strings.TrimSuffix(f.URL, "/") + "/" + url.PathEscape(key)
+}
+
+// Get returns the document for a key from the cache or the fallback URL.
+// Returns leveldb.ErrNotFound, if the endpoint responds with 404 or 410.
+func (f *Fallback) Get(ctx context.Context, key string) ([]byte, error) {
+	if f.Cache != nil {
+		if b, ok := f.Cache.Get(key); ok {
+			return b, nil
+		}
+	}
+	req, err := http.NewRequest("GET", f.link(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	client := f.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		return nil, leveldb.ErrNotFound
+	default:
+		return nil, fmt.Errorf("fallback %s: %s", req.URL, resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if f.Cache != nil {
+		f.Cache.Add(key, b)
+	}
+	return b, nil
+}
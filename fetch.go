@@ -0,0 +1,52 @@
+package microblob
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// AppendURL fetches a file and appends it to the blob file, like
+// AppendKeysOptions. Compressed files, gzip or zstd, are decompressed. The download is
+// streamed into the blob file, which is truncated again, if it fails.
+func AppendURL(ctx context.Context, client *http.Client, blobfn, rawurl string, backend Backend, kf KeysFunc, opts AppendOptions) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch %s: %s", rawurl, resp.Status)
+	}
+	r, err := responseBody(resp)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return AppendReader(blobfn, &finalNewlineReader{r: r, sep: recordSeparator(backend)}, backend, kf, opts)
+}
+
+// responseBody returns the body of a response, decompressed, if it is gzip or
+// zstd compressed.
+func responseBody(resp *http.Response) (io.ReadCloser, error) {
+	return NewDecompressReader(resp.Body)
+}
+
+// allowedURL returns true, if the URL starts with one of the prefixes.
+func allowedURL(rawurl string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if p != "" && strings.HasPrefix(rawurl, p) {
+			return true
+		}
+	}
+	return false
+}
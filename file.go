@@ -1,65 +1,384 @@
 package microblob
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"sync"
+	"time"
 )
 
-// mu protects updates.
+// mu protects updates, see lockBlob.
 var mu sync.Mutex
 
+// ErrCompressedBlob if the blob file is gzip compressed.
+var ErrCompressedBlob = errors.New("blob file is gzip compressed, decompress first or pass the .gz file to have it decompressed")
+
+// IsGzipFile returns true, if the file starts with the gzip magic number.
+func IsGzipFile(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	magic, err := bufio.NewReader(f).Peek(2)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return magic[0] == 0x1f && magic[1] == 0x8b, nil
+}
+
 // Append add a file to an existing blob file and adds their keys to the store.
+// Compressed files, gzip or zstd, are decompressed.
 func Append(blobfn, fn string, backend Backend, kf KeyFunc) error {
 	return AppendBatchSize(blobfn, fn, backend, kf, 100000, false)
 }
 
 // AppendBatchSize uses a given batch size.
 func AppendBatchSize(blobfn, fn string, backend Backend, kf KeyFunc, size int, ignoreMissingKeys bool) (err error) {
-	mu.Lock()
-	defer mu.Unlock()
+	return AppendKeysBatchSize(blobfn, fn, backend, SingleKey(kf), size, ignoreMissingKeys)
+}
 
-	file, err := os.OpenFile(blobfn, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+// AppendKeysBatchSize uses a given batch size and indexes each document under
+// all keys returned by the key function.
+func AppendKeysBatchSize(blobfn, fn string, backend Backend, kf KeysFunc, size int, ignoreMissingKeys bool) (err error) {
+	return AppendKeysOptions(blobfn, fn, backend, kf, AppendOptions{
+		BatchSize:         size,
+		IgnoreMissingKeys: ignoreMissingKeys,
+	})
+}
+
+// AppendOptions configures an append.
+type AppendOptions struct {
+	BatchSize         int            // number of lines in a batch
+	BatchBytes        int64          // if positive, the maximum size of a batch in bytes, bounds memory use on large files
+	MaxRecordSize     int64          // if positive, the append fails at the first longer record, see ErrRecordTooLarge
+	IgnoreMissingKeys bool           // skip documents without key
+	Workers           int            // number of key extraction workers, defaults to the number of CPUs
+	Progress          io.Writer      // receives periodic progress reports, if not nil
+	File              int            // id of the blob file, when serving from multiple files
+	BrokenReport      io.Writer      // if set, documents failing key extraction are skipped and reported here
+	Summary           *AppendSummary // if set, receives the number of keys indexed and bytes appended
+	TTL               time.Duration  // if positive, the keys expire after this duration
+	IfMatch           string         // if set, the append fails, unless the blob file has this size or tag, see BlobTag
+	Dedup             *DedupSet      // if set, documents in the set are not appended again, but indexed at their first copy
+}
+
+// AppendSummary counts what an append added.
+type AppendSummary struct {
+	Keys   int64 // entries written to the index
+	Bytes  int64 // bytes appended to the blob file
+	Offset int64 // size of the blob file before the first append counted
+}
+
+// entryWriter returns the function writing entries to the backend, which sets
+// the expiry time, if a TTL is given, and counts them, if a summary is
+// requested.
+func (o AppendOptions) entryWriter(backend Backend) EntryWriter {
+	if o.Summary == nil && o.TTL <= 0 {
+		return backend.WriteEntries
+	}
+	return func(entries []Entry) error {
+		if o.TTL > 0 {
+			expires := expiresAt(o.TTL)
+			for i := range entries {
+				entries[i].Expires = expires
+			}
+		}
+		if err := backend.WriteEntries(entries); err != nil {
+			return err
+		}
+		if o.Summary != nil {
+			o.Summary.Keys += int64(len(entries))
+		}
+		return nil
+	}
+}
+
+// expiresAt returns the expiry time for a TTL from now, as unix time, rounded
+// up to the next second, or 0, if the TTL is not positive.
+func expiresAt(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl + time.Second - 1).Unix()
+}
+
+// summarize counts the bytes appended to the blob file after offset, if a
+// summary is requested.
+func (o AppendOptions) summarize(blobfn string, offset int64) error {
+	if o.Summary == nil {
+		return nil
+	}
+	fi, err := os.Stat(blobfn)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	var offset int64
+	if o.Summary.Bytes == 0 {
+		o.Summary.Offset = offset
+	}
+	o.Summary.Bytes += fi.Size() - offset
+	return nil
+}
 
-	if fn != "" {
-		offset, err = file.Seek(0, io.SeekEnd)
+// AppendKeysOptions appends a file to the blob file and indexes each document
+// under all keys returned by the key function. If fn is empty, the blob file
+// itself is indexed, which may be on a read-only mount. Compressed files, gzip
+// or zstd, are decompressed. The fingerprint of the blob file is checked
+// before and recorded after indexing, if the backend supports it.
+func AppendKeysOptions(blobfn, fn string, backend Backend, kf KeysFunc, opts AppendOptions) (err error) {
+	if fn == "" {
+		unlock, err := lockBlob(blobfn)
+		if readOnlyError(err) {
+			// Nobody can append to a read-only file, so it is indexed unlocked.
+			unlock, err = func() {}, nil
+		}
 		if err != nil {
 			return err
 		}
+		defer unlock()
+		return indexBlobLocked(blobfn, backend, kf, opts)
+	}
 
-		f, err := os.Open(fn)
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := NewDecompressReader(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return AppendReader(blobfn, r, backend, kf, opts)
+}
+
+// indexBlobLocked indexes the blob file itself, the caller holds its lock.
+func indexBlobLocked(blobfn string, backend Backend, kf KeysFunc, opts AppendOptions) error {
+	if blobCompression(backend) == "zstd" {
+		return fmt.Errorf("compressed blob file can only be indexed from a source file")
+	}
+	if opts.Dedup != nil {
+		return fmt.Errorf("documents can only be deduplicated, when appended from a source file")
+	}
+	if err := checkBlob(backend, blobfn); err != nil {
+		return err
+	}
+	file, err := os.Open(blobfn)
+	if os.IsNotExist(err) {
+		file, err = os.OpenFile(blobfn, os.O_CREATE|os.O_RDONLY, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := indexDocuments(file, 0, backend, kf, opts); err != nil {
+		return err
+	}
+	return recordBlob(backend, blobfn)
+}
+
+// AppendReader appends newline delimited documents read from r to the blob
+// file and indexes each document under all keys returned by the key function.
+// The blob file is truncated to its previous size, if indexing fails. Appends
+// to a blob file, that does not match its recorded fingerprint, fail, as do
+// appends, whose IfMatch precondition does not hold.
+func AppendReader(blobfn string, r io.Reader, backend Backend, kf KeysFunc, opts AppendOptions) error {
+	if opts.File == 0 {
+		opts.File = blobID(backend, blobfn)
+	}
+	unlock, err := lockBlob(blobfn)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := checkBlob(backend, blobfn); err != nil {
+		return err
+	}
+	if err := checkPrecondition(blobfn, opts.IfMatch); err != nil {
+		return err
+	}
+	if err := beginAppend(backend, blobfn); err != nil {
+		return err
+	}
+	if err := appendLocked(blobfn, r, backend, kf, opts); err != nil {
+		if jerr := endAppend(backend, true); jerr != nil {
+			return fmt.Errorf("append and rollback failed: %v, %v", err, jerr)
+		}
+		return err
+	}
+	// The journal goes first: once the fingerprint covers the appended
+	// part, it must not be rolled back.
+	if err := endAppend(backend, false); err != nil {
+		return err
+	}
+	return recordBlob(backend, blobfn)
+}
+
+// appendLocked appends and indexes the documents read from r, the caller holds
+// the lock of the blob file. The fingerprint is not recorded.
+func appendLocked(blobfn string, r io.Reader, backend Backend, kf KeysFunc, opts AppendOptions) error {
+	if compression := blobCompression(backend); compression == "zstd" || opts.Dedup != nil {
+		var (
+			offset int64
+			err    error
+		)
+		if fi, err := os.Stat(blobfn); err == nil {
+			offset = fi.Size()
+		}
+		if compression == "zstd" {
+			err = appendZstd(blobfn, r, backend, kf, opts)
+		} else {
+			err = appendRecords(blobfn, r, backend, kf, opts, nil)
+		}
 		if err != nil {
 			return err
 		}
-		defer f.Close()
+		return opts.summarize(blobfn, offset)
+	}
 
-		if _, err := io.Copy(file, f); err != nil {
-			return err
+	file, err := os.OpenFile(blobfn, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		if terr := os.Truncate(blobfn, offset); terr != nil {
+			return fmt.Errorf("copy and truncate failed: %v, %v", err, terr)
 		}
-		if _, err := file.Seek(offset, io.SeekStart); err != nil {
-			return err
+		return err
+	}
+	if err := syncBlob(backend, file); err != nil {
+		if terr := os.Truncate(blobfn, offset); terr != nil {
+			return fmt.Errorf("sync and truncate failed: %v, %v", err, terr)
 		}
+		return err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
 	}
+	if err := indexDocuments(file, offset, backend, kf, opts); err != nil {
+		if terr := os.Truncate(blobfn, offset); terr != nil {
+			return fmt.Errorf("processing and truncate failed: %v, %v", err, terr)
+		}
+		return err
+	}
+	return opts.summarize(blobfn, offset)
+}
 
-	processor := NewLineProcessor(file, backend.WriteEntries, kf)
-	processor.BatchSize = size
+// indexDocuments indexes the documents read from r, starting at the given
+// offset of the blob file.
+func indexDocuments(r io.Reader, offset int64, backend Backend, kf KeysFunc, opts AppendOptions) error {
+	processor := NewLineProcessor(r, opts.entryWriter(backend), nil)
+	processor.KeysFunc = kf
+	processor.BatchSize = opts.BatchSize
+	processor.MaxBatchBytes = opts.BatchBytes
+	processor.MaxRecordSize = opts.MaxRecordSize
 	processor.InitialOffset = offset
 	processor.Verbose = true
-	processor.IgnoreMissingKeys = ignoreMissingKeys
+	processor.IgnoreMissingKeys = opts.IgnoreMissingKeys
+	processor.Workers = opts.Workers
+	processor.Progress = opts.Progress
+	processor.File = opts.File
+	processor.Separator = recordSeparator(backend)
+	processor.BrokenReport = opts.BrokenReport
+	processor.CRC = recordCRC(backend)
+	processor.Format = recordFormat(backend)
+	return processor.RunWithWorkers()
+}
 
-	if err = processor.RunWithWorkers(); err != nil {
-		if fn != "" {
-			if terr := os.Truncate(blobfn, offset); terr != nil {
-				return fmt.Errorf("processing and truncate failed: %v, %v", err, terr)
-			}
+// AppendDocument appends a single JSON document to the blob file and indexes it
+// under the given key. The document is compacted into a single line. Fails with
+// ErrKeyExists, if the duplicate policy keeps the document indexed already.
+func AppendDocument(blobfn string, backend Backend, key string, doc []byte) error {
+	return AppendDocumentTTL(blobfn, backend, key, doc, 0)
+}
+
+// AppendDocumentTTL is like AppendDocument, but the key expires after the TTL,
+// if positive.
+func AppendDocumentTTL(blobfn string, backend Backend, key string, doc []byte, ttl time.Duration) error {
+	unlock, err := lockBlob(blobfn)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return appendDocumentTTLLocked(blobfn, backend, key, doc, ttl)
+}
+
+// appendDocumentTTLLocked is like AppendDocumentTTL, the caller holds the lock
+// of the blob file, e.g. to read the current document before appending.
+func appendDocumentTTLLocked(blobfn string, backend Backend, key string, doc []byte, ttl time.Duration) error {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, doc); err != nil {
+		return err
+	}
+	buf.WriteByte(recordSeparator(backend))
+
+	if err := checkBlob(backend, blobfn); err != nil {
+		return err
+	}
+	if err := beginAppend(backend, blobfn); err != nil {
+		return err
+	}
+	if err := appendDocumentLocked(blobfn, backend, key, buf.Bytes(), ttl); err != nil {
+		if jerr := endAppend(backend, true); jerr != nil {
+			return fmt.Errorf("append and rollback failed: %v, %v", err, jerr)
+		}
+		return err
+	}
+	if err := endAppend(backend, false); err != nil {
+		return err
+	}
+	return recordBlob(backend, blobfn)
+}
+
+// appendDocumentLocked appends and indexes a record, the caller holds the lock
+// of the blob file.
+func appendDocumentLocked(blobfn string, backend Backend, key string, record []byte, ttl time.Duration) error {
+	file, err := os.OpenFile(blobfn, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	entry := Entry{Key: key, Offset: offset, Length: int64(len(record)), File: blobID(backend, blobfn), Expires: expiresAt(ttl)}
+	data := record
+	if blobCompression(backend) == "zstd" {
+		data = zstdEncoder.EncodeAll(data, nil)
+		entry.Length, entry.Size = int64(len(data)), int64(len(record))
+	}
+	if recordCRC(backend) {
+		entry.CRC = sectionCRC(data)
+	}
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	if err := syncBlob(backend, file); err != nil {
+		return err
+	}
+	if err = WriteEntriesStrict(backend, []Entry{entry}); err != nil {
+		if terr := os.Truncate(blobfn, offset); terr != nil {
+			return fmt.Errorf("write and truncate failed: %v, %v", err, terr)
 		}
+		return err
 	}
-	return err
+	return nil
 }
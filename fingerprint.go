@@ -0,0 +1,243 @@
+package microblob
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fingerprintSize is the number of bytes hashed at the head and at the tail of
+// a blob file.
+const fingerprintSize = 1 << 16
+
+// fingerprintFile is the file in the index directory the fingerprints of the
+// indexed blob files are stored in.
+const fingerprintFile = "FINGERPRINT"
+
+// BlobGuard can detect blob files, that were truncated or replaced after they
+// were indexed.
+type BlobGuard interface {
+	CheckBlob(name string) error
+	RecordBlob(name string) error
+}
+
+// Fingerprint identifies the indexed part of a blob file. Since blob files are
+// only appended to, a file matches, if it is at least as large and the hashes
+// of head and tail of the indexed part are unchanged.
+type Fingerprint struct {
+	Size int64  `json:"size"`
+	Head string `json:"head"` // SHA1 of the first 64KB
+	Tail string `json:"tail"` // SHA1 of the last 64KB before size
+
+	Indexed    int64  `json:"indexed,omitempty"`    // unix time the fingerprint was recorded, not part of the match
+	Generation string `json:"generation,omitempty"` // random id, kept while the file is appended to, not part of the match
+}
+
+// Generationer can tell the generation of a blob file, which changes, when
+// the file is replaced, e.g. by a rebuild or compaction, but not, when it is
+// appended to, so entity tags of documents do not outlive their content.
+type Generationer interface {
+	Generation(file int) (string, error)
+}
+
+// newGeneration returns a random generation for a blob file.
+func newGeneration() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// blobFingerprint returns the fingerprint of the first size bytes of a file.
+func blobFingerprint(filename string, size int64) (Fingerprint, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return Fingerprint{}, err
+	}
+	defer f.Close()
+	hash := func(offset, n int64) (string, error) {
+		h := sha1.New()
+		if _, err := io.Copy(h, io.NewSectionReader(f, offset, n)); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%x", h.Sum(nil)), nil
+	}
+	fp := Fingerprint{Size: size}
+	n := int64(fingerprintSize)
+	if size < n {
+		n = size
+	}
+	if fp.Head, err = hash(0, n); err != nil {
+		return fp, err
+	}
+	if fp.Tail, err = hash(size-n, n); err != nil {
+		return fp, err
+	}
+	return fp, nil
+}
+
+// readFingerprints reads the fingerprints stored in an index directory, keyed
+// by the base name of the blob file.
+func readFingerprints(dir string) (map[string]Fingerprint, error) {
+	fps := make(map[string]Fingerprint)
+	b, err := ioutil.ReadFile(filepath.Join(dir, fingerprintFile))
+	if os.IsNotExist(err) {
+		return fps, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &fps); err != nil {
+		return nil, fmt.Errorf("invalid fingerprint file: %v", err)
+	}
+	return fps, nil
+}
+
+// recordFingerprint stores the fingerprint of the first size bytes of a file
+// in an index directory, under the base name of the given blob file name.
+func recordFingerprint(dir, name, filename string, size int64) error {
+	fps, err := readFingerprints(dir)
+	if err != nil {
+		return err
+	}
+	fp, err := blobFingerprint(filename, size)
+	if err != nil {
+		return err
+	}
+	fp.Indexed = time.Now().Unix()
+	// Appends keep the generation, a replaced file comes with a new index.
+	if prev, ok := fps[filepath.Base(name)]; ok && prev.Generation != "" {
+		fp.Generation = prev.Generation
+	} else {
+		fp.Generation = newGeneration()
+	}
+	fps[filepath.Base(name)] = fp
+	b, err := json.Marshal(fps)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, fingerprintFile+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, fingerprintFile))
+}
+
+// CheckBlob returns an error, if the blob file does not match the fingerprint
+// recorded, when it was last indexed, i.e. it was truncated or replaced. Files
+// without a recorded fingerprint always match.
+func (b *LevelDBBackend) CheckBlob(name string) error {
+	if err := b.reopenReplaced(); err != nil {
+		return err
+	}
+	fps, err := readFingerprints(b.Filename)
+	if err != nil {
+		return err
+	}
+	fp, ok := fps[filepath.Base(name)]
+	if !ok {
+		return nil
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if fi.Size() < fp.Size {
+		return fmt.Errorf("blob file %s truncated, indexed %d bytes, found %d", name, fp.Size, fi.Size())
+	}
+	current, err := blobFingerprint(name, fp.Size)
+	if err != nil {
+		return err
+	}
+	current.Indexed, current.Generation = fp.Indexed, fp.Generation
+	if current != fp {
+		return fmt.Errorf("blob file %s does not match index %s, it was replaced", name, b.Filename)
+	}
+	return nil
+}
+
+// RecordBlob records the fingerprint of the blob file in the index.
+func (b *LevelDBBackend) RecordBlob(name string) error {
+	if b.ReadOnly {
+		return nil
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if err := b.openDatabase(); err != nil {
+		return err
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	return recordFingerprint(b.Filename, name, name, fi.Size())
+}
+
+// Generation returns the generation of the blob file with the given id, as
+// recorded in the index open, empty, if the file has no fingerprint yet.
+func (b *LevelDBBackend) Generation(file int) (string, error) {
+	name, err := b.blobPath(file)
+	if err != nil {
+		return "", err
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if err := b.openDatabase(); err != nil {
+		return "", err
+	}
+	b.openMu.Lock()
+	defer b.openMu.Unlock()
+	if g, ok := b.generations[file]; ok {
+		return g, nil
+	}
+	fps, err := readFingerprints(b.openDir())
+	if err != nil {
+		return "", err
+	}
+	g := fps[filepath.Base(name)].Generation
+	if g != "" {
+		if b.generations == nil {
+			b.generations = make(map[int]string)
+		}
+		b.generations[file] = g
+	}
+	return g, nil
+}
+
+// Generation returns the generation of the blob file from the wrapped backend.
+func (b TransformBackend) Generation(file int) (string, error) {
+	if g, ok := b.Backend.(Generationer); ok {
+		return g.Generation(file)
+	}
+	return "", ErrNotImplemented
+}
+
+// CheckBlob checks the blob file against the wrapped backend.
+func (b TransformBackend) CheckBlob(name string) error { return checkBlob(b.Backend, name) }
+
+// RecordBlob records the blob file in the wrapped backend.
+func (b TransformBackend) RecordBlob(name string) error { return recordBlob(b.Backend, name) }
+
+// checkBlob checks the blob file, if the backend supports it.
+func checkBlob(backend Backend, name string) error {
+	if g, ok := backend.(BlobGuard); ok {
+		return g.CheckBlob(name)
+	}
+	return nil
+}
+
+// recordBlob records the blob file, if the backend supports it.
+func recordBlob(backend Backend, name string) error {
+	if g, ok := backend.(BlobGuard); ok {
+		return g.RecordBlob(name)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package microblob
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The flat index format has one entry per line, in key order, with tab
+// separated key, offset, length, decompressed size, file id, expiry time and,
+// if there is one, the CRC of the section.
+// Tabs, newlines, carriage returns and backslashes in keys are escaped with a
+// backslash. Lines with only key, offset and length, as written by the keys
+// command with -offsets, are read as well. Inlined sections and previous
+// versions are not part of the format.
+var (
+	flatKeyEscaper   = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+	flatKeyUnescaper = strings.NewReplacer(`\\`, `\`, `\t`, "\t", `\n`, "\n", `\r`, "\r")
+)
+
+// WriteFlatIndex writes all entries of the index to w in the flat index
+// format, without reading the blob files. Returns the number of entries
+// written.
+func WriteFlatIndex(w io.Writer, src EntryIterator) (n int64, err error) {
+	bw := bufio.NewWriterSize(w, 1<<20)
+	err = src.Entries(func(e Entry) error {
+		if _, err := fmt.Fprintf(bw, "%s\t%d\t%d\t%d\t%d\t%d",
+			flatKeyEscaper.Replace(e.Key), e.Offset, e.Length, e.Size, e.File, e.Expires); err != nil {
+			return err
+		}
+		if e.CRC != 0 {
+			if _, err := fmt.Fprintf(bw, "\t%d", e.CRC); err != nil {
+				return err
+			}
+		}
+		if err := bw.WriteByte('\n'); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+// ReadFlatIndex writes the entries read from r in the flat index format to
+// dst in batches of the given size, e.g. to build an index shipped next to the
+// blob file, without extracting the keys again. Returns the number of entries
+// written.
+func ReadFlatIndex(r io.Reader, dst Backend, batchSize int) (n int64, err error) {
+	return readFlatEntries(r, batchSize, dst.WriteEntries)
+}
+
+// readFlatEntries passes the entries read from r in the flat index format to
+// f in batches of the given size. Returns the number of entries passed.
+func readFlatEntries(r io.Reader, batchSize int, f func([]Entry) error) (n int64, err error) {
+	if batchSize < 1 {
+		batchSize = 100000
+	}
+	var (
+		br    = bufio.NewReaderSize(r, 1<<20)
+		batch = make([]Entry, 0, batchSize)
+		line  int64
+	)
+	for {
+		b, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if b = strings.TrimRight(b, "\r\n"); b != "" {
+			line++
+			e, perr := parseFlatEntry(b)
+			if perr != nil {
+				return n, fmt.Errorf("line %d: %v", line, perr)
+			}
+			if batch = append(batch, e); len(batch) == batchSize {
+				if err := f(batch); err != nil {
+					return n, err
+				}
+				n += int64(len(batch))
+				batch = batch[:0]
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if len(batch) > 0 {
+		if err := f(batch); err != nil {
+			return n, err
+		}
+		n += int64(len(batch))
+	}
+	return n, nil
+}
+
+// parseFlatEntry parses a line of the flat index format.
+func parseFlatEntry(line string) (Entry, error) {
+	fields := strings.Split(line, "\t")
+	if len(fields) < 3 || len(fields) > 7 {
+		return Entry{}, fmt.Errorf("expected 3 to 7 fields, got %d", len(fields))
+	}
+	var v [6]int64
+	for i, f := range fields[1:] {
+		x, err := strconv.ParseInt(f, 10, 64)
+		if err != nil || x < 0 {
+			return Entry{}, fmt.Errorf("invalid number: %s", f)
+		}
+		v[i] = x
+	}
+	if v[5] > math.MaxUint32 {
+		return Entry{}, fmt.Errorf("invalid crc: %d", v[5])
+	}
+	return Entry{
+		Key:     flatKeyUnescaper.Replace(fields[0]),
+		Offset:  v[0],
+		Length:  v[1],
+		Size:    v[2],
+		File:    int(v[3]),
+		Expires: v[4],
+		CRC:     uint32(v[5]),
+	}, nil
+}
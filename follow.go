@@ -0,0 +1,137 @@
+package microblob
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Follower indexes records an external writer appends to the blob file, like
+// tail -f, e.g. a logging pipeline writing newline delimited JSON directly. A
+// partial record at the end of the file is indexed once it is complete. The
+// blob file must not be appended to by other means meanwhile.
+type Follower struct {
+	Blobfile string
+	Backend  Backend
+	KeysFunc KeysFunc
+	Options  AppendOptions
+	Interval time.Duration // time between checks for growth, defaults to 1s
+
+	offset int64 // end of the last complete record indexed
+}
+
+// Sync indexes the complete records appended since the last sync and returns
+// the number of bytes indexed.
+func (f *Follower) Sync() (int64, error) {
+	if blobCompression(f.Backend) != "" || recordFormat(f.Backend) != "" {
+		return 0, fmt.Errorf("follow requires an uncompressed blob file of separated records")
+	}
+	file, err := os.Open(f.Blobfile)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if fi.Size() < f.offset {
+		return 0, fmt.Errorf("blob file %s truncated from %d to %d bytes", f.Blobfile, f.offset, fi.Size())
+	}
+	end, err := lastSeparator(file, f.offset, fi.Size(), recordSeparator(f.Backend))
+	if err != nil || end == f.offset {
+		return 0, err
+	}
+	opts := f.Options
+	if opts.File == 0 {
+		opts.File = blobID(f.Backend, f.Blobfile)
+	}
+	if err := indexDocuments(io.NewSectionReader(file, f.offset, end-f.offset), f.offset, f.Backend, f.KeysFunc, opts); err != nil {
+		return 0, err
+	}
+	n := end - f.offset
+	f.offset = end
+	// Record only the indexed part, so a restart resumes after it.
+	if lb := levelDBBackend(f.Backend); lb != nil && !lb.ReadOnly {
+		if err := recordFingerprint(lb.Filename, f.Blobfile, f.Blobfile, end); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Run checks for growth of the blob file until the context is canceled,
+// starting after the part recorded as indexed, or at the current end of the
+// file. Failed syncs are logged and retried.
+func (f *Follower) Run(ctx context.Context) error {
+	interval := f.Interval
+	if interval == 0 {
+		interval = time.Second
+	}
+	offset, err := indexedSize(f.Backend, f.Blobfile)
+	if err != nil {
+		return err
+	}
+	f.offset = offset
+	for {
+		n, err := f.Sync()
+		switch {
+		case err != nil:
+			log.Printf("follow failed: %v", err)
+		case n > 0:
+			log.Printf("indexed %s appended to %s", humanBytes(n), f.Blobfile)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// indexedSize returns the size of the blob file recorded in its fingerprint,
+// or its current size, if there is none.
+func indexedSize(backend Backend, blobfile string) (int64, error) {
+	if lb := levelDBBackend(backend); lb != nil {
+		fps, err := readFingerprints(lb.Filename)
+		if err != nil {
+			return 0, err
+		}
+		if fp, ok := fps[filepath.Base(blobfile)]; ok {
+			return fp.Size, nil
+		}
+	}
+	fi, err := os.Stat(blobfile)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// lastSeparator returns the offset after the last separator between from and
+// size, from, if there is none.
+func lastSeparator(r io.ReaderAt, from, size int64, sep byte) (int64, error) {
+	buf := make([]byte, 64<<10)
+	for end := size; end > from; {
+		start := end - int64(len(buf))
+		if start < from {
+			start = from
+		}
+		b := buf[:end-start]
+		if _, err := r.ReadAt(b, start); err != nil {
+			return from, err
+		}
+		for i := len(b) - 1; i >= 0; i-- {
+			if b[i] == sep {
+				return start + int64(i) + 1, nil
+			}
+		}
+		end = start
+	}
+	return from, nil
+}
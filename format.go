@@ -0,0 +1,72 @@
+package microblob
+
+import (
+	"bufio"
+	"fmt"
+)
+
+// RecordFormat determines how records are framed in a blob file. Records end
+// with the record separator by default.
+type RecordFormat string
+
+const (
+	// FormatMARC frames binary MARC21 (ISO 2709) records by the record length
+	// in their leader.
+	FormatMARC RecordFormat = "marc"
+	// FormatMARCXML frames the record elements of MARCXML collections. The
+	// text between records, like the XML declaration and the collection
+	// tags, is part of the blob file, but not indexed.
+	FormatMARCXML RecordFormat = "marcxml"
+)
+
+// ParseRecordFormat parses a record format name, empty for separated records.
+func ParseRecordFormat(s string) (RecordFormat, error) {
+	switch f := RecordFormat(s); f {
+	case "", FormatMARC, FormatMARCXML:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown record format: %s", s)
+	}
+}
+
+// RecordFormat returns the framing of records in the blob file.
+func (b *LevelDBBackend) RecordFormat() RecordFormat { return b.Format }
+
+// RecordFormat returns the record format of the wrapped backend.
+func (b TransformBackend) RecordFormat() RecordFormat { return recordFormat(b.Backend) }
+
+// recordFormat returns the record format of a backend, separated records by
+// default.
+func recordFormat(backend Backend) RecordFormat {
+	if s, ok := backend.(interface{ RecordFormat() RecordFormat }); ok {
+		return s.RecordFormat()
+	}
+	return ""
+}
+
+// readFormatted reads the next record in the given format, or, with MARCXML,
+// the text up to the next record. Records longer than max bytes, if positive,
+// fail with ErrRecordTooLarge.
+func readFormatted(br *bufio.Reader, format RecordFormat, sep byte, max int64) ([]byte, error) {
+	switch format {
+	case FormatMARC:
+		return readMARC(br, max)
+	case FormatMARCXML:
+		return readMARCXML(br, max)
+	default:
+		return readRecord(br, sep, max)
+	}
+}
+
+// skipRecord returns true, if a section read with readFormatted holds no
+// record to index, i.e. it is blank or, with MARCXML, text between records.
+func skipRecord(b []byte, format RecordFormat, sep byte) bool {
+	switch format {
+	case FormatMARC:
+		return isBlank(b, marcRecordTerminator)
+	case FormatMARCXML:
+		return !isMARCXMLRecord(b)
+	default:
+		return isBlank(b, sep)
+	}
+}
@@ -0,0 +1,58 @@
+package microblob
+
+import (
+	"fmt"
+	"os"
+)
+
+// FsyncPolicy decides when appended data is synced to disk.
+type FsyncPolicy string
+
+// Supported fsync policies. With FsyncNone, the default, the operating system
+// decides, when data reaches the disk. FsyncBlob syncs the appended part of the
+// blob file before the index entries pointing into it are written, so after a
+// crash the index does not point to lost data. FsyncAll also syncs each write
+// to the index.
+const (
+	FsyncNone FsyncPolicy = "none"
+	FsyncBlob FsyncPolicy = "blob"
+	FsyncAll  FsyncPolicy = "all"
+)
+
+// ParseFsyncPolicy returns the policy with the given name, an empty name is
+// FsyncNone.
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	switch p := FsyncPolicy(s); p {
+	case "":
+		return FsyncNone, nil
+	case FsyncNone, FsyncBlob, FsyncAll:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown fsync policy: %s", s)
+	}
+}
+
+// FsyncPolicy returns the fsync policy of the backend.
+func (b *LevelDBBackend) FsyncPolicy() FsyncPolicy { return b.Fsync }
+
+// FsyncPolicy returns the fsync policy of the wrapped backend.
+func (b TransformBackend) FsyncPolicy() FsyncPolicy { return fsyncPolicy(b.Backend) }
+
+// fsyncPolicy returns the fsync policy of a backend, FsyncNone by default.
+func fsyncPolicy(backend Backend) FsyncPolicy {
+	if s, ok := backend.(interface{ FsyncPolicy() FsyncPolicy }); ok {
+		return s.FsyncPolicy()
+	}
+	return FsyncNone
+}
+
+// syncBlob syncs the blob file to disk, if the policy of the backend asks
+// for it, before entries pointing to the appended data are written.
+func syncBlob(backend Backend, file *os.File) error {
+	switch fsyncPolicy(backend) {
+	case FsyncBlob, FsyncAll:
+		return file.Sync()
+	default:
+		return nil
+	}
+}
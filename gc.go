@@ -0,0 +1,100 @@
+package microblob
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// BlobGarbage describes the part of a blob file, that no index entry refers
+// to, e.g. superseded, deleted and expired documents, which compaction drops.
+type BlobGarbage struct {
+	Name         string  `json:"name"`
+	Size         int64   `json:"size"`
+	Referenced   int64   `json:"referenced"`
+	Unreferenced int64   `json:"unreferenced"`
+	Ratio        float64 `json:"ratio"`   // unreferenced share of the size
+	Regions      int64   `json:"regions"` // number of unreferenced byte ranges
+	Largest      int64   `json:"largest"` // length of the largest unreferenced range
+}
+
+// GarbageReport sums up the unreferenced parts of all blob files of an index.
+type GarbageReport struct {
+	Entries      int64         `json:"entries"`
+	Size         int64         `json:"size"`
+	Referenced   int64         `json:"referenced"`
+	Unreferenced int64         `json:"unreferenced"`
+	Ratio        float64       `json:"ratio"`
+	Files        []BlobGarbage `json:"files"`
+}
+
+// byteRange is a section of a blob file.
+type byteRange struct {
+	start, end int64
+}
+
+// AnalyzeGarbage walks the entries of an index and reports, which bytes of the
+// blob files, given in the order of their file ids, the entries do not refer
+// to. Documents indexed under multiple keys and overlapping sections, like
+// the blocks of a sparse index, count once. Nothing is changed.
+func AnalyzeGarbage(src EntryIterator, names []string) (GarbageReport, error) {
+	var report GarbageReport
+	ranges := make([][]byteRange, len(names))
+	if err := (withSuppressed{src}).Entries(func(e Entry) error {
+		if e.File < 0 || e.File >= len(names) {
+			return fmt.Errorf("entry %s refers to unknown blob file %d", e.Key, e.File)
+		}
+		report.Entries++
+		ranges[e.File] = append(ranges[e.File], byteRange{e.Offset, e.Offset + e.Length})
+		return nil
+	}); err != nil {
+		return report, err
+	}
+	for i, name := range names {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return report, err
+		}
+		g := BlobGarbage{Name: name, Size: fi.Size()}
+		rs := ranges[i]
+		ranges[i] = nil
+		sort.Slice(rs, func(a, b int) bool { return rs[a].start < rs[b].start })
+		var pos int64 // end of the referenced bytes so far
+		gap := func(end int64) {
+			if end <= pos {
+				return
+			}
+			n := end - pos
+			g.Unreferenced += n
+			g.Regions++
+			if n > g.Largest {
+				g.Largest = n
+			}
+		}
+		for _, r := range rs {
+			if r.start > g.Size {
+				r.start = g.Size
+			}
+			if r.end > g.Size {
+				r.end = g.Size
+			}
+			gap(r.start)
+			if r.end > pos {
+				pos = r.end
+			}
+		}
+		gap(g.Size)
+		g.Referenced = g.Size - g.Unreferenced
+		if g.Size > 0 {
+			g.Ratio = float64(g.Unreferenced) / float64(g.Size)
+		}
+		report.Size += g.Size
+		report.Referenced += g.Referenced
+		report.Unreferenced += g.Unreferenced
+		report.Files = append(report.Files, g)
+	}
+	if report.Size > 0 {
+		report.Ratio = float64(report.Unreferenced) / float64(report.Size)
+	}
+	return report, nil
+}
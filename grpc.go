@@ -0,0 +1,238 @@
+package microblob
+
+import (
+	"context"
+	"crypto/subtle"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/miku/microblob/microblobpb"
+	"github.com/syndtr/goleveldb/leveldb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCServer implements the microblob gRPC service on top of a backend.
+type GRPCServer struct {
+	microblobpb.UnimplementedMicroblobServer
+
+	Backend  Backend
+	Blobfile string
+	// AuthToken, if set, is required as bearer token in the authorization
+	// metadata for Append and restricted documents.
+	AuthToken string
+	// ReadOnly disables Append.
+	ReadOnly bool
+	// SignedURLs, if set, restricts documents like the HTTP API. Since there
+	// are no links to sign, restricted documents require the AuthToken as
+	// bearer token and are refused, if no token is configured.
+	SignedURLs *SignedURLs
+	// Audit, if set, records each Append.
+	Audit *AuditLog
+	// BatchSize, if positive, is the number of documents indexed at once,
+	// instead of 100000.
+	BatchSize int
+}
+
+// NewGRPCServer returns a gRPC server with the microblob service registered.
+func NewGRPCServer(backend Backend, blobfile string, opts HandlerOptions, sopts ...grpc.ServerOption) *grpc.Server {
+	s := grpc.NewServer(sopts...)
+	microblobpb.RegisterMicroblobServer(s, &GRPCServer{
+		Backend:    backend,
+		Blobfile:   blobfile,
+		AuthToken:  opts.AuthToken,
+		ReadOnly:   opts.ReadOnly,
+		SignedURLs: opts.SignedURLs,
+		Audit:      opts.Audit,
+		BatchSize:  opts.BatchSize,
+	})
+	return s
+}
+
+// getError maps backend errors to gRPC status errors.
+func getError(err error) error {
+	switch err {
+	case leveldb.ErrNotFound, ErrSuppressed:
+		return status.Error(codes.NotFound, err.Error())
+	case context.Canceled, context.DeadlineExceeded:
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// Get returns the document for a key.
+func (s *GRPCServer) Get(ctx context.Context, req *microblobpb.GetRequest) (*microblobpb.GetResponse, error) {
+	if err := s.permit(ctx, req.GetKey()); err != nil {
+		return nil, err
+	}
+	b, err := GetContext(ctx, s.Backend, req.GetKey())
+	if err != nil {
+		errCounter.Add(1)
+		return nil, getError(err)
+	}
+	okCounter.Add(1)
+	return &microblobpb.GetResponse{Data: b}, nil
+}
+
+// MultiGet streams the documents for all requested keys, in order. Missing keys
+// are sent with found set to false.
+func (s *GRPCServer) MultiGet(req *microblobpb.MultiGetRequest, stream microblobpb.Microblob_MultiGetServer) error {
+	for _, key := range req.GetKeys() {
+		if err := s.permit(stream.Context(), key); err != nil {
+			return err
+		}
+	}
+	for _, key := range req.GetKeys() {
+		doc := &microblobpb.Document{Key: key}
+		b, err := GetContext(stream.Context(), s.Backend, key)
+		switch {
+		case err == nil:
+			doc.Data, doc.Found = b, true
+			okCounter.Add(1)
+		case err == leveldb.ErrNotFound, err == ErrSuppressed:
+			errCounter.Add(1)
+		default:
+			errCounter.Add(1)
+			return getError(err)
+		}
+		if err := stream.Send(doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Exists reports whether a key is indexed, without reading the document, if
+// the backend supports it.
+func (s *GRPCServer) Exists(ctx context.Context, req *microblobpb.ExistsRequest) (*microblobpb.ExistsResponse, error) {
+	if err := s.permit(ctx, req.GetKey()); err != nil {
+		return nil, err
+	}
+	ok, err := exists(ctx, s.Backend, req.GetKey())
+	if err != nil {
+		return nil, getError(err)
+	}
+	return &microblobpb.ExistsResponse{Exists: ok}, nil
+}
+
+// Append collects the streamed documents in a temporary file, then appends and
+// indexes them like /update.
+func (s *GRPCServer) Append(stream microblobpb.Microblob_AppendServer) error {
+	if s.ReadOnly {
+		return status.Error(codes.FailedPrecondition, "read-only")
+	}
+	if err := s.authorize(stream.Context()); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile("", "microblob-")
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	var (
+		keys []string
+		sep  = DefaultKeySeparator
+		n    int64
+		last byte
+	)
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if keys == nil {
+			keys = req.GetKeys()
+			if req.GetSep() != "" {
+				sep = req.GetSep()
+			}
+		}
+		data := req.GetData()
+		if len(data) == 0 {
+			continue
+		}
+		if _, err := f.Write(data); err != nil {
+			return status.Error(codes.Internal, "temporary copy failed: "+err.Error())
+		}
+		n, last = n+int64(len(data)), data[len(data)-1]
+	}
+	if len(keys) == 0 || keys[0] == "" {
+		return status.Error(codes.InvalidArgument, "append: keys required")
+	}
+	if rs := recordSeparator(s.Backend); last != rs && n > 0 {
+		if _, err := f.Write([]byte{rs}); err != nil {
+			return status.Error(codes.Internal, "temporary copy failed: "+err.Error())
+		}
+	}
+	if err := f.Close(); err != nil {
+		return status.Error(codes.Internal, "temporary file close failed: "+err.Error())
+	}
+	var extractor MultiExtractor
+	for _, key := range keys {
+		extractor.Extractors = append(extractor.Extractors, NewKeyPathExtractor(key, sep))
+	}
+	var summary AppendSummary
+	batchSize := s.BatchSize
+	if batchSize <= 0 {
+		batchSize = 100000
+	}
+	err = AppendKeysOptions(s.Blobfile, f.Name(), s.Backend, extractor.ExtractKeys, AppendOptions{BatchSize: batchSize, Summary: &summary})
+	if s.Audit != nil {
+		rec := AuditRecord{Action: AuditAppend, Blobfile: s.Blobfile, Offset: summary.Offset, Length: summary.Bytes, Keys: summary.Keys}
+		if p, ok := peer.FromContext(stream.Context()); ok {
+			if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+				rec.Client = host
+			}
+			if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.PeerCertificates) > 0 {
+				rec.User = info.State.PeerCertificates[0].Subject.CommonName
+			}
+		}
+		if err != nil {
+			rec.Error = err.Error()
+		}
+		s.Audit.record(rec)
+	}
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "append: "+err.Error())
+	}
+	return stream.SendAndClose(&microblobpb.AppendResponse{Bytes: n})
+}
+
+// authorize checks the bearer token in the request metadata, if a token is
+// configured.
+func (s *GRPCServer) authorize(ctx context.Context) error {
+	if s.AuthToken == "" {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		given, ok := bearerToken(v)
+		if ok && subtle.ConstantTimeCompare([]byte(given), []byte(s.AuthToken)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "unauthorized")
+}
+
+// permit checks, that a lookup of key may read a restricted document, see
+// SignedURLs. Restricted documents require the bearer token.
+func (s *GRPCServer) permit(ctx context.Context, key string) error {
+	if s.SignedURLs == nil || !s.SignedURLs.restrictedKey(s.Backend, key) {
+		return nil
+	}
+	if s.AuthToken == "" || s.authorize(ctx) != nil {
+		errCounter.Add(1)
+		return status.Error(codes.PermissionDenied, "restricted document, bearer token required")
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package microblob
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miku/microblob/microblobpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCSignedURLs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "microblob-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backend := &LevelDBBackend{Blobfile: filepath.Join(dir, "blob.ldj"), Filename: filepath.Join(dir, "index")}
+	defer backend.Close()
+	appendTestDocuments(t, dir, backend, `{"name": "public-1"}`, `{"name": "r-1"}`)
+
+	signed := &SignedURLs{Key: []byte("secret"), Prefixes: []string{"r-"}}
+	bearer := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer t0ken"))
+	var cases = []struct {
+		about string
+		token string
+		ctx   context.Context
+		key   string
+		code  codes.Code
+	}{
+		{"public", "", context.Background(), "public-1", codes.OK},
+		{"restricted without token configured", "", bearer, "r-1", codes.PermissionDenied},
+		{"restricted without token given", "t0ken", context.Background(), "r-1", codes.PermissionDenied},
+		{"restricted with token", "t0ken", bearer, "r-1", codes.OK},
+	}
+	for _, c := range cases {
+		t.Run(c.about, func(t *testing.T) {
+			s := &GRPCServer{Backend: backend, AuthToken: c.token, SignedURLs: signed}
+			_, err := s.Get(c.ctx, &microblobpb.GetRequest{Key: c.key})
+			if code := status.Code(err); code != c.code {
+				t.Fatalf("get: got %v, want %v", code, c.code)
+			}
+			_, err = s.Exists(c.ctx, &microblobpb.ExistsRequest{Key: c.key})
+			if code := status.Code(err); code != c.code {
+				t.Fatalf("exists: got %v, want %v", code, c.code)
+			}
+		})
+	}
+}
+
+func TestGRPCQuotas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "microblob-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backend := &LevelDBBackend{Blobfile: filepath.Join(dir, "blob.ldj"), Filename: filepath.Join(dir, "index")}
+	defer backend.Close()
+	appendTestDocuments(t, dir, backend, `{"name": "a"}`)
+
+	quotas := &Quotas{
+		Global: Quota{Period: time.Hour, Requests: 2},
+		Keys:   map[string]Quota{"k1": {Period: time.Hour, Requests: 1}},
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewGRPCServer(backend, backend.Blobfile, HandlerOptions{}, GRPCQuotas(quotas)...)
+	go s.Serve(ln)
+	defer s.Stop()
+	conn, err := grpc.NewClient(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := microblobpb.NewMicroblobClient(conn)
+
+	var cases = []struct {
+		key  string
+		code codes.Code
+	}{
+		{"k1", codes.OK},
+		{"k1", codes.ResourceExhausted},
+		{"unknown", codes.Unauthenticated},
+		{"", codes.OK},
+		{"", codes.ResourceExhausted},
+	}
+	for i, c := range cases {
+		ctx := context.Background()
+		if c.key != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", c.key)
+		}
+		_, err := client.Get(ctx, &microblobpb.GetRequest{Key: "a"})
+		if code := status.Code(err); code != c.code {
+			t.Fatalf("%d: got %v, want %v", i, code, c.code)
+		}
+	}
+}
+
+func TestGRPCIPFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "microblob-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backend := &LevelDBBackend{Blobfile: filepath.Join(dir, "blob.ldj"), Filename: filepath.Join(dir, "index")}
+	defer backend.Close()
+	appendTestDocuments(t, dir, backend, `{"name": "a"}`)
+
+	filter, err := ParseIPFilter([]string{"10.1.0.0/16"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewGRPCServer(backend, backend.Blobfile, HandlerOptions{}, GRPCIPFilter(filter))
+	go s.Serve(ln)
+	defer s.Stop()
+	conn, err := grpc.NewClient(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := microblobpb.NewMicroblobClient(conn)
+
+	if _, err := client.Get(context.Background(), &microblobpb.GetRequest{Key: "a"}); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	stream, err := client.Append(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&microblobpb.AppendRequest{Keys: []string{"name"}, Data: []byte(`{"name": "b"}` + "\n")}); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if _, err := stream.CloseAndRecv(); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("append: got %v, want %v", status.Code(err), codes.PermissionDenied)
+	}
+}
@@ -1,38 +1,59 @@
 package microblob
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"expvar"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
 )
 
 var (
 	okCounter        *expvar.Int
 	errCounter       *expvar.Int
 	lastResponseTime *expvar.Float
+	routeLatency     *Latencies // recent request latencies per route
+	stageLatency     *Latencies // recent latencies of index lookups and blob reads
 )
 
-// finalNewlineReader appends a final newline to a byte stream, but only if there is not already one.
+// finalNewlineReader appends a final newline or other record separator to a
+// byte stream, but only if there is not already one.
 type finalNewlineReader struct {
 	r    io.Reader
+	sep  byte // defaults to newline
 	done bool // true, when r has been fully read
 }
 
 func (r *finalNewlineReader) Read(p []byte) (n int, err error) {
+	sep := r.sep
+	if sep == 0 {
+		sep = 10
+	}
 	if r.done {
 		if len(p) > 0 {
-			p[0] = 10
+			p[0] = sep
 			return 1, io.EOF
 		}
 		return 0, nil
 	}
 	n, err = r.r.Read(p)
-	if err == io.EOF && (n == 0 || p[n-1] != 10) {
+	if err == io.EOF && (n == 0 || p[n-1] != sep) {
 		r.done = true
 		return n, nil
 	}
@@ -50,15 +71,90 @@ func WithLastResponseTime(h http.Handler) http.Handler {
 	return http.HandlerFunc(f)
 }
 
+// WithRequestTimeout gives each request a deadline, after which lookups are
+// given up and answered with 503, so a stalled disk read does not hold the
+// request forever. A zero duration disables the deadline.
+func WithRequestTimeout(d time.Duration, h http.Handler) http.Handler {
+	if d <= 0 {
+		return h
+	}
+	f := func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	}
+	return http.HandlerFunc(f)
+}
+
+// failureStatus returns the status for a failed operation, 503, if the
+// request ran out of time, 500 otherwise.
+func failureStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// timedOut reports, whether the deadline of a request passed. A request
+// cancelled by the client does not count.
+func timedOut(r *http.Request) bool {
+	return r.Context().Err() == context.DeadlineExceeded
+}
+
+// bearerToken returns the token of an Authorization header value with the
+// Bearer scheme, matched case-insensitively. Values without scheme fail.
+func bearerToken(v string) (string, bool) {
+	v = strings.TrimSpace(v)
+	i := strings.IndexAny(v, " \t")
+	if i < 0 || !strings.EqualFold(v[:i], "Bearer") {
+		return "", false
+	}
+	token := strings.TrimSpace(v[i+1:])
+	return token, token != ""
+}
+
+// WithAuthToken requires a bearer token in the Authorization header. An empty
+// token disables the check.
+func WithAuthToken(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+	f := func(w http.ResponseWriter, r *http.Request) {
+		given, ok := bearerToken(r.Header.Get("Authorization"))
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="microblob"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(f)
+}
+
 // BlobHandler serves blobs.
 type BlobHandler struct {
-	Backend Backend
+	Backend     Backend
+	ContentType string      // defaults to application/json
+	HotKeys     *HotKeys    // counts lookups per key, if not nil
+	Fallback    *Fallback   // asked for keys missing locally, if not nil
+	StreamSize  int64       // if positive, documents of at least this length are copied from the blob file
+	WithKey     bool        // add the key to JSON documents, unless the request has withkey=0
+	KeyField    string      // field the key is added under, defaults to _key
+	Headers     HeaderRules // content type and headers by key prefix, if not nil
+	NotFound    *NotFound   // answers misses with a JSON error, if not nil
+	ScanOnMiss  *ScanOnMiss // scans the blob file for keys missing from the index, if not nil
+	ChunkSize   int64       // if positive, larger documents are written in chunks of this size, flushed after each
 }
 
 // ServeHTTP serves HTTP.
 func (h *BlobHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	contentType := h.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
 	w.Header().Set("X-Blob", Version)
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Accept-Ranges", "bytes")
 	vars := mux.Vars(r)
 	key, ok := vars["key"]
 	if !ok || key == "blob/" {
@@ -75,36 +171,848 @@ func (h *BlobHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	b, err := h.Backend.Get(key)
+	if h.HotKeys != nil {
+		h.HotKeys.Add(key)
+	}
+	h.Headers.apply(w.Header(), key)
+	if v := r.URL.Query().Get("version"); v != "" && ok {
+		h.serveVersion(w, r, key, v)
+		return
+	}
+	if v := r.URL.Query().Get("envelope"); v == "1" || v == "true" {
+		h.serveEnvelope(w, r, key)
+		return
+	}
+	fields := parseFields(r.URL.Query().Get("fields"))
+	v := r.URL.Query().Get("pretty")
+	pretty := v == "1" || v == "true"
+	withKey := h.WithKey
+	switch r.URL.Query().Get("withkey") {
+	case "1", "true":
+		withKey = true
+	case "0", "false":
+		withKey = false
+	}
+	transformed := len(fields) > 0 || pretty || withKey
+	if l, ok := h.Backend.(Locator); ok {
+		if entry, err := l.Locate(key); err == nil {
+			etag := entryTag(h.Backend, entry)
+			if len(fields) > 0 {
+				etag = fieldsTag(etag, fields)
+			}
+			if pretty {
+				etag = strings.TrimSuffix(etag, `"`) + `-pretty"`
+			}
+			if withKey {
+				etag = strings.TrimSuffix(etag, `"`) + `-withkey"`
+			}
+			w.Header().Set("ETag", etag)
+			if matchesTag(r.Header.Get("If-None-Match"), etag) {
+				w.WriteHeader(http.StatusNotModified)
+				okCounter.Add(1)
+				return
+			}
+			if r.Method == "HEAD" && recordSeparator(h.Backend) == '\n' && !transformed {
+				// Answer from the index, without reading the blob.
+				length := entry.Length
+				if entry.Size > 0 {
+					length = entry.Size
+				}
+				w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+				okCounter.Add(1)
+				return
+			}
+			// Ranges of a document are read from the blob file, as are
+			// large documents, with -stream-size.
+			stream := h.StreamSize > 0 && entry.Length >= h.StreamSize
+			if (stream || r.Header.Get("Range") != "") && !transformed {
+				if h.serveSection(w, r, key) {
+					return
+				}
+			}
+		}
+	}
+	b, err := GetContext(r.Context(), h.Backend, key)
+	if err == leveldb.ErrNotFound && h.Fallback != nil {
+		if b, err = h.Fallback.Get(r.Context(), key); err != nil && err != leveldb.ErrNotFound {
+			w.Header().Del("ETag")
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(err.Error()))
+			errCounter.Add(1)
+			return
+		}
+		if err == nil {
+			w.Header().Set("X-Fallback", "true")
+		}
+	}
+	if err == leveldb.ErrNotFound && h.ScanOnMiss != nil {
+		if b, err = h.ScanOnMiss.Get(r.Context(), key); err == nil {
+			w.Header().Set("X-Scan-On-Miss", "true")
+		}
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
+		w.Header().Del("ETag")
+		errCounter.Add(1)
+		if h.NotFound != nil && lookupStatus(err) == http.StatusNotFound {
+			h.NotFound.write(w, h.Backend, key, err)
+			return
+		}
+		w.WriteHeader(lookupStatus(err))
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if len(fields) > 0 {
+		if b, err = projectFields(b, fields); err != nil {
+			w.Header().Del("ETag")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(err.Error()))
+			errCounter.Add(1)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+	}
+	if withKey {
+		field := h.KeyField
+		if field == "" {
+			field = "_key"
+		}
+		if b, err = injectKey(b, field, key); err != nil {
+			w.Header().Del("ETag")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(err.Error()))
+			errCounter.Add(1)
+			return
+		}
+	}
+	if pretty {
+		b = prettyJSON(b)
+	}
+	if r.Header.Get("Range") != "" {
+		// Answers with 206 or 416, honoring If-Range with the ETag.
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+		okCounter.Add(1)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	switch {
+	case r.Method == "HEAD":
+	case h.ChunkSize > 0 && int64(len(b)) > h.ChunkSize:
+		writeChunks(r.Context(), w, bytes.NewReader(b), int64(len(b)), h.ChunkSize)
+	default:
+		w.Write(b)
+	}
+	okCounter.Add(1)
+}
+
+// lookupStatus returns the status code for a failed lookup of a document.
+// Documents over the size limit point to a corrupt index or record, not a
+// missing key.
+func lookupStatus(err error) int {
+	switch {
+	case err == ErrSuppressed:
+		return http.StatusGone
+	case errors.Is(err, ErrRecordTooLarge), errors.Is(err, ErrCRCMismatch):
+		return http.StatusInternalServerError
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusNotFound
+	}
+}
+
+// putStatus returns the status code for a failed append of a document put to
+// a key. A document, that the duplicate policy does not allow to replace the
+// indexed one, is a conflict.
+func putStatus(err error) int {
+	if errors.Is(err, ErrKeyExists) || errors.Is(err, ErrDuplicateKey) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// serveVersion writes the document with the given version number for a key.
+func (h *BlobHandler) serveVersion(w http.ResponseWriter, r *http.Request, key, version string) {
+	n, err := strconv.ParseInt(version, 10, 64)
+	if err != nil || n < 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid version: " + version))
+		errCounter.Add(1)
+		return
+	}
+	v, ok := h.Backend.(Versioner)
+	if !ok {
+		http.Error(w, "not implemented", http.StatusNotFound)
+		errCounter.Add(1)
+		return
+	}
+	b, err := v.GetVersion(key, n)
+	if err != nil {
+		w.WriteHeader(lookupStatus(err))
 		w.Write([]byte(err.Error()))
 		errCounter.Add(1)
 		return
 	}
-	w.Write(b)
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	if r.Method != "HEAD" {
+		w.Write(b)
+	}
 	okCounter.Add(1)
 }
 
-// UpdateHandler adds more data to the blob server.
-type UpdateHandler struct {
+// VersionsHandler lists the retained versions of the document for a key.
+type VersionsHandler struct {
+	Backend Backend
+}
+
+// ServeHTTP returns the versions as JSON, newest first, each with version
+// number, offset and length, which can be requested with the version
+// parameter.
+func (h *VersionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v, ok := h.Backend.(Versioner)
+	if !ok {
+		http.Error(w, "not implemented", http.StatusNotFound)
+		return
+	}
+	versions, err := v.Versions(mux.Vars(r)["key"])
+	switch {
+	case err == ErrNotImplemented:
+		http.Error(w, "not implemented", http.StatusNotFound)
+		return
+	case err == ErrSuppressed:
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	case err == leveldb.ErrNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	type version struct {
+		Version int64 `json:"version"`
+		Offset  int64 `json:"offset"`
+		Length  int64 `json:"length"`
+		File    int   `json:"file,omitempty"`
+	}
+	result := make([]version, len(versions))
+	for i, e := range versions {
+		result[i] = version{Version: e.Version, Offset: e.Offset, Length: e.Length, File: e.File}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"versions": result}); err != nil {
+		http.Error(w, "could not serialize", http.StatusInternalServerError)
+		return
+	}
+}
+
+// ExistsHandler checks, whether a key exists.
+type ExistsHandler struct {
+	Backend Backend
+}
+
+// ServeHTTP responds with 200, if the key exists and 404 otherwise, without a
+// body and without reading the blob.
+func (h *ExistsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Blob", Version)
+	ok, err := exists(r.Context(), h.Backend, mux.Vars(r)["key"])
+	switch {
+	case err != nil:
+		w.WriteHeader(failureStatus(err))
+		errCounter.Add(1)
+	case !ok:
+		w.WriteHeader(http.StatusNotFound)
+		errCounter.Add(1)
+	default:
+		w.WriteHeader(http.StatusOK)
+		okCounter.Add(1)
+	}
+}
+
+// entryTag returns an entity tag for an entry. Since blob files are append
+// only, the blob file, offset and length identify the content, as long as the
+// file is not replaced, which changes its generation, see Generationer.
+func entryTag(backend Backend, e Entry) string {
+	if g, ok := backend.(Generationer); ok {
+		if gen, err := g.Generation(e.File); err == nil && gen != "" {
+			return fmt.Sprintf(`"%s-%x-%x-%x"`, gen, e.File, e.Offset, e.Length)
+		}
+	}
+	return fmt.Sprintf(`"%x-%x-%x"`, e.File, e.Offset, e.Length)
+}
+
+// matchesTag returns true, if the value of an If-None-Match header matches the
+// given entity tag.
+func matchesTag(header, etag string) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == "*" || v == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// BatchHandler serves multiple blobs at once.
+type BatchHandler struct {
+	Backend Backend
+}
+
+// ServeHTTP reads a JSON array of keys or newline separated keys from the
+// request body and streams back the matching documents as newline delimited
+// JSON. Keys not found are reported as JSON array in the X-Missing-Keys trailer.
+// With detail=1, a JSON object maps each key to its document or error.
+func (h *BatchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	keys, err := readKeys(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		errCounter.Add(1)
+		return
+	}
+	if v := r.URL.Query().Get("detail"); v == "1" || v == "true" {
+		h.serveDetail(w, r, keys)
+		return
+	}
+	w.Header().Set("X-Blob", Version)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Trailer", "X-Missing-Keys")
+	var (
+		missing = []string{}
+		written bool
+	)
+	for _, key := range keys {
+		b, err := GetContext(r.Context(), h.Backend, key)
+		if timedOut(r) && !written {
+			http.Error(w, "request timeout", http.StatusServiceUnavailable)
+			errCounter.Add(1)
+			return
+		}
+		if r.Context().Err() != nil {
+			return // Client went away or, after the first document, time ran out.
+		}
+		if err != nil {
+			missing = append(missing, key)
+			errCounter.Add(1)
+			continue
+		}
+		if _, err := w.Write(b); err != nil {
+			return
+		}
+		written = true
+		if !bytes.HasSuffix(b, []byte("\n")) {
+			w.Write([]byte("\n"))
+		}
+		okCounter.Add(1)
+	}
+	v, err := json.Marshal(missing)
+	if err != nil {
+		return
+	}
+	w.Header().Set("X-Missing-Keys", string(v))
+}
+
+// batchResult is the outcome of the lookup of a key, with detail=1. The status
+// is the one a lookup of the key alone would have, e.g. 404 for a missing
+// key and 500 for a read error.
+type batchResult struct {
+	Status   int         `json:"status"`
+	Document interface{} `json:"document,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// serveDetail writes a JSON object mapping each key to its result. Documents,
+// that are not JSON, are included as string.
+func (h *BatchHandler) serveDetail(w http.ResponseWriter, r *http.Request, keys []string) {
+	results := make(map[string]batchResult, len(keys))
+	for _, key := range keys {
+		if _, ok := results[key]; ok {
+			continue
+		}
+		b, err := GetContext(r.Context(), h.Backend, key)
+		if timedOut(r) {
+			http.Error(w, "request timeout", http.StatusServiceUnavailable)
+			errCounter.Add(1)
+			return
+		}
+		if r.Context().Err() != nil {
+			return // Client went away.
+		}
+		if err != nil {
+			results[key] = batchResult{Status: lookupStatus(err), Error: err.Error()}
+			errCounter.Add(1)
+			continue
+		}
+		result := batchResult{Status: http.StatusOK}
+		if trimmed := bytes.TrimSpace(b); json.Valid(trimmed) {
+			result.Document = json.RawMessage(trimmed)
+		} else {
+			result.Document = string(b)
+		}
+		results[key] = result
+		okCounter.Add(1)
+	}
+	w.Header().Set("X-Blob", Version)
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(results); err != nil {
+		errCounter.Add(1)
+	}
+}
+
+// readKeys reads a JSON array of keys or newline separated keys.
+func readKeys(r io.Reader) ([]string, error) {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		if err := json.Unmarshal(body, &keys); err != nil {
+			return nil, fmt.Errorf("invalid key list: %v", err)
+		}
+		return keys, nil
+	}
+	for _, line := range strings.Split(string(body), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			keys = append(keys, line)
+		}
+	}
+	return keys, nil
+}
+
+// defaultMaxExistsKeys is the number of keys, that can be checked at once.
+const defaultMaxExistsKeys = 100000
+
+// ExistsFilterHandler checks, which of a list of keys exist.
+type ExistsFilterHandler struct {
+	Backend Backend
+	MaxKeys int // defaults to 100000
+}
+
+// ServeHTTP reads a JSON array of keys or newline separated keys from the
+// request body and responds with the keys found and the keys missing, using
+// only the index.
+func (h *ExistsFilterHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	keys, err := readKeys(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		errCounter.Add(1)
+		return
+	}
+	max := h.MaxKeys
+	if max == 0 {
+		max = defaultMaxExistsKeys
+	}
+	if len(keys) > max {
+		http.Error(w, fmt.Sprintf("too many keys, at most %d allowed", max), http.StatusRequestEntityTooLarge)
+		errCounter.Add(1)
+		return
+	}
+	result := struct {
+		Found   []string `json:"found"`
+		Missing []string `json:"missing"`
+	}{Found: []string{}, Missing: []string{}}
+	for _, key := range keys {
+		ok, err := exists(r.Context(), h.Backend, key)
+		if timedOut(r) {
+			http.Error(w, "request timeout", http.StatusServiceUnavailable)
+			errCounter.Add(1)
+			return
+		}
+		if r.Context().Err() != nil {
+			return // Client went away.
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			errCounter.Add(1)
+			return
+		}
+		if ok {
+			result.Found = append(result.Found, key)
+		} else {
+			result.Missing = append(result.Missing, key)
+		}
+	}
+	w.Header().Set("X-Blob", Version)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		return
+	}
+	okCounter.Add(1)
+}
+
+// defaultPageSize is the number of keys or blobs returned per page.
+const defaultPageSize = 1000
+
+// parsePage returns limit and start key from limit and cursor query parameters.
+// The cursor is opaque to clients, it is the URL safe base64 encoded last key
+// of the previous page.
+func parsePage(r *http.Request) (limit int, start string, err error) {
+	limit = defaultPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			return 0, "", fmt.Errorf("invalid limit: %s", v)
+		}
+	}
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		b, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil {
+			return 0, "", fmt.Errorf("invalid cursor: %s", v)
+		}
+		start = string(b)
+	}
+	return limit, start, nil
+}
+
+// nextCursor returns the cursor for the page following keys, or the empty
+// string, if there are no more pages.
+func nextCursor(keys []string, limit int) string {
+	if len(keys) < limit || len(keys) == 0 {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(keys[len(keys)-1]))
+}
+
+// PrefixHandler streams blobs for all keys with a given prefix.
+type PrefixHandler struct {
+	Backend Backend
+}
+
+// ServeHTTP streams up to limit blobs as newline delimited JSON. If there are
+// more results, the cursor for the next page is sent in the X-Next-Cursor header.
+func (h *PrefixHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	lister, ok := h.Backend.(KeyLister)
+	if !ok {
+		http.Error(w, "not implemented", http.StatusNotFound)
+		return
+	}
+	limit, start, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		errCounter.Add(1)
+		return
+	}
+	keys, err := lister.Keys(mux.Vars(r)["prefix"], start, limit)
+	if err == ErrNotImplemented {
+		http.Error(w, "not implemented", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		errCounter.Add(1)
+		return
+	}
+	w.Header().Set("X-Blob", Version)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if cursor := nextCursor(keys, limit); cursor != "" {
+		w.Header().Set("X-Next-Cursor", cursor)
+	}
+	// Listed keys are stored keys, which must not be transformed again.
+	stored := storedBackend(h.Backend)
+	for _, key := range keys {
+		b, err := GetContext(r.Context(), stored, key)
+		if r.Context().Err() != nil {
+			return // Client went away.
+		}
+		if err != nil {
+			errCounter.Add(1)
+			continue
+		}
+		if _, err := w.Write(b); err != nil {
+			return
+		}
+		if !bytes.HasSuffix(b, []byte("\n")) {
+			w.Write([]byte("\n"))
+		}
+		okCounter.Add(1)
+	}
+}
+
+// KeysHandler lists keys in lexicographic order.
+type KeysHandler struct {
+	Backend Backend
+}
+
+// ServeHTTP returns a page of keys as JSON, along with a cursor for the next
+// page, which is empty on the last page.
+func (h *KeysHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	lister, ok := h.Backend.(KeyLister)
+	if !ok {
+		http.Error(w, "not implemented", http.StatusNotFound)
+		return
+	}
+	limit, start, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	keys, err := lister.Keys(r.URL.Query().Get("prefix"), start, limit)
+	if err == ErrNotImplemented {
+		http.Error(w, "not implemented", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys":   keys,
+		"cursor": nextCursor(keys, limit),
+	}); err != nil {
+		http.Error(w, "could not serialize", http.StatusInternalServerError)
+		return
+	}
+}
+
+// DeleteHandler removes keys.
+type DeleteHandler struct {
+	Backend  Backend
+	Blobfile string    // recorded in the audit log
+	Audit    *AuditLog // records each deletion, if not nil
+}
+
+// ServeHTTP removes the key from the backend.
+func (h *DeleteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	rec := auditRecord(r, AuditDelete, h.Blobfile)
+	rec.Key = key
+	d, ok := h.Backend.(Deleter)
+	if !ok {
+		http.Error(w, "not implemented", http.StatusMethodNotAllowed)
+		return
+	}
+	err := d.Delete(key)
+	switch {
+	case err == ErrNotImplemented:
+		http.Error(w, "not implemented", http.StatusMethodNotAllowed)
+		return
+	case err == leveldb.ErrNotFound:
+		rec.Status = http.StatusNotFound
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		rec.Status = http.StatusInternalServerError
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		rec.Status, rec.Keys = http.StatusNoContent, 1
+		w.WriteHeader(http.StatusNoContent)
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	h.Audit.record(rec)
+}
+
+// PutHandler adds a single document under a given key.
+type PutHandler struct {
 	Blobfile string
 	Backend  Backend
+	TTL      time.Duration // default TTL of the key, overridden by a ttl parameter
+	Audit    *AuditLog     // records each document put, if not nil
+}
+
+// ServeHTTP appends the JSON document from the request body to the blob file
+// and indexes it under the key from the URL. Responds with 409 Conflict, if the
+// duplicate policy keeps the document indexed already.
+func (h PutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	key := mux.Vars(r)["key"]
+	ttl, err := requestTTL(r.URL.Query(), h.TTL)
+	if err != nil {
+		http.Error(w, "put: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	doc, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !json.Valid(doc) {
+		http.Error(w, "put: invalid JSON", http.StatusBadRequest)
+		return
+	}
+	rec := auditRecord(r, AuditPut, h.Blobfile)
+	rec.Key = key
+	if err := AppendDocumentTTL(h.Blobfile, h.Backend, key, doc, ttl); err != nil {
+		rec.Status, rec.Error = putStatus(err), err.Error()
+		h.Audit.record(rec)
+		http.Error(w, "put: "+err.Error(), rec.Status)
+		return
+	}
+	rec.Status, rec.Keys = http.StatusCreated, 1
+	if l, ok := h.Backend.(Locator); ok && h.Audit != nil {
+		if entry, err := l.Locate(key); err == nil {
+			rec.Offset, rec.Length = entry.Offset, entry.Length
+		}
+	}
+	h.Audit.record(rec)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// ExportHandler streams all documents.
+type ExportHandler struct {
+	Backend Backend
+}
+
+// ServeHTTP writes all indexed documents as newline delimited JSON.
+func (h *ExportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e, ok := h.Backend.(Exporter)
+	if !ok {
+		http.Error(w, "not implemented", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("X-Blob", Version)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if err := e.Export(w); err != nil {
+		// Headers are likely sent already, so we can only log.
+		log.Printf("export failed (request %s): %v", RequestID(r.Context()), err)
+	}
+}
+
+// DumpHandler streams the index.
+type DumpHandler struct {
+	Backend Backend
+}
+
+// ServeHTTP writes all entries in the flat index format, in key order, e.g. to
+// compare indexes with the diff command.
+func (h *DumpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	src, ok := h.Backend.(EntryIterator)
+	if !ok {
+		http.Error(w, "not implemented", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("X-Blob", Version)
+	w.Header().Set("Content-Type", "text/tab-separated-values")
+	if _, err := WriteFlatIndex(w, src); err != nil {
+		log.Printf("dump failed (request %s): %v", RequestID(r.Context()), err)
+	}
 }
 
-// ServeHTTP appends data from POST body to existing blob file.
+// SnapshotHandler streams a consistent backup of blob files and index.
+type SnapshotHandler struct {
+	Backend Backend
+}
+
+// ServeHTTP writes a tar archive, that can be extracted and served.
+func (h *SnapshotHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s, ok := h.Backend.(Snapshotter)
+	if !ok {
+		http.Error(w, "not implemented", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("X-Blob", Version)
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", `attachment; filename="microblob-snapshot.tar"`)
+	if err := s.Snapshot(w); err != nil {
+		// Headers are likely sent already, so we can only log.
+		log.Printf("snapshot failed (request %s): %v", RequestID(r.Context()), err)
+	}
+}
+
+// UpdateHandler adds more data to the blob server.
+type UpdateHandler struct {
+	Blobfile    string
+	Backend     Backend
+	URLPrefixes []string      // allowed prefixes of URLs to fetch, none if empty
+	Webhook     *Webhook      // notified after each successful update, if not nil
+	TTL         time.Duration // default TTL of appended keys, overridden by a ttl parameter
+	Appends     *AppendLog    // records each successful update, if not nil
+	Dedup       bool          // store documents repeated within an update only once
+	BatchSize   int           // documents indexed at once, defaults to 100000
+	Queue       *AppendQueue  // if set, updates are spooled and appended in the background
+	Audit       *AuditLog     // records each update, if not nil
+}
+
+// notify records the update and calls the webhook in the background, failures
+// are only logged.
+func (u UpdateHandler) notify(s AppendSummary, started time.Time) {
+	elapsed := time.Since(started)
+	u.Appends.Add(s, elapsed)
+	if u.Webhook == nil {
+		return
+	}
+	go func() {
+		if err := u.Webhook.Notify(context.Background(), u.Blobfile, s, elapsed); err != nil {
+			log.Printf("webhook failed: %v", err)
+		}
+	}()
+}
+
+// ServeHTTP appends data from POST body to existing blob file. Bodies can be
+// gzip or zstd compressed, see requestBody. With a url parameter, the file is
+// fetched from there instead, if the URL is allowed. A ttl parameter sets the
+// TTL of the appended keys, 0 for keys, that never expire. With an If-Match
+// header, holding the size or tag of the blob file, the update only succeeds,
+// if no other writer appended in between, otherwise it fails with 412. The
+// tag after the update is sent in the ETag header. With a queue, the update is
+// spooled and a 202 response with the job is sent at once, see AppendQueue.
 func (u UpdateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	key := r.URL.Query().Get("key")
-	if key == "" {
+	var (
+		started = time.Now()
+		summary AppendSummary
+		failure error // reason of a failed append, for the audit log
+		rec     = auditRecord(r, AuditUpdate, u.Blobfile)
+		sw      = &statusWriter{ResponseWriter: w}
+	)
+	w = sw
+	if u.Audit != nil {
+		defer func() {
+			rec.Source, rec.Offset, rec.Length, rec.Keys = r.URL.Query().Get("url"), summary.Offset, summary.Bytes, summary.Keys
+			if rec.Status = sw.status; rec.Status == 0 {
+				rec.Status = http.StatusOK
+			}
+			if failure != nil {
+				rec.Error = failure.Error()
+			}
+			u.Audit.record(rec)
+		}()
+	}
+	extractor, opts, err := u.options(r.URL.Query(), r.Header.Get("If-Match"), &summary)
+	if err != nil {
+		failure = err
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("update: key query parameter required"))
+		w.Write([]byte("update: " + err.Error()))
 		return
 	}
-	extractor := ParsingExtractor{Key: key}
+	link := r.URL.Query().Get("url")
+	if link != "" && !allowedURL(link, u.URLPrefixes) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("update: url not allowed"))
+		return
+	}
+	if u.Queue != nil {
+		rec.Job = u.enqueue(w, r, link != "")
+		return
+	}
+	if link != "" {
+		if err := AppendURL(r.Context(), nil, u.Blobfile, link, u.Backend, extractor.ExtractKeys, opts); err != nil {
+			failure = err
+			w.WriteHeader(appendStatus(err))
+			w.Write([]byte("append: " + err.Error()))
+			return
+		}
+		u.setTag(w)
+		u.notify(summary, started)
+		return
+	}
+
+	body, err := requestBody(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		w.Write([]byte("update: " + err.Error()))
+		return
+	}
+	defer body.Close()
 
 	f, err := ioutil.TempFile("", "microblob-")
 	if err != nil {
@@ -112,7 +1020,7 @@ func (u UpdateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(err.Error()))
 		return
 	}
-	if _, err := io.Copy(f, &finalNewlineReader{r: r.Body}); err != nil {
+	if _, err := io.Copy(f, &finalNewlineReader{r: body, sep: recordSeparator(u.Backend)}); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("temporary copy failed: " + err.Error()))
 		return
@@ -125,16 +1033,226 @@ func (u UpdateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("temporary file close failed: " + err.Error()))
 	}
 
-	if err := Append(u.Blobfile, f.Name(), u.Backend, extractor.ExtractKey); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	if err := AppendKeysOptions(u.Blobfile, f.Name(), u.Backend, extractor.ExtractKeys, opts); err != nil {
+		failure = err
+		w.WriteHeader(appendStatus(err))
 		w.Write([]byte("append: " + err.Error()))
 		return
 	}
-	return
+	u.setTag(w)
+	u.notify(summary, started)
+}
+
+// options returns the key extractor and append options for the query and
+// precondition of an update.
+func (u UpdateHandler) options(q url.Values, ifMatch string, summary *AppendSummary) (MultiExtractor, AppendOptions, error) {
+	extractor, err := updateExtractor(q, recordFormat(u.Backend))
+	if err != nil {
+		return extractor, AppendOptions{}, err
+	}
+	ttl, err := requestTTL(q, u.TTL)
+	if err != nil {
+		return extractor, AppendOptions{}, err
+	}
+	opts := AppendOptions{BatchSize: u.BatchSize, Summary: summary, TTL: ttl, IfMatch: ifMatch}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100000
+	}
+	if u.Dedup {
+		opts.Dedup = NewDedupSet()
+	}
+	return extractor, opts, nil
+}
+
+// enqueue spools the body of an update, if it does not name a URL to fetch,
+// and responds with the queued job. Returns the ID of the job, empty, if it
+// could not be queued.
+func (u UpdateHandler) enqueue(w http.ResponseWriter, r *http.Request, fetch bool) string {
+	var body io.Reader = strings.NewReader("")
+	if !fetch {
+		rc, err := requestBody(r)
+		if err != nil {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			w.Write([]byte("update: " + err.Error()))
+			return ""
+		}
+		defer rc.Close()
+		body = &finalNewlineReader{r: rc, sep: recordSeparator(u.Backend)}
+	}
+	job, err := u.Queue.Enqueue(body, r.URL.RawQuery, r.Header.Get("If-Match"))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("update: spooling failed: " + err.Error()))
+		return ""
+	}
+	// Relative to /update, so it works under a path prefix, too.
+	w.Header().Set("Location", "jobs/"+job.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+	return job.ID
+}
+
+// appendJob appends and indexes a queued update.
+func (u UpdateHandler) appendJob(job Job, body string) (AppendSummary, error) {
+	var (
+		started = time.Now()
+		summary AppendSummary
+	)
+	q, err := url.ParseQuery(job.Query)
+	if err != nil {
+		return summary, err
+	}
+	extractor, opts, err := u.options(q, job.IfMatch, &summary)
+	if err != nil {
+		return summary, err
+	}
+	link := q.Get("url")
+	if link != "" {
+		err = AppendURL(context.Background(), nil, u.Blobfile, link, u.Backend, extractor.ExtractKeys, opts)
+	} else {
+		err = AppendKeysOptions(u.Blobfile, body, u.Backend, extractor.ExtractKeys, opts)
+	}
+	if u.Audit != nil {
+		rec := AuditRecord{Action: AuditUpdate, Blobfile: u.Blobfile, Job: job.ID, Source: link, Offset: summary.Offset, Length: summary.Bytes, Keys: summary.Keys, Status: http.StatusOK}
+		if err != nil {
+			rec.Status, rec.Error = appendStatus(err), err.Error()
+		}
+		u.Audit.record(rec)
+	}
+	if err != nil {
+		return summary, err
+	}
+	u.notify(summary, started)
+	return summary, nil
+}
+
+// requestBody returns the body of a request, decompressed according to the
+// Content-Encoding header or, without one, if it starts with the gzip or zstd
+// magic number.
+func requestBody(r *http.Request) (io.ReadCloser, error) {
+	coding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	if coding == "" {
+		return NewDecompressReader(r.Body)
+	}
+	return decodeContent(r.Body, coding)
+}
+
+// setTag sends the current tag of the blob file in the ETag header, so the
+// next update can use it as precondition.
+func (u UpdateHandler) setTag(w http.ResponseWriter) {
+	if tag, err := BlobTag(u.Blobfile); err == nil {
+		w.Header().Set("ETag", `"`+tag+`"`)
+	}
+}
+
+// appendStatus returns the status code for a failed append.
+func appendStatus(err error) int {
+	if errors.Is(err, ErrPreconditionFailed) {
+		return http.StatusPreconditionFailed
+	}
+	return http.StatusBadRequest
+}
+
+// requestTTL returns the TTL given in the ttl query parameter, as duration,
+// e.g. 24h, or the default.
+func requestTTL(q url.Values, def time.Duration) (time.Duration, error) {
+	v := q.Get("ttl")
+	if v == "" {
+		return def, nil
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil || ttl < 0 {
+		return 0, fmt.Errorf("invalid ttl: %s", v)
+	}
+	return ttl, nil
+}
+
+// updateExtractor returns an extractor for the key, pattern or column query
+// parameters, which mirror the -key, -r, -column and -key-template flags. Key
+// and pattern can be repeated. With MARC records, keys name fields, 001 by default.
+func updateExtractor(q url.Values, format RecordFormat) (extractor MultiExtractor, err error) {
+	if format == FormatMARC || format == FormatMARCXML {
+		fields := q["key"]
+		if len(fields) == 0 {
+			fields = []string{"001"}
+		}
+		for _, field := range fields {
+			if _, _, err := marcField(field); err != nil {
+				return extractor, err
+			}
+			if format == FormatMARC {
+				extractor.Extractors = append(extractor.Extractors, MARCExtractor{Field: field})
+			} else {
+				extractor.Extractors = append(extractor.Extractors, MARCXMLExtractor{Field: field})
+			}
+		}
+		return extractor, nil
+	}
+	sep := q.Get("sep")
+	if sep == "" {
+		sep = DefaultKeySeparator
+	}
+	for _, key := range q["key"] {
+		if key != "" {
+			extractor.Extractors = append(extractor.Extractors, NewKeyPathExtractor(key, sep))
+		}
+	}
+	for _, pattern := range q["pattern"] {
+		if pattern == "" {
+			continue
+		}
+		p, err := regexp.Compile(pattern)
+		if err != nil {
+			return extractor, fmt.Errorf("invalid pattern: %v", err)
+		}
+		extractor.Extractors = append(extractor.Extractors, RegexpExtractor{Pattern: p})
+	}
+	if v := q.Get("column"); v != "" {
+		column, err := strconv.Atoi(v)
+		if err != nil || column < 1 {
+			return extractor, fmt.Errorf("invalid column: %s", v)
+		}
+		delimiter := q.Get("delimiter")
+		if delimiter == "" {
+			delimiter = "\t"
+		}
+		extractor.Extractors = append(extractor.Extractors, ColumnExtractor{Delimiter: delimiter, Column: column})
+	}
+	for _, path := range q["xml-path"] {
+		if path != "" {
+			extractor.Extractors = append(extractor.Extractors, XMLExtractor{Path: path})
+		}
+	}
+	if text := q.Get("key-template"); text != "" {
+		t, err := NewTemplateExtractor(text)
+		if err != nil {
+			return extractor, err
+		}
+		extractor.Extractors = append(extractor.Extractors, t)
+	}
+	for _, spec := range q["extractor"] {
+		if spec == "" {
+			continue
+		}
+		e, err := NewExtractor(spec)
+		if err != nil {
+			return extractor, err
+		}
+		extractor.Extractors = append(extractor.Extractors, e)
+	}
+	if len(extractor.Extractors) == 0 {
+		return extractor, fmt.Errorf("key, pattern, column, xml-path, key-template or extractor query parameter required")
+	}
+	return extractor, nil
 }
 
 func init() {
 	okCounter = expvar.NewInt("okCounter")
 	errCounter = expvar.NewInt("errCounter")
 	lastResponseTime = expvar.NewFloat("lastResponseTime")
+	routeLatency = NewLatencies()
+	stageLatency = NewLatencies()
+	expvar.Publish("routeLatency", expvar.Func(func() interface{} { return routeLatency.Summary() }))
+	expvar.Publish("stageLatency", expvar.Func(func() interface{} { return stageLatency.Summary() }))
 }
@@ -0,0 +1,121 @@
+package microblob
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// appendTestDocuments writes documents to a file in dir and appends it to the
+// blob file blob.ldj in dir, with keys taken from the name field.
+func appendTestDocuments(t *testing.T, dir string, backend Backend, docs ...string) {
+	t.Helper()
+	fn := filepath.Join(dir, "docs.ldj")
+	if err := ioutil.WriteFile(fn, []byte(strings.Join(docs, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	kf := ParsingExtractor{Key: "name"}
+	if err := AppendBatchSize(filepath.Join(dir, "blob.ldj"), fn, backend, kf.ExtractKey, 100, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrefixHandlerTransform(t *testing.T) {
+	lower, err := ParseKeyTransform("lower")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha1, err := ParseKeyHash("sha1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		about     string
+		transform KeyTransform
+		hashed    bool
+		status    int
+		body      string
+	}{
+		{"lower", lower, false, http.StatusOK, "{\"name\": \"ABC-1\"}\n{\"name\": \"abc-2\"}\n"},
+		{"sha1", sha1, true, http.StatusNotFound, "not implemented\n"},
+		{"lower,sha1", ChainTransforms(lower, sha1), true, http.StatusNotFound, "not implemented\n"},
+	}
+	for _, c := range cases {
+		t.Run(c.about, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "microblob-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			lb := &LevelDBBackend{Blobfile: filepath.Join(dir, "blob.ldj"), Filename: filepath.Join(dir, "index")}
+			backend := TransformBackend{Backend: lb, Transform: c.transform, Hashed: c.hashed}
+			defer backend.Close()
+			appendTestDocuments(t, dir, backend, `{"name": "ABC-1"}`, `{"name": "abc-2"}`, `{"name": "x-3"}`)
+
+			r := mux.NewRouter()
+			r.Handle("/prefix/{prefix:.+}", &PrefixHandler{Backend: backend})
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "/prefix/ABC", nil))
+			if w.Code != c.status {
+				t.Fatalf("got %d, want %d", w.Code, c.status)
+			}
+			if got := w.Body.String(); got != c.body {
+				t.Fatalf("got %q, want %q", got, c.body)
+			}
+		})
+	}
+}
+
+func TestEntryTagAfterCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "microblob-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backend := &LevelDBBackend{Blobfile: filepath.Join(dir, "blob.ldj"), Filename: filepath.Join(dir, "index")}
+	defer backend.Close()
+	appendTestDocuments(t, dir, backend, `{"name":"a","v":1}`, `{"name": "b"}`)
+
+	r := mux.NewRouter()
+	r.Handle("/{key}", &BlobHandler{Backend: backend})
+	get := func(etag string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/a", nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+	before := get("").Header().Get("ETag")
+	if w := get(before); w.Code != http.StatusNotModified {
+		t.Fatalf("got %d, want %d", w.Code, http.StatusNotModified)
+	}
+	// The new version of a has the same length and moves to the start of the
+	// blob file on compaction, where the old one was.
+	if err := backend.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := AppendDocument(backend.Blobfile, backend, "a", []byte(`{"name": "a", "v": 2}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := backend.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	w := get(before)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := w.Body.String(); got != "{\"name\":\"a\",\"v\":2}\n" {
+		t.Fatalf("got %q", got)
+	}
+	if after := w.Header().Get("ETag"); after == before {
+		t.Fatalf("tag %s kept after compaction", after)
+	}
+}
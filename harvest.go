@@ -0,0 +1,146 @@
+package microblob
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Harvester periodically fetches a feed of documents and appends and indexes
+// the documents, that were not part of the previous fetch, so feeds covering
+// overlapping time windows can be harvested. A feed, that did not change
+// according to ETag or Last-Modified, is not fetched again. Harvests never
+// overlap, as the next one starts only after the previous has completed.
+type Harvester struct {
+	URL      string
+	Blobfile string
+	Backend  Backend
+	KeysFunc KeysFunc
+	Options  AppendOptions
+	Interval time.Duration // time between harvests, defaults to 1h
+	Client   *http.Client  // defaults to http.DefaultClient
+
+	etag, modified string
+	seen           map[uint64]bool // hashes of the documents of the last fetch
+}
+
+// Harvest fetches the feed and appends new documents, returns the number of
+// documents appended and skipped.
+func (h *Harvester) Harvest(ctx context.Context) (appended, skipped int64, err error) {
+	req, err := http.NewRequest("GET", h.URL, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	if h.etag != "" {
+		req.Header.Set("If-None-Match", h.etag)
+	}
+	if h.modified != "" {
+		req.Header.Set("If-Modified-Since", h.modified)
+	}
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return 0, 0, nil
+	case http.StatusOK:
+	default:
+		return 0, 0, fmt.Errorf("harvest %s failed: %s", h.URL, resp.Status)
+	}
+	body, err := responseBody(resp)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer body.Close()
+	sep := recordSeparator(h.Backend)
+	r := &newRecordReader{
+		br:   bufio.NewReader(body),
+		sep:  sep,
+		prev: h.seen,
+		seen: make(map[uint64]bool),
+	}
+	if err := AppendReader(h.Blobfile, r, h.Backend, h.KeysFunc, h.Options); err != nil {
+		return 0, 0, err
+	}
+	h.seen = r.seen
+	h.etag, h.modified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	return r.appended, r.skipped, nil
+}
+
+// Run harvests until the context is canceled. Failed harvests are logged and
+// retried after the interval.
+func (h *Harvester) Run(ctx context.Context) error {
+	interval := h.Interval
+	if interval == 0 {
+		interval = time.Hour
+	}
+	for {
+		appended, skipped, err := h.Harvest(ctx)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			log.Printf("harvest failed: %v", err)
+		case appended > 0 || skipped > 0:
+			log.Printf("harvested %d new documents from %s, skipped %d seen before", appended, h.URL, skipped)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// newRecordReader passes on records, that are not in prev, and records the
+// hashes of all records read. Each record ends with the separator.
+type newRecordReader struct {
+	br                *bufio.Reader
+	sep               byte
+	prev, seen        map[uint64]bool
+	buf               []byte
+	err               error
+	appended, skipped int64
+}
+
+func (r *newRecordReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		var record []byte
+		record, r.err = r.br.ReadBytes(r.sep)
+		if r.err != nil && r.err != io.EOF {
+			return 0, r.err
+		}
+		if isBlank(record, r.sep) {
+			continue
+		}
+		if record[len(record)-1] != r.sep {
+			record = append(record, r.sep)
+		}
+		h := fnv.New64a()
+		h.Write(record)
+		sum := h.Sum64()
+		r.seen[sum] = true
+		if r.prev[sum] {
+			r.skipped++
+			continue
+		}
+		r.buf = record
+		r.appended++
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,82 @@
+package microblob
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// HeaderRule sets the response headers for documents, whose keys start with
+// Prefix, e.g. application/xml for keys starting with xml:, so a store can
+// hold records in mixed formats from different pipelines. ContentType replaces
+// the default content type, Headers are sent in addition.
+type HeaderRule struct {
+	Prefix      string
+	ContentType string `yaml:"content-type"`
+	Headers     map[string]string
+}
+
+// HeaderRules are the header rules of a handler, the first rule, whose prefix
+// a key starts with, applies.
+type HeaderRules []HeaderRule
+
+// ParseHeaderRules checks the rules and returns them with canonical header
+// names. No rules yield nil.
+func ParseHeaderRules(rules []HeaderRule) (HeaderRules, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	var parsed HeaderRules
+	for i, rule := range rules {
+		if rule.Prefix == "" {
+			return nil, fmt.Errorf("header rule %d: prefix required", i+1)
+		}
+		if rule.ContentType == "" && len(rule.Headers) == 0 {
+			return nil, fmt.Errorf("header rule %d: content-type or headers required", i+1)
+		}
+		if rule.ContentType != "" {
+			if _, _, err := mime.ParseMediaType(rule.ContentType); err != nil {
+				return nil, fmt.Errorf("header rule %d: invalid content type: %v", i+1, err)
+			}
+		}
+		headers := make(map[string]string, len(rule.Headers))
+		for name, value := range rule.Headers {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" || strings.ContainsAny(name, " :\r\n") || strings.ContainsAny(value, "\r\n") {
+				return nil, fmt.Errorf("header rule %d: invalid header: %q", i+1, name)
+			}
+			if name == "Content-Type" {
+				return nil, fmt.Errorf("header rule %d: use content-type to set the content type", i+1)
+			}
+			headers[name] = value
+		}
+		rule.Headers = headers
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
+
+// Match returns the first rule for a key, false, if there is none.
+func (rules HeaderRules) Match(key string) (HeaderRule, bool) {
+	for _, rule := range rules {
+		if strings.HasPrefix(key, rule.Prefix) {
+			return rule, true
+		}
+	}
+	return HeaderRule{}, false
+}
+
+// apply sets the headers of the rule matching a key, if any.
+func (rules HeaderRules) apply(h http.Header, key string) {
+	rule, ok := rules.Match(key)
+	if !ok {
+		return
+	}
+	if rule.ContentType != "" {
+		h.Set("Content-Type", rule.ContentType)
+	}
+	for name, value := range rule.Headers {
+		h.Set(name, value)
+	}
+}
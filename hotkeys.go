@@ -0,0 +1,127 @@
+package microblob
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	sketchDepth = 4       // rows of the count-min sketch
+	sketchWidth = 1 << 16 // counters per row
+)
+
+// KeyCount is the approximate number of lookups of a key.
+type KeyCount struct {
+	Key   string  `json:"key"`
+	Count uint64  `json:"count"`
+	Share float64 `json:"share"` // of all lookups
+	Rate  float64 `json:"rate"`  // lookups per second
+}
+
+// HotKeys tracks the most frequently looked up keys. Counts are estimated with
+// a count-min sketch, so they may be too high, but never too low; only the
+// current top keys are kept. Safe for concurrent use.
+type HotKeys struct {
+	mu      sync.Mutex
+	n       int
+	sketch  [sketchDepth][]uint64
+	top     map[string]uint64
+	minKey  string // key with the smallest count in top
+	total   uint64
+	started time.Time
+}
+
+// NewHotKeys returns a tracker for the n most frequently looked up keys.
+func NewHotKeys(n int) *HotKeys {
+	k := &HotKeys{n: n, top: make(map[string]uint64), started: time.Now()}
+	for i := range k.sketch {
+		k.sketch[i] = make([]uint64, sketchWidth)
+	}
+	return k
+}
+
+// Add counts a lookup of a key.
+func (k *HotKeys) Add(key string) {
+	h1, h2 := keyHashes(key)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.total++
+	var est uint64
+	for i := range k.sketch {
+		j := (h1 + uint64(i)*h2) % sketchWidth
+		k.sketch[i][j]++
+		if v := k.sketch[i][j]; i == 0 || v < est {
+			est = v
+		}
+	}
+	_, ok := k.top[key]
+	if !ok && len(k.top) >= k.n {
+		if est <= k.top[k.minKey] {
+			return
+		}
+		delete(k.top, k.minKey)
+	}
+	k.top[key] = est
+	if !ok || key == k.minKey {
+		k.minKey = ""
+		for t, c := range k.top {
+			if k.minKey == "" || c < k.top[k.minKey] {
+				k.minKey = t
+			}
+		}
+	}
+}
+
+// Top returns the keys looked up most often, most frequent first.
+func (k *HotKeys) Top() []KeyCount {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	elapsed := time.Since(k.started).Seconds()
+	result := make([]KeyCount, 0, len(k.top))
+	for key, count := range k.top {
+		result = append(result, KeyCount{
+			Key:   key,
+			Count: count,
+			Share: float64(count) / float64(k.total),
+			Rate:  float64(count) / elapsed,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
+
+// ServeHTTP serves the top keys as JSON, at most n, if given as parameter.
+func (k *HotKeys) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	top := k.Top()
+	if v := r.URL.Query().Get("n"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid n", http.StatusBadRequest)
+			return
+		}
+		if n < len(top) {
+			top = top[:n]
+		}
+	}
+	k.mu.Lock()
+	total, started := k.total, k.started
+	k.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"since": started.Format(time.RFC3339),
+		"total": total,
+		"keys":  top,
+	}); err != nil {
+		http.Error(w, "could not serialize", http.StatusInternalServerError)
+		return
+	}
+}
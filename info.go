@@ -0,0 +1,109 @@
+package microblob
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Info summarizes a blob file and its index.
+type Info struct {
+	Backend    string     `json:"backend"`
+	Keys       int64      `json:"keys"`
+	BlobSize   int64      `json:"blob_size"`
+	BlobTag    string     `json:"blob_tag,omitempty"` // tag of the blob file appends go to, see BlobTag
+	IndexSize  int64      `json:"index_size"`
+	LastAppend *time.Time `json:"last_append,omitempty"`
+}
+
+// ReadInfo collects information about the backend and the blob file. Counting
+// keys iterates over the whole index. The time of the last append is the
+// modification time of the blob file, since the file is only ever appended to.
+func ReadInfo(backend Backend, blobfile string) (Info, error) {
+	info := Info{Backend: backendName(backend)}
+	if c, ok := backend.(Counter); ok {
+		n, err := c.Count()
+		if err != nil && err != ErrNotImplemented {
+			return info, err
+		}
+		info.Keys = n
+	}
+	if s, ok := backend.(IndexSizer); ok {
+		size, err := s.IndexSize()
+		if err != nil && err != ErrNotImplemented {
+			return info, err
+		}
+		info.IndexSize = size
+	}
+	var names []string
+	if blobfile != "" {
+		tag, err := BlobTag(blobfile)
+		if err != nil {
+			return info, err
+		}
+		info.BlobTag = tag
+		names = append(names, blobfile)
+		if lb := levelDBBackend(backend); lb != nil {
+			names = append(names, lb.Blobfiles...)
+		}
+	}
+	for _, name := range names {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return info, err
+		}
+		info.BlobSize += fi.Size()
+		if t := fi.ModTime(); info.LastAppend == nil || t.After(*info.LastAppend) {
+			info.LastAppend = &t
+		}
+	}
+	return info, nil
+}
+
+// backendName returns a short name for the type of a backend.
+func backendName(backend Backend) string {
+	switch b := backend.(type) {
+	case *LevelDBBackend:
+		return "leveldb"
+	case DebugBackend:
+		return "debug"
+	case TransformBackend:
+		return backendName(b.Backend)
+	default:
+		return "unknown"
+	}
+}
+
+// levelDBBackend returns the LevelDB backend, possibly wrapped in a transform,
+// or nil.
+func levelDBBackend(backend Backend) *LevelDBBackend {
+	switch b := backend.(type) {
+	case *LevelDBBackend:
+		return b
+	case TransformBackend:
+		return levelDBBackend(b.Backend)
+	default:
+		return nil
+	}
+}
+
+// InfoHandler serves information about the blob file and index.
+type InfoHandler struct {
+	Backend  Backend
+	Blobfile string
+}
+
+// ServeHTTP serves the information as JSON.
+func (h *InfoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	info, err := ReadInfo(h.Backend, h.Blobfile)
+	if err != nil {
+		http.Error(w, "info failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		http.Error(w, "could not serialize", http.StatusInternalServerError)
+		return
+	}
+}
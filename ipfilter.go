@@ -0,0 +1,119 @@
+package microblob
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/miku/microblob/microblobpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// IPFilter allows or denies clients by their address, e.g. to restrict
+// updates to the subnet of an ingest pipeline. Requests on unix domain
+// sockets are always allowed, file permissions guard those.
+type IPFilter struct {
+	Allow []*net.IPNet // if not empty, only clients in these networks are allowed
+	Deny  []*net.IPNet // clients in these networks are denied, even if allowed
+}
+
+// ParseIPFilter returns a filter for lists of networks in CIDR notation, like
+// 10.1.0.0/16, or single addresses.
+func ParseIPFilter(allow, deny []string) (*IPFilter, error) {
+	parse := func(list []string) ([]*net.IPNet, error) {
+		var nets []*net.IPNet
+		for _, s := range list {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			if !strings.Contains(s, "/") {
+				ip := net.ParseIP(s)
+				if ip == nil {
+					return nil, fmt.Errorf("invalid address: %s", s)
+				}
+				bits := 128
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network: %s", s)
+			}
+			nets = append(nets, n)
+		}
+		return nets, nil
+	}
+	var (
+		f   IPFilter
+		err error
+	)
+	if f.Allow, err = parse(allow); err != nil {
+		return nil, err
+	}
+	if f.Deny, err = parse(deny); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// Allowed returns true, if the client of a request is allowed.
+func (f *IPFilter) Allowed(r *http.Request) bool {
+	if _, ok := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr); ok {
+		return true
+	}
+	return f.allowedAddr(r.RemoteAddr)
+}
+
+// allowedAddr returns true, if a client with the address, host and port, is
+// allowed.
+func (f *IPFilter) allowedAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range f.Deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.Allow) == 0 {
+		return true
+	}
+	for _, n := range f.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// GRPCIPFilter returns a server option, that lets only clients allowed by the
+// filter call Append, the update of the gRPC API, and fails other calls of it
+// with PermissionDenied. Calls on unix domain sockets are always allowed.
+func GRPCIPFilter(f *IPFilter) grpc.ServerOption {
+	return grpc.ChainStreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if info.FullMethod != microblobpb.Microblob_Append_FullMethodName {
+			return handler(srv, ss)
+		}
+		p, ok := peer.FromContext(ss.Context())
+		if !ok {
+			return status.Error(codes.PermissionDenied, "forbidden")
+		}
+		if _, unix := p.Addr.(*net.UnixAddr); !unix && !f.allowedAddr(p.Addr.String()) {
+			return status.Error(codes.PermissionDenied, "forbidden")
+		}
+		return handler(srv, ss)
+	})
+}
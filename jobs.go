@@ -0,0 +1,290 @@
+package microblob
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// Job states.
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// defaultJobKeep is how long finished jobs are kept, if not set.
+const defaultJobKeep = 24 * time.Hour
+
+// Job is an update, that is appended and indexed in the background.
+type Job struct {
+	ID       string     `json:"id"`
+	State    string     `json:"state"`
+	Query    string     `json:"query,omitempty"`    // query of the update request, e.g. key=id
+	IfMatch  string     `json:"if_match,omitempty"` // precondition of the update request
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Keys     int64      `json:"keys"`
+	Bytes    int64      `json:"bytes"`
+	Status   int        `json:"status,omitempty"` // HTTP status the update would have had, if it failed
+	Error    string     `json:"error,omitempty"`
+}
+
+// AppendQueue spools updates to a directory and appends and indexes them in
+// the background, one at a time, in the order received. For each job, the
+// directory holds its state in ID.json and, until it is finished, the
+// uploaded data in ID.body, so jobs survive a restart; jobs interrupted by a
+// restart run again.
+type AppendQueue struct {
+	Dir  string
+	Keep time.Duration // finished jobs are removed after this long, 24 hours by default
+
+	mu      sync.Mutex
+	pending []string
+	wake    chan struct{}
+	once    sync.Once
+}
+
+// NewAppendQueue returns a queue spooling to dir, which is created, if it
+// does not exist.
+func NewAppendQueue(dir string) (*AppendQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &AppendQueue{Dir: dir, wake: make(chan struct{}, 1)}, nil
+}
+
+// path returns the name of a file of a job.
+func (q *AppendQueue) path(id, ext string) string {
+	return filepath.Join(q.Dir, id+ext)
+}
+
+// validJobID allows the IDs created by newJobID only, so they can be used as
+// file names.
+func validJobID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// newJobID returns an ID, that sorts by creation time.
+func newJobID() string {
+	return fmt.Sprintf("%016x-%.8s", time.Now().UnixNano(), newRequestID())
+}
+
+// Job returns the state of a job.
+func (q *AppendQueue) Job(id string) (Job, error) {
+	var job Job
+	if !validJobID(id) {
+		return job, os.ErrNotExist
+	}
+	b, err := ioutil.ReadFile(q.path(id, ".json"))
+	if err != nil {
+		return job, err
+	}
+	err = json.Unmarshal(b, &job)
+	return job, err
+}
+
+// save writes the state of a job, replacing the previous one atomically.
+func (q *AppendQueue) save(job Job) error {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	tmp := q.path(job.ID, ".json.tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path(job.ID, ".json"))
+}
+
+// Enqueue spools the data of an update, which can be empty for updates with a
+// url parameter, and queues the job. The data is synced to disk, before the
+// job is queued.
+func (q *AppendQueue) Enqueue(r io.Reader, query, ifMatch string) (Job, error) {
+	job := Job{ID: newJobID(), State: JobQueued, Query: query, IfMatch: ifMatch, Created: time.Now()}
+	f, err := os.OpenFile(q.path(job.ID, ".body"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return job, err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = q.save(job)
+	}
+	if err != nil {
+		os.Remove(q.path(job.ID, ".body"))
+		return job, err
+	}
+	q.push(job.ID)
+	return job, nil
+}
+
+// push adds a job to the pending jobs and wakes the worker.
+func (q *AppendQueue) push(id string) {
+	q.mu.Lock()
+	q.pending = append(q.pending, id)
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the next pending job, false, if there is none.
+func (q *AppendQueue) pop() (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		return "", false
+	}
+	id := q.pending[0]
+	q.pending = q.pending[1:]
+	return id, true
+}
+
+// Start requeues the unfinished jobs found in the directory, then starts the
+// worker running jobs with the given function, which returns what an update
+// appended. Later calls do nothing.
+func (q *AppendQueue) Start(run func(job Job, body string) (AppendSummary, error)) error {
+	var err error
+	q.once.Do(func() {
+		if q.wake == nil {
+			q.wake = make(chan struct{}, 1)
+		}
+		var names []string
+		if names, err = filepath.Glob(filepath.Join(q.Dir, "*.json")); err != nil {
+			return
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			job, jerr := q.Job(strings.TrimSuffix(filepath.Base(name), ".json"))
+			if jerr != nil {
+				log.Printf("skipping job %s: %v", name, jerr)
+				continue
+			}
+			if job.State == JobQueued || job.State == JobRunning {
+				q.pending = append(q.pending, job.ID)
+			}
+		}
+		if len(q.pending) > 0 {
+			log.Printf("resuming %d queued updates from %s", len(q.pending), q.Dir)
+		}
+		go q.work(run)
+	})
+	return err
+}
+
+// work runs pending jobs, waiting for new ones, if there are none.
+func (q *AppendQueue) work(run func(job Job, body string) (AppendSummary, error)) {
+	for {
+		id, ok := q.pop()
+		if !ok {
+			<-q.wake
+			continue
+		}
+		if err := q.runJob(id, run); err != nil {
+			log.Printf("job %s: %v", id, err)
+		}
+		q.prune()
+	}
+}
+
+// runJob runs a job and records its outcome.
+func (q *AppendQueue) runJob(id string, run func(job Job, body string) (AppendSummary, error)) error {
+	job, err := q.Job(id)
+	if err != nil {
+		return err
+	}
+	started := time.Now()
+	job.State, job.Started = JobRunning, &started
+	if err := q.save(job); err != nil {
+		return err
+	}
+	body := q.path(id, ".body")
+	summary, err := run(job, body)
+	finished := time.Now()
+	job.Finished, job.Keys, job.Bytes = &finished, summary.Keys, summary.Bytes
+	if err != nil {
+		job.State, job.Error, job.Status = JobFailed, err.Error(), appendStatus(err)
+		log.Printf("queued update %s failed: %v", id, err)
+	} else {
+		job.State = JobDone
+	}
+	if err := q.save(job); err != nil {
+		return err
+	}
+	return os.Remove(body)
+}
+
+// prune removes finished jobs older than Keep.
+func (q *AppendQueue) prune() {
+	keep := q.Keep
+	if keep <= 0 {
+		keep = defaultJobKeep
+	}
+	names, err := filepath.Glob(filepath.Join(q.Dir, "*.json"))
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		job, err := q.Job(strings.TrimSuffix(filepath.Base(name), ".json"))
+		if err != nil || job.Finished == nil || time.Since(*job.Finished) < keep {
+			continue
+		}
+		os.Remove(name)
+	}
+}
+
+// ServeHTTP serves the state of the job given as id route variable.
+func (q *AppendQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	job, err := q.Job(mux.Vars(r)["id"])
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
@@ -0,0 +1,229 @@
+package microblob
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// journalFile is the file in the index directory, that journals the append in
+// progress.
+const journalFile = "JOURNAL"
+
+// Journaler can journal the changes an append makes to the index, so an
+// append interrupted by a crash is rolled back, when the index is opened
+// again, and a failed append leaves no entries pointing to the truncated part
+// of the blob file behind.
+type Journaler interface {
+	// BeginAppend starts journaling an append to the given blob file.
+	BeginAppend(blob string) error
+	// EndAppend stops journaling, after undoing the changes to the index and
+	// truncating the blob file to its size before the append, if rollback is
+	// true.
+	EndAppend(rollback bool) error
+}
+
+// journalRecord is a line of the journal. The first line names the blob file
+// and its size before the append, each following line holds the location of
+// an entry written and the value its key had in the index before, empty, if
+// the key was new.
+type journalRecord struct {
+	Blob   string `json:"blob,omitempty"`
+	Start  int64  `json:"start,omitempty"`
+	Key    []byte `json:"key,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+	Length int64  `json:"length,omitempty"`
+	Prev   []byte `json:"prev,omitempty"`
+}
+
+// appendJournal is the journal of the append in progress.
+type appendJournal struct {
+	f   *os.File
+	enc *json.Encoder
+}
+
+// BeginAppend creates the journal for an append to the blob file, if the
+// backend journals appends. Appends to the same index are journaled one at a
+// time.
+func (b *LevelDBBackend) BeginAppend(blob string) error {
+	if !b.Journal || b.ReadOnly || b.Shared != nil {
+		return nil
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if err := b.openDatabase(); err != nil {
+		return err
+	}
+	name, err := filepath.Abs(blob)
+	if err != nil {
+		return err
+	}
+	var start int64
+	if fi, err := os.Stat(name); err == nil {
+		start = fi.Size()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	b.journalMu.Lock()
+	defer b.journalMu.Unlock()
+	if b.journal != nil {
+		return errors.New("another append is journaled")
+	}
+	f, err := os.Create(filepath.Join(b.Filename, journalFile))
+	if err != nil {
+		return err
+	}
+	j := &appendJournal{f: f, enc: json.NewEncoder(f)}
+	if err := j.enc.Encode(journalRecord{Blob: name, Start: start}); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	b.journal = j
+	return nil
+}
+
+// EndAppend removes the journal of the append in progress, after rolling the
+// append back, if requested.
+func (b *LevelDBBackend) EndAppend(rollback bool) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	b.journalMu.Lock()
+	defer b.journalMu.Unlock()
+	j := b.journal
+	if j == nil {
+		return nil
+	}
+	b.journal = nil
+	if err := j.f.Close(); err != nil {
+		return err
+	}
+	if !rollback {
+		return os.Remove(filepath.Join(b.Filename, journalFile))
+	}
+	if b.Cache != nil {
+		b.Cache.Purge()
+	}
+	if b.Misses != nil {
+		b.Misses.Purge()
+	}
+	_, err := recoverJournal(b.db, b.Filename)
+	return err
+}
+
+// journalEntries records the entries about to be written and the previous
+// values of their keys, synced to disk, if an append is journaled.
+func (b *LevelDBBackend) journalEntries(entries []Entry) error {
+	b.journalMu.Lock()
+	defer b.journalMu.Unlock()
+	if b.journal == nil {
+		return nil
+	}
+	for _, entry := range entries {
+		key := b.dbKey(entry.Key)
+		prev, err := b.db.Get(key, nil)
+		if err != nil && err != leveldb.ErrNotFound {
+			return err
+		}
+		rec := journalRecord{Key: key, Offset: entry.Offset, Length: entry.Length, Prev: prev}
+		if err := b.journal.enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	return b.journal.f.Sync()
+}
+
+// BeginAppend starts journaling in the wrapped backend.
+func (b TransformBackend) BeginAppend(blob string) error { return beginAppend(b.Backend, blob) }
+
+// EndAppend stops journaling in the wrapped backend.
+func (b TransformBackend) EndAppend(rollback bool) error { return endAppend(b.Backend, rollback) }
+
+// beginAppend starts journaling an append, if the backend supports it.
+func beginAppend(backend Backend, blob string) error {
+	if j, ok := backend.(Journaler); ok {
+		return j.BeginAppend(blob)
+	}
+	return nil
+}
+
+// endAppend stops journaling an append, if the backend supports it.
+func endAppend(backend Backend, rollback bool) error {
+	if j, ok := backend.(Journaler); ok {
+		return j.EndAppend(rollback)
+	}
+	return nil
+}
+
+// recoverJournal rolls back the append journaled in an index directory, if
+// any: keys written by it get their previous values back, new keys are
+// removed, the blob file is truncated to its size before the append and the
+// journal is removed. A last line cut short belongs to entries, that were
+// never written. Returns the number of entries rolled back.
+func recoverJournal(db *leveldb.DB, dir string) (int, error) {
+	name := filepath.Join(dir, journalFile)
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var (
+		head    journalRecord
+		records []journalRecord
+	)
+	br := bufio.NewReader(f)
+	for i := 0; ; i++ {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			break // Incomplete or no line.
+		}
+		var rec journalRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return 0, fmt.Errorf("invalid journal %s: line %d: %v", name, i+1, err)
+		}
+		if i == 0 {
+			head = rec
+			continue
+		}
+		records = append(records, rec)
+	}
+	if head.Blob != "" {
+		batch := new(leveldb.Batch)
+		for i := len(records) - 1; i >= 0; i-- {
+			if rec := records[i]; len(rec.Prev) > 0 {
+				batch.Put(rec.Key, rec.Prev)
+			} else {
+				batch.Delete(rec.Key)
+			}
+		}
+		if err := db.Write(batch, &opt.WriteOptions{Sync: true}); err != nil {
+			return 0, err
+		}
+		fi, err := os.Stat(head.Blob)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return 0, err
+		case fi.Size() > head.Start:
+			if err := os.Truncate(head.Blob, head.Start); err != nil {
+				return 0, err
+			}
+		}
+		log.Printf("rolled back append to %s: %d entries, truncated to %d bytes", head.Blob, len(records), head.Start)
+	}
+	f.Close()
+	return len(records), os.Remove(name)
+}
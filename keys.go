@@ -4,16 +4,20 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"reflect"
 	"regexp"
 	"runtime"
+	"strings"
 	"sync"
+	"text/template"
 	"time"
 
-	"github.com/schollz/progressbar"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -25,6 +29,24 @@ type KeyExtractor interface {
 // KeyFunc extracts a key from a blob.
 type KeyFunc func([]byte) (string, error)
 
+// ExtractKey calls f, so a function can be used as KeyExtractor.
+func (f KeyFunc) ExtractKey(b []byte) (string, error) { return f(b) }
+
+// KeysFunc extracts any number of keys from a blob, so the same blob can be
+// retrieved under any of its identifiers.
+type KeysFunc func([]byte) ([]string, error)
+
+// SingleKey turns a KeyFunc into a KeysFunc.
+func SingleKey(f KeyFunc) KeysFunc {
+	return func(b []byte) ([]string, error) {
+		key, err := f(b)
+		if err != nil {
+			return nil, err
+		}
+		return []string{key}, nil
+	}
+}
+
 // EntryWriter writes entries to some storage, e.g. a file or a database.
 type EntryWriter func(entries []Entry) error
 
@@ -33,10 +55,20 @@ type LineProcessor struct {
 	r                 io.Reader   // input data
 	f                 KeyFunc     // extracts a string key from a byte blob
 	w                 EntryWriter // serializes entries
+	KeysFunc          KeysFunc    // extracts multiple keys, takes precedence over f
 	BatchSize         int         // number of lines in a batch
+	MaxBatchBytes     int64       // if positive, a batch is also cut, before it would grow beyond this many bytes
+	MaxRecordSize     int64       // if positive, longer records fail with ErrRecordTooLarge
 	InitialOffset     int64       // allow offsets beside zero
 	Verbose           bool
-	IgnoreMissingKeys bool // skip document with missing keys
+	IgnoreMissingKeys bool         // skip document with missing keys
+	Workers           int          // number of key extraction workers, defaults to the number of CPUs
+	Progress          io.Writer    // receives periodic progress reports, if not nil
+	File              int          // blob file id recorded in entries
+	Separator         byte         // terminates records, defaults to newline
+	BrokenReport      io.Writer    // if set, documents failing key extraction are skipped and reported as TSV: line, offset, error
+	CRC               bool         // if set, entries carry the CRC of their record
+	Format            RecordFormat // frames records, if not separated
 }
 
 // NewLineProcessor reads lines from the given reader, extracts the key with the
@@ -52,16 +84,68 @@ func NewLineProcessorBatchSize(r io.Reader, w EntryWriter, f KeyFunc, size int)
 	return LineProcessor{r: r, w: w, f: f, BatchSize: size}
 }
 
+// batchFull returns true, if a record of size n would push a non-empty batch
+// of size blen over MaxBatchBytes. A single record larger than the limit still
+// makes up a batch of its own.
+func (p LineProcessor) batchFull(blen int64, n, count int) bool {
+	return p.MaxBatchBytes > 0 && count > 0 && blen+int64(n) > p.MaxBatchBytes
+}
+
+// separator returns the record separator.
+func (p LineProcessor) separator() byte {
+	if p.Separator == 0 {
+		return '\n'
+	}
+	return p.Separator
+}
+
+// keys returns the keys for a document.
+func (p LineProcessor) keys(b []byte) ([]string, error) {
+	b = trimSeparator(b, p.separator())
+	if p.KeysFunc != nil {
+		return p.KeysFunc(b)
+	}
+	key, err := p.f(b)
+	if err != nil {
+		return nil, err
+	}
+	return []string{key}, nil
+}
+
 // workPackage is a unit of work handed to a worker.
 type workPackage struct {
 	docs   [][]byte // list of documents to work on
 	offset int64    // offset to start with
+	line   int64    // number of the first document, 1-based
+}
+
+// brokenReport reports documents, that failed key extraction, to a writer
+// shared by multiple workers.
+type brokenReport struct {
+	mu sync.Mutex
+	w  io.Writer
+	n  int64
+}
+
+// add reports a document.
+func (r *brokenReport) add(line, offset int64, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.n++
+	fmt.Fprintf(r.w, "%d\t%d\t%s\n", line, offset, strings.Join(strings.Fields(err.Error()), " "))
 }
 
-// RunWithWorkers start processing the input, uses multiple workers.
+// RunWithWorkers start processing the input, uses multiple workers. Documents
+// are only held in memory batch by batch: the batch being read and one per
+// worker, so with MaxBatchBytes set, about (Workers+2) * MaxBatchBytes bytes of
+// documents are buffered at most, independent of the size of the input.
 func (p LineProcessor) RunWithWorkers() error {
 
 	var processingErr error
+	var report *brokenReport
+	if p.BrokenReport != nil {
+		report = &brokenReport{w: p.BrokenReport}
+	}
 
 	// Setup communication channels.
 	work := make(chan workPackage)
@@ -89,8 +173,19 @@ func (p LineProcessor) RunWithWorkers() error {
 		for pkg := range queue {
 			offset := pkg.offset
 			var entries []Entry
-			for _, b := range pkg.docs {
-				key, err := p.f(b)
+			for i, b := range pkg.docs {
+				length := int64(len(b))
+				if skipRecord(b, p.Format, p.separator()) {
+					// Skipped, but part of the offsets.
+					offset += length
+					continue
+				}
+				keys, err := p.keys(b)
+				if err != nil && report != nil {
+					report.add(pkg.line+int64(i), offset, err)
+					offset += length
+					continue
+				}
 				if err != nil {
 					if p.Verbose {
 						log.Printf("worker error: %v", err)
@@ -98,14 +193,20 @@ func (p LineProcessor) RunWithWorkers() error {
 					if p.IgnoreMissingKeys {
 						if p.Verbose {
 							log.Printf("ignoring missing key at offset: %d", offset)
-							continue
 						}
+						offset += length
+						continue
 					}
 					processingErr = err
 					break
 				}
-				length := int64(len(b))
-				entries = append(entries, Entry{key, offset, length})
+				var crc uint32
+				if p.CRC {
+					crc = sectionCRC(b)
+				}
+				for _, key := range keys {
+					entries = append(entries, Entry{Key: key, Offset: offset, Length: length, File: p.File, CRC: crc})
+				}
 				offset += length
 			}
 			updates <- entries
@@ -120,7 +221,11 @@ func (p LineProcessor) RunWithWorkers() error {
 
 	var wg sync.WaitGroup
 
-	for i := 0; i < runtime.NumCPU(); i++ {
+	numWorkers := p.Workers
+	if numWorkers < 1 {
+		numWorkers = runtime.NumCPU()
+	}
+	for i := 0; i < numWorkers; i++ {
 		wg.Add(1)
 		go worker(work, &wg)
 	}
@@ -130,32 +235,36 @@ func (p LineProcessor) RunWithWorkers() error {
 	br := bufio.NewReader(p.r)
 	var offset = p.InitialOffset
 	var blen int64
+	var line int64 = 1
 	batch := [][]byte{}
 
-	var filesize int64
-	var bar *progressbar.ProgressBar
-
-	if f, ok := p.r.(*os.File); ok {
-		fi, err := f.Stat()
-		if err != nil {
-			return err
+	if p.Progress != nil {
+		var total int64
+		if f, ok := p.r.(*os.File); ok {
+			fi, err := f.Stat()
+			if err != nil {
+				return err
+			}
+			total = fi.Size() - p.InitialOffset
 		}
-		filesize = fi.Size()
-		bar = progressbar.New(int(filesize))
+		prog := newProgress(p.Progress, total, 5*time.Second)
+		defer prog.stop()
+		br = bufio.NewReader(io.TeeReader(p.r, prog))
 	}
 
+	sep := p.separator()
 	for {
-		b, err := br.ReadBytes('\n')
-		if err == io.EOF {
+		b, err := readFormatted(br, p.Format, sep, p.MaxRecordSize)
+		if errors.Is(err, ErrRecordTooLarge) || errors.Is(err, errInvalidLeader) {
+			return fmt.Errorf("record %d at offset %d: %w", line+int64(len(batch)), offset+blen, err)
+		}
+		if err == io.EOF && len(b) == 0 {
 			break
 		}
-		if err != nil {
+		if err != nil && err != io.EOF {
 			return err
 		}
-		if len(bytes.TrimSpace(b)) == 0 {
-			continue
-		}
-		if len(batch) == p.BatchSize {
+		if len(batch) == p.BatchSize || p.batchFull(blen, len(b), len(batch)) {
 			if processingErr != nil {
 				if p.Verbose {
 					log.Printf("stopping early due to processing err: %v", processingErr)
@@ -165,35 +274,37 @@ func (p LineProcessor) RunWithWorkers() error {
 			}
 			bb := make([][]byte, len(batch))
 			copy(bb, batch)
-			work <- workPackage{docs: bb, offset: offset}
-			if _, ok := p.r.(*os.File); ok {
-				bar.Add(int(offset))
-			}
+			work <- workPackage{docs: bb, offset: offset, line: line}
 			offset += blen
+			line += int64(len(bb))
 			blen, batch = 0, nil
 		}
 		batch = append(batch, b)
 		blen += int64(len(b))
+		if err == io.EOF {
+			break // Last record without separator.
+		}
 	}
 
 	bb := make([][]byte, len(batch))
 	copy(bb, batch)
-	work <- workPackage{docs: bb, offset: offset}
-
-	if _, ok := p.r.(*os.File); ok {
-		bar.Add(int(filesize))
-		fmt.Println()
-	}
+	work <- workPackage{docs: bb, offset: offset, line: line}
 
 	close(work)
 	wg.Wait()
 	close(updates)
 	<-done
 
+	if report != nil && report.n > 0 {
+		log.Printf("skipped %d broken documents", report.n)
+	}
+
 	return processingErr
 }
 
-// RegexpExtractor extract a key via regular expression.
+// RegexpExtractor extract a key via regular expression. If the pattern contains
+// a named group "key", e.g. `"id":"(?P<key>[^"]+)"`, only that group is used as
+// the key, otherwise the whole match.
 type RegexpExtractor struct {
 	Pattern *regexp.Regexp
 }
@@ -201,7 +312,15 @@ type RegexpExtractor struct {
 // ExtractKey returns the key found in a byte slice. Never fails, just might
 // return unexpected values.
 func (e RegexpExtractor) ExtractKey(b []byte) (string, error) {
-	return string(e.Pattern.Find(b)), nil
+	i := e.Pattern.SubexpIndex("key")
+	if i < 0 {
+		return string(e.Pattern.Find(b)), nil
+	}
+	m := e.Pattern.FindSubmatch(b)
+	if m == nil {
+		return "", nil
+	}
+	return string(m[i]), nil
 }
 
 // ParsingExtractor actually parses the JSON and extracts a top-level key at the
@@ -222,6 +341,239 @@ func (e ParsingExtractor) ExtractKey(b []byte) (s string, err error) {
 	return renderString(dst[e.Key])
 }
 
+// CompositeExtractor parses the JSON and builds a key from several top-level
+// fields, joined by a separator, e.g. "49:ai-49-12345" for fields source_id
+// and record_id.
+type CompositeExtractor struct {
+	Keys      []string
+	Separator string
+}
+
+// ExtractKey extracts and joins all configured fields. Fails, if any of the keys
+// cannot be found in the document.
+func (e CompositeExtractor) ExtractKey(b []byte) (s string, err error) {
+	dst := make(map[string]interface{})
+	if err = json.Unmarshal(b, &dst); err != nil {
+		return
+	}
+	parts := make([]string, len(e.Keys))
+	for i, key := range e.Keys {
+		v, ok := dst[key]
+		if !ok {
+			return "", fmt.Errorf("key %s not found in: %s", key, string(bytes.TrimSpace(b)))
+		}
+		if parts[i], err = renderString(v); err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(parts, e.Separator), nil
+}
+
+// TemplateExtractor builds a key from the top-level fields of a JSON document
+// with a template, e.g. "{{.source}}-{{.id | lower}}". Besides the functions
+// of text/template, like index for nested fields, the template can use lower,
+// upper, trim, urldecode, stripprefix PREFIX, stripsuffix SUFFIX and replace
+// OLD NEW, like the key transformations. Numbers are rendered as they appear
+// in the document.
+type TemplateExtractor struct {
+	Template *template.Template
+}
+
+// templateFuncs are the functions available in key templates.
+var templateFuncs = template.FuncMap{
+	"lower": func(v interface{}) string { return strings.ToLower(templateString(v)) },
+	"upper": func(v interface{}) string { return strings.ToUpper(templateString(v)) },
+	"trim":  func(v interface{}) string { return strings.TrimSpace(templateString(v)) },
+	"urldecode": func(v interface{}) (string, error) {
+		return url.QueryUnescape(templateString(v))
+	},
+	"stripprefix": func(prefix string, v interface{}) string {
+		return strings.TrimPrefix(templateString(v), prefix)
+	},
+	"stripsuffix": func(suffix string, v interface{}) string {
+		return strings.TrimSuffix(templateString(v), suffix)
+	},
+	"replace": func(old, new string, v interface{}) string {
+		return strings.ReplaceAll(templateString(v), old, new)
+	},
+}
+
+// templateString renders a field value for a template function.
+func templateString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// NewTemplateExtractor parses a key template. Fields missing in a document
+// make the extraction fail.
+func NewTemplateExtractor(text string) (TemplateExtractor, error) {
+	t, err := template.New("key").Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return TemplateExtractor{}, fmt.Errorf("invalid key template: %v", err)
+	}
+	return TemplateExtractor{Template: t}, nil
+}
+
+// ExtractKey executes the template over the fields of the document.
+func (e TemplateExtractor) ExtractKey(b []byte) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var doc map[string]interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return "", err
+	}
+	var buf strings.Builder
+	if err := e.Template.Execute(&buf, doc); err != nil {
+		return "", fmt.Errorf("key template: %v in: %s", err, string(bytes.TrimSpace(b)))
+	}
+	return buf.String(), nil
+}
+
+// ColumnExtractor extracts a key from a delimited line, e.g. a TSV with an ID
+// column followed by a JSON payload column.
+type ColumnExtractor struct {
+	Delimiter string
+	Column    int // 1-based
+}
+
+// ExtractKey returns the value of the configured column. Fails, if the line has
+// fewer columns.
+func (e ColumnExtractor) ExtractKey(b []byte) (string, error) {
+	fields := strings.SplitN(string(bytes.TrimRight(b, "\r\n")), e.Delimiter, e.Column+1)
+	if e.Column < 1 || len(fields) < e.Column {
+		return "", fmt.Errorf("column %d not found in: %s", e.Column, string(bytes.TrimSpace(b)))
+	}
+	return fields[e.Column-1], nil
+}
+
+// XMLExtractor extracts a key from an XML record, e.g. an OAI-PMH record per
+// line. The path is a list of element names separated by slashes, like
+// "header/identifier", matched against the innermost elements, or against the
+// whole path from the root element, if it starts with a slash. Namespaces are
+// ignored. A last step like "@id" selects an attribute of the element.
+type XMLExtractor struct {
+	Path string
+}
+
+// ExtractKey returns the trimmed text of the first matching element or the
+// value of the attribute. Fails, if nothing matches.
+func (e XMLExtractor) ExtractKey(b []byte) (string, error) {
+	var (
+		anchored = strings.HasPrefix(e.Path, "/")
+		steps    = strings.Split(strings.Trim(e.Path, "/"), "/")
+		attr     string
+		stack    []string
+		text     *strings.Builder // collects text of a matching element
+		depth    int              // stack depth of the matching element
+	)
+	if last := steps[len(steps)-1]; strings.HasPrefix(last, "@") {
+		attr, steps = last[1:], steps[:len(steps)-1]
+	}
+	matches := func() bool {
+		if len(stack) < len(steps) || (anchored && len(stack) != len(steps)) {
+			return false
+		}
+		for i, step := range steps {
+			if stack[len(stack)-len(steps)+i] != step {
+				return false
+			}
+		}
+		return true
+	}
+	dec := xml.NewDecoder(bytes.NewReader(b))
+	dec.Strict = false
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+			if text != nil || !matches() {
+				continue
+			}
+			if attr == "" {
+				text, depth = new(strings.Builder), len(stack)
+				continue
+			}
+			for _, a := range t.Attr {
+				if a.Name.Local == attr {
+					return a.Value, nil
+				}
+			}
+		case xml.CharData:
+			if text != nil {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			if text != nil && len(stack) == depth {
+				return strings.TrimSpace(text.String()), nil
+			}
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+	return "", fmt.Errorf("path %s not found in: %s", e.Path, string(bytes.TrimSpace(b)))
+}
+
+// ErrNoKey is returned, if no extractor finds a key in a document, e.g. since
+// a regular expression does not match.
+var ErrNoKey = errors.New("no key found")
+
+// MultiExtractor extracts a key with each of the given extractors. Extractors
+// failing on a document are skipped, extraction only fails, if no key at all
+// can be found.
+type MultiExtractor struct {
+	Extractors []KeyExtractor
+}
+
+// ExtractKeys returns all non-empty keys found.
+func (e MultiExtractor) ExtractKeys(b []byte) (keys []string, err error) {
+	var firstErr error
+	for _, x := range e.Extractors {
+		key, err := x.ExtractKey(b)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 && firstErr != nil {
+		return nil, firstErr
+	}
+	if len(keys) == 0 {
+		return nil, ErrNoKey
+	}
+	return keys, nil
+}
+
+// NewKeyPathExtractor returns an extractor for a key path given on the command
+// line or in a query. A single field yields a ParsingExtractor, a comma
+// separated list of fields a CompositeExtractor using the given separator.
+func NewKeyPathExtractor(keypath, sep string) KeyExtractor {
+	if !strings.Contains(keypath, ",") {
+		return ParsingExtractor{Key: keypath}
+	}
+	var keys []string
+	for _, k := range strings.Split(keypath, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return CompositeExtractor{Keys: keys, Separator: sep}
+}
+
 // renderString tries various ways to get a string out of a given type.
 func renderString(v interface{}) (s string, err error) {
 	switch w := v.(type) {
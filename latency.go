@@ -0,0 +1,105 @@
+package microblob
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencySamples is the number of most recent observations kept per series,
+// quantiles are computed over these.
+const latencySamples = 1024
+
+// latencyRing holds the most recent observations of a series, in seconds.
+type latencyRing struct {
+	samples []float64
+	next    int
+	count   int64 // observations since start
+}
+
+// Latencies keeps recent latencies per series, e.g. per route, and reports
+// quantiles over them. Unlike the histograms at /metrics, which count since
+// start, the quantiles follow the current behavior, including its tail. Safe
+// for concurrent use.
+type Latencies struct {
+	mu     sync.Mutex
+	series map[string]*latencyRing
+}
+
+// NewLatencies returns an empty latency collector.
+func NewLatencies() *Latencies {
+	return &Latencies{series: make(map[string]*latencyRing)}
+}
+
+// Observe records the time passed since started for a series.
+func (l *Latencies) Observe(name string, started time.Time) {
+	seconds := time.Since(started).Seconds()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ring, ok := l.series[name]
+	if !ok {
+		ring = &latencyRing{samples: make([]float64, 0, latencySamples)}
+		l.series[name] = ring
+	}
+	if len(ring.samples) < latencySamples {
+		ring.samples = append(ring.samples, seconds)
+	} else {
+		ring.samples[ring.next] = seconds
+	}
+	ring.next = (ring.next + 1) % latencySamples
+	ring.count++
+}
+
+// LatencySummary reports quantiles in seconds over the recent observations of
+// a series.
+type LatencySummary struct {
+	Count int64   `json:"count"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+}
+
+// Summary returns the quantiles of all series.
+func (l *Latencies) Summary() map[string]LatencySummary {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := make(map[string]LatencySummary, len(l.series))
+	for name, ring := range l.series {
+		sorted := append([]float64(nil), ring.samples...)
+		sort.Float64s(sorted)
+		result[name] = LatencySummary{
+			Count: ring.count,
+			P50:   quantile(sorted, 0.5),
+			P90:   quantile(sorted, 0.9),
+			P99:   quantile(sorted, 0.99),
+		}
+	}
+	return result
+}
+
+// quantile returns the q-quantile of sorted values by nearest rank.
+func quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// latencyHandler serves recent latency quantiles per route and per stage of a
+// lookup as JSON.
+func latencyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"routes": routeLatency.Summary(),
+		"stages": stageLatency.Summary(),
+	}); err != nil {
+		http.Error(w, "could not serialize", http.StatusInternalServerError)
+	}
+}
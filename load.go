@@ -0,0 +1,96 @@
+package microblob
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// LoadHandler indexes entries computed by external tools, e.g. a Spark job
+// writing the blob file along with the offsets of its records, without
+// extracting keys. The body is in the flat index format, one entry per line:
+//
+//	key TAB offset TAB length [TAB size TAB file TAB expires TAB crc]
+//
+// as written by WriteFlatIndex. Keys are transformed like extracted keys.
+type LoadHandler struct {
+	Backend   Backend
+	Blobfile  string
+	BatchSize int       // entries written at once, defaults to 100000
+	Audit     *AuditLog // records each load, if not nil
+}
+
+// ServeHTTP writes the entries in the request body to the index, after
+// checking, that they lie within the blob files. Entries are written in
+// batches, so on failure, those of earlier batches stay indexed; the response
+// reports the number of entries written in any case.
+func (h LoadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec := auditRecord(r, AuditLoad, h.Blobfile)
+	check, err := h.bounds()
+	if err != nil {
+		rec.Status, rec.Error = http.StatusInternalServerError, err.Error()
+		h.Audit.record(rec)
+		http.Error(w, "load: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body, err := requestBody(r)
+	if err != nil {
+		http.Error(w, "load: "+err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	defer body.Close()
+	var stored bool // whether an error came from the backend, not the body
+	n, err := readFlatEntries(body, h.BatchSize, func(entries []Entry) error {
+		for _, e := range entries {
+			if err := check(e); err != nil {
+				return err
+			}
+		}
+		if err := WriteEntriesContext(r.Context(), h.Backend, entries); err != nil {
+			stored = true
+			return err
+		}
+		return nil
+	})
+	rec.Keys, rec.Status = n, http.StatusOK
+	if err != nil {
+		rec.Status, rec.Error = http.StatusBadRequest, err.Error()
+		if stored {
+			rec.Status = failureStatus(err)
+		}
+	}
+	h.Audit.record(rec)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(rec.Status)
+	json.NewEncoder(w).Encode(struct {
+		Keys  int64  `json:"keys"`
+		Error string `json:"error,omitempty"`
+	}{n, rec.Error})
+}
+
+// bounds returns a check, whether an entry lies within the blob files.
+func (h LoadHandler) bounds() (func(Entry) error, error) {
+	names := []string{h.Blobfile}
+	if lb := levelDBBackend(h.Backend); lb != nil {
+		names = append(names, lb.Blobfiles...)
+	}
+	sizes := make([]int64, len(names))
+	for i, name := range names {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		sizes[i] = fi.Size()
+	}
+	return func(e Entry) error {
+		if e.File >= len(sizes) {
+			return fmt.Errorf("%w: key %s: unknown blob file %d", ErrInvalidValue, e.Key, e.File)
+		}
+		if e.Length == 0 || e.Offset+e.Length > sizes[e.File] {
+			return fmt.Errorf("%w: key %s: region %d+%d out of bounds, file size is %d",
+				ErrInvalidValue, e.Key, e.Offset, e.Length, sizes[e.File])
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,70 @@
+package microblob
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockBlob serializes appends to a blob file. Within the process, appends hold
+// mu, across processes an exclusive lock on a lock file next to the blob file,
+// so a command line append cannot interleave its writes with those of a
+// running server. The lock file is left in place. Call unlock to release both.
+func lockBlob(blobfn string) (unlock func(), err error) {
+	mu.Lock()
+	f, err := lockBlobFile(blobfn)
+	if err != nil {
+		mu.Unlock()
+		return nil, err
+	}
+	return func() {
+		f.Close() // Releases the file lock.
+		mu.Unlock()
+	}, nil
+}
+
+// lockBlobs is like lockBlob for multiple blob files, which are locked in
+// order. Blob files on a read-only mount are not locked, since nobody can
+// append to them.
+func lockBlobs(names ...string) (unlock func(), err error) {
+	mu.Lock()
+	var files []*os.File
+	unlock = func() {
+		for _, f := range files {
+			f.Close()
+		}
+		mu.Unlock()
+	}
+	for _, name := range names {
+		f, err := lockBlobFile(name)
+		if readOnlyError(err) {
+			continue
+		}
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return unlock, nil
+}
+
+// lockBlobFile acquires the lock on the lock file next to the blob file, which
+// is released, when the returned file is closed.
+func lockBlobFile(blobfn string) (*os.File, error) {
+	f, err := os.OpenFile(blobfn+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// readOnlyError returns true for errors creating files on a read-only mount
+// or in a directory without write permission.
+func readOnlyError(err error) bool {
+	return errors.Is(err, syscall.EROFS) || errors.Is(err, os.ErrPermission)
+}
@@ -0,0 +1,14 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package microblob
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile blocks until it acquires an exclusive lock on the file, with
+// flock(2).
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
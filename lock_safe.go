@@ -0,0 +1,11 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package microblob
+
+import "os"
+
+// lockFile is a no-op on systems without flock(2) or LockFileEx, appends are
+// only serialized within the process.
+func lockFile(f *os.File) error {
+	return nil
+}
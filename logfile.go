@@ -0,0 +1,107 @@
+package microblob
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LogFile is an append-only log file, that can be reopened after it has been
+// moved away, e.g. by logrotate, and that can rotate itself by size or age.
+// Rotated files get the time of rotation as suffix. Safe for concurrent use.
+type LogFile struct {
+	Filename string
+	MaxSize  int64         // rotate before the file exceeds this size, 0 disables
+	MaxAge   time.Duration // rotate files opened longer ago than this, 0 disables
+	Keep     int           // number of rotated files to keep, 0 keeps all
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// OpenLogFile opens or creates a log file for appending.
+func OpenLogFile(filename string) (*LogFile, error) {
+	l := &LogFile{Filename: filename}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the file, the lock must be held.
+func (l *LogFile) open() error {
+	f, err := os.OpenFile(l.Filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size, l.opened = f, fi.Size(), time.Now()
+	return nil
+}
+
+// Write appends to the log file, rotating it first, if necessary.
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size > 0 && ((l.MaxSize > 0 && l.size+int64(len(p)) > l.MaxSize) ||
+		(l.MaxAge > 0 && time.Since(l.opened) > l.MaxAge)) {
+		if err := l.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// Reopen closes and reopens the file under its name, so logging continues in
+// a new file, after the old one was moved away.
+func (l *LogFile) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// rotate moves the current file away, removes surplus rotated files and opens
+// a new file, the lock must be held.
+func (l *LogFile) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	rotated := l.Filename + "." + time.Now().Format("20060102-150405.000000")
+	if err := os.Rename(l.Filename, rotated); err != nil {
+		return err
+	}
+	if l.Keep > 0 {
+		names, err := filepath.Glob(l.Filename + ".*")
+		if err != nil {
+			return err
+		}
+		sort.Strings(names)
+		for len(names) > l.Keep {
+			if err := os.Remove(names[0]); err != nil {
+				return err
+			}
+			names = names[1:]
+		}
+	}
+	return l.open()
+}
+
+// Close closes the file.
+func (l *LogFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
@@ -0,0 +1,146 @@
+package microblob
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrBadSignature is returned, if the signature of a manifest does not match.
+var ErrBadSignature = errors.New("manifest signature does not match")
+
+// Manifest describes a dataset, so mirrored deployments can prove they serve
+// identical data: the number of keys, the SHA256 of each blob file and of the
+// index entries, in flat index format, which does not depend on how the index
+// is stored on disk. The signature is an HMAC-SHA256 over the manifest
+// without it, with a key shared by the deployments.
+type Manifest struct {
+	Keys      int64          `json:"keys"`
+	Blobfiles []ManifestFile `json:"blobfiles"`
+	Index     string         `json:"index"` // SHA256 of the entries in flat index format
+	Created   time.Time      `json:"created"`
+	Signature string         `json:"signature,omitempty"`
+}
+
+// ManifestFile is a blob file in a manifest, by base name, since mirrors may
+// keep their files in different places.
+type ManifestFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// BuildManifest hashes the blob files and the entries of the index. Reads the
+// blob files completely.
+func BuildManifest(src EntryIterator, blobfiles []string) (Manifest, error) {
+	m := Manifest{Created: time.Now().UTC().Truncate(time.Second)}
+	for _, name := range blobfiles {
+		mf, err := hashManifestFile(name)
+		if err != nil {
+			return m, err
+		}
+		m.Blobfiles = append(m.Blobfiles, mf)
+	}
+	h := sha256.New()
+	n, err := WriteFlatIndex(h, withSuppressed{src})
+	if err != nil {
+		return m, err
+	}
+	m.Keys, m.Index = n, hex.EncodeToString(h.Sum(nil))
+	return m, nil
+}
+
+// hashManifestFile returns size and SHA256 of a file.
+func hashManifestFile(filename string) (ManifestFile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	return ManifestFile{Name: filepath.Base(filename), Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// ReadManifest reads a manifest written as JSON.
+func ReadManifest(filename string) (Manifest, error) {
+	var m Manifest
+	f, err := os.Open(filename)
+	if err != nil {
+		return m, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		return m, fmt.Errorf("invalid manifest %s: %v", filename, err)
+	}
+	return m, nil
+}
+
+// mac returns the HMAC-SHA256 of the manifest without signature.
+func (m Manifest) mac(key []byte) ([]byte, error) {
+	m.Signature = ""
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write(b)
+	return h.Sum(nil), nil
+}
+
+// Sign sets the signature of the manifest.
+func (m *Manifest) Sign(key []byte) error {
+	sum, err := m.mac(key)
+	if err != nil {
+		return err
+	}
+	m.Signature = hex.EncodeToString(sum)
+	return nil
+}
+
+// VerifySignature returns ErrBadSignature, if the manifest is not signed with
+// the key or was changed after it was signed.
+func (m Manifest) VerifySignature(key []byte) error {
+	sig, err := hex.DecodeString(m.Signature)
+	if err != nil || len(sig) == 0 {
+		return ErrBadSignature
+	}
+	sum, err := m.mac(key)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(sig, sum) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Compare returns an error describing the first difference to another
+// manifest, ignoring creation time and signature.
+func (m Manifest) Compare(other Manifest) error {
+	if m.Keys != other.Keys {
+		return fmt.Errorf("manifest lists %d keys, found %d", other.Keys, m.Keys)
+	}
+	if len(m.Blobfiles) != len(other.Blobfiles) {
+		return fmt.Errorf("manifest lists %d blob files, found %d", len(other.Blobfiles), len(m.Blobfiles))
+	}
+	for i, f := range m.Blobfiles {
+		if f != other.Blobfiles[i] {
+			return fmt.Errorf("blob file %s does not match %s in manifest", f.Name, other.Blobfiles[i].Name)
+		}
+	}
+	if m.Index != other.Index {
+		return fmt.Errorf("index does not match manifest")
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package microblob
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	marcLeaderLength     = 24
+	marcFieldTerminator  = 0x1e
+	marcRecordTerminator = 0x1d
+	marcSubfieldCode     = 0x1f
+)
+
+// errInvalidLeader is returned for binary MARC records, that cannot be framed
+// by their leader.
+var errInvalidLeader = errors.New("invalid MARC leader")
+
+// readMARC reads the next binary MARC record, as many bytes as the record
+// length at the start of its leader, including the record terminator. Blank
+// bytes between records, e.g. a newline added by some tools, are returned on
+// their own.
+func readMARC(br *bufio.Reader, max int64) ([]byte, error) {
+	head, err := br.Peek(5)
+	if len(head) == 0 {
+		return nil, err
+	}
+	if isMARCBlank(head[0]) {
+		var b []byte
+		for {
+			c, err := br.ReadByte()
+			if err != nil {
+				return b, err
+			}
+			if !isMARCBlank(c) {
+				return b, br.UnreadByte()
+			}
+			b = append(b, c)
+		}
+	}
+	n, ok := marcNumber(head)
+	if !ok || n <= marcLeaderLength {
+		return nil, fmt.Errorf("%w: record length %q", errInvalidLeader, head)
+	}
+	if max > 0 && int64(n) > max {
+		return nil, fmt.Errorf("%w: longer than %d bytes", ErrRecordTooLarge, max)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(br, b); err == io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("%w: record of %d bytes truncated", errInvalidLeader, n)
+	} else if err != nil {
+		return nil, err
+	}
+	if b[n-1] != marcRecordTerminator {
+		return nil, fmt.Errorf("%w: record of %d bytes without record terminator", errInvalidLeader, n)
+	}
+	return b, nil
+}
+
+// isMARCBlank returns true for bytes, that may appear between binary MARC
+// records.
+func isMARCBlank(c byte) bool {
+	return c == '\n' || c == '\r' || c == ' ' || c == '\t' || c == marcRecordTerminator
+}
+
+// marcNumber parses a number of the leader or of the directory, which
+// consists of ASCII digits only.
+func marcNumber(b []byte) (int, bool) {
+	var n int
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n, len(b) > 0
+}
+
+// readMARCXML reads the next record element of a MARCXML collection, from
+// its start to its end tag, or the text up to the next record, like the XML
+// declaration and the collection start tag. Whitespace after a tag belongs to
+// it, so records start at their start tag and usually end with a newline.
+// Namespace prefixes, like marc:record, are ignored.
+func readMARCXML(br *bufio.Reader, max int64) ([]byte, error) {
+	var (
+		b        []byte
+		inRecord bool
+	)
+	for {
+		if !inRecord && len(b) > 0 && peekMARCXMLRecord(br) {
+			return b, nil
+		}
+		chunk, err := br.ReadBytes('>')
+		for err == nil {
+			c, cerr := br.ReadByte()
+			if cerr != nil {
+				err = cerr
+				break
+			}
+			if !isXMLSpace(c) {
+				err = br.UnreadByte()
+				break
+			}
+			chunk = append(chunk, c)
+		}
+		b = append(b, chunk...)
+		if max > 0 && int64(len(b)) > max {
+			return nil, fmt.Errorf("%w: longer than %d bytes", ErrRecordTooLarge, max)
+		}
+		if err != nil {
+			return b, err
+		}
+		tag := chunk[bytes.LastIndexByte(chunk, '<')+1:]
+		name, end := xmlTagName(tag)
+		switch {
+		case name == "record" && !end && !inRecord:
+			if bytes.HasSuffix(bytes.TrimRight(tag, " \t\r\n"), []byte("/>")) {
+				return b, nil
+			}
+			inRecord = true
+		case name == "record" && end && inRecord:
+			return b, nil
+		}
+	}
+}
+
+// peekMARCXMLRecord returns true, if a record start tag comes next.
+func peekMARCXMLRecord(br *bufio.Reader) bool {
+	p, _ := br.Peek(64)
+	if len(p) == 0 || p[0] != '<' {
+		return false
+	}
+	name, end := xmlTagName(p[1:])
+	return name == "record" && !end
+}
+
+// isMARCXMLRecord returns true, if a section read with readMARCXML is a
+// record.
+func isMARCXMLRecord(b []byte) bool {
+	b = bytes.TrimLeft(b, " \t\r\n")
+	if len(b) == 0 || b[0] != '<' {
+		return false
+	}
+	name, end := xmlTagName(b[1:])
+	return name == "record" && !end
+}
+
+// xmlTagName returns the local name of a tag, given from after the opening
+// angle bracket, and whether it is an end tag.
+func xmlTagName(tag []byte) (name string, end bool) {
+	if end = bytes.HasPrefix(tag, []byte("/")); end {
+		tag = tag[1:]
+	}
+	if i := bytes.IndexAny(tag, " \t\r\n/>"); i >= 0 {
+		tag = tag[:i]
+	}
+	if i := bytes.LastIndexByte(tag, ':'); i >= 0 {
+		tag = tag[i+1:]
+	}
+	return string(tag), end
+}
+
+// isXMLSpace returns true for whitespace in XML.
+func isXMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// marcField splits a field like "001" or "035a" into tag and subfield code.
+// Control fields, with tags starting with "00", have no subfields, data
+// fields need a code.
+func marcField(field string) (tag, code string, err error) {
+	if field == "" {
+		field = "001"
+	}
+	switch control := strings.HasPrefix(field, "00"); {
+	case len(field) == 3 && control:
+		return field, "", nil
+	case len(field) == 4 && !control:
+		return field[:3], field[3:], nil
+	default:
+		return "", "", fmt.Errorf("invalid MARC field %q, need a control field like 001 or a tag and subfield code like 035a", field)
+	}
+}
+
+// MARCExtractor extracts a key from a binary MARC record, a control field,
+// by default the control number in 001, or the first subfield with a code
+// of a data field, like "035a".
+type MARCExtractor struct {
+	Field string
+}
+
+// ExtractKey returns the trimmed value of the first matching field. Fails, if
+// the field is not found or the record is malformed.
+func (e MARCExtractor) ExtractKey(b []byte) (string, error) {
+	tag, code, err := marcField(e.Field)
+	if err != nil {
+		return "", err
+	}
+	if len(b) < marcLeaderLength {
+		return "", fmt.Errorf("%w: record of %d bytes", errInvalidLeader, len(b))
+	}
+	base, ok := marcNumber(b[12:17])
+	if !ok || base <= marcLeaderLength || base > len(b) {
+		return "", fmt.Errorf("%w: base address %q", errInvalidLeader, b[12:17])
+	}
+	dir := bytes.TrimSuffix(b[marcLeaderLength:base], []byte{marcFieldTerminator})
+	for ; len(dir) >= 12; dir = dir[12:] {
+		if string(dir[:3]) != tag {
+			continue
+		}
+		length, lok := marcNumber(dir[3:7])
+		start, sok := marcNumber(dir[7:12])
+		if !lok || !sok || base+start+length > len(b) {
+			return "", fmt.Errorf("invalid MARC directory entry %q", dir[:12])
+		}
+		data := bytes.TrimSuffix(b[base+start:base+start+length], []byte{marcFieldTerminator})
+		if code == "" {
+			return strings.TrimSpace(string(data)), nil
+		}
+		for _, sub := range bytes.Split(data, []byte{marcSubfieldCode})[1:] {
+			if len(sub) > 0 && string(sub[:1]) == code {
+				return strings.TrimSpace(string(sub[1:])), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("field %s not found in MARC record with leader %q", e.Field, b[:marcLeaderLength])
+}
+
+// MARCXMLExtractor extracts a key from a MARCXML record, like MARCExtractor
+// from a binary record. Namespaces are ignored.
+type MARCXMLExtractor struct {
+	Field string
+}
+
+// ExtractKey returns the trimmed text of the first matching control field or
+// subfield. Fails, if nothing matches.
+func (e MARCXMLExtractor) ExtractKey(b []byte) (string, error) {
+	tag, code, err := marcField(e.Field)
+	if err != nil {
+		return "", err
+	}
+	attr := func(t xml.StartElement, name string) string {
+		for _, a := range t.Attr {
+			if a.Name.Local == name {
+				return a.Value
+			}
+		}
+		return ""
+	}
+	var (
+		inField bool
+		text    *strings.Builder
+	)
+	dec := xml.NewDecoder(bytes.NewReader(b))
+	dec.Strict = false
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "controlfield", "datafield":
+				inField = attr(t, "tag") == tag
+				if inField && code == "" {
+					text = new(strings.Builder)
+				}
+			case "subfield":
+				if inField && code != "" && attr(t, "code") == code {
+					text = new(strings.Builder)
+				}
+			}
+		case xml.CharData:
+			if text != nil {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			if text != nil {
+				return strings.TrimSpace(text.String()), nil
+			}
+			if t.Name.Local == "datafield" {
+				inField = false
+			}
+		}
+	}
+	return "", fmt.Errorf("field %s not found in: %s", e.Field, string(bytes.TrimSpace(b)))
+}
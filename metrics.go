@@ -0,0 +1,284 @@
+package microblob
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// latencyBuckets are the upper bounds of the latency histogram, in seconds.
+var latencyBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// IndexSizer can report the size of the index on disk.
+type IndexSizer interface {
+	IndexSize() (int64, error)
+}
+
+// IndexSize returns the size of the LevelDB directory in bytes.
+func (b *LevelDBBackend) IndexSize() (size int64, err error) {
+	err = filepath.Walk(indexDir(b.Filename), func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// IndexSize reports the index size of the wrapped backend.
+func (b TransformBackend) IndexSize() (int64, error) {
+	if s, ok := b.Backend.(IndexSizer); ok {
+		return s.IndexSize()
+	}
+	return 0, ErrNotImplemented
+}
+
+// histogram counts observations in cumulative buckets.
+type histogram struct {
+	counts []int64 // one per bucket, plus +Inf
+	sum    float64
+}
+
+// routeStatus labels a request counter.
+type routeStatus struct {
+	route  string
+	method string
+	status int
+}
+
+// statusWriter records status code and bytes written.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Metrics collects request statistics and exposes them in the Prometheus text
+// format.
+type Metrics struct {
+	Backend  Backend // optional, for index size
+	Blobfile string  // optional, for blob file size
+
+	mu       sync.Mutex
+	started  time.Time
+	requests map[routeStatus]int64
+	latency  map[string]*histogram
+	bytes    map[string]int64
+}
+
+// NewMetrics returns a metrics collector.
+func NewMetrics(backend Backend, blobfile string) *Metrics {
+	return &Metrics{
+		Backend:  backend,
+		Blobfile: blobfile,
+		started:  time.Now(),
+		requests: make(map[routeStatus]int64),
+		latency:  make(map[string]*histogram),
+		bytes:    make(map[string]int64),
+	}
+}
+
+// Middleware records count, latency and bytes served per route, where routes
+// are identified by their path template.
+func (m *Metrics) Middleware(h http.Handler) http.Handler {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		route := r.URL.Path
+		if cr := mux.CurrentRoute(r); cr != nil {
+			if t, err := cr.GetPathTemplate(); err == nil {
+				route = t
+			}
+		}
+		m.observe(routeStatus{route, r.Method, sw.status}, time.Since(started).Seconds(), sw.n)
+		routeLatency.Observe(route, started)
+	}
+	return http.HandlerFunc(f)
+}
+
+func (m *Metrics) observe(rs routeStatus, seconds float64, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[rs]++
+	m.bytes[rs.route] += n
+	hist, ok := m.latency[rs.route]
+	if !ok {
+		hist = &histogram{counts: make([]int64, len(latencyBuckets)+1)}
+		m.latency[rs.route] = hist
+	}
+	i := sort.SearchFloat64s(latencyBuckets, seconds)
+	hist.counts[i]++
+	hist.sum += seconds
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cw := &countingWriter{w: w}
+
+	fmt.Fprintln(cw, "# HELP microblob_requests_total Number of HTTP requests.")
+	fmt.Fprintln(cw, "# TYPE microblob_requests_total counter")
+	var keys []routeStatus
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+	var notFound int64
+	for _, k := range keys {
+		fmt.Fprintf(cw, "microblob_requests_total{route=%q,method=%q,code=\"%d\"} %d\n",
+			k.route, k.method, k.status, m.requests[k])
+		if k.status == http.StatusNotFound {
+			notFound += m.requests[k]
+		}
+	}
+
+	fmt.Fprintln(cw, "# HELP microblob_not_found_total Number of requests answered with 404.")
+	fmt.Fprintln(cw, "# TYPE microblob_not_found_total counter")
+	fmt.Fprintf(cw, "microblob_not_found_total %d\n", notFound)
+
+	var routes []string
+	for k := range m.latency {
+		routes = append(routes, k)
+	}
+	sort.Strings(routes)
+
+	fmt.Fprintln(cw, "# HELP microblob_response_bytes_total Number of response body bytes served.")
+	fmt.Fprintln(cw, "# TYPE microblob_response_bytes_total counter")
+	for _, route := range routes {
+		fmt.Fprintf(cw, "microblob_response_bytes_total{route=%q} %d\n", route, m.bytes[route])
+	}
+
+	fmt.Fprintln(cw, "# HELP microblob_request_duration_seconds Request latency.")
+	fmt.Fprintln(cw, "# TYPE microblob_request_duration_seconds histogram")
+	for _, route := range routes {
+		hist := m.latency[route]
+		var cum int64
+		for i, le := range latencyBuckets {
+			cum += hist.counts[i]
+			fmt.Fprintf(cw, "microblob_request_duration_seconds_bucket{route=%q,le=\"%g\"} %d\n", route, le, cum)
+		}
+		cum += hist.counts[len(latencyBuckets)]
+		fmt.Fprintf(cw, "microblob_request_duration_seconds_bucket{route=%q,le=\"+Inf\"} %d\n", route, cum)
+		fmt.Fprintf(cw, "microblob_request_duration_seconds_sum{route=%q} %g\n", route, hist.sum)
+		fmt.Fprintf(cw, "microblob_request_duration_seconds_count{route=%q} %d\n", route, cum)
+	}
+
+	fmt.Fprintln(cw, "# HELP microblob_crc_errors_total Number of documents, that did not match their CRC.")
+	fmt.Fprintln(cw, "# TYPE microblob_crc_errors_total counter")
+	fmt.Fprintf(cw, "microblob_crc_errors_total %d\n", crcErrors.Value())
+
+	fmt.Fprintln(cw, "# HELP microblob_scan_miss_total Number of keys missing from the index looked up in the blob file, by result.")
+	fmt.Fprintln(cw, "# TYPE microblob_scan_miss_total counter")
+	fmt.Fprintf(cw, "microblob_scan_miss_total{result=\"found\"} %d\n", scanMissFound.Value())
+	fmt.Fprintf(cw, "microblob_scan_miss_total{result=\"missing\"} %d\n", scanMissScans.Value()-scanMissFound.Value())
+	fmt.Fprintf(cw, "microblob_scan_miss_total{result=\"skipped\"} %d\n", scanMissSkipped.Value())
+
+	if s, ok := m.Backend.(IndexSizer); ok {
+		if size, err := s.IndexSize(); err == nil {
+			fmt.Fprintln(cw, "# HELP microblob_index_bytes Size of the index on disk.")
+			fmt.Fprintln(cw, "# TYPE microblob_index_bytes gauge")
+			fmt.Fprintf(cw, "microblob_index_bytes %d\n", size)
+		}
+	}
+	if m.Blobfile != "" {
+		if fi, err := os.Stat(m.Blobfile); err == nil {
+			fmt.Fprintln(cw, "# HELP microblob_blob_bytes Size of the blob file.")
+			fmt.Fprintln(cw, "# TYPE microblob_blob_bytes gauge")
+			fmt.Fprintf(cw, "microblob_blob_bytes %d\n", fi.Size())
+		}
+	}
+	return cw.n, cw.err
+}
+
+// RouteRate is the number of requests to a route and their average rate.
+type RouteRate struct {
+	Route    string
+	Requests int64
+	Rate     float64 // requests per second since start
+}
+
+// Rates returns the number of requests per route since the collector was
+// created, busiest route first.
+func (m *Metrics) Rates() []RouteRate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := make(map[string]int64)
+	for k, n := range m.requests {
+		counts[k.route] += n
+	}
+	elapsed := time.Since(m.started).Seconds()
+	rates := make([]RouteRate, 0, len(counts))
+	for route, n := range counts {
+		rates = append(rates, RouteRate{Route: route, Requests: n, Rate: float64(n) / elapsed})
+	}
+	sort.Slice(rates, func(i, j int) bool {
+		if rates[i].Requests != rates[j].Requests {
+			return rates[i].Requests > rates[j].Requests
+		}
+		return rates[i].Route < rates[j].Route
+	})
+	return rates
+}
+
+// ServeHTTP serves metrics.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// countingWriter counts bytes written and keeps the first error.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	w.err = err
+	return n, err
+}
@@ -0,0 +1,252 @@
+// Protocol for the microblob gRPC service, regenerate with:
+//
+//     $ protoc --go_out=. --go_opt=paths=source_relative \
+//         --go-grpc_out=. --go-grpc_opt=paths=source_relative \
+//         microblobpb/microblob.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: microblobpb/microblob.proto
+
+package microblobpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Microblob_Get_FullMethodName      = "/microblob.Microblob/Get"
+	Microblob_MultiGet_FullMethodName = "/microblob.Microblob/MultiGet"
+	Microblob_Exists_FullMethodName   = "/microblob.Microblob/Exists"
+	Microblob_Append_FullMethodName   = "/microblob.Microblob/Append"
+)
+
+// MicroblobClient is the client API for Microblob service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Microblob serves documents by key.
+type MicroblobClient interface {
+	// Get returns the document for a key.
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
+	// MultiGet streams the documents for a list of keys, in order.
+	MultiGet(ctx context.Context, in *MultiGetRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Document], error)
+	// Exists reports whether a key is indexed.
+	Exists(ctx context.Context, in *ExistsRequest, opts ...grpc.CallOption) (*ExistsResponse, error)
+	// Append appends newline delimited documents streamed in chunks and indexes
+	// them. The key paths are taken from the first message.
+	Append(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[AppendRequest, AppendResponse], error)
+}
+
+type microblobClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMicroblobClient(cc grpc.ClientConnInterface) MicroblobClient {
+	return &microblobClient{cc}
+}
+
+func (c *microblobClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetResponse)
+	err := c.cc.Invoke(ctx, Microblob_Get_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *microblobClient) MultiGet(ctx context.Context, in *MultiGetRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Document], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Microblob_ServiceDesc.Streams[0], Microblob_MultiGet_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[MultiGetRequest, Document]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Microblob_MultiGetClient = grpc.ServerStreamingClient[Document]
+
+func (c *microblobClient) Exists(ctx context.Context, in *ExistsRequest, opts ...grpc.CallOption) (*ExistsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ExistsResponse)
+	err := c.cc.Invoke(ctx, Microblob_Exists_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *microblobClient) Append(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[AppendRequest, AppendResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Microblob_ServiceDesc.Streams[1], Microblob_Append_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[AppendRequest, AppendResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Microblob_AppendClient = grpc.ClientStreamingClient[AppendRequest, AppendResponse]
+
+// MicroblobServer is the server API for Microblob service.
+// All implementations must embed UnimplementedMicroblobServer
+// for forward compatibility.
+//
+// Microblob serves documents by key.
+type MicroblobServer interface {
+	// Get returns the document for a key.
+	Get(context.Context, *GetRequest) (*GetResponse, error)
+	// MultiGet streams the documents for a list of keys, in order.
+	MultiGet(*MultiGetRequest, grpc.ServerStreamingServer[Document]) error
+	// Exists reports whether a key is indexed.
+	Exists(context.Context, *ExistsRequest) (*ExistsResponse, error)
+	// Append appends newline delimited documents streamed in chunks and indexes
+	// them. The key paths are taken from the first message.
+	Append(grpc.ClientStreamingServer[AppendRequest, AppendResponse]) error
+	mustEmbedUnimplementedMicroblobServer()
+}
+
+// UnimplementedMicroblobServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedMicroblobServer struct{}
+
+func (UnimplementedMicroblobServer) Get(context.Context, *GetRequest) (*GetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedMicroblobServer) MultiGet(*MultiGetRequest, grpc.ServerStreamingServer[Document]) error {
+	return status.Errorf(codes.Unimplemented, "method MultiGet not implemented")
+}
+func (UnimplementedMicroblobServer) Exists(context.Context, *ExistsRequest) (*ExistsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Exists not implemented")
+}
+func (UnimplementedMicroblobServer) Append(grpc.ClientStreamingServer[AppendRequest, AppendResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Append not implemented")
+}
+func (UnimplementedMicroblobServer) mustEmbedUnimplementedMicroblobServer() {}
+func (UnimplementedMicroblobServer) testEmbeddedByValue()                   {}
+
+// UnsafeMicroblobServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MicroblobServer will
+// result in compilation errors.
+type UnsafeMicroblobServer interface {
+	mustEmbedUnimplementedMicroblobServer()
+}
+
+func RegisterMicroblobServer(s grpc.ServiceRegistrar, srv MicroblobServer) {
+	// If the following call pancis, it indicates UnimplementedMicroblobServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Microblob_ServiceDesc, srv)
+}
+
+func _Microblob_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MicroblobServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Microblob_Get_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MicroblobServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Microblob_MultiGet_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(MultiGetRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MicroblobServer).MultiGet(m, &grpc.GenericServerStream[MultiGetRequest, Document]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Microblob_MultiGetServer = grpc.ServerStreamingServer[Document]
+
+func _Microblob_Exists_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExistsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MicroblobServer).Exists(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Microblob_Exists_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MicroblobServer).Exists(ctx, req.(*ExistsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Microblob_Append_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(MicroblobServer).Append(&grpc.GenericServerStream[AppendRequest, AppendResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Microblob_AppendServer = grpc.ClientStreamingServer[AppendRequest, AppendResponse]
+
+// Microblob_ServiceDesc is the grpc.ServiceDesc for Microblob service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Microblob_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "microblob.Microblob",
+	HandlerType: (*MicroblobServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Get",
+			Handler:    _Microblob_Get_Handler,
+		},
+		{
+			MethodName: "Exists",
+			Handler:    _Microblob_Exists_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "MultiGet",
+			Handler:       _Microblob_MultiGet_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Append",
+			Handler:       _Microblob_Append_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "microblobpb/microblob.proto",
+}
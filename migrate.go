@@ -0,0 +1,145 @@
+package microblob
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Migrator can rewrite an index written by an earlier version in the current
+// format.
+type Migrator interface {
+	Migrate() (int64, error)
+}
+
+// Migrate migrates the wrapped backend.
+func (b TransformBackend) Migrate() (int64, error) {
+	if m, ok := b.Backend.(Migrator); ok {
+		return m.Migrate()
+	}
+	return 0, ErrNotImplemented
+}
+
+// Migrate rewrites all values in the fixed format in the compact format, then
+// compacts the database to reclaim the space. Returns the number of values
+// rewritten. Both formats can be read, so migration is optional and can be
+// repeated. Appends are blocked during the migration.
+func (b *LevelDBBackend) Migrate() (n int64, err error) {
+	if err := b.notShared("migration"); err != nil {
+		return 0, err
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if err := b.openDatabase(); err != nil {
+		return 0, err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+
+	iter := b.db.NewIterator(nil, nil)
+	defer iter.Release()
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		value := iter.Value()
+		if len(value) > 0 && value[0]&compactValue != 0 {
+			continue
+		}
+		e, err := decodeEntry(iter.Key(), value)
+		if err != nil {
+			return n, err
+		}
+		batch.Put(append([]byte(nil), iter.Key()...), encodeEntry(e))
+		n++
+		if batch.Len() == 100000 {
+			if err := b.db.Write(batch, nil); err != nil {
+				return n, err
+			}
+			batch.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return n, err
+	}
+	if err := b.db.Write(batch, nil); err != nil {
+		return n, err
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, b.db.CompactRange(util.Range{})
+}
+
+// EntryIterator can walk all entries of an index, as stored.
+type EntryIterator interface {
+	Entries(f func(Entry) error) error
+}
+
+// Entries walks the entries of the wrapped backend, with keys as stored.
+func (b TransformBackend) Entries(f func(Entry) error) error {
+	if it, ok := b.Backend.(EntryIterator); ok {
+		return it.Entries(f)
+	}
+	return ErrNotImplemented
+}
+
+// allEntries walks the entries of the wrapped backend, including suppressed
+// keys.
+func (b TransformBackend) allEntries(f func(Entry) error) error {
+	if it, ok := b.Backend.(allEntryIterator); ok {
+		return it.allEntries(f)
+	}
+	return b.Entries(f)
+}
+
+// allEntryIterator can walk the entries of an index including suppressed
+// keys, for copies and maintenance, that must not drop documents, which are
+// only hidden.
+type allEntryIterator interface {
+	allEntries(f func(Entry) error) error
+}
+
+// withSuppressed lists the entries of an iterator including suppressed keys,
+// if it can list them.
+type withSuppressed struct {
+	EntryIterator
+}
+
+// Entries calls f for each entry.
+func (s withSuppressed) Entries(f func(Entry) error) error {
+	if it, ok := s.EntryIterator.(allEntryIterator); ok {
+		return it.allEntries(f)
+	}
+	return s.EntryIterator.Entries(f)
+}
+
+// CopyEntries writes all entries of src to dst in batches of the given size,
+// without reading the blob files, e.g. to switch to another backend without
+// extracting the keys again. Keys are copied as stored, so dst must not
+// transform them again. Returns the number of entries copied.
+func CopyEntries(dst Backend, src EntryIterator, batchSize int) (n int64, err error) {
+	if batchSize < 1 {
+		batchSize = 100000
+	}
+	batch := make([]Entry, 0, batchSize)
+	err = withSuppressed{src}.Entries(func(e Entry) error {
+		batch = append(batch, e)
+		if len(batch) < batchSize {
+			return nil
+		}
+		if err := dst.WriteEntries(batch); err != nil {
+			return err
+		}
+		n += int64(len(batch))
+		batch = batch[:0]
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	if len(batch) > 0 {
+		if err := dst.WriteEntries(batch); err != nil {
+			return n, err
+		}
+		n += int64(len(batch))
+	}
+	return n, nil
+}
@@ -0,0 +1,110 @@
+package microblob
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultMissCacheKeys is the number of missing keys remembered, if not set.
+const defaultMissCacheKeys = 100000
+
+// MissCache remembers keys, that were not found, for a short time, so clients
+// asking for the same missing key over and over, e.g. because of a bug, are
+// answered without a database lookup. Writes remove the keys written, so new
+// documents are visible at once. Safe for concurrent use.
+type MissCache struct {
+	TTL     time.Duration // how long a key is remembered
+	MaxKeys int           // number of keys remembered, defaults to 100000
+
+	mu    sync.Mutex
+	gen   uint64 // counts invalidations, see Generation
+	items map[string]time.Time
+}
+
+// NewMissCache returns a cache remembering missing keys for ttl.
+func NewMissCache(ttl time.Duration) *MissCache {
+	return &MissCache{TTL: ttl, items: make(map[string]time.Time)}
+}
+
+// Contains returns true, if the key was recently not found.
+func (c *MissCache) Contains(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires, ok := c.items[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expires) {
+		delete(c.items, key)
+		return false
+	}
+	return true
+}
+
+// Generation returns the number of invalidations so far. A lookup takes the
+// generation before asking the database and passes it to Add, so a miss is
+// not remembered, if the key was written in the meantime.
+func (c *MissCache) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// Add remembers a missing key, unless the cache was invalidated since the
+// given generation. If the cache is full, expired keys are dropped first,
+// then arbitrary ones.
+func (c *MissCache) Add(key string, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if c.items == nil {
+		c.items = make(map[string]time.Time)
+	}
+	max := c.MaxKeys
+	if max <= 0 {
+		max = defaultMissCacheKeys
+	}
+	if len(c.items) >= max {
+		now := time.Now()
+		for k, expires := range c.items {
+			if now.After(expires) {
+				delete(c.items, k)
+			}
+		}
+		for k := range c.items {
+			if len(c.items) < max {
+				break
+			}
+			delete(c.items, k)
+		}
+	}
+	c.items[key] = time.Now().Add(c.TTL)
+}
+
+// Remove forgets the given keys, e.g. after they were written.
+func (c *MissCache) Remove(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for _, key := range keys {
+		delete(c.items, key)
+	}
+}
+
+// Purge forgets all keys.
+func (c *MissCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.items = make(map[string]time.Time)
+}
+
+// Len returns the number of keys remembered, including expired ones not yet
+// dropped.
+func (c *MissCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items)
+}
@@ -0,0 +1,468 @@
+package microblob
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// The MPH file holds a minimal perfect hash function over all keys and, for
+// each of the n slots, the entry of the key, that hashes to it. Keys are not
+// stored: each slot has the 64 bit hash of its key instead, to tell keys not
+// in the index apart. After an 8 byte magic and the number of slots and
+// buckets follow the bucket seeds and the slot columns: hash, offset, length,
+// decompressed size, file id and expiry time. Each column is an array of
+// integers packed with the bit width of its largest value, e.g. offsets in a
+// 4GB file take 32 bits and a column of zeros takes none. All numbers are
+// little endian.
+//
+// The function follows "hash, displace and compress": keys are hashed into n
+// buckets, which are placed largest first, each with the first seed, that
+// hashes all its keys into free slots; buckets with a single key take the next
+// free slot directly.
+const mphMagic = "MBMPH\x00\x00\x01"
+
+// mphMaxSeed limits the search for a seed of a bucket.
+const mphMaxSeed = 1 << 24
+
+// errMPHCollision if two keys have the same hash, which the index cannot hold.
+var errMPHCollision = errors.New("hash collision")
+
+// mphHash returns the hash of a key, as stored in the index.
+func mphHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// mphMix is the finalizer of splitmix64.
+func mphMix(z uint64) uint64 {
+	z ^= z >> 30
+	z *= 0xbf58476d1ce4e5b9
+	z ^= z >> 27
+	z *= 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// mphSlot returns the slot of a key hash with a seed, out of n.
+func mphSlot(h, seed, n uint64) uint64 {
+	return mphMix(h^(seed*0x9e3779b97f4a7c15)) % n
+}
+
+// packedInts is an array of unsigned integers of a fixed bit width.
+type packedInts struct {
+	width uint
+	words []uint64
+}
+
+// newPackedInts packs values with the bit width of the largest value.
+func newPackedInts(values []uint64) packedInts {
+	var max uint64
+	for _, v := range values {
+		if v > max {
+			max = v
+		}
+	}
+	p := packedInts{width: uint(bits.Len64(max))}
+	p.words = make([]uint64, (uint64(len(values))*uint64(p.width)+63)/64)
+	for i, v := range values {
+		p.set(i, v)
+	}
+	return p
+}
+
+func (p packedInts) set(i int, v uint64) {
+	if p.width == 0 {
+		return
+	}
+	bit := uint64(i) * uint64(p.width)
+	w, off := bit/64, uint(bit%64)
+	p.words[w] |= v << off
+	if off+p.width > 64 {
+		p.words[w+1] |= v >> (64 - off)
+	}
+}
+
+func (p packedInts) get(i uint64) uint64 {
+	if p.width == 0 {
+		return 0
+	}
+	bit := i * uint64(p.width)
+	w, off := bit/64, uint(bit%64)
+	v := p.words[w] >> off
+	if off+p.width > 64 {
+		v |= p.words[w+1] << (64 - off)
+	}
+	if p.width < 64 {
+		v &= 1<<p.width - 1
+	}
+	return v
+}
+
+// mphIndex is a loaded MPH file.
+type mphIndex struct {
+	n, nb   uint64
+	seeds   packedInts // seed<<1, or slot<<1|1 for buckets with a single key
+	columns [6]packedInts
+}
+
+// Column order in the MPH file.
+const (
+	mphHashes = iota
+	mphOffsets
+	mphLengths
+	mphSizes
+	mphFiles
+	mphExpires
+)
+
+// lookup returns the entry for a key.
+func (x *mphIndex) lookup(key string) (Entry, bool) {
+	if x.n == 0 {
+		return Entry{}, false
+	}
+	h := mphHash(key)
+	slot := x.seeds.get(mphMix(h) % x.nb)
+	if slot&1 == 1 {
+		slot >>= 1
+	} else {
+		slot = mphSlot(h, slot>>1, x.n)
+	}
+	if slot >= x.n || x.columns[mphHashes].get(slot) != h {
+		return Entry{}, false
+	}
+	return Entry{
+		Key:     key,
+		Offset:  int64(x.columns[mphOffsets].get(slot)),
+		Length:  int64(x.columns[mphLengths].get(slot)),
+		Size:    int64(x.columns[mphSizes].get(slot)),
+		File:    int(x.columns[mphFiles].get(slot)),
+		Expires: int64(x.columns[mphExpires].get(slot)),
+	}, true
+}
+
+// BuildMPH writes all entries of an index into a new MPH file, so it can be
+// served with MPHBackend. Only the current version of each key is kept and
+// expired entries are dropped; inlined sections are not supported. All
+// entries are held in memory while building. The file is written next to
+// filename and renamed, when complete. Returns the number of entries written.
+func BuildMPH(filename string, src EntryIterator) (int64, error) {
+	var (
+		now     = time.Now()
+		hashes  []uint64
+		entries []Entry
+	)
+	err := withSuppressed{src}.Entries(func(e Entry) error {
+		if e.Data != nil {
+			return fmt.Errorf("entry %s is inlined, which the mph index does not support", e.Key)
+		}
+		if e.expired(now) {
+			return nil
+		}
+		hashes = append(hashes, mphHash(e.Key))
+		entries = append(entries, Entry{Offset: e.Offset, Length: e.Length, Size: e.Size, File: e.File, Expires: e.Expires})
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	n := uint64(len(hashes))
+	seeds := make([]uint64, n)
+	slots, err := placeMPH(hashes, seeds)
+	if err != nil {
+		return 0, err
+	}
+	var columns [6][]uint64
+	for i := range columns {
+		columns[i] = make([]uint64, n)
+	}
+	for i, s := range slots {
+		e := entries[i]
+		columns[mphHashes][s] = hashes[i]
+		columns[mphOffsets][s] = uint64(e.Offset)
+		columns[mphLengths][s] = uint64(e.Length)
+		columns[mphSizes][s] = uint64(e.Size)
+		columns[mphFiles][s] = uint64(e.File)
+		columns[mphExpires][s] = uint64(e.Expires)
+	}
+
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	bw := bufio.NewWriterSize(f, 1<<20)
+	var buf [8]byte
+	writeUint := func(v uint64) {
+		binary.LittleEndian.PutUint64(buf[:], v)
+		bw.Write(buf[:])
+	}
+	bw.WriteString(mphMagic)
+	writeUint(n)
+	writeUint(n) // number of buckets
+	for _, values := range append([][]uint64{seeds}, columns[:]...) {
+		p := newPackedInts(values)
+		writeUint(uint64(p.width))
+		for _, w := range p.words {
+			writeUint(w)
+		}
+	}
+	// Write errors stick to the buffered writer.
+	err = bw.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return 0, err
+	}
+	return int64(n), nil
+}
+
+// placeMPH finds a seed for each bucket, so that the hashes map to distinct
+// slots, one bucket per hash. Returns the slot of each hash.
+func placeMPH(hashes, seeds []uint64) ([]uint64, error) {
+	n := uint64(len(hashes))
+	if n == 0 {
+		return nil, nil
+	}
+	buckets := make([][]int, n)
+	for i, h := range hashes {
+		b := mphMix(h) % n
+		buckets[b] = append(buckets[b], i)
+	}
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return len(buckets[order[i]]) > len(buckets[order[j]]) })
+
+	var (
+		slots    = make([]uint64, n)
+		occupied = make([]bool, n)
+		tried    []uint64
+		free     uint64 // next slot to check for buckets with a single key
+	)
+	for _, b := range order {
+		items := buckets[b]
+		switch len(items) {
+		case 0:
+			continue
+		case 1:
+			for occupied[free] {
+				free++
+			}
+			occupied[free], slots[items[0]] = true, free
+			seeds[b] = free<<1 | 1
+			continue
+		}
+		for i := 1; i < len(items); i++ {
+			for _, j := range items[:i] {
+				if hashes[items[i]] == hashes[j] {
+					return nil, errMPHCollision
+				}
+			}
+		}
+		seed := uint64(1)
+	search:
+		for ; ; seed++ {
+			if seed > mphMaxSeed {
+				return nil, fmt.Errorf("no seed found for bucket of %d keys", len(items))
+			}
+			tried = tried[:0]
+			for _, i := range items {
+				s := mphSlot(hashes[i], seed, n)
+				if occupied[s] {
+					continue search
+				}
+				for _, t := range tried {
+					if t == s {
+						continue search
+					}
+				}
+				tried = append(tried, s)
+			}
+			break
+		}
+		for k, i := range items {
+			occupied[tried[k]], slots[i] = true, tried[k]
+		}
+		seeds[b] = seed << 1
+	}
+	return slots, nil
+}
+
+// readMPH loads an MPH file.
+func readMPH(filename string) (*mphIndex, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	invalid := fmt.Errorf("%s: not an mph index", filename)
+	if len(b) < 24 || !bytes.Equal(b[:8], []byte(mphMagic)) {
+		return nil, invalid
+	}
+	x := &mphIndex{
+		n:  binary.LittleEndian.Uint64(b[8:]),
+		nb: binary.LittleEndian.Uint64(b[16:]),
+	}
+	b = b[24:]
+	for i := -1; i < len(x.columns); i++ {
+		count := x.n
+		if i < 0 {
+			count = x.nb
+		}
+		if len(b) < 8 {
+			return nil, invalid
+		}
+		p := packedInts{width: uint(binary.LittleEndian.Uint64(b))}
+		b = b[8:]
+		if p.width > 64 {
+			return nil, invalid
+		}
+		nw := (count*uint64(p.width) + 63) / 64
+		if uint64(len(b))/8 < nw {
+			return nil, invalid
+		}
+		p.words = make([]uint64, nw)
+		for k := range p.words {
+			p.words[k] = binary.LittleEndian.Uint64(b[k*8:])
+		}
+		b = b[nw*8:]
+		if i < 0 {
+			x.seeds = p
+		} else {
+			x.columns[i] = p
+		}
+	}
+	if len(b) != 0 {
+		return nil, invalid
+	}
+	return x, nil
+}
+
+// MPHBackend serves documents with an immutable index in a single MPH file, as
+// written by BuildMPH. The index is held in memory, it takes about the width of
+// the key hash, offset and length per key, and a lookup takes a few hash
+// computations and no reads besides the document. A key not in the index is
+// reported as found only if its 64 bit hash equals that of an indexed key.
+// Updates are not supported.
+type MPHBackend struct {
+	Filename      string
+	Blobfile      string
+	Blobfiles     []string // additional blob files, entries with file id n refer to Blobfiles[n-1]
+	Separator     byte     // terminates records in the blob file, defaults to newline
+	Compression   string   // "zstd", if each blob is stored as a separate zstd frame
+	MaxRecordSize int64    // if positive, longer documents are not read, see ErrRecordTooLarge
+
+	mu    sync.Mutex
+	index *mphIndex
+	blobs blobSet
+}
+
+// open loads the index and opens the blob files. Safe to call many times.
+func (b *MPHBackend) open() (*mphIndex, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.index != nil {
+		return b.index, nil
+	}
+	index, err := readMPH(b.Filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.blobs.open(append([]string{b.Blobfile}, b.Blobfiles...)); err != nil {
+		return nil, err
+	}
+	b.index = index
+	return index, nil
+}
+
+// WriteEntries fails, the index is immutable.
+func (b *MPHBackend) WriteEntries(entries []Entry) error {
+	return fmt.Errorf("mph index %s is read-only", b.Filename)
+}
+
+// Locate returns the entry for a key, leveldb.ErrNotFound, if there is none.
+func (b *MPHBackend) Locate(key string) (Entry, error) {
+	defer stageLatency.Observe("index", time.Now())
+	index, err := b.open()
+	if err != nil {
+		return Entry{}, err
+	}
+	e, ok := index.lookup(key)
+	if !ok || e.expired(time.Now()) {
+		return Entry{}, leveldb.ErrNotFound
+	}
+	return e, nil
+}
+
+// Get retrieves the document for a key.
+func (b *MPHBackend) Get(key string) ([]byte, error) {
+	e, err := b.Locate(key)
+	if err != nil {
+		return nil, err
+	}
+	return b.blobs.read(e, b.Compression, b.Separator, b.MaxRecordSize)
+}
+
+// Count returns the number of entries.
+func (b *MPHBackend) Count() (int64, error) {
+	index, err := b.open()
+	if err != nil {
+		return 0, err
+	}
+	return int64(index.n), nil
+}
+
+// Check returns an error, if the index cannot be loaded or the blob files
+// cannot be opened.
+func (b *MPHBackend) Check() error {
+	_, err := b.open()
+	return err
+}
+
+// RecordSeparator returns the record separator of the blob files.
+func (b *MPHBackend) RecordSeparator() byte {
+	if b.Separator == 0 {
+		return '\n'
+	}
+	return b.Separator
+}
+
+// IndexSize returns the size of the MPH file.
+func (b *MPHBackend) IndexSize() (int64, error) {
+	fi, err := os.Stat(b.Filename)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// Reload drops the loaded index and closes the blob files, they are loaded
+// again on next access, e.g. after a rebuilt index has been moved into place.
+func (b *MPHBackend) Reload() error { return b.Close() }
+
+// Close closes the blob files.
+func (b *MPHBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.index = nil
+	return b.blobs.Close()
+}
@@ -0,0 +1,62 @@
+package microblob
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// maxSuggestProbes bounds the prefix lookups for suggestions per miss.
+const maxSuggestProbes = 8
+
+// NotFound answers lookups of missing keys with a JSON error instead of plain
+// text, optionally listing the indexed keys nearest to the requested one, to
+// help with identifier formatting issues, like a wrong prefix or a trailing
+// character.
+type NotFound struct {
+	Suggest int // number of nearest keys listed, 0 disables suggestions
+}
+
+// notFoundError is the JSON body of a miss.
+type notFoundError struct {
+	Error       string   `json:"error"`
+	Key         string   `json:"key"`
+	Status      int      `json:"status"`
+	Suggestions []string `json:"suggestions,omitempty"`
+}
+
+// write responds to the miss of a key.
+func (n *NotFound) write(w http.ResponseWriter, backend Backend, key string, err error) {
+	body := notFoundError{Error: err.Error(), Key: key, Status: http.StatusNotFound}
+	if n.Suggest > 0 {
+		body.Suggestions = suggestKeys(backend, key, n.Suggest)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(body)
+}
+
+// suggestKeys returns up to limit keys sharing the longest prefix with the
+// given key. Prefixes are shortened by 1, 2, 4 and so on characters, so a miss
+// costs a few lookups only. Suppressed keys are not listed.
+func suggestKeys(backend Backend, key string, limit int) []string {
+	lister, ok := backend.(KeyLister)
+	if !ok {
+		return nil
+	}
+	for i, cut := 0, 1; i < maxSuggestProbes && cut < len(key); i, cut = i+1, cut*2 {
+		keys, err := lister.Keys(key[:len(key)-cut], "", limit+1)
+		if err != nil {
+			return nil
+		}
+		var suggestions []string
+		for _, k := range keys {
+			if k != key && len(suggestions) < limit {
+				suggestions = append(suggestions, k)
+			}
+		}
+		if len(suggestions) > 0 {
+			return suggestions
+		}
+	}
+	return nil
+}
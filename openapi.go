@@ -0,0 +1,458 @@
+package microblob
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// apiSchema is a (small subset of a) JSON schema, the empty schema allows any
+// value.
+type apiSchema struct {
+	Type   string     `json:"type,omitempty"`
+	Format string     `json:"format,omitempty"`
+	Items  *apiSchema `json:"items,omitempty"`
+}
+
+var (
+	anySchema    = apiSchema{}
+	stringSchema = apiSchema{Type: "string"}
+	intSchema    = apiSchema{Type: "integer", Format: "int64"}
+	boolSchema   = apiSchema{Type: "boolean"}
+	objectSchema = apiSchema{Type: "object"}
+	binarySchema = apiSchema{Type: "string", Format: "binary"}
+)
+
+// apiParameter describes a path, query or header parameter.
+type apiParameter struct {
+	Name        string    `json:"name"`
+	In          string    `json:"in"`
+	Description string    `json:"description,omitempty"`
+	Required    bool      `json:"required,omitempty"`
+	Schema      apiSchema `json:"schema"`
+}
+
+// apiMedia is the schema of a request or response body of a media type.
+type apiMedia struct {
+	Schema apiSchema `json:"schema"`
+}
+
+// apiBody describes a request body.
+type apiBody struct {
+	Required bool                `json:"required"`
+	Content  map[string]apiMedia `json:"content"`
+}
+
+// apiResponse describes a response.
+type apiResponse struct {
+	Description string              `json:"description"`
+	Content     map[string]apiMedia `json:"content,omitempty"`
+}
+
+// apiOperation describes a method on a path.
+type apiOperation struct {
+	Summary     string                 `json:"summary"`
+	OperationID string                 `json:"operationId"`
+	Deprecated  bool                   `json:"deprecated,omitempty"`
+	Parameters  []apiParameter         `json:"parameters,omitempty"`
+	RequestBody *apiBody               `json:"requestBody,omitempty"`
+	Responses   map[string]apiResponse `json:"responses"`
+	Security    []map[string][]string  `json:"security,omitempty"`
+}
+
+func pathParam(name, description string) apiParameter {
+	return apiParameter{Name: name, In: "path", Description: description, Required: true, Schema: stringSchema}
+}
+
+func queryParam(name string, schema apiSchema, description string) apiParameter {
+	return apiParameter{Name: name, In: "query", Description: description, Schema: schema}
+}
+
+func headerParam(name, description string) apiParameter {
+	return apiParameter{Name: name, In: "header", Description: description, Schema: stringSchema}
+}
+
+// body returns a request body of the given media types.
+func body(schema apiSchema, mediaTypes ...string) *apiBody {
+	b := &apiBody{Required: true, Content: make(map[string]apiMedia)}
+	for _, t := range mediaTypes {
+		b.Content[t] = apiMedia{Schema: schema}
+	}
+	return b
+}
+
+// response returns a response, with a body of the media type, if not empty.
+func response(description, mediaType string, schema apiSchema) apiResponse {
+	r := apiResponse{Description: description}
+	if mediaType != "" {
+		r.Content = map[string]apiMedia{mediaType: {Schema: schema}}
+	}
+	return r
+}
+
+// openAPI returns an OpenAPI 3 document describing the routes set up by
+// NewHandlerOptions with the given options. Mutating routes are left out, if
+// read-only, and require a bearer token, if one is set. Keys may contain
+// slashes, which OpenAPI cannot express in path parameters.
+func openAPI(opts HandlerOptions) map[string]interface{} {
+	var (
+		contentType = opts.ContentType
+		paths       = make(map[string]map[string]apiOperation)
+		security    []map[string][]string
+	)
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	if opts.AuthToken != "" {
+		security = []map[string][]string{{"bearer": {}}}
+	}
+	add := func(path, method string, op apiOperation) {
+		if paths[path] == nil {
+			paths[path] = make(map[string]apiOperation)
+		}
+		paths[path][method] = op
+	}
+	key := pathParam("key", "the key, may contain slashes")
+	page := []apiParameter{
+		queryParam("limit", intSchema, "page size, default 1000"),
+		queryParam("cursor", stringSchema, "cursor of the next page, from the previous response"),
+	}
+	keysBody := body(apiSchema{Type: "array", Items: &stringSchema}, "application/json", "text/plain")
+	notFound := response("not found or not supported by the backend", "", anySchema)
+
+	blobResponses := map[string]apiResponse{
+		"200": response("the document", contentType, anySchema),
+		"206": response("the requested ranges of the document", contentType, anySchema),
+		"304": response("not modified, the document matches If-None-Match", "", anySchema),
+		"404": response("key not found", "", anySchema),
+		"410": response("key suppressed", "", anySchema),
+		"416": response("range beyond the end of the document", "", anySchema),
+		"422": response("fields requested from a document, that is no JSON object", "", anySchema),
+	}
+	if opts.Fallback != nil {
+		blobResponses["502"] = response("fallback failed", "", anySchema)
+	}
+	add("/{key}", "get", apiOperation{
+		Summary:     "Get the document for a key",
+		OperationID: "getBlob",
+		Parameters: []apiParameter{
+			key,
+			queryParam("version", intSchema, "a retained version, see /versions/{key}"),
+			queryParam("envelope", boolSchema, "wrap the document in a JSON object with key, offset and length"),
+			queryParam("fields", stringSchema, "comma separated top-level fields to return"),
+			queryParam("pretty", boolSchema, "indent JSON documents"),
+			queryParam("withkey", boolSchema, "add the key to the JSON document"),
+			headerParam("If-None-Match", "entity tag of a cached copy"),
+			headerParam("Range", "byte ranges of the document, e.g. bytes=0-1023"),
+			headerParam("If-Range", "entity tag, the ranges apply to, otherwise the whole document is sent"),
+		},
+		Responses: blobResponses,
+	})
+	add("/blob", "get", apiOperation{
+		Summary:     "Get the document for a key, legacy route",
+		OperationID: "getBlobLegacy",
+		Deprecated:  true,
+		Parameters:  []apiParameter{{Name: "key", In: "query", Required: true, Schema: stringSchema}},
+		Responses:   blobResponses,
+	})
+	add("/blobs", "post", apiOperation{
+		Summary:     "Get the documents for a list of keys",
+		OperationID: "getBlobs",
+		RequestBody: keysBody,
+		Responses: map[string]apiResponse{
+			"200": response("the documents found, missing keys in the X-Missing-Keys trailer", "application/x-ndjson", stringSchema),
+			"400": response("invalid list of keys", "", anySchema),
+		},
+	})
+	add("/multiget", "post", apiOperation{
+		Summary:     "Get the documents for a list of keys, with the status of each key",
+		OperationID: "multiGet",
+		Parameters:  []apiParameter{queryParam("detail", boolSchema, "map each key to its status and document or error, instead of streaming the documents found")},
+		RequestBody: keysBody,
+		Responses: map[string]apiResponse{
+			"200": response("with detail=1, an object mapping each key to status, document and error; otherwise as /blobs", "application/json", anySchema),
+			"400": response("invalid list of keys", "", anySchema),
+		},
+	})
+	add("/exists/{key}", "get", apiOperation{
+		Summary:     "Check, whether a key exists",
+		OperationID: "exists",
+		Parameters:  []apiParameter{key},
+		Responses: map[string]apiResponse{
+			"200": response("key exists", "", anySchema),
+			"404": response("key not found", "", anySchema),
+		},
+	})
+	add("/exists", "post", apiOperation{
+		Summary:     "Check, which of a list of keys exist",
+		OperationID: "existsBatch",
+		RequestBody: keysBody,
+		Responses: map[string]apiResponse{
+			"200": response("found and missing keys", "application/json", objectSchema),
+			"400": response("invalid list of keys", "", anySchema),
+			"413": response("too many keys", "", anySchema),
+		},
+	})
+	add("/versions/{key}", "get", apiOperation{
+		Summary:     "List the retained versions of the document for a key",
+		OperationID: "versions",
+		Parameters:  []apiParameter{key},
+		Responses: map[string]apiResponse{
+			"200": response("versions, newest first", "application/json", objectSchema),
+			"404": notFound,
+		},
+	})
+	add("/checksum/{key}", "get", apiOperation{
+		Summary:     "Get the SHA-256 of the document for a key",
+		OperationID: "checksum",
+		Parameters:  []apiParameter{key},
+		Responses: map[string]apiResponse{
+			"200": response("key and hex encoded SHA-256", "application/json", objectSchema),
+			"404": response("key not found", "", anySchema),
+			"410": response("key suppressed", "", anySchema),
+		},
+	})
+	add("/audit", "get", apiOperation{
+		Summary:     "List the most recent mutations from the audit log",
+		OperationID: "audit",
+		Parameters: []apiParameter{
+			queryParam("action", stringSchema, "only update, put, delete or append"),
+			queryParam("key", stringSchema, "only mutations of this key"),
+			queryParam("client", stringSchema, "only mutations by this client address"),
+			queryParam("since", stringSchema, "only mutations at or after this RFC 3339 time"),
+			queryParam("limit", intSchema, "maximum number of records, default 1000"),
+		},
+		Responses: map[string]apiResponse{
+			"200": response("the records, oldest first", "application/json", apiSchema{Type: "array"}),
+			"401": response("missing or invalid token", "", anySchema),
+			"404": response("no audit log", "", anySchema),
+		},
+	})
+	add("/jobs/{id}", "get", apiOperation{
+		Summary:     "Get the state of a queued update",
+		OperationID: "job",
+		Parameters:  []apiParameter{{Name: "id", In: "path", Required: true, Schema: stringSchema}},
+		Responses: map[string]apiResponse{
+			"200": response("state of the job: queued, running, done or failed", "application/json", objectSchema),
+			"404": response("job not found or no queue", "", anySchema),
+		},
+	})
+	add("/prefix/{prefix}", "get", apiOperation{
+		Summary:     "Get the documents for all keys with a prefix",
+		OperationID: "prefix",
+		Parameters:  append([]apiParameter{pathParam("prefix", "the key prefix")}, page...),
+		Responses: map[string]apiResponse{
+			"200": response("the documents, the cursor of the next page in X-Next-Cursor", "application/x-ndjson", stringSchema),
+			"404": notFound,
+		},
+	})
+	add("/keys", "get", apiOperation{
+		Summary:     "List keys in lexicographic order",
+		OperationID: "keys",
+		Parameters:  append([]apiParameter{queryParam("prefix", stringSchema, "only keys with this prefix")}, page...),
+		Responses: map[string]apiResponse{
+			"200": response("a page of keys and the cursor of the next page", "application/json", objectSchema),
+			"404": notFound,
+		},
+	})
+	add("/export", "get", apiOperation{
+		Summary:     "Stream all documents",
+		OperationID: "export",
+		Responses: map[string]apiResponse{
+			"200": response("all documents", "application/x-ndjson", stringSchema),
+			"404": notFound,
+		},
+	})
+	add("/dump", "get", apiOperation{
+		Summary:     "Stream the index in flat index format, in key order",
+		OperationID: "dump",
+		Responses: map[string]apiResponse{
+			"200": response("key, offset, length, size, file, expiry and crc per line", "text/tab-separated-values", stringSchema),
+			"404": notFound,
+		},
+	})
+	add("/scan", "get", apiOperation{
+		Summary:     "Stream the records matching a regular expression",
+		OperationID: "scan",
+		Parameters: []apiParameter{
+			{Name: "match", In: "query", Description: "regular expression", Required: true, Schema: stringSchema},
+			queryParam("limit", intSchema, "maximum number of matches, default 100"),
+			queryParam("from", intSchema, "offset to start from, see the X-Next-Offset trailer"),
+		},
+		Responses: map[string]apiResponse{
+			"200": response("matching records", "application/x-ndjson", stringSchema),
+			"400": response("invalid parameters", "", anySchema),
+			"404": notFound,
+			"416": response("offset beyond end of blob file", "", anySchema),
+		},
+	})
+	add("/replicate", "get", apiOperation{
+		Summary:     "Stream the blob file from an offset",
+		OperationID: "replicate",
+		Security:    security,
+		Parameters:  []apiParameter{queryParam("from", intSchema, "offset to start from")},
+		Responses: map[string]apiResponse{
+			"200": response("raw bytes of the blob file", "application/octet-stream", binarySchema),
+		},
+	})
+	add("/snapshot", "post", apiOperation{
+		Summary:     "Stream a consistent backup of blob files and index",
+		OperationID: "snapshot",
+		Security:    security,
+		Responses: map[string]apiResponse{
+			"200": response("a tar archive", "application/x-tar", binarySchema),
+			"401": response("missing or invalid token", "", anySchema),
+			"404": notFound,
+		},
+	})
+	if !opts.ReadOnly {
+		add("/rebuild", "post", apiOperation{
+			Summary:     "Rebuild the index from a new file in the background, then switch to it",
+			OperationID: "rebuild",
+			Security:    security,
+			Parameters:  []apiParameter{queryParam("file", stringSchema, "name of the new file, in the directory of the blob file")},
+			Responses: map[string]apiResponse{
+				"202": response("started, the state of the rebuild", "application/json", anySchema),
+				"400": response("missing or invalid file", "", anySchema),
+				"401": response("missing or invalid token", "", anySchema),
+				"404": notFound,
+				"409": response("a rebuild is running", "", anySchema),
+			},
+		})
+		add("/update", "post", apiOperation{
+			Summary:     "Append documents and index them",
+			OperationID: "update",
+			Security:    security,
+			Parameters: []apiParameter{
+				queryParam("key", stringSchema, "key path in JSON documents, may be repeated"),
+				queryParam("sep", stringSchema, "separator of multiple values of a key"),
+				queryParam("pattern", stringSchema, "regular expression extracting the key, may be repeated"),
+				queryParam("column", intSchema, "1-based column holding the key"),
+				queryParam("delimiter", stringSchema, "column delimiter, default tab"),
+				queryParam("xml-path", stringSchema, "path to the key in XML records, may be repeated"),
+				queryParam("key-template", stringSchema, "template building a key from fields of JSON documents"),
+				queryParam("extractor", stringSchema, "registered key extractor with options, e.g. json:id"),
+				queryParam("url", stringSchema, "fetch the documents from this URL instead of the body"),
+				queryParam("ttl", stringSchema, "TTL of the keys, e.g. 24h"),
+				headerParam("If-Match", "size or tag the blob file must have"),
+			},
+			RequestBody: &apiBody{Content: map[string]apiMedia{"application/x-ndjson": {Schema: stringSchema}}},
+			Responses: map[string]apiResponse{
+				"200": response("appended, the new tag of the blob file in ETag", "", anySchema),
+				"202": response("queued, with -update-spool, the job, whose state is served at the Location", "application/json", objectSchema),
+				"400": response("invalid parameters or documents", "", anySchema),
+				"401": response("missing or invalid token", "", anySchema),
+				"403": response("url not allowed", "", anySchema),
+				"412": response("blob file does not match If-Match", "", anySchema),
+			},
+		})
+		add("/load", "post", apiOperation{
+			Summary:     "Index precomputed entries in flat index format, without extracting keys",
+			OperationID: "load",
+			Security:    security,
+			RequestBody: &apiBody{Content: map[string]apiMedia{"text/tab-separated-values": {Schema: stringSchema}}},
+			Responses: map[string]apiResponse{
+				"200": response("the number of entries indexed", "application/json", objectSchema),
+				"400": response("malformed line or entry out of bounds, with the number of entries indexed before", "application/json", objectSchema),
+				"401": response("missing or invalid token", "", anySchema),
+			},
+		})
+		add("/{key}", "put", apiOperation{
+			Summary:     "Add a document under a key",
+			OperationID: "putBlob",
+			Security:    security,
+			Parameters:  []apiParameter{key, queryParam("ttl", stringSchema, "TTL of the key, e.g. 24h")},
+			RequestBody: body(anySchema, "application/json"),
+			Responses: map[string]apiResponse{
+				"201": response("created", "", anySchema),
+				"400": response("invalid JSON or ttl", "", anySchema),
+				"401": response("missing or invalid token", "", anySchema),
+				"409": response("key exists and -on-duplicate keeps the indexed document", "", anySchema),
+			},
+		})
+		add("/{key}", "patch", apiOperation{
+			Summary:     "Merge a JSON merge patch into a document and append the result",
+			OperationID: "patchBlob",
+			Security:    security,
+			Parameters:  []apiParameter{key, queryParam("ttl", stringSchema, "TTL of the key, e.g. 24h")},
+			RequestBody: body(anySchema, "application/merge-patch+json"),
+			Responses: map[string]apiResponse{
+				"200": response("the merged document", "application/json", anySchema),
+				"400": response("invalid JSON or ttl", "", anySchema),
+				"401": response("missing or invalid token", "", anySchema),
+				"404": response("key not found", "", anySchema),
+				"409": response("-on-duplicate keeps the indexed document", "", anySchema),
+				"412": response("document does not match If-Match", "", anySchema),
+				"422": response("document is not JSON", "", anySchema),
+			},
+		})
+		add("/{key}", "delete", apiOperation{
+			Summary:     "Remove a key",
+			OperationID: "deleteBlob",
+			Security:    security,
+			Parameters:  []apiParameter{key},
+			Responses: map[string]apiResponse{
+				"204": response("deleted", "", anySchema),
+				"401": response("missing or invalid token", "", anySchema),
+				"404": response("key not found", "", anySchema),
+				"405": response("not supported by the backend", "", anySchema),
+			},
+		})
+	}
+	for _, r := range []struct {
+		path, id, summary, mediaType string
+	}{
+		{"/", "index", "Name, version and links", "application/json"},
+		{"/count", "count", "Number of keys", "application/json"},
+		{"/info", "info", "Number of keys, sizes of blob file and index, time of the last append", "application/json"},
+		{"/stats", "stats", "Request statistics", "application/json"},
+		{"/stats/latency", "latency", "Recent latency quantiles per route and for index lookups and blob reads", "application/json"},
+		{"/stats/topkeys", "topKeys", "Most frequently looked up keys, with -top-keys", "application/json"},
+		{"/metrics", "metrics", "Metrics in the Prometheus text format", "text/plain"},
+		{"/debug/vars", "vars", "Exported variables", "application/json"},
+		{"/healthz", "healthz", "Liveness", "text/plain"},
+		{"/rebuild", "rebuildStatus", "State of the running or last rebuild", "application/json"},
+		{"/readyz", "readyz", "Readiness, 503 if index or blob file cannot be opened", "text/plain"},
+		{"/ui", "ui", "Status page", "text/html"},
+		{"/openapi.json", "openapi", "This document", "application/json"},
+	} {
+		op := apiOperation{
+			Summary:     r.summary,
+			OperationID: r.id,
+			Responses:   map[string]apiResponse{"200": response("ok", r.mediaType, anySchema)},
+		}
+		if r.path == "/stats/topkeys" {
+			op.Parameters = []apiParameter{queryParam("n", intSchema, "number of keys")}
+		}
+		add(r.path, "get", op)
+	}
+	doc := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]string{
+			"title":   "microblob",
+			"version": Version,
+		},
+		"paths": paths,
+	}
+	if opts.Prefix != "" {
+		doc["servers"] = []map[string]string{{"url": opts.Prefix}}
+	}
+	if opts.AuthToken != "" {
+		doc["components"] = map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]string{"type": "http", "scheme": "bearer"},
+			},
+		}
+	}
+	return doc
+}
+
+// openAPIHandler serves the OpenAPI document as JSON.
+func openAPIHandler(opts HandlerOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(openAPI(opts)); err != nil {
+			http.Error(w, "could not serialize", http.StatusInternalServerError)
+			return
+		}
+	})
+}
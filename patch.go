@@ -0,0 +1,152 @@
+package microblob
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// PatchHandler applies a JSON merge patch (RFC 7386) to a document. The
+// merged document is appended to the blob file and the key points to it, the
+// previous document stays, like with PUT.
+type PatchHandler struct {
+	Blobfile string
+	Backend  Backend
+	TTL      time.Duration // default TTL of the key, overridden by a ttl parameter
+	Audit    *AuditLog     // records each patch, if not nil
+}
+
+// ServeHTTP merges the patch in the request body into the document of the key
+// from the URL and responds with the merged document. With If-Match, the
+// document must have the given ETag, so clients can detect changes made since
+// they read it.
+func (h PatchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	key := mux.Vars(r)["key"]
+	ttl, err := requestTTL(r.URL.Query(), h.TTL)
+	if err != nil {
+		http.Error(w, "patch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	patch, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !json.Valid(patch) {
+		http.Error(w, "patch: invalid JSON", http.StatusBadRequest)
+		return
+	}
+	rec := auditRecord(r, AuditPatch, h.Blobfile)
+	rec.Key = key
+	var merged []byte
+	// The lock of the blob file is held from reading the document to
+	// appending the merged one, so no other append, like a PUT or another
+	// patch, gets lost in between, but not while responding.
+	status, err := func() (int, error) {
+		unlock, err := lockBlob(h.Blobfile)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		defer unlock()
+		if v := r.Header.Get("If-Match"); v != "" {
+			l, ok := h.Backend.(Locator)
+			if !ok {
+				return http.StatusNotImplemented, errors.New("If-Match not supported by the backend")
+			}
+			entry, err := l.Locate(key)
+			if err != nil {
+				return lookupStatus(err), err
+			}
+			if !matchesTag(v, entryTag(h.Backend, entry)) {
+				return http.StatusPreconditionFailed, errors.New("document changed")
+			}
+		}
+		doc, err := GetContext(r.Context(), h.Backend, key)
+		if err != nil {
+			return lookupStatus(err), err
+		}
+		if merged, err = mergeJSON(doc, patch); err != nil {
+			return http.StatusUnprocessableEntity, fmt.Errorf("document is not JSON: %v", err)
+		}
+		if err := appendDocumentTTLLocked(h.Blobfile, h.Backend, key, merged, ttl); err != nil {
+			rec.Status, rec.Error = putStatus(err), err.Error()
+			h.Audit.record(rec)
+			return rec.Status, err
+		}
+		if l, ok := h.Backend.(Locator); ok {
+			if entry, err := l.Locate(key); err == nil {
+				rec.Offset, rec.Length = entry.Offset, entry.Length
+				w.Header().Set("ETag", entryTag(h.Backend, entry))
+			}
+		}
+		return http.StatusOK, nil
+	}()
+	if err != nil {
+		http.Error(w, "patch: "+err.Error(), status)
+		return
+	}
+	rec.Status, rec.Keys = http.StatusOK, 1
+	h.Audit.record(rec)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(merged)
+}
+
+// mergeJSON applies a JSON merge patch to a document and returns the merged
+// document. Numbers are kept as written, object members come out sorted.
+func mergeJSON(doc, patch []byte) ([]byte, error) {
+	target, err := decodeJSON(doc)
+	if err != nil {
+		return nil, err
+	}
+	p, err := decodeJSON(patch)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(mergePatch(target, p)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeJSON decodes a JSON value, keeping numbers as written.
+func decodeJSON(b []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// mergePatch merges a patch into a target as described in RFC 7386: members
+// of a patch object replace those of the target, null removes them, objects
+// are merged recursively. A patch, that is not an object, replaces the target.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
+}
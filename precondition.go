@@ -0,0 +1,53 @@
+package microblob
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrPreconditionFailed if an append expects a different state of the blob
+// file, e.g. since another writer appended in between.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// BlobTag returns a tag for the current state of a blob file, its size and a
+// short hash of its tail. Since blob files are only appended to, the tag
+// changes with every append. Empty and missing files have the tag "0".
+func BlobTag(blobfn string) (string, error) {
+	fi, err := os.Stat(blobfn)
+	if os.IsNotExist(err) || (err == nil && fi.Size() == 0) {
+		return "0", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	fp, err := blobFingerprint(blobfn, fi.Size())
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%s", fi.Size(), fp.Tail[:16]), nil
+}
+
+// checkPrecondition returns ErrPreconditionFailed, unless the blob file matches
+// the expected state, given as size in bytes or as tag, see BlobTag. A quoted
+// entity tag, as in an If-Match header, is accepted as well, as is "*", which
+// always matches.
+func checkPrecondition(blobfn, expected string) error {
+	expected = strings.Trim(strings.TrimPrefix(strings.TrimSpace(expected), "W/"), `"`)
+	if expected == "" || expected == "*" {
+		return nil
+	}
+	tag, err := BlobTag(blobfn)
+	if err != nil {
+		return err
+	}
+	if _, err := strconv.ParseInt(expected, 10, 64); err == nil {
+		tag = strings.SplitN(tag, "-", 2)[0] // Compare sizes only.
+	}
+	if tag != expected {
+		return fmt.Errorf("%w: blob file is at %s, expected %s", ErrPreconditionFailed, tag, expected)
+	}
+	return nil
+}
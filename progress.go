@@ -0,0 +1,88 @@
+package microblob
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// progress tracks bytes and lines read during indexing and periodically
+// reports them.
+type progress struct {
+	w       io.Writer
+	total   int64 // expected number of bytes, zero if unknown
+	bytes   int64 // accessed atomically
+	lines   int64 // accessed atomically
+	started time.Time
+	done    chan struct{}
+}
+
+// newProgress starts reporting to w every interval.
+func newProgress(w io.Writer, total int64, interval time.Duration) *progress {
+	p := &progress{w: w, total: total, started: time.Now(), done: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.report()
+			case <-p.done:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// Write counts bytes and lines read.
+func (p *progress) Write(b []byte) (int, error) {
+	atomic.AddInt64(&p.bytes, int64(len(b)))
+	atomic.AddInt64(&p.lines, int64(bytes.Count(b, []byte("\n"))))
+	return len(b), nil
+}
+
+// report writes a single progress line.
+func (p *progress) report() {
+	var (
+		n       = atomic.LoadInt64(&p.bytes)
+		lines   = atomic.LoadInt64(&p.lines)
+		elapsed = time.Since(p.started)
+		rate    = float64(lines) / elapsed.Seconds()
+	)
+	if p.total <= 0 {
+		fmt.Fprintf(p.w, "%s processed, %d lines, %0.0f lines/s\n", humanBytes(n), lines, rate)
+		return
+	}
+	var (
+		pct = 100 * float64(n) / float64(p.total)
+		eta time.Duration
+	)
+	if n > 0 {
+		eta = time.Duration(float64(elapsed) * float64(p.total-n) / float64(n))
+	}
+	fmt.Fprintf(p.w, "%s of %s processed (%0.1f%%), %d lines, %0.0f lines/s, ETA %s\n",
+		humanBytes(n), humanBytes(p.total), pct, lines, rate, eta.Round(time.Second))
+}
+
+// stop stops reporting and writes a final line.
+func (p *progress) stop() {
+	close(p.done)
+	p.report()
+}
+
+// humanBytes formats a number of bytes, e.g. 1.5 GB.
+func humanBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
@@ -0,0 +1,120 @@
+package microblob
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// ErrNotObject if fields are requested from a document, that is no JSON object.
+var ErrNotObject = errors.New("document is not a JSON object")
+
+// parseFields returns the distinct, non-empty field names of a comma
+// separated list, in the given order.
+func parseFields(s string) []string {
+	var (
+		fields []string
+		seen   = make(map[string]bool)
+	)
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" && !seen[f] {
+			seen[f] = true
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// projectFields returns a JSON object with only the given top-level fields of
+// a document, in the given order, followed by a newline. Fields missing from
+// the document are left out.
+func projectFields(doc []byte, fields []string) ([]byte, error) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(doc, &m); err != nil || m == nil {
+		return nil, ErrNotObject
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, f := range fields {
+		v, ok := m[f]
+		if !ok {
+			continue
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(f)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes(), nil
+}
+
+// injectKey returns a JSON object with the key added as first field under the
+// given name, e.g. for records indexed by a pattern, that lack their own
+// identifier. Documents, that already have a field of that name, are returned
+// unchanged; documents, that are no JSON object, fail with ErrNotObject.
+func injectKey(doc []byte, name, key string) ([]byte, error) {
+	trimmed := bytes.TrimLeft(doc, " \t\r\n")
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return nil, ErrNotObject
+	}
+	k, err := json.Marshal(name)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Contains(trimmed, k) {
+		// Only parse documents, that may have the field.
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(trimmed, &m); err != nil || m == nil {
+			return nil, ErrNotObject
+		}
+		if _, ok := m[name]; ok {
+			return doc, nil
+		}
+	}
+	v, err := json.Marshal(key)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		buf  bytes.Buffer
+		rest = trimmed[1:]
+	)
+	buf.WriteByte('{')
+	buf.Write(k)
+	buf.WriteByte(':')
+	buf.Write(v)
+	if r := bytes.TrimLeft(rest, " \t\r\n"); len(r) > 0 && r[0] != '}' {
+		buf.WriteByte(',')
+	}
+	buf.Write(rest)
+	return buf.Bytes(), nil
+}
+
+// prettyJSON returns a JSON document indented for reading, followed by a
+// newline; other documents are returned unchanged.
+func prettyJSON(doc []byte) []byte {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, bytes.TrimSpace(doc), "", "  "); err != nil {
+		return doc
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// fieldsTag derives the entity tag of a projection from the tag of the
+// document.
+func fieldsTag(etag string, fields []string) string {
+	h := fnv.New32a()
+	h.Write([]byte(strings.Join(fields, ",")))
+	return fmt.Sprintf(`%s-%x"`, strings.TrimSuffix(etag, `"`), h.Sum32())
+}
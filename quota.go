@@ -0,0 +1,344 @@
+package microblob
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Quota limits the requests and the bytes served in each period, e.g. a day,
+// counted in fixed windows aligned to the period, so daily quotas reset at
+// midnight UTC and hourly quotas on the hour. A zero limit disables it.
+type Quota struct {
+	Period   time.Duration
+	Requests int64
+	Bytes    int64
+}
+
+// enabled returns true, if the quota limits anything.
+func (q Quota) enabled() bool {
+	return q.Period > 0 && (q.Requests > 0 || q.Bytes > 0)
+}
+
+// quotaUsage counts requests and bytes in the current window of a quota.
+type quotaUsage struct {
+	window   time.Time // start of the window
+	end      time.Time
+	requests int64
+	bytes    int64
+}
+
+// quotaSubject is a quota applying to a request and the key its usage is
+// counted under.
+type quotaSubject struct {
+	name  string
+	quota Quota
+}
+
+// Quotas limits requests and bandwidth globally, per namespace and per API
+// key, so a public instance cannot exceed an egress budget. Requests without
+// API key share the anonymous quota per client IP. Usage is kept in memory
+// and starts over on restart. Safe for concurrent use.
+type Quotas struct {
+	Global     Quota
+	Anonymous  Quota            // per client IP, for requests without API key
+	Keys       map[string]Quota // by API key, sent in the X-API-Key header
+	Namespaces map[string]Quota // by namespace, for requests below /ns/{name}/
+
+	mu        sync.Mutex
+	usage     map[string]*quotaUsage
+	nextPrune time.Time // end of the earliest window left after the last prune
+}
+
+// subjects returns the quotas applying to a request, the most specific first,
+// false, if the request has an unknown API key.
+func (q *Quotas) subjects(r *http.Request) ([]quotaSubject, bool) {
+	var namespace string
+	if rest := strings.TrimPrefix(r.URL.Path, "/ns/"); rest != r.URL.Path {
+		namespace = rest
+		if i := strings.Index(rest, "/"); i >= 0 {
+			namespace = rest[:i]
+		}
+	}
+	return q.subjectsFor(r.Header.Get("X-API-Key"), r.RemoteAddr, namespace)
+}
+
+// subjectsFor returns the quotas applying to a request with an API key, which
+// may be empty, from a client address to a namespace, which may be empty.
+func (q *Quotas) subjectsFor(key, addr, namespace string) ([]quotaSubject, bool) {
+	var subjects []quotaSubject
+	if key != "" {
+		quota, ok := q.Keys[key]
+		if !ok {
+			return nil, false
+		}
+		subjects = append(subjects, quotaSubject{"key:" + key, quota})
+	} else if q.Anonymous.enabled() {
+		client, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			client = addr
+		}
+		subjects = append(subjects, quotaSubject{"client:" + client, q.Anonymous})
+	}
+	if namespace != "" {
+		if quota, ok := q.Namespaces[namespace]; ok {
+			subjects = append(subjects, quotaSubject{"ns:" + namespace, quota})
+		}
+	}
+	subjects = append(subjects, quotaSubject{"global", q.Global})
+	return subjects, true
+}
+
+// current returns the usage of a subject in the window of the given time. The
+// caller holds the lock.
+func (q *Quotas) current(s quotaSubject, now time.Time) *quotaUsage {
+	if q.usage == nil {
+		q.usage = make(map[string]*quotaUsage)
+	}
+	if len(q.usage) > 100000 && !now.Before(q.nextPrune) {
+		q.prune(now)
+	}
+	window := now.Truncate(s.quota.Period)
+	u, ok := q.usage[s.name]
+	if !ok {
+		u = &quotaUsage{}
+		q.usage[s.name] = u
+	}
+	if !u.window.Equal(window) {
+		*u = quotaUsage{window: window, end: window.Add(s.quota.Period)}
+	}
+	return u
+}
+
+// prune removes the usage of windows, that have ended. Since nothing ends
+// before the earliest window left, the next prune waits for it. The caller
+// holds the lock.
+func (q *Quotas) prune(now time.Time) {
+	var next time.Time
+	for name, u := range q.usage {
+		if !now.Before(u.end) {
+			delete(q.usage, name)
+			continue
+		}
+		if next.IsZero() || u.end.Before(next) {
+			next = u.end
+		}
+	}
+	q.nextPrune = next
+}
+
+// quotaState is the usage of a quota, after a request was counted.
+type quotaState struct {
+	quota Quota
+	usage quotaUsage
+}
+
+// take counts a request against all quotas, unless one of them is exhausted.
+// Returns the state of the quota to report, the first exhausted one or the
+// most specific, and false, if the request exceeds a quota.
+func (q *Quotas) take(subjects []quotaSubject, now time.Time) (quotaState, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var report *quotaState
+	for _, s := range subjects {
+		if !s.quota.enabled() {
+			continue
+		}
+		u := q.current(s, now)
+		if (s.quota.Requests > 0 && u.requests >= s.quota.Requests) || (s.quota.Bytes > 0 && u.bytes >= s.quota.Bytes) {
+			return quotaState{s.quota, *u}, false
+		}
+		if report == nil {
+			report = &quotaState{quota: s.quota, usage: *u}
+		}
+	}
+	if report == nil {
+		return quotaState{}, true
+	}
+	for _, s := range subjects {
+		if s.quota.enabled() {
+			q.current(s, now).requests++
+		}
+	}
+	report.usage.requests++
+	return *report, true
+}
+
+// charge counts the bytes of a response against all quotas, in the window the
+// request was counted in.
+func (q *Quotas) charge(subjects []quotaSubject, started time.Time, n int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, s := range subjects {
+		if u, ok := q.usage[s.name]; ok && s.quota.enabled() && u.window.Equal(started.Truncate(s.quota.Period)) {
+			u.bytes += n
+		}
+	}
+}
+
+// setHeaders reports limits, remaining requests and bytes and the seconds
+// until the window resets.
+func (s quotaState) setHeaders(h http.Header, now time.Time) {
+	if s.quota.Requests > 0 {
+		h.Set("X-Quota-Requests-Limit", strconv.FormatInt(s.quota.Requests, 10))
+		h.Set("X-Quota-Requests-Remaining", strconv.FormatInt(remaining(s.quota.Requests, s.usage.requests), 10))
+	}
+	if s.quota.Bytes > 0 {
+		h.Set("X-Quota-Bytes-Limit", strconv.FormatInt(s.quota.Bytes, 10))
+		h.Set("X-Quota-Bytes-Remaining", strconv.FormatInt(remaining(s.quota.Bytes, s.usage.bytes), 10))
+	}
+	h.Set("X-Quota-Reset", strconv.FormatInt(int64(s.reset(now).Seconds()), 10))
+}
+
+// reset returns the time until the window of the quota ends, at least a
+// second.
+func (s quotaState) reset(now time.Time) time.Duration {
+	d := s.usage.end.Sub(now)
+	if d < time.Second {
+		d = time.Second
+	}
+	return d.Round(time.Second)
+}
+
+// remaining returns what is left of a limit, at least zero.
+func remaining(limit, used int64) int64 {
+	if used >= limit {
+		return 0
+	}
+	return limit - used
+}
+
+// WithQuotas responds with 429 Too Many Requests, if a request exceeds a quota,
+// with Retry-After set to the end of the window, and with 401 Unauthorized to
+// requests with an unknown API key. Responses carry the state of the quota in
+// X-Quota-* headers. Health checks are not counted.
+func WithQuotas(q *Quotas, h http.Handler) http.Handler {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		subjects, ok := q.subjects(r)
+		if !ok {
+			http.Error(w, "unknown API key", http.StatusUnauthorized)
+			errCounter.Add(1)
+			return
+		}
+		now := time.Now()
+		state, ok := q.take(subjects, now)
+		if state.quota.enabled() {
+			state.setHeaders(w.Header(), now)
+		}
+		if !ok {
+			w.Header().Set("Retry-After", strconv.FormatInt(int64(state.reset(now).Seconds()), 10))
+			http.Error(w, "quota exceeded", http.StatusTooManyRequests)
+			errCounter.Add(1)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		q.charge(subjects, now, sw.n)
+	}
+	return http.HandlerFunc(f)
+}
+
+// GRPCQuotas returns server options, that count gRPC calls against the global
+// quota and those of API keys, sent in the x-api-key metadata, or of client
+// addresses. The bytes of the documents sent are counted as well. Calls
+// exceeding a quota fail with ResourceExhausted, with the seconds until the
+// window ends in the retry-after metadata, calls with an unknown API key with
+// Unauthenticated. The state of the quota is sent in x-quota-* metadata.
+func GRPCQuotas(q *Quotas) []grpc.ServerOption {
+	unary := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		subjects, now, err := q.takeGRPC(ctx, func(md metadata.MD) error { return grpc.SetHeader(ctx, md) })
+		if err != nil {
+			return nil, err
+		}
+		resp, err := handler(ctx, req)
+		q.charge(subjects, now, documentBytes(resp))
+		return resp, err
+	}
+	stream := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		subjects, now, err := q.takeGRPC(ss.Context(), ss.SetHeader)
+		if err != nil {
+			return err
+		}
+		cs := &countingStream{ServerStream: ss}
+		err = handler(srv, cs)
+		q.charge(subjects, now, cs.n)
+		return err
+	}
+	return []grpc.ServerOption{grpc.ChainUnaryInterceptor(unary), grpc.ChainStreamInterceptor(stream)}
+}
+
+// takeGRPC counts a gRPC call against the quotas and reports the state of the
+// quota in metadata with setHeader.
+func (q *Quotas) takeGRPC(ctx context.Context, setHeader func(metadata.MD) error) ([]quotaSubject, time.Time, error) {
+	var key, addr string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("x-api-key"); len(v) > 0 {
+			key = v[0]
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+	}
+	subjects, ok := q.subjectsFor(key, addr, "")
+	if !ok {
+		errCounter.Add(1)
+		return nil, time.Time{}, status.Error(codes.Unauthenticated, "unknown API key")
+	}
+	now := time.Now()
+	state, ok := q.take(subjects, now)
+	h := make(http.Header)
+	if state.quota.enabled() {
+		state.setHeaders(h, now)
+	}
+	if !ok {
+		h.Set("Retry-After", strconv.FormatInt(int64(state.reset(now).Seconds()), 10))
+	}
+	if len(h) > 0 {
+		md := make(metadata.MD)
+		for k, v := range h {
+			md.Set(k, v...)
+		}
+		setHeader(md)
+	}
+	if !ok {
+		errCounter.Add(1)
+		return nil, now, status.Error(codes.ResourceExhausted, "quota exceeded")
+	}
+	return subjects, now, nil
+}
+
+// countingStream counts the bytes of the documents sent on a stream.
+type countingStream struct {
+	grpc.ServerStream
+	n int64
+}
+
+func (s *countingStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.n += documentBytes(m)
+	}
+	return err
+}
+
+// documentBytes returns the size of the document in a message, if any.
+func documentBytes(m interface{}) int64 {
+	if d, ok := m.(interface{ GetData() []byte }); ok {
+		return int64(len(d.GetData()))
+	}
+	return 0
+}
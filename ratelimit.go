@@ -0,0 +1,109 @@
+package microblob
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tokenBucket holds up to burst tokens and is refilled with rate tokens per second.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket and takes a token, if there is one.
+func (b *tokenBucket) take(now time.Time, rate, burst float64) bool {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// RateLimiter limits requests with token buckets, globally and per client IP.
+// A zero rate disables the respective limit.
+type RateLimiter struct {
+	Rate        float64 // global requests per second
+	Burst       float64
+	ClientRate  float64 // requests per second per client IP
+	ClientBurst float64
+
+	mu      sync.Mutex
+	global  tokenBucket
+	clients map[string]*tokenBucket
+	pruned  time.Time // time of the last prune
+}
+
+// Allow returns true, if a request from the given client may proceed.
+func (l *RateLimiter) Allow(client string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.ClientRate > 0 {
+		if l.clients == nil {
+			l.clients = make(map[string]*tokenBucket)
+		}
+		if len(l.clients) > 100000 && now.Sub(l.pruned) >= l.refill() {
+			l.prune(now)
+		}
+		b, ok := l.clients[client]
+		if !ok {
+			b = &tokenBucket{}
+			l.clients[client] = b
+		}
+		if !b.take(now, l.ClientRate, l.ClientBurst) {
+			return false
+		}
+	}
+	if l.Rate > 0 && !l.global.take(now, l.Rate, l.Burst) {
+		return false
+	}
+	return true
+}
+
+// refill returns the time an empty client bucket takes to be full again.
+func (l *RateLimiter) refill() time.Duration {
+	return time.Duration(l.ClientBurst / l.ClientRate * float64(time.Second))
+}
+
+// prune removes client buckets, that would be full again. Prunes are at least
+// the refill time apart, so many clients do not cause a scan per request.
+func (l *RateLimiter) prune(now time.Time) {
+	full := l.refill()
+	for k, b := range l.clients {
+		if now.Sub(b.last) > full {
+			delete(l.clients, k)
+		}
+	}
+	l.pruned = now
+}
+
+// WithRateLimit responds with 429 Too Many Requests, if the limiter does not
+// allow a request.
+func WithRateLimit(l *RateLimiter, h http.Handler) http.Handler {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		if !l.Allow(client) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			errCounter.Add(1)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(f)
+}
@@ -0,0 +1,228 @@
+package microblob
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Rebuilder can index a new blob file, while serving from the current one, and
+// switch to it, when complete.
+type Rebuilder interface {
+	Rebuild(name string, kf KeysFunc, opts AppendOptions) error
+}
+
+// Rebuild rebuilds the wrapped backend, applying the transformation to the
+// extracted keys.
+func (b TransformBackend) Rebuild(name string, kf KeysFunc, opts AppendOptions) error {
+	r, ok := b.Backend.(Rebuilder)
+	if !ok {
+		return ErrNotImplemented
+	}
+	return r.Rebuild(name, b.transformKeys(kf), opts)
+}
+
+// Rebuild indexes the named file into a new index next to the current one,
+// while documents are still served from the current blob file and index. When
+// complete, the file is moved over the blob file and the indexes are swapped,
+// both while reads are blocked, so readers see either the old or the new data.
+// Appends are blocked during the rebuild, so none get lost. Deleted keys stay
+// deleted in the new file. The file must be on the same file system as the
+// blob file.
+func (b *LevelDBBackend) Rebuild(name string, kf KeysFunc, opts AppendOptions) error {
+	switch {
+	case len(b.Blobfiles) > 0:
+		return fmt.Errorf("rebuild of multiple blob files is not supported")
+	case b.Compression != "", b.Remote != nil, b.Sparse > 0, b.ReadOnly:
+		return fmt.Errorf("rebuild of a compressed, remote, sparse or read-only index is not supported")
+	}
+	if err := b.notShared("rebuild"); err != nil {
+		return err
+	}
+	unlock, err := lockBlob(b.Blobfile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := b.loadedTombstones()
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	deleted := current.rebase(b.Blobfile, fi.Size())
+	tmp := &LevelDBBackend{
+		Filename:        b.Filename + ".rebuild",
+		Blobfile:        name,
+		tombstones:      deleted,
+		OnDuplicate:     b.OnDuplicate,
+		DuplicateReport: b.DuplicateReport,
+		Inline:          b.Inline,
+		KeepVersions:    b.KeepVersions,
+		DBOptions:       b.DBOptions,
+		Separator:       b.Separator,
+		MaxRecordSize:   b.MaxRecordSize,
+		CRC:             b.CRC,
+		Format:          b.Format,
+	}
+	if err := os.RemoveAll(tmp.Filename); err != nil {
+		return err
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	opts.File = 0
+	err = indexDocuments(f, 0, tmp, kf, opts)
+	f.Close()
+	if err != nil {
+		tmp.Close()
+		os.RemoveAll(tmp.Filename)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := b.swapRebuilt(name, tmp.Filename, deleted); err != nil {
+		return err
+	}
+	return b.RecordBlob(b.Blobfile)
+}
+
+// swapRebuilt moves the rebuilt blob file and index into place, along with the
+// tombstones for the new blob file.
+func (b *LevelDBBackend) swapRebuilt(name, index string, deleted *tombstones) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.closeHandles(); err != nil {
+		return err
+	}
+	old := b.Filename + ".old"
+	if err := removeIndex(old); err != nil {
+		return err
+	}
+	if err := os.Rename(b.Filename, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(index, b.Filename); err != nil {
+		os.Rename(old, b.Filename)
+		return err
+	}
+	if err := os.Rename(name, b.Blobfile); err != nil {
+		os.RemoveAll(b.Filename)
+		os.Rename(old, b.Filename)
+		return err
+	}
+	if err := deleted.save(); err != nil {
+		return err
+	}
+	return removeIndex(old)
+}
+
+// errRebuildRunning is returned, when a rebuild is requested during another.
+var errRebuildRunning = errors.New("a rebuild is running")
+
+// RebuildStatus describes the running or the last rebuild.
+type RebuildStatus struct {
+	File     string     `json:"file,omitempty"`
+	Running  bool       `json:"running"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// RebuildHandler rebuilds the index from a new file in the background, while
+// the server keeps answering from the current one. POST /rebuild?file=NAME
+// starts a rebuild from NAME, a file in the directory of the blob file, GET
+// /rebuild reports on the running or last rebuild. One rebuild runs at a time.
+type RebuildHandler struct {
+	Backend  Backend
+	Blobfile string
+	KeysFunc KeysFunc
+	Options  AppendOptions
+
+	mu     sync.Mutex
+	status RebuildStatus
+}
+
+// Status returns the state of the running or last rebuild.
+func (h *RebuildHandler) Status() RebuildStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.status
+}
+
+// Start starts a rebuild from the named file in the background.
+func (h *RebuildHandler) Start(name string) error {
+	r, ok := h.Backend.(Rebuilder)
+	if !ok {
+		return ErrNotImplemented
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.status.Running {
+		return errRebuildRunning
+	}
+	started := time.Now()
+	h.status = RebuildStatus{File: name, Running: true, Started: &started}
+	go func() {
+		log.Printf("rebuilding %s from %s ...", h.Blobfile, name)
+		err := r.Rebuild(name, h.KeysFunc, h.Options)
+		finished := time.Now()
+		h.mu.Lock()
+		h.status.Running, h.status.Finished = false, &finished
+		if err != nil {
+			h.status.Error = err.Error()
+		}
+		h.mu.Unlock()
+		if err != nil {
+			log.Printf("rebuild from %s failed: %v", name, err)
+			return
+		}
+		log.Printf("rebuilt %s from %s in %s", h.Blobfile, name, finished.Sub(started))
+	}()
+	return nil
+}
+
+// ServeHTTP starts rebuilds and reports on them.
+func (h *RebuildHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	if r.Method == "POST" {
+		name := r.URL.Query().Get("file")
+		if name == "" || name != filepath.Base(name) || name == filepath.Base(h.Blobfile) {
+			http.Error(w, "file parameter with a file name beside the blob file required", http.StatusBadRequest)
+			return
+		}
+		name = filepath.Join(filepath.Dir(h.Blobfile), name)
+		if _, err := os.Stat(name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err := h.Start(name)
+		switch {
+		case err == ErrNotImplemented:
+			http.Error(w, "not implemented", http.StatusNotFound)
+			return
+		case err == errRebuildRunning:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		status = http.StatusAccepted
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(h.Status())
+}
@@ -0,0 +1,50 @@
+package microblob
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+)
+
+// ErrRecordTooLarge is returned for records longer than a configured maximum,
+// when indexing, and for documents, that would be read, when serving.
+var ErrRecordTooLarge = errors.New("record too large")
+
+// readRecord reads the next record including the separator, like ReadBytes.
+// If max is positive, it fails with ErrRecordTooLarge as soon as the record
+// grows beyond max bytes, so a pathological record, e.g. a file without
+// separators, is not buffered completely.
+func readRecord(br *bufio.Reader, sep byte, max int64) ([]byte, error) {
+	if max <= 0 {
+		return br.ReadBytes(sep)
+	}
+	var b []byte
+	for {
+		chunk, err := br.ReadSlice(sep)
+		if int64(len(b)+len(chunk)) > max {
+			return nil, fmt.Errorf("%w: longer than %d bytes", ErrRecordTooLarge, max)
+		}
+		b = append(b, chunk...)
+		if err != bufio.ErrBufferFull {
+			return b, err
+		}
+	}
+}
+
+// checkRecordSize returns ErrRecordTooLarge, if a document stored at the
+// entry is longer than max bytes, compressed or not, e.g. because of a corrupt
+// length in the index. A max of zero or less allows any size.
+func checkRecordSize(e Entry, max int64) error {
+	if max <= 0 {
+		return nil
+	}
+	n := e.Length
+	if e.Size > n {
+		n = e.Size
+	}
+	if n > max {
+		return fmt.Errorf("%w: %s has %d bytes at offset %d, limit is %d",
+			ErrRecordTooLarge, e.Key, n, e.Offset, max)
+	}
+	return nil
+}
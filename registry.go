@@ -0,0 +1,106 @@
+package microblob
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ExtractorFactory returns a key extractor configured with options, e.g. a
+// field name or a pattern, which may be empty.
+type ExtractorFactory func(options string) (KeyExtractor, error)
+
+var (
+	extractorsMu sync.RWMutex
+	extractors   = make(map[string]ExtractorFactory)
+)
+
+// RegisterExtractor makes a key extractor available under a name, so it can
+// be used with -extractor name:options, e.g. from the init function of a
+// package imported by a wrapper binary, that calls cli.Main. Registering a
+// name twice or a nil factory panics.
+func RegisterExtractor(name string, factory ExtractorFactory) {
+	extractorsMu.Lock()
+	defer extractorsMu.Unlock()
+	if factory == nil {
+		panic("microblob: register extractor with nil factory: " + name)
+	}
+	if name == "" || strings.Contains(name, ":") {
+		panic("microblob: invalid extractor name: " + name)
+	}
+	if _, ok := extractors[name]; ok {
+		panic("microblob: extractor registered twice: " + name)
+	}
+	extractors[name] = factory
+}
+
+// Extractors returns the names of the registered extractors, sorted.
+func Extractors() []string {
+	extractorsMu.RLock()
+	defer extractorsMu.RUnlock()
+	var names []string
+	for name := range extractors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewExtractor returns the registered extractor for a specification like
+// "name:options" or "name", configured with the options.
+func NewExtractor(spec string) (KeyExtractor, error) {
+	name, options := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, options = spec[:i], spec[i+1:]
+	}
+	extractorsMu.RLock()
+	factory, ok := extractors[name]
+	extractorsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown extractor %q, registered are: %s", name, strings.Join(Extractors(), ", "))
+	}
+	e, err := factory(options)
+	if err != nil {
+		return nil, fmt.Errorf("extractor %s: %v", name, err)
+	}
+	return e, nil
+}
+
+func init() {
+	RegisterExtractor("json", func(options string) (KeyExtractor, error) {
+		if options == "" {
+			return nil, fmt.Errorf("key path required, like json:id")
+		}
+		return NewKeyPathExtractor(options, DefaultKeySeparator), nil
+	})
+	RegisterExtractor("regexp", func(options string) (KeyExtractor, error) {
+		p, err := regexp.Compile(options)
+		if err != nil {
+			return nil, err
+		}
+		return RegexpExtractor{Pattern: p}, nil
+	})
+	RegisterExtractor("xml", func(options string) (KeyExtractor, error) {
+		if options == "" {
+			return nil, fmt.Errorf("path required, like xml:record/id")
+		}
+		return XMLExtractor{Path: options}, nil
+	})
+	RegisterExtractor("template", func(options string) (KeyExtractor, error) {
+		return NewTemplateExtractor(options)
+	})
+	RegisterExtractor("marc", func(options string) (KeyExtractor, error) {
+		if _, _, err := marcField(options); err != nil {
+			return nil, err
+		}
+		return MARCExtractor{Field: options}, nil
+	})
+	RegisterExtractor("marcxml", func(options string) (KeyExtractor, error) {
+		if _, _, err := marcField(options); err != nil {
+			return nil, err
+		}
+		return MARCXMLExtractor{Field: options}, nil
+	})
+}
@@ -0,0 +1,196 @@
+package microblob
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// Reindexer can rebuild an index from scratch.
+type Reindexer interface {
+	Reindex(kf KeysFunc, opts AppendOptions) error
+}
+
+// reindexDirInfix is part of the names of index directories built by Reindex,
+// which are named after the index.
+const reindexDirInfix = ".reindex-"
+
+// Reindex builds a new index from the blob files into a new directory next to
+// the current index and, when complete, points the index name, a symbolic
+// link, to it. Appends are blocked until then, also those of other processes.
+// Another process can keep serving from the old index directory in the
+// meantime and switches to the new one on reload, or before its next append.
+// Index directories no longer open in any process are removed. An index
+// directory, that is not a link yet, is replaced by one, which requires, that
+// no other process has it open.
+func (b *LevelDBBackend) Reindex(kf KeysFunc, opts AppendOptions) error {
+	if err := b.notShared("reindexing"); err != nil {
+		return err
+	}
+	b.mu.RLock()
+	open := b.db != nil // then the lock is held here, checked again before the switch
+	b.mu.RUnlock()
+	fi, err := os.Lstat(b.Filename)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	case fi.Mode()&os.ModeSymlink == 0 && !open && indexInUse(b.Filename):
+		return fmt.Errorf("index %s is open in another process and not a link yet, reindex it once, while it is not in use", b.Filename)
+	}
+	names := append([]string{b.Blobfile}, b.Blobfiles...)
+	unlock, err := lockBlobs(names...)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	dir, err := ioutil.TempDir(filepath.Dir(b.Filename), filepath.Base(b.Filename)+reindexDirInfix)
+	if err != nil {
+		return err
+	}
+	tmp := &LevelDBBackend{
+		Filename:        dir,
+		Blobfile:        b.Blobfile,
+		Blobfiles:       b.Blobfiles,
+		OnDuplicate:     b.OnDuplicate,
+		DuplicateReport: b.DuplicateReport,
+		Inline:          b.Inline,
+		KeepVersions:    b.KeepVersions,
+		DBOptions:       b.DBOptions,
+		Separator:       b.Separator,
+		CRC:             b.CRC,
+		Format:          b.Format,
+	}
+	for i, name := range names {
+		opts.File = i
+		if err := indexBlobLocked(name, tmp, kf, opts); err != nil {
+			tmp.Close()
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.closeHandles(); err != nil {
+		return err
+	}
+	return switchIndex(b.Filename, dir)
+}
+
+// switchIndex points the link to the index directory dir, replacing the link
+// atomically. An index directory in place of the link is removed, as are
+// directories built by an earlier reindex, that no process has open anymore.
+func switchIndex(link, dir string) error {
+	fi, err := os.Lstat(link)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	case fi.Mode()&os.ModeSymlink == 0:
+		if indexInUse(link) {
+			return fmt.Errorf("index %s was opened by another process, new index left at %s", link, dir)
+		}
+		if err := os.RemoveAll(link); err != nil {
+			return err
+		}
+	}
+	tmp := link + ".link"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Symlink(filepath.Base(dir), tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	previous, err := filepath.Glob(link + reindexDirInfix + "*")
+	if err != nil {
+		return err
+	}
+	for _, name := range previous {
+		if name == filepath.Clean(dir) || indexInUse(name) {
+			continue
+		}
+		if err := os.RemoveAll(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexInUse returns true, if a process has the index directory open, that is,
+// holds the lock of the database.
+func indexInUse(dir string) bool {
+	s, err := storage.OpenFile(dir, false)
+	if err != nil {
+		return true
+	}
+	s.Close()
+	return false
+}
+
+// indexDir returns the index directory a link points to, or the name itself,
+// if it is not a link.
+func indexDir(name string) string {
+	if dir, err := filepath.EvalSymlinks(name); err == nil {
+		return dir
+	}
+	return name
+}
+
+// removeIndex removes an index directory, the one it points to as well, if it
+// is a link.
+func removeIndex(name string) error {
+	if dir := indexDir(name); dir != filepath.Clean(name) {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(name)
+}
+
+// openDir returns the index directory open, or the index name, if the
+// database is shared. The caller holds a read lock.
+func (b *LevelDBBackend) openDir() string {
+	if b.dir == "" {
+		return b.Filename
+	}
+	return b.dir
+}
+
+// reopenReplaced closes the database, if the index name points to another
+// directory than the one open, e.g. after a reindex in another process, so
+// the current index is opened on next access.
+func (b *LevelDBBackend) reopenReplaced() error {
+	if b.Shared != nil {
+		return nil
+	}
+	b.mu.RLock()
+	stale := b.db != nil && b.dir != indexDir(b.Filename)
+	b.mu.RUnlock()
+	if !stale {
+		return nil
+	}
+	return b.Close()
+}
+
+// Reindex reindexes the wrapped backend, applying the transformation to the
+// extracted keys.
+func (b TransformBackend) Reindex(kf KeysFunc, opts AppendOptions) error {
+	r, ok := b.Backend.(Reindexer)
+	if !ok {
+		return ErrNotImplemented
+	}
+	return r.Reindex(b.transformKeys(kf), opts)
+}
@@ -0,0 +1,74 @@
+package microblob
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReindexWhileServing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "microblob-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blobfn, index := filepath.Join(dir, "blob.ldj"), filepath.Join(dir, "index")
+	kf := ParsingExtractor{Key: "name"}
+	reindex := func() error {
+		b := &LevelDBBackend{Blobfile: blobfn, Filename: index}
+		defer b.Close()
+		return b.Reindex(SingleKey(kf.ExtractKey), AppendOptions{BatchSize: 100})
+	}
+	initial := &LevelDBBackend{Blobfile: blobfn, Filename: index}
+	appendTestDocuments(t, dir, initial, `{"name": "a"}`, `{"name": "b"}`)
+	if err := initial.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Turn the index into a link, while not in use.
+	if err := reindex(); err != nil {
+		t.Fatal(err)
+	}
+
+	serving := &LevelDBBackend{Blobfile: blobfn, Filename: index}
+	defer serving.Close()
+	if _, err := serving.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+	old := indexDir(index)
+	if err := reindex(); err != nil {
+		t.Fatal(err)
+	}
+	if indexDir(index) == old {
+		t.Fatalf("index still links to %s", old)
+	}
+	if _, err := os.Stat(old); err != nil {
+		t.Fatalf("index directory in use removed: %v", err)
+	}
+	if _, err := serving.Get("b"); err != nil {
+		t.Fatalf("serving from the old index failed: %v", err)
+	}
+	// The next append switches to the new index.
+	if err := AppendDocument(blobfn, serving, "c", []byte(`{"name": "c"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if serving.dir != indexDir(index) {
+		t.Fatalf("appended to %s, want %s", serving.dir, indexDir(index))
+	}
+	if err := serving.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := reindex(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Fatalf("unused index directory %s kept: %v", old, err)
+	}
+	reopened := &LevelDBBackend{Blobfile: blobfn, Filename: index}
+	defer reopened.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := reopened.Get(key); err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package microblob
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// HTTPBlob reads sections of a blob file from an HTTP server supporting range
+// requests, e.g. an S3 or other object store, so only the index needs to be
+// kept locally. Private objects can be accessed via presigned URL or by
+// passing credentials in Header.
+type HTTPBlob struct {
+	URL    string
+	Header http.Header  // additional headers sent with each request
+	Client *http.Client // defaults to http.DefaultClient
+}
+
+// ReadAt reads len(p) bytes starting at offset off with a single range request.
+func (b HTTPBlob) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	req, err := http.NewRequest("GET", b.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+	for k, vs := range b.Header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	client := b.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		return 0, io.EOF
+	default:
+		return 0, fmt.Errorf("range request to %s failed: %s", b.URL, resp.Status)
+	}
+	n, err := io.ReadFull(resp.Body, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
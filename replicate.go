@@ -0,0 +1,203 @@
+package microblob
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ReplicateHandler serves the blob file from a given offset up to its current
+// size, so replicas can tail it, and the tombstones of deleted keys.
+type ReplicateHandler struct {
+	Blobfile string
+}
+
+// ServeHTTP serves the blob file starting at the offset given in the from
+// query parameter, with deleted=1 the tombstone file. The size of the file is
+// returned in X-Blob-Size.
+func (h ReplicateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var from int64
+	if v := r.URL.Query().Get("from"); v != "" {
+		var err error
+		if from, err = strconv.ParseInt(v, 10, 64); err != nil || from < 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+	name := h.Blobfile
+	if r.URL.Query().Get("deleted") == "1" {
+		name = tombstoneFile(h.Blobfile)
+	}
+	var (
+		src  io.ReaderAt = strings.NewReader("") // no keys deleted yet
+		size int64
+	)
+	f, err := os.Open(name)
+	switch {
+	case os.IsNotExist(err) && name != h.Blobfile:
+	case err != nil:
+		http.Error(w, "not available", http.StatusNotFound)
+		return
+	default:
+		defer f.Close()
+		// Appends and deletions hold the lock, so the size is at a document
+		// or tombstone boundary.
+		mu.Lock()
+		fi, err := f.Stat()
+		mu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		src, size = f, fi.Size()
+	}
+	if from > size {
+		http.Error(w, "offset beyond end of blob file", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	w.Header().Set("X-Blob", Version)
+	w.Header().Set("X-Blob-Size", strconv.FormatInt(size, 10))
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Length", strconv.FormatInt(size-from, 10))
+	if r.Method == "HEAD" {
+		return
+	}
+	if _, err := io.Copy(w, io.NewSectionReader(src, from, size-from)); err != nil {
+		log.Printf("replicate failed: %v", err)
+	}
+}
+
+// Replica tails the blob file of a primary and appends and indexes new
+// documents locally, using its own key extraction. Deletions on the primary
+// are replicated as tombstones, which hold stored keys, so the replica must
+// transform keys like the primary.
+type Replica struct {
+	URL      string // base URL of the primary, e.g. http://primary:8820
+	Blobfile string
+	Backend  Backend
+	KeysFunc KeysFunc
+	Options  AppendOptions
+	Interval time.Duration // time between polls, defaults to 5s
+	Client   *http.Client  // defaults to http.DefaultClient
+	Token    string        // bearer token of the primary, if required
+
+	deleted int64 // bytes of the tombstone file of the primary applied
+}
+
+// get requests a file from the replicate endpoint of the primary.
+func (r *Replica) get(ctx context.Context, query string) (*http.Response, error) {
+	link := fmt.Sprintf("%s/replicate?%s", strings.TrimSuffix(r.URL, "/"), query)
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.Token)
+	}
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req.WithContext(ctx))
+}
+
+// syncDeleted applies the tombstones added on the primary since the last sync.
+// Tombstones are applied once more after a restart or a compaction of the
+// primary, which is harmless.
+func (r *Replica) syncDeleted(ctx context.Context) error {
+	t, ok := r.Backend.(Tombstoner)
+	if !ok {
+		return nil
+	}
+	resp, err := r.get(ctx, fmt.Sprintf("deleted=1&from=%d", r.deleted))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusRequestedRangeNotSatisfiable:
+		r.deleted = 0 // Tombstones dropped by compaction.
+		return nil
+	default:
+		return fmt.Errorf("replicate deletions from %s failed: %s", r.URL, resp.Status)
+	}
+	cr := &countingReader{r: resp.Body}
+	if err := t.ApplyTombstones(cr); err != nil {
+		return err
+	}
+	r.deleted += cr.n
+	return nil
+}
+
+// Sync fetches and indexes all documents appended to the primary since the
+// last sync and applies deletions, returns the number of bytes of documents
+// replicated.
+func (r *Replica) Sync(ctx context.Context) (int64, error) {
+	if blobCompression(r.Backend) != "" {
+		return 0, fmt.Errorf("replication of a compressed blob file is not supported")
+	}
+	var from int64
+	if fi, err := os.Stat(r.Blobfile); err == nil {
+		from = fi.Size()
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	resp, err := r.get(ctx, fmt.Sprintf("from=%d", from))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("replicate from %s failed: %s", r.URL, resp.Status)
+	}
+	cr := &countingReader{r: resp.Body}
+	if resp.ContentLength != 0 {
+		if err := AppendReader(r.Blobfile, cr, r.Backend, r.KeysFunc, r.Options); err != nil {
+			return 0, err
+		}
+	}
+	return cr.n, r.syncDeleted(ctx)
+}
+
+// Run syncs with the primary until the context is canceled. Failed syncs are
+// logged and retried.
+func (r *Replica) Run(ctx context.Context) error {
+	interval := r.Interval
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+	for {
+		n, err := r.Sync(ctx)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			log.Printf("replication failed: %v", err)
+		case n > 0:
+			log.Printf("replicated %s from %s", humanBytes(n), r.URL)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// countingReader counts the bytes read.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,63 @@
+package microblob
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// RequestIDHeader carries the ID of a request, in requests and responses.
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDKey is the context key of the request ID.
+type requestIDKey struct{}
+
+// WithRequestID assigns each request an ID, the one given in the X-Request-ID
+// header, if valid, or a random one. The ID is sent back in the X-Request-ID
+// response header, including error responses, and is available to wrapped
+// handlers with RequestID, e.g. for access logs.
+func WithRequestID(h http.Handler) http.Handler {
+	f := func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	}
+	return http.HandlerFunc(f)
+}
+
+// RequestID returns the ID of the request the context belongs to, or the empty
+// string.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID allows non-empty IDs of up to 128 letters, digits and a few
+// punctuation characters, so they can be logged as they are.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':', c == '/', c == '+', c == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,142 @@
+package microblob
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Restore extracts a snapshot archive, as written by Snapshot, into dir and
+// checks, that the index matches the blob files. The archive is extracted into
+// a staging directory inside dir first and the files are moved into place only
+// after the check, blob files first and the index last, so dir never holds an
+// index without its blob files. Existing files are never overwritten. Returns
+// the paths of the restored blob files, in the order of their file ids, and of
+// the index.
+func Restore(r io.Reader, dir string) (blobfiles []string, index string, err error) {
+	staging, err := ioutil.TempDir(dir, ".restore-")
+	if err != nil {
+		return nil, "", err
+	}
+	defer os.RemoveAll(staging)
+
+	var names []string // blob files in archive order
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		name := path.Clean(h.Name)
+		if name == "." || name == ".." || path.IsAbs(name) || strings.HasPrefix(name, "../") {
+			return nil, "", fmt.Errorf("invalid name in archive: %s", h.Name)
+		}
+		parent, base := path.Split(name)
+		switch {
+		case h.Typeflag == tar.TypeDir && parent == "":
+			if index != "" {
+				return nil, "", fmt.Errorf("archive contains more than one index: %s, %s", index, name)
+			}
+			if err := os.Mkdir(filepath.Join(staging, name), 0755); err != nil {
+				return nil, "", err
+			}
+			index = name
+		case h.Typeflag == tar.TypeReg && (parent == "" || (index != "" && parent == index+"/")):
+			if err := extractFile(tr, filepath.Join(staging, filepath.FromSlash(name))); err != nil {
+				return nil, "", err
+			}
+			if parent == "" {
+				names = append(names, base)
+			}
+		default:
+			return nil, "", fmt.Errorf("unexpected entry in archive: %s", h.Name)
+		}
+	}
+	if index == "" || len(names) == 0 {
+		return nil, "", fmt.Errorf("archive is not a snapshot, blob file and index required")
+	}
+
+	// Fail early, instead of after some of the files have been moved.
+	for _, name := range append(names, index) {
+		if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+			return nil, "", fmt.Errorf("%s exists, will not overwrite", filepath.Join(dir, name))
+		}
+	}
+	if err := checkRestored(staging, names, index); err != nil {
+		return nil, "", err
+	}
+	for _, name := range append(names, index) {
+		if err := os.Rename(filepath.Join(staging, name), filepath.Join(dir, name)); err != nil {
+			return blobfiles, "", err
+		}
+		if name != index {
+			blobfiles = append(blobfiles, filepath.Join(dir, name))
+		}
+	}
+	return blobfiles, filepath.Join(dir, index), nil
+}
+
+// extractFile writes the current archive entry to a new file.
+func extractFile(r io.Reader, filename string) error {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// checkRestored checks, that each extracted blob file matches the fingerprint
+// recorded in the index and that all index entries lie within their blob file.
+func checkRestored(staging string, names []string, index string) error {
+	var paths []string
+	for _, name := range names {
+		paths = append(paths, filepath.Join(staging, name))
+	}
+	b := &LevelDBBackend{
+		Filename:  filepath.Join(staging, index),
+		Blobfile:  paths[0],
+		Blobfiles: paths[1:],
+		ReadOnly:  true,
+	}
+	defer b.Close()
+	fps, err := readFingerprints(b.Filename)
+	if err != nil {
+		return err
+	}
+	sizes := make([]int64, len(paths))
+	for i, p := range paths {
+		if _, ok := fps[filepath.Base(p)]; !ok {
+			return fmt.Errorf("no fingerprint for %s in index %s", names[i], index)
+		}
+		if err := b.CheckBlob(p); err != nil {
+			return err
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		sizes[i] = fi.Size()
+	}
+	return b.allEntries(func(e Entry) error {
+		if e.File >= len(sizes) || e.Offset+e.Length > sizes[e.File] {
+			return fmt.Errorf("entry %s at offset %d of file %d out of bounds", e.Key, e.Offset, e.File)
+		}
+		return nil
+	})
+}
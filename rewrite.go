@@ -0,0 +1,68 @@
+package microblob
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RewriteRule rewrites the keys of requests before lookup, e.g. so legacy
+// identifiers keep resolving after a migration without reindexing. A rule
+// either maps a Prefix, which keys starting with it get replaced by Replace,
+// or has a regular expression to Match, whose matches are replaced by
+// Replace, which can refer to groups, like $1.
+type RewriteRule struct {
+	Prefix  string
+	Match   string
+	Replace string
+}
+
+// ParseRewriteRules returns a transform, that applies the first matching rule
+// to a key; keys matching no rule are looked up as given. No rules yield a
+// nil transform.
+func ParseRewriteRules(rules []RewriteRule) (KeyTransform, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	var rewrites []func(string) (string, bool)
+	for i, rule := range rules {
+		switch {
+		case rule.Prefix != "" && rule.Match != "":
+			return nil, fmt.Errorf("rewrite rule %d: either prefix or match, not both", i+1)
+		case rule.Prefix != "":
+			prefix, replace := rule.Prefix, rule.Replace
+			rewrites = append(rewrites, func(s string) (string, bool) {
+				if !strings.HasPrefix(s, prefix) {
+					return s, false
+				}
+				return replace + strings.TrimPrefix(s, prefix), true
+			})
+		case rule.Match != "":
+			re, err := regexp.Compile(rule.Match)
+			if err != nil {
+				return nil, fmt.Errorf("rewrite rule %d: %v", i+1, err)
+			}
+			replace := rule.Replace
+			rewrites = append(rewrites, func(s string) (string, bool) {
+				if !re.MatchString(s) {
+					return s, false
+				}
+				return re.ReplaceAllString(s, replace), true
+			})
+		default:
+			return nil, fmt.Errorf("rewrite rule %d: prefix or match required", i+1)
+		}
+	}
+	return func(s string) (string, error) {
+		for _, rewrite := range rewrites {
+			if t, ok := rewrite(s); ok {
+				if t == "" {
+					return "", errors.New("key rewritten to empty key: " + s)
+				}
+				return t, nil
+			}
+		}
+		return s, nil
+	}, nil
+}
@@ -0,0 +1,185 @@
+package microblob
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultScanLimit    = 100
+	defaultScanTimeout  = 10 * time.Second
+	defaultScanMaxBytes = 1 << 30
+)
+
+// ScanHandler streams the records of the blob file, whose raw bytes match a
+// regular expression, for ad-hoc investigations. It reads the file
+// sequentially and stops after a number of matches or when the time or
+// number of bytes scanned exceeds the budget, whichever comes first.
+type ScanHandler struct {
+	Backend  Backend
+	Blobfile string
+	Timeout  time.Duration // time budget per request, defaults to 10s
+	MaxBytes int64         // bytes scanned per request, defaults to 1GB
+	KeysFunc KeysFunc      // extracts the keys of matches, to skip suppressed documents
+}
+
+// ServeHTTP streams matching records from the offset given in from as newline
+// delimited JSON. If the scan stops before the end of the file, the
+// X-Scan-Stopped trailer tells why, limit, timeout or bytes, and X-Next-Offset
+// holds the offset to continue from.
+func (h *ScanHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("match") == "" {
+		http.Error(w, "match is required", http.StatusBadRequest)
+		return
+	}
+	re, err := regexp.Compile(q.Get("match"))
+	if err != nil {
+		http.Error(w, "invalid match: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := defaultScanLimit
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			http.Error(w, "invalid limit: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+	var from int64
+	if v := q.Get("from"); v != "" {
+		if from, err = strconv.ParseInt(v, 10, 64); err != nil || from < 0 {
+			http.Error(w, "invalid offset: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+	if h.Blobfile == "" || strings.HasSuffix(h.Blobfile, ".zst") {
+		http.Error(w, "not implemented", http.StatusNotFound)
+		return
+	}
+	suppressed, kf := h.suppression()
+	if suppressed.Len() > 0 && kf == nil {
+		http.Error(w, "scan not available, while keys are suppressed", http.StatusForbidden)
+		return
+	}
+	f, err := os.Open(h.Blobfile)
+	if err != nil {
+		http.Error(w, "not available", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	// Appends hold the lock, so the size is at a record boundary.
+	mu.Lock()
+	fi, err := f.Stat()
+	mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	size := fi.Size()
+	if from > size {
+		http.Error(w, "offset beyond end of blob file", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	timeout, maxBytes := h.Timeout, h.MaxBytes
+	if timeout <= 0 {
+		timeout = defaultScanTimeout
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultScanMaxBytes
+	}
+	w.Header().Set("X-Blob", Version)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Trailer", "X-Scan-Stopped, X-Next-Offset")
+
+	var (
+		sep      = recordSeparator(h.Backend)
+		format   = recordFormat(h.Backend)
+		br       = bufio.NewReaderSize(io.NewSectionReader(f, from, size-from), 1<<20)
+		deadline = time.Now().Add(timeout)
+		offset   = from
+		matches  int
+		stopped  string
+	)
+	for offset < size {
+		switch {
+		case matches == limit:
+			stopped = "limit"
+		case offset-from >= maxBytes:
+			stopped = "bytes"
+		case time.Now().After(deadline):
+			stopped = "timeout"
+		}
+		if stopped != "" {
+			break
+		}
+		if r.Context().Err() != nil {
+			return // Client went away.
+		}
+		record, err := readFormatted(br, format, sep, 0)
+		if err != nil && err != io.EOF {
+			log.Printf("scan failed: %v", err)
+			return
+		}
+		offset += int64(len(record))
+		if len(record) > 0 && !skipRecord(record, format, sep) && re.Match(record) && !isSuppressed(record, suppressed, kf) {
+			record = trimSeparator(record, sep)
+			if !bytes.HasSuffix(record, []byte("\n")) {
+				record = append(record, '\n')
+			}
+			if _, err := w.Write(record); err != nil {
+				return
+			}
+			matches++
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if stopped != "" {
+		w.Header().Set("X-Scan-Stopped", stopped)
+		w.Header().Set("X-Next-Offset", strconv.FormatInt(offset, 10))
+	}
+}
+
+// suppression returns the deny list of the backend and the function
+// extracting keys as stored, that is, transformed.
+func (h *ScanHandler) suppression() (*DenyList, KeysFunc) {
+	lb := levelDBBackend(h.Backend)
+	if lb == nil {
+		return nil, nil
+	}
+	if h.KeysFunc == nil {
+		return lb.Suppressed, nil
+	}
+	if tb, ok := h.Backend.(TransformBackend); ok {
+		return lb.Suppressed, tb.transformKeys(h.KeysFunc)
+	}
+	return lb.Suppressed, h.KeysFunc
+}
+
+// isSuppressed returns true, if any key of a record is on the deny list.
+// Records, whose keys cannot be extracted, are not suppressed.
+func isSuppressed(record []byte, suppressed *DenyList, kf KeysFunc) bool {
+	if suppressed.Len() == 0 {
+		return false
+	}
+	keys, err := kf(record)
+	if err != nil {
+		return false
+	}
+	for _, key := range keys {
+		if suppressed.Contains(key) {
+			return true
+		}
+	}
+	return false
+}
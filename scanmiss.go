@@ -0,0 +1,93 @@
+package microblob
+
+import (
+	"bufio"
+	"context"
+	"expvar"
+	"io"
+	"os"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// defaultScanMissSize is the largest blob file scanned on a miss by default.
+const defaultScanMissSize = 64 << 20
+
+var (
+	// scanMissScans counts scans on misses, scanMissFound those, that found
+	// the key, scanMissSkipped misses not scanned, since the blob file was
+	// too large.
+	scanMissScans   = expvar.NewInt("scanMissScans")
+	scanMissFound   = expvar.NewInt("scanMissFound")
+	scanMissSkipped = expvar.NewInt("scanMissSkipped")
+)
+
+// ScanOnMiss looks for keys missing from the index with a sequential scan of
+// a small blob file, e.g. while an incremental repair of the index is running.
+// Since the scan does not know about deletions and expiry, it finds deleted
+// and expired documents as well.
+type ScanOnMiss struct {
+	Blobfile  string
+	KeysFunc  KeysFunc
+	Transform KeyTransform // applied to looked up and extracted keys, if not nil
+	Separator byte         // record separator, defaults to newline
+	MaxSize   int64        // larger blob files are not scanned, defaults to 64MB
+}
+
+// Get returns the first record in the blob file with the key. Returns
+// leveldb.ErrNotFound, if there is none or the blob file is too large.
+func (s *ScanOnMiss) Get(ctx context.Context, key string) ([]byte, error) {
+	maxSize, sep := s.MaxSize, s.Separator
+	if maxSize == 0 {
+		maxSize = defaultScanMissSize
+	}
+	if sep == 0 {
+		sep = '\n'
+	}
+	var err error
+	if s.Transform != nil {
+		if key, err = s.Transform(key); err != nil {
+			return nil, err
+		}
+	}
+	kf := TransformKeys(s.KeysFunc, s.Transform)
+	f, err := os.Open(s.Blobfile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() > maxSize {
+		scanMissSkipped.Add(1)
+		return nil, leveldb.ErrNotFound
+	}
+	scanMissScans.Add(1)
+	br := bufio.NewReader(io.LimitReader(f, maxSize))
+	for i := 0; ; i++ {
+		if i%1000 == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		record, err := br.ReadBytes(sep)
+		if len(record) > 0 {
+			if keys, kerr := kf(record); kerr == nil {
+				for _, k := range keys {
+					if k == key {
+						scanMissFound.Add(1)
+						return record, nil
+					}
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil, leveldb.ErrNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package microblob
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// SectionOpener can open the blob file holding the document for a key, so
+// large documents are copied to a response without reading them into memory.
+type SectionOpener interface {
+	// OpenSection returns the blob file, positioned at the start of the
+	// document, and the length of the document. The caller must close the
+	// file.
+	OpenSection(key string) (*os.File, int64, error)
+}
+
+// OpenSection opens the blob file of a document stored uncompressed in a local
+// blob file, with newline as record separator, and returns ErrNotImplemented
+// otherwise. The file is opened for the caller, so a compaction or reload
+// while the document is copied does not close it; a replaced blob file stays
+// readable until closed. Unlike Get, the document is not checked for being all
+// zero bytes.
+func (b *LevelDBBackend) OpenSection(key string) (*os.File, int64, error) {
+	if b.Suppressed.Contains(key) {
+		return nil, 0, ErrSuppressed
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	entry, err := b.locate(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := checkRecordSize(entry, b.MaxRecordSize); err != nil {
+		return nil, 0, err
+	}
+	switch {
+	case entry.Data != nil, entry.Size > 0, b.Compression != "", entry.CRC != 0:
+		return nil, 0, ErrNotImplemented
+	case entry.File == 0 && b.Remote != nil:
+		return nil, 0, ErrNotImplemented
+	case b.Separator != 0 && b.Separator != '\n':
+		return nil, 0, ErrNotImplemented
+	}
+	name, err := b.blobPath(entry.File)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := f.Seek(entry.Offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, entry.Length, nil
+}
+
+// OpenSection transforms the key, then asks the wrapped backend to open the
+// section.
+func (b TransformBackend) OpenSection(key string) (*os.File, int64, error) {
+	s, ok := b.Backend.(SectionOpener)
+	if !ok {
+		return nil, 0, ErrNotImplemented
+	}
+	key, err := b.Transform(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return s.OpenSection(key)
+}
+
+// serveSection copies the document for a key from the blob file to the
+// response, which uses sendfile, where the response writer and connection
+// support it, or the requested ranges of it. Returns false without writing
+// anything, if the backend cannot open the section, so the caller serves the
+// document as usual.
+func (h *BlobHandler) serveSection(w http.ResponseWriter, r *http.Request, key string) bool {
+	s, ok := h.Backend.(SectionOpener)
+	if !ok {
+		return false
+	}
+	f, length, err := s.OpenSection(key)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if r.Header.Get("Range") != "" {
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return false
+		}
+		http.ServeContent(w, r, "", time.Time{}, io.NewSectionReader(f, offset, length))
+		okCounter.Add(1)
+		return true
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	// Headers are sent, errors can only cut the response short.
+	switch {
+	case r.Method == "HEAD":
+	case h.ChunkSize > 0 && length > h.ChunkSize:
+		writeChunks(r.Context(), w, f, length, h.ChunkSize)
+	default:
+		io.Copy(w, &io.LimitedReader{R: f, N: length})
+	}
+	okCounter.Add(1)
+	return true
+}
@@ -0,0 +1,48 @@
+package microblob
+
+import (
+	"bytes"
+	"unicode"
+)
+
+// RecordSeparator returns the byte terminating records in the blob file, the
+// record terminator for binary MARC.
+func (b *LevelDBBackend) RecordSeparator() byte {
+	switch {
+	case b.Separator == 0 && b.Format == FormatMARC:
+		return marcRecordTerminator
+	case b.Separator == 0:
+		return '\n'
+	}
+	return b.Separator
+}
+
+// RecordSeparator returns the record separator of the wrapped backend.
+func (b TransformBackend) RecordSeparator() byte { return recordSeparator(b.Backend) }
+
+// recordSeparator returns the record separator of a backend, newline by
+// default.
+func recordSeparator(backend Backend) byte {
+	if s, ok := backend.(interface{ RecordSeparator() byte }); ok {
+		return s.RecordSeparator()
+	}
+	return '\n'
+}
+
+// trimSeparator removes a trailing record separator other than newline, so
+// records like those in JSON text sequences (RFC 7464) are served and parsed
+// without it. Newlines are kept, as they always have been.
+func trimSeparator(b []byte, sep byte) []byte {
+	if sep == 0 || sep == '\n' {
+		return b
+	}
+	return bytes.TrimSuffix(b, []byte{sep})
+}
+
+// isBlank returns true, if a record contains nothing but whitespace and
+// separators.
+func isBlank(b []byte, sep byte) bool {
+	return len(bytes.TrimFunc(b, func(r rune) bool {
+		return unicode.IsSpace(r) || r == rune(sep)
+	})) == 0
+}
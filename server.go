@@ -4,19 +4,308 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
 	"github.com/thoas/stats"
 )
 
-// NewHandler sets up routes for serving and stats.
-func NewHandler(backend Backend, blobfile string) http.Handler {
+// HandlerOptions configures the routes set up by NewHandlerOptions.
+type HandlerOptions struct {
+	// AuthToken, if set, is required as bearer token for mutating endpoints.
+	AuthToken string
+	// Ready, if set, is an additional readiness check, e.g. for a running
+	// indexing process.
+	Ready func() error
+	// Prefix, if set, is the path prefix the handler is mounted under in
+	// another mux, e.g. /blobs.
+	Prefix string
+	// ReadOnly disables all mutating endpoints.
+	ReadOnly bool
+	// ContentType, if set, is sent with documents instead of application/json,
+	// e.g. for blob files with one XML record per line.
+	ContentType string
+	// TopKeys, if positive, is the number of most frequently looked up keys
+	// tracked and served at /stats/topkeys.
+	TopKeys int
+	// UpdateURLs are the prefixes of URLs, that /update may fetch files
+	// from, given as url parameter. Fetching is disabled, if empty.
+	UpdateURLs []string
+	// Webhook, if set, is the URL a summary is posted to after each
+	// successful update.
+	Webhook string
+	// TTL, if positive, is the default TTL of keys added by updates, unless
+	// a request sets its own.
+	TTL time.Duration
+	// Dedup stores documents repeated within an update only once.
+	Dedup bool
+	// BatchSize, if positive, is the number of documents of an update
+	// indexed at once, instead of 100000.
+	BatchSize int
+	// Fallback, if set, is asked for documents missing locally.
+	Fallback *Fallback
+	// ScanTimeout and ScanMaxBytes, if positive, limit the time and bytes
+	// scanned per /scan request, instead of 10s and 1GB.
+	ScanTimeout  time.Duration
+	ScanMaxBytes int64
+	// StreamSize, if positive, is the length from which documents are copied
+	// from the blob file to the response, with sendfile where possible,
+	// instead of being read into memory.
+	StreamSize int64
+	// WithKey adds the key of a document to the served JSON object under
+	// KeyField, _key by default, unless a request asks otherwise with
+	// withkey=0; requests can ask for it with withkey=1 in any case.
+	WithKey  bool
+	KeyField string
+	// CacheControl, if set, is sent as Cache-Control header with documents,
+	// Expires, if positive, sets the Expires header this long ahead.
+	CacheControl string
+	Expires      time.Duration
+	// RequestTimeout, if positive, limits the time a lookup may take, before
+	// it is answered with 503.
+	RequestTimeout time.Duration
+	// Headers, if set, override the content type and add headers for
+	// documents by key prefix, see ParseHeaderRules.
+	Headers HeaderRules
+	// NotFound, if set, answers lookups of missing keys with a JSON error,
+	// optionally with suggestions, see NotFound.
+	NotFound *NotFound
+	// Rewrite, if set, rewrites the keys of lookups, e.g. legacy identifiers,
+	// see ParseRewriteRules. Updates and deletions use keys as given.
+	Rewrite KeyTransform
+	// Rebuild, if set, rebuilds the index from a new file in the background
+	// on POST /rebuild.
+	Rebuild *RebuildHandler
+	// Queue, if set, spools updates and appends them in the background, one
+	// at a time, with their status at /jobs/{id}.
+	Queue *AppendQueue
+	// Audit, if set, records updates, documents put and deletions, listed at
+	// /audit.
+	Audit *AuditLog
+	// Shards, if set, forwards requests for single keys owned by another
+	// shard of a cluster to that shard.
+	Shards *ShardRouter
+	// SignedURLs, if set, requires signed, expiring links for restricted
+	// documents, see SignedURLs.
+	SignedURLs *SignedURLs
+	// ScanOnMiss, if set, looks for keys missing from the index in the blob
+	// file, see ScanOnMiss.
+	ScanOnMiss *ScanOnMiss
+	// ChunkSize, if positive, is the size of the chunks documents larger than
+	// it are written in, with a flush after each, so clients receive the start
+	// early and a client going away stops the response.
+	ChunkSize int64
+	// KeysFunc, if set, extracts the keys of documents, so /scan can skip
+	// suppressed documents; without it, /scan is not available, while keys
+	// are suppressed.
+	KeysFunc KeysFunc
+}
+
+// handlerConfig collects the settings of the options passed to NewHandler.
+type handlerConfig struct {
+	HandlerOptions
+	blobfile string
+}
+
+// Option configures a handler created with NewHandler.
+type Option func(c *handlerConfig)
+
+// Blobfile sets the blob file updates are appended to.
+func Blobfile(name string) Option {
+	return func(c *handlerConfig) { c.blobfile = name }
+}
+
+// AuthToken sets the bearer token required for mutating endpoints.
+func AuthToken(token string) Option {
+	return func(c *handlerConfig) { c.AuthToken = token }
+}
+
+// ReadyCheck sets an additional readiness check.
+func ReadyCheck(f func() error) Option {
+	return func(c *handlerConfig) { c.Ready = f }
+}
+
+// ReadOnly disables all mutating endpoints.
+func ReadOnly() Option {
+	return func(c *handlerConfig) { c.ReadOnly = true }
+}
+
+// PathPrefix sets the path prefix the handler is mounted under.
+func PathPrefix(prefix string) Option {
+	return func(c *handlerConfig) { c.Prefix = prefix }
+}
+
+// ContentType sets the content type sent with documents.
+func ContentType(contentType string) Option {
+	return func(c *handlerConfig) { c.ContentType = contentType }
+}
+
+// TopKeys sets the number of most frequently looked up keys to track.
+func TopKeys(n int) Option {
+	return func(c *handlerConfig) { c.TopKeys = n }
+}
+
+// UpdateURLs sets the prefixes of URLs, that /update may fetch files from.
+func UpdateURLs(prefixes ...string) Option {
+	return func(c *handlerConfig) { c.UpdateURLs = prefixes }
+}
+
+// WebhookURL sets the URL notified after each successful update.
+func WebhookURL(link string) Option {
+	return func(c *handlerConfig) { c.Webhook = link }
+}
+
+// DefaultTTL sets the TTL of keys added by updates, that do not set their own.
+func DefaultTTL(ttl time.Duration) Option {
+	return func(c *handlerConfig) { c.TTL = ttl }
+}
+
+// UpdateBatchSize sets the number of documents of an update indexed at once.
+func UpdateBatchSize(n int) Option {
+	return func(c *handlerConfig) { c.BatchSize = n }
+}
+
+// FallbackTo sets where documents missing locally are fetched from.
+func FallbackTo(f *Fallback) Option {
+	return func(c *handlerConfig) { c.Fallback = f }
+}
+
+// PrefixHeaders sets the content type and headers of documents by key prefix.
+func PrefixHeaders(rules HeaderRules) Option {
+	return func(c *handlerConfig) { c.Headers = rules }
+}
+
+// NotFoundJSON answers misses with a JSON error, see NotFound.
+func NotFoundJSON(n *NotFound) Option {
+	return func(c *handlerConfig) { c.NotFound = n }
+}
+
+// SignURLs requires signed links for restricted documents.
+func SignURLs(s *SignedURLs) Option {
+	return func(c *handlerConfig) { c.SignedURLs = s }
+}
+
+// ChunkSize sets the size of the chunks large documents are written in.
+func ChunkSize(size int64) Option {
+	return func(c *handlerConfig) { c.ChunkSize = size }
+}
+
+// Audit sets the log mutations are recorded in.
+func Audit(l *AuditLog) Option {
+	return func(c *handlerConfig) { c.Audit = l }
+}
+
+// RewriteKeys sets the rewriting of the keys of lookups.
+func RewriteKeys(t KeyTransform) Option {
+	return func(c *handlerConfig) { c.Rewrite = t }
+}
+
+// NewHandler sets up all routes for serving, updates and stats, so microblob
+// can be mounted in another server:
+//
+//	mux.Handle("/blobs/", microblob.NewHandler(backend,
+//		microblob.Blobfile("data.ldj"), microblob.PathPrefix("/blobs")))
+func NewHandler(backend Backend, options ...Option) http.Handler {
+	var c handlerConfig
+	for _, option := range options {
+		option(&c)
+	}
+	return NewHandlerOptions(backend, c.blobfile, c.HandlerOptions)
+}
+
+// NewHandlerOptions sets up routes for serving and stats with additional options.
+func NewHandlerOptions(backend Backend, blobfile string, opts HandlerOptions) http.Handler {
+	write := func(h http.Handler) http.Handler {
+		if opts.ReadOnly {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "read-only", http.StatusMethodNotAllowed)
+			})
+		}
+		return WithAuthToken(opts.AuthToken, h)
+	}
+	route := func(h http.Handler) http.Handler {
+		if opts.Shards == nil {
+			return h
+		}
+		return opts.Shards.Route(h)
+	}
+	var hotKeys *HotKeys
+	if opts.TopKeys > 0 {
+		hotKeys = NewHotKeys(opts.TopKeys)
+	}
+	var webhook *Webhook
+	if opts.Webhook != "" {
+		webhook = &Webhook{URL: opts.Webhook}
+	}
+	// Lookups go through reads, which rewrites keys, if requested.
+	reads := backend
+	if opts.Rewrite != nil {
+		reads = TransformBackend{Backend: backend, Transform: opts.Rewrite}
+	}
+	timeout := func(h http.Handler) http.Handler {
+		return WithRequestTimeout(opts.RequestTimeout, h)
+	}
+	signed := func(h http.Handler) http.Handler {
+		return WithSignedURLs(opts.SignedURLs, reads, h)
+	}
 	metrics := stats.New()
-	blobHandler := metrics.Handler(
+	blobHandler := signed(metrics.Handler(
 		WithLastResponseTime(
-			&BlobHandler{Backend: backend}))
+			WithCompression(
+				WithCacheHeaders(opts.CacheControl, opts.Expires, timeout(&BlobHandler{
+					Backend:     reads,
+					ContentType: opts.ContentType,
+					HotKeys:     hotKeys,
+					Fallback:    opts.Fallback,
+					StreamSize:  opts.StreamSize,
+					WithKey:     opts.WithKey,
+					KeyField:    opts.KeyField,
+					Headers:     opts.Headers,
+					NotFound:    opts.NotFound,
+					ScanOnMiss:  opts.ScanOnMiss,
+					ChunkSize:   opts.ChunkSize,
+				}))))))
+
+	prom := NewMetrics(backend, blobfile)
+	appends := NewAppendLog(20)
+	prefix := strings.TrimSuffix(opts.Prefix, "/")
 
 	r := mux.NewRouter()
+	r.Use(prom.Middleware)
+	r.Handle("/metrics", prom)
+	r.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	r.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		check := func() error {
+			if opts.Ready != nil {
+				if err := opts.Ready(); err != nil {
+					return err
+				}
+			}
+			if c, ok := backend.(Checker); ok {
+				if err := c.Check(); err != nil {
+					return err
+				}
+			}
+			if blobfile == "" {
+				return nil
+			}
+			f, err := os.Open(blobfile)
+			if err != nil {
+				return err
+			}
+			return f.Close()
+		}
+		if err := check(); err != nil {
+			http.Error(w, "not ready: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
 	r.Handle("/debug/vars", http.DefaultServeMux)
 	r.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -25,13 +314,24 @@ func NewHandler(backend Backend, blobfile string) http.Handler {
 			return
 		}
 	})
+	r.HandleFunc("/stats/latency", latencyHandler)
+	r.Handle("/stats/topkeys", signed(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hotKeys == nil {
+			http.Error(w, "not implemented", http.StatusNotFound)
+			return
+		}
+		hotKeys.ServeHTTP(w, r)
+	})))
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(map[string]interface{}{
 			"name":    "microblob",
 			"version": Version,
-			"stats":   fmt.Sprintf("http://%s/stats", r.Host),
-			"vars":    fmt.Sprintf("http://%s/debug/vars", r.Host),
+			"stats":   fmt.Sprintf("http://%s%s/stats", r.Host, prefix),
+			"vars":    fmt.Sprintf("http://%s%s/debug/vars", r.Host, prefix),
+			"metrics": fmt.Sprintf("http://%s%s/metrics", r.Host, prefix),
+			"ui":      fmt.Sprintf("http://%s%s/ui", r.Host, prefix),
+			"openapi": fmt.Sprintf("http://%s%s/openapi.json", r.Host, prefix),
 		}); err != nil {
 			http.Error(w, "could not serialize", http.StatusInternalServerError)
 			return
@@ -40,6 +340,10 @@ func NewHandler(backend Backend, blobfile string) http.Handler {
 	r.HandleFunc("/count", func(w http.ResponseWriter, r *http.Request) {
 		if c, ok := backend.(Counter); ok {
 			count, err := c.Count()
+			if err == ErrNotImplemented {
+				http.Error(w, "not implemented", http.StatusNotFound)
+				return
+			}
 			if err != nil {
 				http.Error(w, fmt.Sprintf("count failed: %s", err), http.StatusInternalServerError)
 				return
@@ -53,9 +357,77 @@ func NewHandler(backend Backend, blobfile string) http.Handler {
 			return
 		}
 	})
-	r.Handle("/update", UpdateHandler{Backend: backend, Blobfile: blobfile})
-	r.Handle("/blob", blobHandler)     // Legacy route.
-	r.Handle("/{key:.+}", blobHandler) // Preferred.
+	r.Handle("/info", signed(&InfoHandler{Backend: backend, Blobfile: blobfile}))
+	r.Handle("/openapi.json", openAPIHandler(opts)).Methods("GET")
+	r.Handle("/ui", signed(&StatusHandler{
+		Backend:  backend,
+		Blobfile: blobfile,
+		HotKeys:  hotKeys,
+		Metrics:  prom,
+		Appends:  appends,
+		Started:  time.Now(),
+	})).Methods("GET")
+	update := UpdateHandler{Backend: backend, Blobfile: blobfile, URLPrefixes: opts.UpdateURLs, Webhook: webhook, TTL: opts.TTL, Dedup: opts.Dedup, BatchSize: opts.BatchSize, Appends: appends, Audit: opts.Audit}
+	if opts.Queue != nil && !opts.ReadOnly {
+		if err := opts.Queue.Start(update.appendJob); err != nil {
+			log.Printf("update queue not started: %v", err)
+		} else {
+			update.Queue = opts.Queue
+		}
+	}
+	r.Handle("/update", write(update))
+	r.Handle("/load", write(LoadHandler{Backend: backend, Blobfile: blobfile, Audit: opts.Audit})).Methods("POST")
+	r.Handle("/audit", WithAuthToken(opts.AuthToken, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if opts.Audit == nil {
+			http.Error(w, "not implemented", http.StatusNotFound)
+			return
+		}
+		opts.Audit.ServeHTTP(w, r)
+	}))).Methods("GET")
+	r.HandleFunc("/jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if update.Queue == nil {
+			http.Error(w, "not implemented", http.StatusNotFound)
+			return
+		}
+		update.Queue.ServeHTTP(w, r)
+	}).Methods("GET")
+	batch := signed(metrics.Handler(WithCompression(timeout(&BatchHandler{Backend: reads}))))
+	r.Handle("/blobs", batch).Methods("POST")
+	r.Handle("/multiget", batch).Methods("POST")
+	r.Handle("/prefix/{prefix:.+}", signed(metrics.Handler(WithCompression(&PrefixHandler{Backend: backend}))))
+	r.Handle("/keys", signed(&KeysHandler{Backend: backend}))
+	r.Handle("/export", signed(WithCompression(&ExportHandler{Backend: backend})))
+	r.Handle("/dump", signed(WithCompression(&DumpHandler{Backend: backend}))).Methods("GET")
+	r.Handle("/replicate", signed(WithAuthToken(opts.AuthToken, ReplicateHandler{Blobfile: blobfile})))
+	r.Handle("/scan", signed(WithCompression(&ScanHandler{
+		Backend:  backend,
+		Blobfile: blobfile,
+		Timeout:  opts.ScanTimeout,
+		MaxBytes: opts.ScanMaxBytes,
+		KeysFunc: opts.KeysFunc,
+	}))).Methods("GET")
+	r.Handle("/snapshot", WithAuthToken(opts.AuthToken, &SnapshotHandler{Backend: backend})).Methods("POST")
+	rebuild := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if opts.Rebuild == nil {
+			http.Error(w, "not implemented", http.StatusNotFound)
+			return
+		}
+		opts.Rebuild.ServeHTTP(w, r)
+	})
+	r.Handle("/rebuild", write(rebuild)).Methods("POST")
+	r.Handle("/rebuild", rebuild).Methods("GET")
+	r.Handle("/exists", signed(metrics.Handler(WithCompression(timeout(&ExistsFilterHandler{Backend: reads}))))).Methods("POST")
+	r.Handle("/exists/{key:.+}", route(signed(metrics.Handler(timeout(&ExistsHandler{Backend: reads}))))).Methods("GET", "HEAD")
+	r.Handle("/versions/{key:.+}", route(signed(&VersionsHandler{Backend: reads}))).Methods("GET")
+	r.Handle("/checksum/{key:.+}", route(signed(metrics.Handler(timeout(&ChecksumHandler{Backend: reads}))))).Methods("GET")
+	r.Handle("/{key:.+}", route(write(&DeleteHandler{Backend: backend, Blobfile: blobfile, Audit: opts.Audit}))).Methods("DELETE")
+	r.Handle("/{key:.+}", route(write(PutHandler{Backend: backend, Blobfile: blobfile, TTL: opts.TTL, Audit: opts.Audit}))).Methods("PUT")
+	r.Handle("/{key:.+}", route(write(PatchHandler{Backend: backend, Blobfile: blobfile, TTL: opts.TTL, Audit: opts.Audit}))).Methods("PATCH")
+	r.Handle("/blob", route(blobHandler))     // Legacy route.
+	r.Handle("/{key:.+}", route(blobHandler)) // Preferred.
 
+	if prefix != "" {
+		return http.StripPrefix(prefix, r)
+	}
 	return r
 }
@@ -0,0 +1,256 @@
+package microblob
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// ShardHeader names the shard, that forwarded a request, so the receiving
+// shard serves it locally instead of forwarding it again. In responses, it
+// names the shard, that served a forwarded request.
+const ShardHeader = "X-Microblob-Shard"
+
+// shardPoints is the number of points per shard on the ring, enough to spread
+// keys evenly over a handful of shards.
+const shardPoints = 128
+
+// Shard is a microblob instance serving part of the keys of a cluster.
+type Shard struct {
+	Name string // identifies the shard, its points on the ring derive from it
+	URL  string // where the shard is served, including a path prefix, if any
+}
+
+// ShardMap assigns keys to shards by consistent hashing. Each shard has a
+// number of points on a ring of 64-bit hashes and owns the keys hashing up to
+// its points, so adding or removing a shard only moves the keys of the
+// neighbouring ranges, about one in n keys. Owners only depend on the names
+// of the shards, not on their order or URLs.
+type ShardMap struct {
+	shards []Shard
+	points []uint64
+	owners []int // index of the shard owning each point
+}
+
+// NewShardMap returns the map for the given shards, which need distinct names
+// and absolute URLs.
+func NewShardMap(shards []Shard) (*ShardMap, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("no shards")
+	}
+	m := &ShardMap{shards: append([]Shard(nil), shards...)}
+	sort.Slice(m.shards, func(i, j int) bool { return m.shards[i].Name < m.shards[j].Name })
+	for i, s := range m.shards {
+		if s.Name == "" {
+			return nil, errors.New("shard without name")
+		}
+		if i > 0 && m.shards[i-1].Name == s.Name {
+			return nil, fmt.Errorf("duplicate shard: %s", s.Name)
+		}
+		if u, err := url.Parse(s.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("shard %s: invalid url: %q", s.Name, s.URL)
+		}
+	}
+	type point struct {
+		hash  uint64
+		owner int
+	}
+	var points []point
+	for i, s := range m.shards {
+		for j := 0; j < shardPoints; j++ {
+			points = append(points, point{shardHash(fmt.Sprintf("%s#%d", s.Name, j)), i})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].owner < points[j].owner
+	})
+	for _, p := range points {
+		m.points = append(m.points, p.hash)
+		m.owners = append(m.owners, p.owner)
+	}
+	return m, nil
+}
+
+// shardHash returns the position of a string on the ring: 64-bit FNV-1a,
+// mixed with the finalizer of SplitMix64, as FNV alone clusters similar
+// strings, e.g. keys with a common prefix.
+func shardHash(s string) uint64 {
+	h := fnv.New64a()
+	io.WriteString(h, s)
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Owner returns the shard owning a key.
+func (m *ShardMap) Owner(key string) Shard {
+	h := shardHash(key)
+	i := sort.Search(len(m.points), func(i int) bool { return m.points[i] >= h })
+	if i == len(m.points) {
+		i = 0
+	}
+	return m.shards[m.owners[i]]
+}
+
+// Shards returns all shards, ordered by name.
+func (m *ShardMap) Shards() []Shard {
+	return append([]Shard(nil), m.shards...)
+}
+
+// Shard returns the shard with the given name.
+func (m *ShardMap) Shard(name string) (Shard, bool) {
+	for _, s := range m.shards {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return Shard{}, false
+}
+
+// ShardRouter forwards requests for single keys to the shard owning the key,
+// so any shard of a cluster can answer them. Requests for keys owned by Self
+// and requests forwarded by another shard are served locally. Batch requests
+// and updates are not routed, each shard indexes its own part of the data,
+// e.g. split with SplitShards.
+type ShardRouter struct {
+	Map       *ShardMap
+	Self      string            // name of the local shard
+	Transform KeyTransform      // applied to keys before looking up the owner, as to indexed keys
+	Transport http.RoundTripper // defaults to http.DefaultTransport
+}
+
+// owner returns the shard owning the key of a request, false, if the
+// request is served locally.
+func (s *ShardRouter) owner(r *http.Request) (Shard, bool) {
+	if r.Header.Get(ShardHeader) != "" {
+		return Shard{}, false
+	}
+	key, ok := mux.Vars(r)["key"]
+	if !ok {
+		key = r.URL.Query().Get("key")
+	}
+	if key == "" {
+		return Shard{}, false
+	}
+	if s.Transform != nil {
+		var err error
+		if key, err = s.Transform(key); err != nil {
+			return Shard{}, false
+		}
+	}
+	owner := s.Map.Owner(key)
+	return owner, owner.Name != s.Self
+}
+
+// Route returns a handler serving requests for local keys with h and
+// forwarding the others.
+func (s *ShardRouter) Route(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		owner, ok := s.owner(r)
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		s.forward(owner, w, r)
+	})
+}
+
+// forward proxies a request to a shard; the path is relative to the shard
+// URL.
+func (s *ShardRouter) forward(owner Shard, w http.ResponseWriter, r *http.Request) {
+	target, err := url.Parse(owner.URL)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("shard %s: %v", owner.Name, err), http.StatusBadGateway)
+		return
+	}
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme, req.URL.Host, req.Host = target.Scheme, target.Host, target.Host
+			if req.URL.RawPath != "" {
+				req.URL.RawPath = strings.TrimSuffix(target.EscapedPath(), "/") + req.URL.RawPath
+			}
+			req.URL.Path = strings.TrimSuffix(target.Path, "/") + req.URL.Path
+			req.Header.Set(ShardHeader, s.Self)
+		},
+		Transport: s.Transport,
+		ModifyResponse: func(resp *http.Response) error {
+			resp.Header.Set(ShardHeader, owner.Name)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			http.Error(w, fmt.Sprintf("shard %s: %v", owner.Name, err), http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// SplitShards writes each record read from r to the writer of the shard
+// owning its keys, and a record with keys on several shards to each of them,
+// e.g. to split a dataset too large for a single host. Blank records are
+// dropped. Returns the number of records written per shard.
+func SplitShards(r io.Reader, kf KeysFunc, sep byte, m *ShardMap, writers map[string]io.Writer) (map[string]int64, error) {
+	if sep == 0 {
+		sep = '\n'
+	}
+	var (
+		br     = bufio.NewReaderSize(r, 1<<20)
+		counts = make(map[string]int64)
+		line   int64
+		seen   = make(map[string]bool)
+	)
+	for {
+		b, err := br.ReadBytes(sep)
+		if len(b) > 0 {
+			line++
+		}
+		if len(b) > 0 && !isBlank(b, sep) {
+			if b[len(b)-1] != sep {
+				b = append(b, sep)
+			}
+			keys, kerr := kf(trimSeparator(b, sep))
+			if kerr != nil {
+				return counts, fmt.Errorf("record %d: %v", line, kerr)
+			}
+			for k := range seen {
+				delete(seen, k)
+			}
+			for _, key := range keys {
+				owner := m.Owner(key).Name
+				if seen[owner] {
+					continue
+				}
+				seen[owner] = true
+				w, ok := writers[owner]
+				if !ok {
+					return counts, fmt.Errorf("no writer for shard %s", owner)
+				}
+				if _, err := w.Write(b); err != nil {
+					return counts, err
+				}
+				counts[owner]++
+			}
+		}
+		if err == io.EOF {
+			return counts, nil
+		}
+		if err != nil {
+			return counts, err
+		}
+	}
+}
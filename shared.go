@@ -0,0 +1,111 @@
+package microblob
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// SharedDB is a LevelDB database shared by several datasets, each a
+// LevelDBBackend with its own Prefix, e.g. to host dozens of small collections
+// with one set of open files and one background compaction. The database is
+// opened on first use and closed, when the last backend using it is closed.
+type SharedDB struct {
+	Filename string
+	Options  *opt.Options // if set, used to open the database
+
+	mu   sync.Mutex
+	db   *leveldb.DB
+	refs int
+}
+
+// acquire returns the database handle, opening it, if necessary.
+func (s *SharedDB) acquire() (*leveldb.DB, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		db, err := leveldb.OpenFile(s.Filename, s.Options)
+		if err != nil {
+			return nil, err
+		}
+		s.db = db
+	}
+	s.refs++
+	return s.db, nil
+}
+
+// release gives up a handle returned by acquire and closes the database, if
+// it is no longer used.
+func (s *SharedDB) release() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refs--; s.refs > 0 {
+		return nil
+	}
+	db := s.db
+	s.db, s.refs = nil, 0
+	return db.Close()
+}
+
+// dbKey returns the key an entry is stored under in the database.
+func (b *LevelDBBackend) dbKey(key string) []byte {
+	return []byte(b.Prefix + key)
+}
+
+// keyRange returns the range of the keys of the dataset, nil for all keys.
+func (b *LevelDBBackend) keyRange() *util.Range {
+	if b.Prefix == "" {
+		return nil
+	}
+	return util.BytesPrefix([]byte(b.Prefix))
+}
+
+// notShared returns an error for operations, that rewrite the whole database
+// and so are not supported for datasets sharing it.
+func (b *LevelDBBackend) notShared(op string) error {
+	if b.Prefix != "" {
+		return fmt.Errorf("%s of a dataset with a key prefix is not supported", op)
+	}
+	return nil
+}
+
+// DeleteAll removes all entries of the dataset from the database, e.g. after a
+// failed indexing run into a shared database. The blob files are not touched.
+func (b *LevelDBBackend) DeleteAll() error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if err := b.openDatabase(); err != nil {
+		return err
+	}
+	iter := b.db.NewIterator(b.keyRange(), nil)
+	defer iter.Release()
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		batch.Delete(append([]byte(nil), iter.Key()...))
+		if batch.Len() == 100000 {
+			if err := b.db.Write(batch, nil); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if err := b.db.Write(batch, nil); err != nil {
+		return err
+	}
+	if b.Cache != nil {
+		b.Cache.Purge()
+	}
+	if b.Misses != nil {
+		b.Misses.Purge()
+	}
+	if b.Bloom != nil {
+		b.Bloom.Reset()
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package microblob
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Snapshotter can write a consistent backup of blob files and index.
+type Snapshotter interface {
+	Snapshot(w io.Writer) error
+}
+
+// Snapshot snapshots the wrapped backend.
+func (b TransformBackend) Snapshot(w io.Writer) error {
+	if s, ok := b.Backend.(Snapshotter); ok {
+		return s.Snapshot(w)
+	}
+	return ErrNotImplemented
+}
+
+// Snapshot writes a tar archive with the blob files, cut at their length at
+// the time of the snapshot, and an index built from a LevelDB snapshot taken
+// at the same time. Extracting the archive yields a blob file and index, that
+// can be served right away. Appends are blocked only while the snapshot is
+// taken.
+func (b *LevelDBBackend) Snapshot(w io.Writer) error {
+	if b.Remote != nil {
+		return fmt.Errorf("snapshot of a remote blob file is not supported")
+	}
+	if err := b.notShared("snapshot"); err != nil {
+		return err
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if err := b.openDatabase(); err != nil {
+		return err
+	}
+
+	names := append([]string{b.Blobfile}, b.Blobfiles...)
+	sizes := make([]int64, len(names))
+
+	mu.Lock()
+	for i, name := range names {
+		fi, err := os.Stat(name)
+		if err != nil {
+			mu.Unlock()
+			return err
+		}
+		sizes[i] = fi.Size()
+	}
+	snap, err := b.db.GetSnapshot()
+	mu.Unlock()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	// The live index directory cannot be copied safely, so the snapshot is
+	// written into a fresh database next to it.
+	dir, err := ioutil.TempDir(filepath.Dir(b.Filename), filepath.Base(b.Filename)+".snapshot-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		return err
+	}
+	iter := snap.NewIterator(nil, nil)
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		batch.Put(append([]byte(nil), iter.Key()...), append([]byte(nil), iter.Value()...))
+		if batch.Len() == 100000 {
+			if err := db.Write(batch, nil); err != nil {
+				iter.Release()
+				db.Close()
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		db.Close()
+		return err
+	}
+	if err := db.Write(batch, nil); err != nil {
+		db.Close()
+		return err
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+	for i, name := range names {
+		if err := recordFingerprint(dir, name, name, sizes[i]); err != nil {
+			return err
+		}
+	}
+
+	tw := tar.NewWriter(w)
+	for i, name := range names {
+		if err := tarFile(tw, name, filepath.Base(name), sizes[i]); err != nil {
+			return err
+		}
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	base := filepath.Base(b.Filename)
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     base + "/",
+		Mode:     0755,
+	}); err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if fi.IsDir() {
+			continue
+		}
+		if err := tarFile(tw, filepath.Join(dir, fi.Name()), base+"/"+fi.Name(), fi.Size()); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// tarFile writes the first size bytes of a file to the archive.
+func tarFile(tw *tar.Writer, filename, name string, size int64) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: fi.ModTime(),
+	}); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, f, size)
+	return err
+}
@@ -0,0 +1,169 @@
+package microblob
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// IndexSparse indexes a blob file, whose records are sorted by key, in blocks
+// of n records: each index entry holds the first key of a block and the region
+// of the whole block. Lookups with LevelDBBackend.Sparse find the block and scan
+// it for the key, which trades a few reads for an index about n times smaller.
+// Each record is indexed under its first key only. The records must be sorted
+// by key as stored, i.e. after transformation, otherwise indexing fails.
+func IndexSparse(blobfn string, backend Backend, kf KeysFunc, n int, opts AppendOptions) error {
+	if n < 1 {
+		return fmt.Errorf("invalid block size: %d", n)
+	}
+	if t, ok := backend.(TransformBackend); ok {
+		// Sort order and block keys are those of the stored keys.
+		backend, kf = t.Backend, t.transformKeys(kf)
+	}
+	unlock, err := lockBlob(blobfn)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	f, err := os.Open(blobfn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var (
+		br        = bufio.NewReaderSize(f, 1<<20)
+		sep       = recordSeparator(backend)
+		batchSize = opts.BatchSize
+		batch     []Entry
+		block     Entry // current block
+		count     int   // records with a key in the current block
+		offset    int64
+		last      string
+	)
+	if batchSize < 1 {
+		batchSize = 100000
+	}
+	for {
+		record, rerr := br.ReadBytes(sep)
+		if rerr != nil && rerr != io.EOF {
+			return rerr
+		}
+		if len(record) > 0 && !isBlank(record, sep) {
+			keys, err := kf(record)
+			switch {
+			case err != nil && !opts.IgnoreMissingKeys:
+				return fmt.Errorf("record at offset %d: %v", offset, err)
+			case err != nil || len(keys) == 0:
+				// Skipped, but part of the block.
+			case count > 0 && keys[0] < last:
+				return fmt.Errorf("records not sorted by key at offset %d: %s after %s", offset, keys[0], last)
+			default:
+				if count == n {
+					if batch = append(batch, block); len(batch) == batchSize {
+						if err := backend.WriteEntries(batch); err != nil {
+							return err
+						}
+						batch = batch[:0]
+					}
+					count = 0
+				}
+				if count == 0 {
+					block = Entry{Key: keys[0], Offset: offset}
+				}
+				last = keys[0]
+				count++
+			}
+		}
+		offset += int64(len(record))
+		if count > 0 {
+			block.Length = offset - block.Offset
+		}
+		if rerr == io.EOF {
+			break
+		}
+	}
+	if count > 0 {
+		batch = append(batch, block)
+	}
+	if len(batch) > 0 {
+		if err := backend.WriteEntries(batch); err != nil {
+			return err
+		}
+	}
+	return recordBlob(backend, blobfn)
+}
+
+// locateSparse finds the record for a key in the block, that starts with the
+// largest indexed key not after the key, the caller must hold a read lock.
+func (b *LevelDBBackend) locateSparse(key string) (Entry, error) {
+	if b.SparseKeys == nil {
+		return Entry{}, fmt.Errorf("sparse index requires a key function")
+	}
+	iter := b.db.NewIterator(nil, nil)
+	defer iter.Release()
+	ok := iter.Seek([]byte(key))
+	switch {
+	case ok && string(iter.Key()) == key:
+	case ok:
+		ok = iter.Prev()
+	default:
+		ok = iter.Last()
+	}
+	if !ok {
+		if err := iter.Error(); err != nil {
+			return Entry{}, err
+		}
+		return Entry{}, leveldb.ErrNotFound
+	}
+	block, err := decodeEntry(iter.Key(), iter.Value())
+	if err != nil {
+		return Entry{}, err
+	}
+	data := block.Data
+	if data == nil {
+		data = make([]byte, block.Length)
+		var r io.ReaderAt = b.Remote
+		if block.File != 0 || b.Remote == nil {
+			file, err := b.blobFile(block.File)
+			if err != nil {
+				return Entry{}, err
+			}
+			r = file
+		}
+		if _, err := r.ReadAt(data, block.Offset); err != nil {
+			return Entry{}, err
+		}
+	}
+	if e, ok := scanBlock(block, data, key, b.RecordSeparator(), b.SparseKeys); ok {
+		return e, nil
+	}
+	return Entry{}, leveldb.ErrNotFound
+}
+
+// scanBlock returns the entry of the record with the key in the data of a
+// block, records are indexed under their first key.
+func scanBlock(block Entry, data []byte, key string, sep byte, kf KeysFunc) (Entry, bool) {
+	for offset := block.Offset; len(data) > 0; {
+		record := data
+		if i := bytes.IndexByte(data, sep); i >= 0 {
+			record = data[:i+1]
+		}
+		if keys, err := kf(record); err == nil && len(keys) > 0 {
+			if keys[0] == key {
+				return Entry{Key: key, Offset: offset, Length: int64(len(record)), File: block.File}, true
+			}
+			if keys[0] > key {
+				break
+			}
+		}
+		offset += int64(len(record))
+		data = data[len(record):]
+	}
+	return Entry{}, false
+}
@@ -0,0 +1,157 @@
+package microblob
+
+import (
+	"html/template"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AppendRecord describes an append over HTTP.
+type AppendRecord struct {
+	Time     time.Time
+	Keys     int64
+	Bytes    int64
+	Duration time.Duration
+}
+
+// AppendLog keeps the most recent appends. Safe for concurrent use.
+type AppendLog struct {
+	mu      sync.Mutex
+	n       int
+	records []AppendRecord
+}
+
+// NewAppendLog returns a log of the last n appends.
+func NewAppendLog(n int) *AppendLog {
+	return &AppendLog{n: n}
+}
+
+// Add records an append. A nil log does nothing.
+func (l *AppendLog) Add(s AppendSummary, elapsed time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, AppendRecord{
+		Time:     time.Now(),
+		Keys:     s.Keys,
+		Bytes:    s.Bytes,
+		Duration: elapsed.Round(time.Millisecond),
+	})
+	if len(l.records) > l.n {
+		l.records = l.records[len(l.records)-l.n:]
+	}
+}
+
+// Recent returns the recorded appends, most recent first.
+func (l *AppendLog) Recent() []AppendRecord {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := make([]AppendRecord, len(l.records))
+	for i, r := range l.records {
+		result[len(result)-1-i] = r
+	}
+	return result
+}
+
+// statusTemplate renders the status page.
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"bytes":   humanBytes,
+	"percent": func(f float64) float64 { return 100 * f },
+	"time":    func(t time.Time) string { return t.Format("2006-01-02 15:04:05") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>microblob {{ .Version }}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { text-align: left; padding: 0.2em 1em 0.2em 0; }
+td.n { text-align: right; font-family: monospace; }
+h2 { font-size: 1.1em; }
+</style>
+</head>
+<body>
+<h1>microblob {{ .Version }}</h1>
+{{ with .Err }}<p>info failed: {{ . }}</p>{{ end }}
+<table>
+<tr><th>Backend</th><td>{{ .Info.Backend }}</td></tr>
+<tr><th>Keys</th><td class="n">{{ .Info.Keys }}</td></tr>
+<tr><th>Blob size</th><td class="n">{{ bytes .Info.BlobSize }}</td></tr>
+<tr><th>Index size</th><td class="n">{{ bytes .Info.IndexSize }}</td></tr>
+{{ with .Info.LastAppend }}<tr><th>Last append</th><td>{{ time . }}</td></tr>{{ end }}
+<tr><th>Up since</th><td>{{ time .Started }}</td></tr>
+</table>
+<h2>Recent appends</h2>
+{{ if .Appends }}<table>
+<tr><th>Time</th><th>Keys</th><th>Bytes</th><th>Duration</th></tr>
+{{ range .Appends }}<tr><td>{{ time .Time }}</td><td class="n">{{ .Keys }}</td><td class="n">{{ bytes .Bytes }}</td><td class="n">{{ .Duration }}</td></tr>
+{{ end }}</table>{{ else }}<p>None since start.</p>{{ end }}
+<h2>Top keys</h2>
+{{ if .TopKeys }}<table>
+<tr><th>Key</th><th>Lookups</th><th>Share</th><th>Per second</th></tr>
+{{ range .TopKeys }}<tr><td>{{ .Key }}</td><td class="n">{{ .Count }}</td><td class="n">{{ printf "%.1f%%" (percent .Share) }}</td><td class="n">{{ printf "%.2f" .Rate }}</td></tr>
+{{ end }}</table>{{ else }}<p>Not tracked, see -top-keys.</p>{{ end }}
+<h2>Requests</h2>
+{{ if .Rates }}<table>
+<tr><th>Route</th><th>Requests</th><th>Per second</th></tr>
+{{ range .Rates }}<tr><td>{{ .Route }}</td><td class="n">{{ .Requests }}</td><td class="n">{{ printf "%.2f" .Rate }}</td></tr>
+{{ end }}</table>{{ else }}<p>None since start.</p>{{ end }}
+</body>
+</html>
+`))
+
+// StatusHandler serves a small HTML page summarizing the instance, for
+// operators to glance at. HotKeys, Metrics and Appends are optional.
+type StatusHandler struct {
+	Backend  Backend
+	Blobfile string
+	HotKeys  *HotKeys
+	Metrics  *Metrics
+	Appends  *AppendLog
+	Started  time.Time
+	TopKeys  int // number of top keys shown, defaults to 10
+}
+
+// ServeHTTP renders the status page.
+func (h *StatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	info, err := ReadInfo(h.Backend, h.Blobfile)
+	data := struct {
+		Version string
+		Info    Info
+		Err     error
+		Started time.Time
+		Appends []AppendRecord
+		TopKeys []KeyCount
+		Rates   []RouteRate
+	}{
+		Version: Version,
+		Info:    info,
+		Err:     err,
+		Started: h.Started,
+		Appends: h.Appends.Recent(),
+	}
+	if h.HotKeys != nil {
+		n := h.TopKeys
+		if n <= 0 {
+			n = 10
+		}
+		if data.TopKeys = h.HotKeys.Top(); len(data.TopKeys) > n {
+			data.TopKeys = data.TopKeys[:n]
+		}
+	}
+	if h.Metrics != nil {
+		data.Rates = h.Metrics.Rates()
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, data); err != nil {
+		http.Error(w, "could not render", http.StatusInternalServerError)
+		return
+	}
+}
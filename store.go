@@ -0,0 +1,52 @@
+package microblob
+
+import "io"
+
+// Store is a blob file with its index, for embedding microblob in other
+// programs.
+//
+//	s, err := microblob.Open("data.ldj", "data.ldj.db")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer s.Close()
+//	if err := s.Append(r, microblob.ParsingExtractor{Key: "id"}); err != nil {
+//		log.Fatal(err)
+//	}
+//	b, err := s.Get("1")
+type Store struct {
+	Blobfile string
+	Backend  *LevelDBBackend
+}
+
+// Open opens the blob file and index at the given paths. Both are created, if
+// they do not exist. Fails, if the blob file does not match the index.
+func Open(blobfile, dbfile string) (*Store, error) {
+	backend := &LevelDBBackend{Blobfile: blobfile, Filename: dbfile}
+	if err := backend.openDatabase(); err != nil {
+		return nil, err
+	}
+	if err := backend.CheckBlob(blobfile); err != nil {
+		backend.Close()
+		return nil, err
+	}
+	return &Store{Blobfile: blobfile, Backend: backend}, nil
+}
+
+// Get returns the document for a key.
+func (s *Store) Get(key string) ([]byte, error) {
+	return s.Backend.Get(key)
+}
+
+// Append appends newline delimited documents from r to the blob file and
+// indexes them under the key found by the extractor.
+func (s *Store) Append(r io.Reader, extractor KeyExtractor) error {
+	return AppendReader(s.Blobfile, r, s.Backend, SingleKey(extractor.ExtractKey), AppendOptions{
+		BatchSize: 100000,
+	})
+}
+
+// Close closes blob file and index.
+func (s *Store) Close() error {
+	return s.Backend.Close()
+}
@@ -0,0 +1,114 @@
+package microblob
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrSuppressed if a key is indexed, but on the deny list.
+var ErrSuppressed = errors.New("suppressed")
+
+// DenyList is a set of keys, that are not served, even though they are
+// indexed, e.g. for takedown or embargo requests. The keys are read from a
+// file or an HTTP endpoint, one per line, and can be reloaded without a
+// restart. Safe for concurrent use.
+type DenyList struct {
+	Source    string       // file name or http(s) URL
+	Transform KeyTransform // applied to each key, as to keys looked up, if set
+
+	mu   sync.RWMutex
+	keys map[string]bool
+}
+
+// Load reads the keys from the source and replaces the current keys. On error,
+// the current keys stay in place.
+func (d *DenyList) Load() error {
+	var r io.ReadCloser
+	if strings.HasPrefix(d.Source, "http://") || strings.HasPrefix(d.Source, "https://") {
+		resp, err := http.Get(d.Source)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("deny list %s: %s", d.Source, resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(d.Source)
+		if err != nil {
+			return err
+		}
+		r = f
+	}
+	defer r.Close()
+	keys := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		key := strings.TrimSpace(scanner.Text())
+		if key == "" || strings.HasPrefix(key, "#") {
+			continue
+		}
+		if d.Transform != nil {
+			var err error
+			if key, err = d.Transform(key); err != nil {
+				return err
+			}
+		}
+		keys[key] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.keys = keys
+	return nil
+}
+
+// Contains returns true, if the key is on the list. A nil list contains no
+// keys.
+func (d *DenyList) Contains(key string) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.keys[key]
+}
+
+// Len returns the number of keys on the list.
+func (d *DenyList) Len() int {
+	if d == nil {
+		return 0
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return len(d.keys)
+}
+
+// Run reloads the list periodically, until the context is canceled. Failed
+// reloads are logged, the previous keys stay in place.
+func (d *DenyList) Run(ctx context.Context, interval time.Duration) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+		if err := d.Load(); err != nil {
+			log.Printf("reloading deny list failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package microblob
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Tombstoner can apply tombstones, e.g. those replicated from a primary.
+type Tombstoner interface {
+	ApplyTombstones(r io.Reader) error
+}
+
+// tombstoneFile returns the name of the file next to the blob file, that
+// records deleted keys.
+func tombstoneFile(blobfn string) string {
+	return blobfn + ".deleted"
+}
+
+// tombstone is a line of the tombstone file. It marks the documents of the key
+// up to a position in the blob files as deleted, that is, the size of the blob
+// file at the time of deletion. Documents appended later are served again. Keys
+// are stored keys, after transformations.
+type tombstone struct {
+	Key    string `json:"key"`
+	File   int    `json:"file,omitempty"`
+	Offset int64  `json:"offset"`
+}
+
+// tombstones are the deleted keys of a blob file. Since the documents stay in
+// the blob file until compaction, which drops the tombstones as well, they
+// keep deleted keys deleted, when the blob file is indexed again, e.g. with
+// reindex, rebuild, follow or on a replica. Safe for concurrent use.
+type tombstones struct {
+	filename string
+
+	mu      sync.RWMutex
+	deleted map[string]Entry // key to position of the tombstone
+}
+
+// loadTombstones reads the tombstones of a blob file. A missing tombstone file
+// means no deleted keys.
+func loadTombstones(blobfn string) (*tombstones, error) {
+	t := &tombstones{deleted: make(map[string]Entry)}
+	if blobfn == "" {
+		return t, nil
+	}
+	t.filename = tombstoneFile(blobfn)
+	f, err := os.Open(t.filename)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := t.read(f); err != nil {
+		return nil, fmt.Errorf("%s: %v", t.filename, err)
+	}
+	return t, nil
+}
+
+// read adds the tombstones read from r and returns those, that were new or
+// moved the position of a key forward.
+func (t *tombstones) read(r io.Reader) ([]tombstone, error) {
+	var added []tombstone
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var ts tombstone
+			if err := json.Unmarshal(line, &ts); err != nil {
+				return nil, err
+			}
+			if ts.Key == "" {
+				return nil, fmt.Errorf("invalid tombstone: %s", bytes.TrimSpace(line))
+			}
+			if t.put(ts) {
+				added = append(added, ts)
+			}
+		}
+		if err == io.EOF {
+			return added, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// put records a tombstone in memory, returns false, if the key has the same or
+// a later one already.
+func (t *tombstones) put(ts tombstone) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pos := Entry{File: ts.File, Offset: ts.Offset}
+	if prev, ok := t.deleted[ts.Key]; ok && !after(pos, prev) {
+		return false
+	}
+	t.deleted[ts.Key] = pos
+	return true
+}
+
+// known returns true, if the key has the same or a later tombstone already.
+func (t *tombstones) known(ts tombstone) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	prev, ok := t.deleted[ts.Key]
+	return ok && !after(Entry{File: ts.File, Offset: ts.Offset}, prev)
+}
+
+// add appends tombstones to the tombstone file and syncs it, then records them
+// in memory. The caller holds the lock of the blob file.
+func (t *tombstones) add(ts ...tombstone) error {
+	if len(ts) == 0 {
+		return nil
+	}
+	if t.filename == "" {
+		return fmt.Errorf("no blob file to record deletions for")
+	}
+	f, err := os.OpenFile(t.filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, v := range ts {
+		if err := enc.Encode(v); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	for _, v := range ts {
+		t.put(v)
+	}
+	return nil
+}
+
+// isDeleted returns true, if the entry comes before the tombstone of its key.
+// A nil set has no deleted keys.
+func (t *tombstones) isDeleted(e Entry) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	pos, ok := t.deleted[e.Key]
+	return ok && after(pos, e)
+}
+
+// filter returns the entries, that are not deleted.
+func (t *tombstones) filter(entries []Entry) []Entry {
+	if t == nil {
+		return entries
+	}
+	t.mu.RLock()
+	n := len(t.deleted)
+	t.mu.RUnlock()
+	if n == 0 {
+		return entries
+	}
+	var result []Entry
+	for i, e := range entries {
+		if !t.isDeleted(e) {
+			if result != nil {
+				result = append(result, e)
+			}
+			continue
+		}
+		if result == nil {
+			result = append(make([]Entry, 0, len(entries)), entries[:i]...)
+		}
+	}
+	if result == nil {
+		return entries
+	}
+	return result
+}
+
+// rebase returns tombstones for another blob file of the given size, that keep
+// the deleted keys deleted in all of it, see Rebuild.
+func (t *tombstones) rebase(blobfn string, size int64) *tombstones {
+	r := &tombstones{filename: tombstoneFile(blobfn), deleted: make(map[string]Entry)}
+	if t == nil {
+		return r
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for key := range t.deleted {
+		r.deleted[key] = Entry{Offset: size}
+	}
+	return r
+}
+
+// save writes all tombstones to a new tombstone file and moves it into place.
+func (t *tombstones) save() error {
+	tmp := t.filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	enc := json.NewEncoder(bw)
+	t.mu.RLock()
+	for key, pos := range t.deleted {
+		if err = enc.Encode(tombstone{Key: key, File: pos.File, Offset: pos.Offset}); err != nil {
+			break
+		}
+	}
+	t.mu.RUnlock()
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, t.filename)
+}
+
+// loadedTombstones returns the tombstones of the blob file, loading them, if
+// necessary.
+func (b *LevelDBBackend) loadedTombstones() (*tombstones, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if err := b.openDatabase(); err != nil {
+		return nil, err
+	}
+	return b.tombstones, nil
+}
+
+// ApplyTombstones records the tombstones read from r, e.g. the tombstone file
+// of a primary, and removes keys indexed before their tombstone. Known
+// tombstones are skipped, so the same tombstones can be applied again.
+func (b *LevelDBBackend) ApplyTombstones(r io.Reader) error {
+	var (
+		received = &tombstones{deleted: make(map[string]Entry)}
+		fresh    []tombstone
+	)
+	all, err := received.read(r)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockBlob(b.Blobfile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := b.reopenReplaced(); err != nil {
+		return err
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if err := b.openDatabase(); err != nil {
+		return err
+	}
+	for _, ts := range all {
+		if !b.tombstones.known(ts) {
+			fresh = append(fresh, ts)
+		}
+	}
+	if err := b.tombstones.add(fresh...); err != nil {
+		return err
+	}
+	for _, ts := range fresh {
+		value, err := b.db.Get(b.dbKey(ts.Key), nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		e, err := decodeEntry([]byte(ts.Key), value)
+		if err != nil {
+			return err
+		}
+		if !b.tombstones.isDeleted(e) {
+			continue
+		}
+		if err := b.db.Delete(b.dbKey(ts.Key), nil); err != nil {
+			return err
+		}
+		if b.Cache != nil {
+			b.Cache.Remove(ts.Key)
+		}
+	}
+	return nil
+}
+
+// ApplyTombstones applies tombstones to the wrapped backend. Tombstones hold
+// stored keys, which are not transformed again.
+func (b TransformBackend) ApplyTombstones(r io.Reader) error {
+	if t, ok := b.Backend.(Tombstoner); ok {
+		return t.ApplyTombstones(r)
+	}
+	return ErrNotImplemented
+}
@@ -0,0 +1,66 @@
+package microblob
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestDeleteReindex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "microblob-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blobfn := filepath.Join(dir, "blob.ldj")
+	backend := &LevelDBBackend{Blobfile: blobfn, Filename: filepath.Join(dir, "index")}
+	defer backend.Close()
+	appendTestDocuments(t, dir, backend, `{"name": "a"}`, `{"name": "b"}`, `{"name": "c"}`)
+
+	for _, key := range []string{"b", "c"} {
+		if err := backend.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := AppendDocument(blobfn, backend, "c", []byte(`{"name": "c", "v": 2}`)); err != nil {
+		t.Fatal(err)
+	}
+	kf := ParsingExtractor{Key: "name"}
+	if err := backend.Reindex(SingleKey(kf.ExtractKey), AppendOptions{BatchSize: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		key string
+		doc string
+		err error
+	}{
+		{"a", "{\"name\": \"a\"}\n", nil},
+		{"b", "", leveldb.ErrNotFound},
+		{"c", "{\"name\":\"c\",\"v\":2}\n", nil},
+	}
+	for _, c := range cases {
+		b, err := backend.Get(c.key)
+		if err != c.err {
+			t.Fatalf("%s: got %v, want %v", c.key, err, c.err)
+		}
+		if string(b) != c.doc {
+			t.Fatalf("%s: got %q, want %q", c.key, b, c.doc)
+		}
+	}
+
+	if _, _, err := backend.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tombstoneFile(blobfn)); !os.IsNotExist(err) {
+		t.Fatalf("tombstones kept after compaction: %v", err)
+	}
+	if _, err := backend.Get("b"); err != leveldb.ErrNotFound {
+		t.Fatalf("b: got %v, want %v", err, leveldb.ErrNotFound)
+	}
+}
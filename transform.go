@@ -0,0 +1,81 @@
+package microblob
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"strings"
+)
+
+// KeyTransform modifies a key, e.g. to normalize case. Transformations are
+// applied after extraction and before lookup.
+type KeyTransform func(string) (string, error)
+
+// ChainTransforms applies transformations in order.
+func ChainTransforms(ts ...KeyTransform) KeyTransform {
+	return func(s string) (string, error) {
+		var err error
+		for _, t := range ts {
+			if s, err = t(s); err != nil {
+				return "", err
+			}
+		}
+		return s, nil
+	}
+}
+
+// ParseKeyTransform parses a comma separated list of transformations, e.g.
+// "lower,trim". Supported are lower, upper, trim, urldecode and
+// strip-prefix=PREFIX. An empty string yields a nil transform.
+func ParseKeyTransform(s string) (KeyTransform, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var ts []KeyTransform
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "lower":
+			ts = append(ts, func(s string) (string, error) { return strings.ToLower(s), nil })
+		case name == "upper":
+			ts = append(ts, func(s string) (string, error) { return strings.ToUpper(s), nil })
+		case name == "trim":
+			ts = append(ts, func(s string) (string, error) { return strings.TrimSpace(s), nil })
+		case name == "urldecode":
+			ts = append(ts, url.QueryUnescape)
+		case strings.HasPrefix(name, "strip-prefix="):
+			prefix := strings.TrimPrefix(name, "strip-prefix=")
+			ts = append(ts, func(s string) (string, error) { return strings.TrimPrefix(s, prefix), nil })
+		default:
+			return nil, fmt.Errorf("unknown key transform: %s", name)
+		}
+	}
+	return ChainTransforms(ts...), nil
+}
+
+// ParseKeyHash returns a transform, that replaces a key by its digest, so long
+// keys like URLs are stored with a fixed size. Supported are sha1 and fnv
+// (64-bit FNV-1a). The digest is stored in unpadded, URL-safe base64, 27 bytes
+// for sha1 and 11 for fnv, so keys stay printable in key listings and dumps.
+// An empty string yields a nil transform.
+func ParseKeyHash(s string) (KeyTransform, error) {
+	switch s {
+	case "":
+		return nil, nil
+	case "sha1":
+		return func(s string) (string, error) {
+			h := sha1.Sum([]byte(s))
+			return base64.RawURLEncoding.EncodeToString(h[:]), nil
+		}, nil
+	case "fnv":
+		return func(s string) (string, error) {
+			h := fnv.New64a()
+			h.Write([]byte(s))
+			return base64.RawURLEncoding.EncodeToString(h.Sum(nil)), nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown key hash: %s", s)
+	}
+}
@@ -0,0 +1,234 @@
+package microblob
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// Problem describes an index entry, that does not match the blob file.
+type Problem struct {
+	Entry
+	Reason string
+}
+
+// String formats a problem as TSV: key, offset, length and reason.
+func (p Problem) String() string {
+	return fmt.Sprintf("%s\t%d\t%d\t%s", p.Key, p.Offset, p.Length, p.Reason)
+}
+
+// Verifier can check index entries against the blob file.
+type Verifier interface {
+	Verify(kf KeysFunc, f func(Problem) error) (checked int64, err error)
+}
+
+// VerifySampler can check a random sample of index entries against the blob
+// file, e.g. on start.
+type VerifySampler interface {
+	VerifySample(kf KeysFunc, n int, f func(Problem) error) (checked int64, err error)
+}
+
+// entryChecker reads the region of an entry from its blob file and checks
+// the key.
+type entryChecker struct {
+	b     *LevelDBBackend
+	kf    KeysFunc
+	files []*os.File
+	sizes []int64
+}
+
+// newEntryChecker opens the blob files of the backend. Call close, when done.
+func (b *LevelDBBackend) newEntryChecker(kf KeysFunc) (*entryChecker, error) {
+	c := &entryChecker{b: b, kf: kf}
+	for _, name := range append([]string{b.Blobfile}, b.Blobfiles...) {
+		file, err := os.Open(name)
+		if err != nil {
+			c.close()
+			return nil, err
+		}
+		c.files = append(c.files, file)
+		fi, err := file.Stat()
+		if err != nil {
+			c.close()
+			return nil, err
+		}
+		c.sizes = append(c.sizes, fi.Size())
+	}
+	return c, nil
+}
+
+// close closes the blob files.
+func (c *entryChecker) close() {
+	for _, f := range c.files {
+		f.Close()
+	}
+}
+
+// check returns the reason, why an entry does not match the blob file, or an
+// empty string.
+func (c *entryChecker) check(e Entry) (string, error) {
+	if e.File < 0 || e.File >= len(c.files) {
+		return fmt.Sprintf("unknown blob file %d", e.File), nil
+	}
+	file, size := c.files[e.File], c.sizes[e.File]
+	if e.Offset < 0 || e.Length < 0 || e.Offset+e.Length > size {
+		return fmt.Sprintf("out of bounds, file size is %d", size), nil
+	}
+	data := make([]byte, e.Length)
+	if _, err := file.ReadAt(data, e.Offset); err != nil {
+		return "", err
+	}
+	data, err := c.b.decode(data)
+	if err != nil {
+		return fmt.Sprintf("decompression failed: %v", err), nil
+	}
+	keys, err := c.kf(data)
+	if err != nil {
+		return fmt.Sprintf("extraction failed: %v", err), nil
+	}
+	for _, key := range keys {
+		if key == e.Key {
+			return "", nil
+		}
+	}
+	return fmt.Sprintf("key mismatch, found %q", keys), nil
+}
+
+// verify checks an entry and calls f, if there is a problem.
+func (c *entryChecker) verify(e Entry, f func(Problem) error) error {
+	reason, err := c.check(e)
+	if err != nil || reason == "" {
+		return err
+	}
+	return f(Problem{Entry: e, Reason: reason})
+}
+
+// Verify walks all entries, reads the stored region from its blob file,
+// re-extracts the keys with kf and calls f for each entry with an out of bounds
+// region or a key, that cannot be found in the region.
+func (b *LevelDBBackend) Verify(kf KeysFunc, f func(Problem) error) (checked int64, err error) {
+	c, err := b.newEntryChecker(kf)
+	if err != nil {
+		return 0, err
+	}
+	defer c.close()
+	err = b.allEntries(func(e Entry) error {
+		checked++
+		return c.verify(e, f)
+	})
+	return checked, err
+}
+
+// VerifySample checks up to n entries like Verify, found by seeking to random
+// keys between the first and the last key, so it does not walk the index.
+// The sample is not uniform: keys following sparse ranges of the key space
+// are more likely to be checked.
+func (b *LevelDBBackend) VerifySample(kf KeysFunc, n int, f func(Problem) error) (checked int64, err error) {
+	entries, err := b.sampleEntries(n)
+	if err != nil {
+		return 0, err
+	}
+	c, err := b.newEntryChecker(kf)
+	if err != nil {
+		return 0, err
+	}
+	defer c.close()
+	for _, e := range entries {
+		checked++
+		if err := c.verify(e, f); err != nil {
+			return checked, err
+		}
+	}
+	return checked, nil
+}
+
+// sampleEntries returns up to n distinct entries, which are not expired, at
+// random keys.
+func (b *LevelDBBackend) sampleEntries(n int) ([]Entry, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if err := b.openDatabase(); err != nil {
+		return nil, err
+	}
+	iter := b.db.NewIterator(b.keyRange(), nil)
+	defer iter.Release()
+	if !iter.First() {
+		return nil, iter.Error()
+	}
+	first := append([]byte(nil), iter.Key()...)
+	if !iter.Last() {
+		return nil, iter.Error()
+	}
+	last := append([]byte(nil), iter.Key()...)
+	var (
+		entries []Entry
+		seen    = make(map[string]bool)
+		now     = time.Now()
+	)
+	for i := 0; i < 4*n && len(entries) < n; i++ {
+		// Take the next entry not yet sampled, as seeks cluster on keys
+		// following sparse ranges of the key space.
+		ok := iter.Seek(randomKeyBetween(first, last))
+		for ok && seen[string(iter.Key())] {
+			ok = iter.Next()
+		}
+		if !ok {
+			continue
+		}
+		seen[string(iter.Key())] = true
+		e, err := decodeEntry(iter.Key()[len(b.Prefix):], iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		if !e.expired(now) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, iter.Error()
+}
+
+// randomKeyBetween returns a random key sharing the common prefix of lo and
+// hi, followed by a byte between theirs and a few random bytes.
+func randomKeyBetween(lo, hi []byte) []byte {
+	i := 0
+	for i < len(lo) && i < len(hi) && lo[i] == hi[i] {
+		i++
+	}
+	key := append([]byte(nil), hi[:i]...)
+	var a, z int
+	if i < len(lo) {
+		a = int(lo[i])
+	}
+	if i < len(hi) {
+		z = int(hi[i])
+	}
+	if z < a {
+		return key
+	}
+	key = append(key, byte(a+rand.Intn(z-a+1)))
+	for j := 0; j < 4; j++ {
+		key = append(key, byte(rand.Intn(256)))
+	}
+	return key
+}
+
+// Verify verifies the wrapped backend, applying the transformation to the
+// re-extracted keys.
+func (b TransformBackend) Verify(kf KeysFunc, f func(Problem) error) (int64, error) {
+	v, ok := b.Backend.(Verifier)
+	if !ok {
+		return 0, ErrNotImplemented
+	}
+	return v.Verify(b.transformKeys(kf), f)
+}
+
+// VerifySample verifies a sample of the wrapped backend, applying the
+// transformation to the re-extracted keys.
+func (b TransformBackend) VerifySample(kf KeysFunc, n int, f func(Problem) error) (int64, error) {
+	v, ok := b.Backend.(VerifySampler)
+	if !ok {
+		return 0, ErrNotImplemented
+	}
+	return v.VerifySample(b.transformKeys(kf), n, f)
+}
@@ -0,0 +1,84 @@
+package microblob
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Versioner can return superseded versions of the document for a key, since
+// appends keep the old documents in the blob file until compaction.
+type Versioner interface {
+	// Versions returns the retained versions of the document for a key,
+	// newest first, starting with the current one.
+	Versions(key string) ([]Entry, error)
+	// GetVersion returns the document for a key with the given version number.
+	GetVersion(key string, version int64) ([]byte, error)
+}
+
+// Versions returns the current and the retained previous versions of the
+// document for a key, newest first. Versions are only kept with KeepVersions,
+// compaction drops all but the current version.
+func (b *LevelDBBackend) Versions(key string) ([]Entry, error) {
+	entry, err := b.Locate(key)
+	if err != nil {
+		return nil, err
+	}
+	return entryVersions(entry), nil
+}
+
+// GetVersion returns the document with the given version number for a key,
+// leveldb.ErrNotFound, if that version is not retained.
+func (b *LevelDBBackend) GetVersion(key string, version int64) ([]byte, error) {
+	if b.Suppressed.Contains(key) {
+		return nil, ErrSuppressed
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	entry, err := b.locate(key)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range entryVersions(entry) {
+		if v.Version == version {
+			return b.read(v)
+		}
+	}
+	return nil, leveldb.ErrNotFound
+}
+
+// entryVersions returns an entry followed by its previous versions, each with
+// a version number.
+func entryVersions(entry Entry) []Entry {
+	current := entry
+	current.Previous = nil
+	if current.Version == 0 {
+		current.Version = 1
+	}
+	return append([]Entry{current}, entry.Previous...)
+}
+
+// Versions transforms the key, then lists the versions in the wrapped backend.
+func (b TransformBackend) Versions(key string) ([]Entry, error) {
+	v, ok := b.Backend.(Versioner)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	key, err := b.Transform(key)
+	if err != nil {
+		return nil, err
+	}
+	return v.Versions(key)
+}
+
+// GetVersion transforms the key, then retrieves the version from the wrapped
+// backend.
+func (b TransformBackend) GetVersion(key string, version int64) ([]byte, error) {
+	v, ok := b.Backend.(Versioner)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	key, err := b.Transform(key)
+	if err != nil {
+		return nil, err
+	}
+	return v.GetVersion(key, version)
+}
@@ -0,0 +1,82 @@
+package microblob
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// WarmupKeys looks up the keys read from r, one per line, with the given
+// number of workers, so their documents are in the page cache, and in the
+// blob cache, if the backend has one, before traffic arrives. Missing keys are
+// skipped. Returns the number of documents and bytes read.
+func WarmupKeys(ctx context.Context, backend Backend, r io.Reader, workers int) (docs, size int64, err error) {
+	if workers < 1 {
+		workers = 1
+	}
+	var (
+		keys = make(chan string)
+		wg   sync.WaitGroup
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				if b, err := GetContext(ctx, backend, key); err == nil {
+					atomic.AddInt64(&docs, 1)
+					atomic.AddInt64(&size, int64(len(b)))
+				}
+			}
+		}()
+	}
+	br := bufio.NewReader(r)
+	for ctx.Err() == nil {
+		line, rerr := br.ReadString('\n')
+		if key := strings.TrimRight(line, "\r\n"); key != "" {
+			keys <- key
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			err = rerr
+			break
+		}
+	}
+	close(keys)
+	wg.Wait()
+	if err == nil {
+		err = ctx.Err()
+	}
+	return docs, size, err
+}
+
+// WarmupFiles reads the files sequentially, so they are in the page cache, as
+// far as it holds them. Returns the number of bytes read.
+func WarmupFiles(ctx context.Context, names ...string) (size int64, err error) {
+	buf := make([]byte, 4<<20)
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			return size, err
+		}
+		for err == nil {
+			if err = ctx.Err(); err != nil {
+				break
+			}
+			var n int
+			n, err = f.Read(buf)
+			size += int64(n)
+		}
+		f.Close()
+		if err != io.EOF {
+			return size, err
+		}
+	}
+	return size, nil
+}
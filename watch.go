@@ -0,0 +1,81 @@
+package microblob
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// WatchDir watches a spool directory and appends and indexes each new file
+// dropped there. Processed files are moved to a "done", files that could not
+// be appended to a "failed" subdirectory. Files starting with a dot or ending
+// in .tmp are ignored, so writers can create a file under a temporary name and
+// rename it, when complete. Files present at startup are processed first.
+// Blocks until the watcher fails.
+func WatchDir(dir, blobfn string, backend Backend, kf KeysFunc) error {
+	for _, sub := range []string{"done", "failed"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return err
+		}
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	if err := watcher.Add(dir); err != nil {
+		return err
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		spoolFile(dir, name, blobfn, backend, kf)
+	}
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			spoolFile(dir, event.Name, blobfn, backend, kf)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// spoolFile appends a single file from the spool directory and moves it out of
+// the way.
+func spoolFile(dir, name, blobfn string, backend Backend, kf KeysFunc) {
+	base := filepath.Base(name)
+	if strings.HasPrefix(base, ".") || strings.HasSuffix(base, ".tmp") {
+		return
+	}
+	fi, err := os.Stat(name)
+	if err != nil || !fi.Mode().IsRegular() {
+		return
+	}
+	target := filepath.Join(dir, "done", base)
+	if err := AppendKeysBatchSize(blobfn, name, backend, kf, 100000, false); err != nil {
+		log.Printf("watch: append %s failed: %v", name, err)
+		target = filepath.Join(dir, "failed", base)
+	} else {
+		log.Printf("watch: appended %s", name)
+	}
+	if err := os.Rename(name, target); err != nil {
+		log.Printf("watch: %v", err)
+	}
+}
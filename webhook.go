@@ -0,0 +1,64 @@
+package microblob
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Webhook notifies another service after a successful append, e.g. so caches
+// and search indexes downstream can refresh.
+type Webhook struct {
+	URL    string
+	Client *http.Client // defaults to a client with a 10s timeout
+}
+
+// webhookPayload is the JSON body posted to a webhook.
+type webhookPayload struct {
+	Event    string  `json:"event"`
+	Blobfile string  `json:"blobfile"`
+	Keys     int64   `json:"keys"`
+	Bytes    int64   `json:"bytes"`
+	Duration float64 `json:"duration"` // seconds
+	Time     string  `json:"time"`
+}
+
+// Notify posts a summary of an append to the webhook URL as JSON. A nil webhook
+// does nothing.
+func (h *Webhook) Notify(ctx context.Context, blobfile string, s AppendSummary, elapsed time.Duration) error {
+	if h == nil || h.URL == "" {
+		return nil
+	}
+	b, err := json.Marshal(webhookPayload{
+		Event:    "append",
+		Blobfile: blobfile,
+		Keys:     s.Keys,
+		Bytes:    s.Bytes,
+		Duration: elapsed.Seconds(),
+		Time:     time.Now().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := h.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s: %s", h.URL, resp.Status)
+	}
+	return nil
+}
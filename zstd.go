@@ -0,0 +1,231 @@
+package microblob
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	zstdDecoder *zstd.Decoder // safe for concurrent use with DecodeAll
+	zstdEncoder *zstd.Encoder
+)
+
+func init() {
+	var err error
+	if zstdDecoder, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0)); err != nil {
+		panic(err)
+	}
+	if zstdEncoder, err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1)); err != nil {
+		panic(err)
+	}
+}
+
+// BlobCompression returns the compression of the blob file.
+func (b *LevelDBBackend) BlobCompression() string { return b.Compression }
+
+// BlobCompression returns the compression of the wrapped backend.
+func (b TransformBackend) BlobCompression() string { return blobCompression(b.Backend) }
+
+// blobCompression returns the compression of a backend, if any.
+func blobCompression(backend Backend) string {
+	if c, ok := backend.(interface{ BlobCompression() string }); ok {
+		return c.BlobCompression()
+	}
+	return ""
+}
+
+// decode decompresses a stored region, if the blob file is compressed, and
+// drops a record separator other than newline.
+func (b *LevelDBBackend) decode(data []byte) ([]byte, error) {
+	return decodeSection(data, b.Compression, b.Separator)
+}
+
+// decodeSection decompresses a section read from a blob file with the given
+// compression and drops a record separator other than newline.
+func decodeSection(data []byte, compression string, sep byte) ([]byte, error) {
+	switch compression {
+	case "":
+		return trimSeparator(data, sep), nil
+	case "zstd":
+		data, err := zstdDecoder.DecodeAll(data, nil)
+		if err != nil {
+			return nil, err
+		}
+		return trimSeparator(data, sep), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", compression)
+	}
+}
+
+// appendZstd appends the lines read from r to blobfn, each compressed into a
+// separate zstd frame, so documents can be read without decompressing anything
+// else. The index records offset and length of the frame and the decompressed
+// size. The caller must hold the append lock.
+func appendZstd(blobfn string, r io.Reader, backend Backend, kf KeysFunc, opts AppendOptions) error {
+	return appendRecords(blobfn, r, backend, kf, opts, func(doc []byte) []byte {
+		return zstdEncoder.EncodeAll(doc, nil)
+	})
+}
+
+// appendRecords appends the records read from r to blobfn one by one, each
+// encoded with encode, if not nil, and indexes them. Keys are extracted from
+// batches of records in parallel. With opts.Dedup, records already appended
+// are not appended again, their keys point to the earlier copy. The caller
+// must hold the append lock.
+func appendRecords(blobfn string, r io.Reader, backend Backend, kf KeysFunc, opts AppendOptions, encode func(doc []byte) []byte) error {
+	file, err := os.OpenFile(blobfn, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	start, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	size := opts.BatchSize
+	if size < 1 {
+		size = 100000
+	}
+	workers := opts.Workers
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	var (
+		br     = bufio.NewReader(r)
+		bw     = bufio.NewWriterSize(file, 1<<20)
+		offset = start
+		sep    = recordSeparator(backend)
+		crc    = recordCRC(backend)
+		line   int64 // number of records read, including blank ones
+		eof    bool
+		report *brokenReport
+	)
+	if opts.BrokenReport != nil {
+		report = &brokenReport{w: opts.BrokenReport}
+		defer func() {
+			if report.n > 0 {
+				log.Printf("skipped %d broken documents", report.n)
+			}
+		}()
+	}
+	fail := func(err error) error {
+		if opts.Dedup != nil {
+			opts.Dedup.truncate(opts.File, start)
+		}
+		if terr := os.Truncate(blobfn, start); terr != nil {
+			return fmt.Errorf("processing and truncate failed: %v, %v", err, terr)
+		}
+		return err
+	}
+	for {
+		var (
+			docs  [][]byte
+			lines []int64
+			blen  int64
+		)
+		for len(docs) < size && (opts.BatchBytes <= 0 || blen < opts.BatchBytes) {
+			b, err := readRecord(br, sep, opts.MaxRecordSize)
+			if errors.Is(err, ErrRecordTooLarge) {
+				return fail(fmt.Errorf("record %d: %w", line+1, err))
+			}
+			if len(b) > 0 {
+				line++
+			}
+			if !isBlank(b, sep) {
+				docs = append(docs, b)
+				lines = append(lines, line)
+				blen += int64(len(b))
+			}
+			if err == io.EOF {
+				eof = true
+				break
+			}
+			if err != nil {
+				return fail(err)
+			}
+		}
+		if len(docs) == 0 {
+			break
+		}
+		frames := make([][]byte, len(docs))
+		keys := make([][]string, len(docs))
+		errs := make([]error, len(docs))
+		hashes := make([][16]byte, len(docs))
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := w; i < len(docs); i += workers {
+					doc := trimSeparator(docs[i], sep)
+					if frames[i] = docs[i]; encode != nil {
+						frames[i] = encode(docs[i])
+					}
+					if opts.Dedup != nil {
+						hashes[i] = contentHash(doc)
+					}
+					keys[i], errs[i] = kf(doc)
+				}
+			}(w)
+		}
+		wg.Wait()
+		var entries []Entry
+		for i, frame := range frames {
+			switch {
+			case errs[i] != nil && report != nil:
+				report.add(lines[i], offset, errs[i])
+			case errs[i] != nil && !opts.IgnoreMissingKeys:
+				return fail(errs[i])
+			}
+			loc := Entry{Offset: offset, Length: int64(len(frame)), File: opts.File}
+			if encode != nil {
+				loc.Size = int64(len(docs[i]))
+			}
+			if crc {
+				loc.CRC = sectionCRC(frame)
+			}
+			dup := false
+			if opts.Dedup != nil {
+				var prev Entry
+				if prev, dup = opts.Dedup.lookup(hashes[i], loc.Length); dup {
+					loc = prev
+				}
+			}
+			if !dup {
+				if _, err := bw.Write(frame); err != nil {
+					return fail(err)
+				}
+				if opts.Dedup != nil {
+					opts.Dedup.add(hashes[i], loc)
+				}
+				offset += loc.Length
+			}
+			for _, key := range keys[i] {
+				e := loc
+				e.Key = key
+				entries = append(entries, e)
+			}
+		}
+		if err := bw.Flush(); err != nil {
+			return fail(err)
+		}
+		if err := syncBlob(backend, file); err != nil {
+			return fail(err)
+		}
+		if err := opts.entryWriter(backend)(entries); err != nil {
+			return fail(err)
+		}
+		if eof {
+			break
+		}
+	}
+	return nil
+}